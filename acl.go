@@ -0,0 +1,182 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ACLAllMethods is the ACL key whose roles are required by every method of
+// the service.
+const ACLAllMethods = "*"
+
+// ACL maps method names of a service to the roles required to call them.
+// A caller must hold all the required roles.
+type ACL map[string][]string
+
+// RolePrincipal is a Principal holding roles, checked against method ACLs.
+type RolePrincipal interface {
+	Principal
+	HasRole(role string) bool
+}
+
+// ErrForbidden is returned when the caller lacks a role required by the method.
+var ErrForbidden = errors.New("rpc: permission denied")
+
+/*
+authorize checks that p holds all the roles
+*/
+func authorize(p Principal, roles []string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	rp, ok := p.(RolePrincipal)
+	if !ok {
+		return ErrForbidden
+	}
+	for _, role := range roles {
+		if !rp.HasRole(role) {
+			return ErrForbidden
+		}
+	}
+	return nil
+}
+
+// ACLTable maps method patterns, "Service.Method", "Service.*" or ACLAllMethods, to the roles
+// required to call the matching methods, in addition to the ACLs of their services. It is
+// typically loaded from the configuration of a deployment by LoadACLFile.
+type ACLTable map[string][]string
+
+/*
+LoadACLFile returns the table of a JSON file mapping method patterns to roles:
+
+	{"*": ["user"], "Admin.*": ["admin"], "Billing.Refund": ["billing", "supervisor"]}
+*/
+func LoadACLFile(path string) (ACLTable, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var table ACLTable
+	if err := json.Unmarshal(b, &table); err != nil {
+		return nil, fmt.Errorf("rpc: %s: %w", path, err)
+	}
+	return table, nil
+}
+
+/*
+SetACLTable requires the roles of the table to call the methods matching its patterns, checked
+with the ACLs of the services before the args are decoded. Patterns may match methods
+registered later. A nil table removes the requirements.
+*/
+func (s *Server) SetACLTable(table ACLTable) error {
+	if table == nil {
+		s.aclTable = nil
+		return nil
+	}
+	t, err := compileACLTable(table)
+	if err != nil {
+		return err
+	}
+	s.aclTable = t
+	return nil
+}
+
+/*
+Permissions returns the roles required to call every registered method, by the ACL of its
+service and the ACLTable, e.g. for documentation generators. Methods without requirement are
+mapped to an empty list.
+*/
+func (s *Server) Permissions() map[string][]string {
+	perms := make(map[string][]string)
+	for _, service := range s.services.load() {
+		for name, method := range service.methods {
+			full := service.name + "." + name
+			roles := append([]string{}, method.roles...)
+			roles = append(roles, s.aclTable.roles(service.name, full)...)
+			sort.Strings(roles)
+			perms[full] = compactStrings(roles)
+		}
+	}
+	return perms
+}
+
+// aclTable is an ACLTable indexed by kind of pattern.
+type aclTable struct {
+	all      []string            // roles of every method
+	services map[string][]string // roles of the methods of a service, by service
+	methods  map[string][]string // roles of a method, by method
+}
+
+/*
+compileACLTable indexes the patterns of the table
+*/
+func compileACLTable(table ACLTable) (*aclTable, error) {
+	t := &aclTable{services: make(map[string][]string), methods: make(map[string][]string)}
+	for pattern, roles := range table {
+		dot := strings.LastIndex(pattern, ".")
+		switch {
+		case pattern == ACLAllMethods:
+			t.all = roles
+		case dot > 0 && pattern[dot+1:] == "*":
+			t.services[pattern[:dot]] = roles
+		case dot > 0 && dot < len(pattern)-1 && !strings.Contains(pattern, "*"):
+			t.methods[pattern] = roles
+		default:
+			return nil, fmt.Errorf("rpc: invalid acl pattern %q", pattern)
+		}
+	}
+	return t, nil
+}
+
+/*
+roles returns the roles required by the table to call the method of the service
+*/
+func (t *aclTable) roles(service, method string) []string {
+	if t == nil {
+		return nil
+	}
+	var roles []string
+	roles = append(roles, t.all...)
+	roles = append(roles, t.services[service]...)
+	return append(roles, t.methods[method]...)
+}
+
+/*
+authorize checks that p holds the roles required by the table to call the method
+*/
+func (t *aclTable) authorize(p Principal, method string) error {
+	if err := authorize(p, t.all); err != nil {
+		return err
+	}
+	if err := authorize(p, t.methods[method]); err != nil {
+		return err
+	}
+	if len(t.services) == 0 {
+		return nil
+	}
+	if dot := strings.LastIndex(method, "."); dot >= 0 {
+		return authorize(p, t.services[method[:dot]])
+	}
+	return nil
+}
+
+/*
+compactStrings removes the consecutive duplicates of the sorted list
+*/
+func compactStrings(list []string) []string {
+	out := list[:0]
+	for i, v := range list {
+		if i == 0 || v != list[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
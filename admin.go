@@ -0,0 +1,246 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+SetAdminAuth sets the check of the requests of the AdminHandler, a request being rejected with
+status 403 if check returns an error. Without check, every request is rejected.
+*/
+func (s *Server) SetAdminAuth(check func(*http.Request) error) {
+	s.adminAuth = check
+}
+
+/*
+AdminHandler returns a handler exposing the internals of the server to ops, without a separate
+HTTP server:
+
+	/pprof/            profiles of the runtime, read by go tool pprof
+	/pprof/profile     CPU profile, for the number of seconds of the query, 30 by default
+	/pprof/trace       execution trace, for the number of seconds of the query, 1 by default
+	/pprof/<name>      profile of the name, e.g. heap or goroutine, as text if debug=1
+	/services          methods of the registered services
+	/config            settings of the server and of its methods
+	/stats             DebugVars of the server
+
+Paths are relative to where the handler is mounted, e.g. with
+http.StripPrefix("/admin", server.AdminHandler()). Requests are checked by the func of
+SetAdminAuth.
+*/
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pprof/", s.servePprof)
+	mux.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, s.services.Map())
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, s.config())
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, s.DebugVars())
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminAuth == nil {
+			WriteError(w, 403, "rpc: admin handler has no auth check")
+			return
+		}
+		if err := s.adminAuth(r); err != nil {
+			WriteError(w, 403, err.Error())
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+/*
+servePprof serves the profiles of the runtime with runtime/pprof, sparing the side effects of
+importing net/http/pprof
+*/
+func (s *Server) servePprof(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/pprof/")
+	switch name {
+	case "":
+		profiles := pprof.Profiles()
+		sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name() < profiles[j].Name() })
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range profiles {
+			fmt.Fprintf(w, "%s %d\n", p.Name(), p.Count())
+		}
+		io.WriteString(w, "profile\ntrace\n")
+	case "profile", "trace":
+		seconds := 30
+		if name == "trace" {
+			seconds = 1
+		}
+		if v := r.URL.Query().Get("seconds"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				WriteError(w, 400, fmt.Sprintf("rpc: invalid seconds %q", v))
+				return
+			}
+			seconds = n
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		var err error
+		if name == "profile" {
+			err = pprof.StartCPUProfile(w)
+		} else {
+			err = trace.Start(w)
+		}
+		if err != nil {
+			WriteError(w, 500, err.Error())
+			return
+		}
+		select {
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-r.Context().Done():
+		}
+		if name == "profile" {
+			pprof.StopCPUProfile()
+		} else {
+			trace.Stop()
+		}
+	default:
+		p := pprof.Lookup(name)
+		if p == nil {
+			WriteError(w, 404, fmt.Sprintf("rpc: unknown profile %q", name))
+			return
+		}
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		p.WriteTo(w, debug)
+	}
+}
+
+// adminConfig is the dump of the settings of a server.
+type adminConfig struct {
+	Codecs          []string                     `json:"codecs"`
+	Pooling         bool                         `json:"pooling"`
+	Arenas          bool                         `json:"arenas"`
+	Minimal         bool                         `json:"minimal"`
+	WorkerPool      bool                         `json:"worker_pool"`
+	Introspection   bool                         `json:"introspection"`
+	Subscriptions   bool                         `json:"subscriptions"`
+	Webhooks        bool                         `json:"webhooks"`
+	MetadataHeaders []string                     `json:"metadata_headers"`
+	Authenticator   bool                         `json:"authenticator"`
+	SignaturePolicy bool                         `json:"signature_policy"`
+	IPFilter        bool                         `json:"ip_filter"`
+	RatePolicy      bool                         `json:"rate_policy"`
+	CSRFPolicy      bool                         `json:"csrf_policy"`
+	SecurityHeaders bool                         `json:"security_headers"`
+	LockoutPolicy   bool                         `json:"lockout_policy"`
+	TenantPolicy    bool                         `json:"tenant_policy"`
+	Idempotency     bool                         `json:"idempotency"`
+	CacheStore      bool                         `json:"cache_store"`
+	AuditSink       bool                         `json:"audit_sink"`
+	SampleSink      bool                         `json:"sample_sink"`
+	ErrorTranslator bool                         `json:"error_translator"`
+	StatsHandler    bool                         `json:"stats_handler"`
+	Tracer          bool                         `json:"tracer"`
+	Logger          bool                         `json:"logger"`
+	SlowCalls       string                       `json:"slow_call_threshold,omitempty"`
+	BeforeFuncs     int                          `json:"before_funcs"`
+	AfterFuncs      int                          `json:"after_funcs"`
+	Methods         map[string]adminMethodConfig `json:"methods"`
+}
+
+// adminMethodConfig is the dump of the settings of a method.
+type adminMethodConfig struct {
+	Roles         []string `json:"roles,omitempty"`
+	CacheTTL      string   `json:"cache_ttl,omitempty"`
+	WorkerPool    bool     `json:"worker_pool"`
+	LogLevel      string   `json:"log_level"`
+	SlowThreshold string   `json:"slow_call_threshold,omitempty"`
+	SampleRate    float64  `json:"sample_rate"`
+}
+
+/*
+config returns the dump of the settings of the server
+*/
+func (s *Server) config() *adminConfig {
+	c := &adminConfig{
+		Codecs:          make([]string, 0, len(s.codecs)),
+		Pooling:         s.pooling,
+		Arenas:          s.arenas,
+		Minimal:         s.minimal,
+		WorkerPool:      s.workers != nil,
+		Introspection:   s.introspection,
+		Subscriptions:   s.subscriptions != nil,
+		Webhooks:        s.webhooks != nil,
+		MetadataHeaders: s.metadataHeaders,
+		Authenticator:   s.authenticator != nil,
+		SignaturePolicy: s.signatures != nil,
+		IPFilter:        s.ipFilter != nil,
+		RatePolicy:      s.rateLimits != nil,
+		CSRFPolicy:      s.csrf != nil,
+		SecurityHeaders: s.secHeaders != nil,
+		LockoutPolicy:   s.lockout != nil,
+		TenantPolicy:    s.tenants != nil,
+		Idempotency:     s.idempotency != nil,
+		CacheStore:      s.cache != nil,
+		AuditSink:       s.auditSink != nil,
+		SampleSink:      s.sampleSink != nil,
+		ErrorTranslator: s.errorTranslator != nil,
+		StatsHandler:    s.statsHandler != nil,
+		Tracer:          s.tracer != nil,
+		Logger:          s.logger != nil,
+		BeforeFuncs:     len(s.beforeFns.load()),
+		AfterFuncs:      len(s.afterFns.load()),
+		Methods:         make(map[string]adminMethodConfig),
+	}
+	for contentType := range s.codecs {
+		c.Codecs = append(c.Codecs, contentType)
+	}
+	sort.Strings(c.Codecs)
+	if s.slowCalls != nil && s.slowCalls.Threshold > 0 {
+		c.SlowCalls = s.slowCalls.Threshold.String()
+	}
+	perms := s.Permissions()
+	for _, service := range s.services.load() {
+		for name, method := range service.methods {
+			mc := adminMethodConfig{
+				Roles:      perms[service.name+"."+name],
+				WorkerPool: method.workers != nil,
+				LogLevel:   method.logLevel.String(),
+				SampleRate: method.sampling,
+			}
+			if method.cacheTTL > 0 {
+				mc.CacheTTL = method.cacheTTL.String()
+			}
+			if method.slowAfter > 0 {
+				mc.SlowThreshold = method.slowAfter.String()
+			}
+			c.Methods[service.name+"."+name] = mc
+		}
+	}
+	return c
+}
+
+/*
+writeAdminJSON writes v as indented JSON
+*/
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
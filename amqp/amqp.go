@@ -0,0 +1,149 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package amqp serves the services of an rpc.Server to the requests of an AMQP queue, e.g. on
+RabbitMQ, publishing the responses to the reply queue of each request with its correlation id.
+
+The binding depends on a small Channel interface rather than on an AMQP client library. A
+*amqp.Channel of github.com/rabbitmq/amqp091-go is adapted with:
+
+	type amqpChannel struct{ *amqp.Channel }
+
+	func (c amqpChannel) Consume(queue string) (<-chan *rpcamqp.Delivery, error) {
+		deliveries, err := c.Channel.Consume(queue, "", false, false, false, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		ret := make(chan *rpcamqp.Delivery)
+		go func() {
+			defer close(ret)
+			for d := range deliveries {
+				d := d
+				ret <- &rpcamqp.Delivery{
+					Body: d.Body, ContentType: d.ContentType, CorrelationId: d.CorrelationId,
+					ReplyTo: d.ReplyTo, Headers: d.Headers,
+					Ack:  func() error { return d.Ack(false) },
+					Nack: func(requeue bool) error { return d.Nack(false, requeue) },
+				}
+			}
+		}()
+		return ret, nil
+	}
+
+	func (c amqpChannel) Publish(ctx context.Context, queue string, p *rpcamqp.Publishing) error {
+		return c.Channel.PublishWithContext(ctx, "", queue, false, false, amqp.Publishing{
+			Body: p.Body, ContentType: p.ContentType, CorrelationId: p.CorrelationId,
+		})
+	}
+*/
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"net/http"
+	"sync"
+)
+
+// Delivery is a request received from a queue.
+type Delivery struct {
+	Body          []byte
+	ContentType   string                 // selects the codec of the request
+	CorrelationId string                 // copied to the response
+	ReplyTo       string                 // queue of the response, empty for notifications
+	Headers       map[string]interface{} // headers of the message, seen by hooks
+
+	Ack  func() error             // acknowledges the delivery
+	Nack func(requeue bool) error // rejects the delivery
+}
+
+// Publishing is a response published to a reply queue.
+type Publishing struct {
+	Body          []byte
+	ContentType   string
+	CorrelationId string
+}
+
+// Channel is the part of an AMQP channel used by the binding.
+type Channel interface {
+	// Consume returns the deliveries of the queue, to be acknowledged.
+	Consume(queue string) (<-chan *Delivery, error)
+	// Publish publishes the message to the queue through the default exchange.
+	Publish(ctx context.Context, queue string, msg *Publishing) error
+}
+
+/*
+Serve consumes the requests of the queue with concurrency workers, and serves them until ctx is done
+or the deliveries stop.
+
+A delivery is acknowledged once its response is published to its ReplyTo queue with its
+CorrelationId. It is rejected without requeue if the response can't be published, so a dead
+letter exchange can keep it.
+*/
+func Serve(ctx context.Context, server *rpc.Server, ch Channel, queue string, concurrency int) error {
+	deliveries, err := ch.Consume(queue)
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d, ok := <-deliveries:
+					if !ok {
+						return
+					}
+					serveDelivery(ctx, server, ch, d)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+/*
+serveDelivery serves the request of a delivery, and publishes its response
+*/
+func serveDelivery(ctx context.Context, server *rpc.Server, ch Channel, d *Delivery) {
+	header := make(http.Header, len(d.Headers)+1)
+	for k, v := range d.Headers {
+		header.Set(k, fmt.Sprint(v))
+	}
+	if d.ContentType != "" {
+		header.Set("Content-Type", d.ContentType)
+	}
+
+	resp, err := server.ServeMessage(ctx, header, d.Body)
+	if err != nil {
+		resp = []byte(err.Error())
+	}
+	if d.ReplyTo != "" {
+		err := ch.Publish(ctx, d.ReplyTo, &Publishing{
+			Body:          resp,
+			ContentType:   d.ContentType,
+			CorrelationId: d.CorrelationId,
+		})
+		if err != nil {
+			if d.Nack != nil {
+				d.Nack(false)
+			}
+			return
+		}
+	}
+	if d.Ack != nil {
+		d.Ack()
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package apikey authenticates the callers of an rpc.Server with API keys, sent in a header or a
+query parameter, and resolved to principals by a KeyStore:
+
+	store, err := apikey.LoadFile("/etc/rpc/keys.json")
+	if err != nil {
+		...
+	}
+	server.SetAuthenticator(apikey.NewAuthenticator(store, apikey.Options{}))
+
+Keys may be rate limited, the requests over the limit of their key failing with
+rpc.ErrRateLimited and status 429.
+*/
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultHeader is the header carrying the key if Options.Header is empty.
+const DefaultHeader = "X-Api-Key"
+
+var (
+	ErrMissingKey = errors.New("apikey: missing api key")
+	ErrInvalidKey = errors.New("apikey: invalid api key")
+)
+
+// Key is a key resolved by a KeyStore.
+type Key struct {
+	Principal rpc.Principal // caller of the requests of the key
+	Rate      float64       // requests per second allowed, unlimited if zero
+	Burst     int           // requests allowed at once, the rate rounded up if zero
+}
+
+// KeyStore resolves API keys.
+type KeyStore interface {
+	// Lookup returns the key, nil if it is unknown.
+	Lookup(ctx context.Context, key string) (*Key, error)
+}
+
+// StoreFunc is an adapter to allow the use of ordinary functions, e.g.
+// querying a database, as KeyStore.
+type StoreFunc func(ctx context.Context, key string) (*Key, error)
+
+// Lookup calls f(ctx, key).
+func (f StoreFunc) Lookup(ctx context.Context, key string) (*Key, error) {
+	return f(ctx, key)
+}
+
+// StaticStore is a KeyStore of a fixed set of keys.
+type StaticStore map[string]*Key
+
+// Lookup returns the key from the map.
+func (s StaticStore) Lookup(ctx context.Context, key string) (*Key, error) {
+	return s[key], nil
+}
+
+// Principal is the caller of the keys of a file.
+type Principal struct {
+	Username string   `json:"name"`
+	Roles    []string `json:"roles"`
+}
+
+// Name returns the name of the caller.
+func (p *Principal) Name() string {
+	return p.Username
+}
+
+// HasRole reports whether the caller holds the role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+LoadFile returns the store of the keys of a JSON file, mapping keys to their principal and limits:
+
+	{"3f9c...": {"name": "billing", "roles": ["invoices"], "rate": 10, "burst": 20}}
+*/
+func LoadFile(path string) (StaticStore, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]struct {
+		Principal
+		Rate  float64 `json:"rate"`
+		Burst int     `json:"burst"`
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("apikey: %s: %w", path, err)
+	}
+	store := make(StaticStore, len(entries))
+	for key, entry := range entries {
+		p := entry.Principal
+		store[key] = &Key{Principal: &p, Rate: entry.Rate, Burst: entry.Burst}
+	}
+	return store, nil
+}
+
+// Options configures an Authenticator.
+type Options struct {
+	Header     string // header carrying the key, DefaultHeader if empty
+	QueryParam string // query parameter carrying the key if the header is missing, none if empty
+	Optional   bool   // requests without key are anonymous rather than rejected
+}
+
+// Authenticator is an rpc.Authenticator resolving the API key of requests.
+type Authenticator struct {
+	store KeyStore
+	opts  Options
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket // rate limits by key
+}
+
+/*
+NewAuthenticator returns an Authenticator resolving keys with the store
+*/
+func NewAuthenticator(store KeyStore, opts Options) *Authenticator {
+	if opts.Header == "" {
+		opts.Header = DefaultHeader
+	}
+	return &Authenticator{store: store, opts: opts, buckets: make(map[string]*bucket)}
+}
+
+/*
+Authenticate resolves the key of the request, and returns its principal
+*/
+func (a *Authenticator) Authenticate(r *http.Request) (rpc.Principal, error) {
+	key := r.Header.Get(a.opts.Header)
+	if key == "" && a.opts.QueryParam != "" {
+		key = r.URL.Query().Get(a.opts.QueryParam)
+	}
+	if key == "" {
+		if a.opts.Optional {
+			return nil, nil
+		}
+		return nil, rpc.Unauthenticated(ErrMissingKey)
+	}
+	k, err := a.store.Lookup(r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, rpc.Unauthenticated(ErrInvalidKey)
+	}
+	if k.Rate > 0 && !a.allow(key, k, time.Now()) {
+		return nil, rpc.ErrRateLimited
+	}
+	return k.Principal, nil
+}
+
+// bucket is the token bucket limiting the rate of a key.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+allow takes a token from the bucket of the key, refilled at its rate
+*/
+func (a *Authenticator) allow(key string, k *Key, now time.Time) bool {
+	burst := float64(k.Burst)
+	if burst <= 0 {
+		burst = float64(int(k.Rate + 0.999999))
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	b := a.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: burst, last: now}
+		a.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * k.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,40 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"reflect"
+)
+
+/*
+SetArenas enables the experimental allocation of the context, args and reply of calls in a memory
+arena freed at once when the response is written, sparing the garbage collector the values of
+every call. It only takes effect in binaries built with GOEXPERIMENT=arenas, and overrides
+pooling. Methods and hooks must not retain the values, e.g. in a goroutine outliving the call,
+as they are unusable once freed. The values of audited and sampled calls, cached replies, streams
+and calls timing out are allocated as usual, the arena of the latter being left to the garbage
+collector.
+*/
+func (s *Server) SetArenas(enabled bool) {
+	s.arenas = enabled
+}
+
+// requestArena allocates the values of a call, freed all at once.
+type requestArena interface {
+	// new returns a pointer to a new zero value of the type.
+	new(t reflect.Type) reflect.Value
+	free()
+}
+
+/*
+newArena returns the arena of a call, nil if arenas are disabled or not supported
+*/
+func (s *Server) newArena() requestArena {
+	// The audit sink may retain the args and reply.
+	if !s.arenas || s.auditSink != nil {
+		return nil
+	}
+	return newRequestArena()
+}
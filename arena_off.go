@@ -0,0 +1,13 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !goexperiment.arenas
+
+package rpc
+
+// newRequestArena returns nil, arenas are not supported without
+// GOEXPERIMENT=arenas.
+func newRequestArena() requestArena {
+	return nil
+}
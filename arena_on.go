@@ -0,0 +1,29 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build goexperiment.arenas
+
+package rpc
+
+import (
+	"arena"
+	"reflect"
+)
+
+// goArena is a requestArena backed by the arena package.
+type goArena struct {
+	a *arena.Arena
+}
+
+func newRequestArena() requestArena {
+	return &goArena{a: arena.NewArena()}
+}
+
+func (g *goArena) new(t reflect.Type) reflect.Value {
+	return reflect.ArenaNew(g.a, t)
+}
+
+func (g *goArena) free() {
+	g.a.Free()
+}
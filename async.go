@@ -0,0 +1,43 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+)
+
+// AsyncCall represents an active asynchronous call started by Client.Go.
+type AsyncCall struct {
+	Method string          // method in dotted notation, "Service.Method"
+	Args   interface{}     // args of the method
+	Reply  interface{}     // filled with the result of the call
+	Error  error           // error of the call, set when completed
+	Done   chan *AsyncCall // receives the call when completed
+}
+
+/*
+Go calls the RPC method asynchronously, and returns the AsyncCall sent on done when completed.
+
+If done is nil, a new buffered channel is allocated. Otherwise done must be buffered, or Go
+panics, like net/rpc.
+*/
+func (c *Client) Go(ctx context.Context, method string, args interface{}, reply interface{}, done chan *AsyncCall) *AsyncCall {
+	if done == nil {
+		done = make(chan *AsyncCall, 10)
+	} else if cap(done) == 0 {
+		panic("rpc: done channel is unbuffered")
+	}
+	call := &AsyncCall{
+		Method: method,
+		Args:   args,
+		Reply:  reply,
+		Done:   done,
+	}
+	go func() {
+		call.Error = c.Call(ctx, method, args, reply)
+		call.Done <- call
+	}()
+	return call
+}
@@ -0,0 +1,34 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"time"
+)
+
+// AuditEvent describes a call of a service method.
+type AuditEvent struct {
+	Method    string        // method in dotted notation, "Service.Method"
+	Principal Principal     // authenticated caller, nil if anonymous
+	Args      interface{}   // redacted args
+	Reply     interface{}   // redacted reply, nil if the call failed
+	Err       error         // error of the call
+	Duration  time.Duration // time spent from method lookup to reply
+}
+
+// AuditSink receives an AuditEvent for every call of a service method.
+// Fields of args and reply tagged with `redact:"true"` are masked.
+type AuditSink interface {
+	Audit(*AuditEvent)
+}
+
+// AuditSinkFunc is an adapter to allow the use of ordinary functions as
+// AuditSink.
+type AuditSinkFunc func(*AuditEvent)
+
+// Audit calls f(e).
+func (f AuditSinkFunc) Audit(e *AuditEvent) {
+	f(e)
+}
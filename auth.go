@@ -0,0 +1,113 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrRateLimited is returned for callers over their rate limit, by the RatePolicy
+// or by Authenticators. The request then fails with status 429 rather than 401.
+var ErrRateLimited = errors.New("rpc: rate limit exceeded")
+
+// ErrUnauthenticated is wrapped by the errors of Authenticators rejecting the credentials of a
+// caller, e.g. with Unauthenticated, rather than failing to verify them.
+var ErrUnauthenticated = errors.New("rpc: unauthenticated")
+
+/*
+Unauthenticated returns err marked as a rejection of the credentials of the caller: it matches
+ErrUnauthenticated with errors.Is, while keeping the message of err
+*/
+func Unauthenticated(err error) error {
+	return &unauthenticatedError{err}
+}
+
+// unauthenticatedError is an error wrapping ErrUnauthenticated with its own message.
+type unauthenticatedError struct {
+	err error
+}
+
+func (e *unauthenticatedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unauthenticatedError) Unwrap() []error {
+	return []error{e.err, ErrUnauthenticated}
+}
+
+// Principal identifies the authenticated caller of a request.
+type Principal interface {
+	Name() string
+}
+
+// Authenticator authenticates a request before it is dispatched.
+// A nil Principal with a nil error means an anonymous caller. Errors rejecting
+// the credentials of the caller wrap ErrUnauthenticated, unlike the errors of
+// failures to verify them, e.g. of an unreachable identity provider.
+type Authenticator interface {
+	Authenticate(*http.Request) (Principal, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as
+// Authenticator.
+type AuthenticatorFunc func(*http.Request) (Principal, error)
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Principal, error) {
+	return f(r)
+}
+
+// PrincipalSetter is implemented by context types that want to receive the
+// principal returned by the Authenticator.
+type PrincipalSetter interface {
+	SetPrincipal(Principal)
+}
+
+type principalKey struct{}
+
+/*
+PrincipalFromRequest returns the principal attached to the request by the server, used by hooks
+*/
+func PrincipalFromRequest(r *http.Request) Principal {
+	p, _ := r.Context().Value(principalKey{}).(Principal)
+	return p
+}
+
+/*
+withPrincipal returns a shallow copy of r carrying p in its context
+*/
+func withPrincipal(r *http.Request, p Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+type authenticatedKey struct{}
+
+/*
+withAuthenticated returns a shallow copy of r carrying p in its context, marked as authenticated
+so that its calls are not authenticated again
+*/
+func withAuthenticated(r *http.Request, p Principal) *http.Request {
+	ctx := context.WithValue(r.Context(), principalKey{}, p)
+	return r.WithContext(context.WithValue(ctx, authenticatedKey{}, true))
+}
+
+/*
+authenticated reports whether the caller of the request has been authenticated
+*/
+func authenticated(r *http.Request) bool {
+	return r.Context().Value(authenticatedKey{}) != nil
+}
+
+/*
+authStatus returns the http status of a request failing authentication with err
+*/
+func authStatus(err error) int {
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrLockedOut) {
+		return 429
+	}
+	return 401
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// BalancePolicy selects the endpoint of each call among the endpoints of a Client.
+type BalancePolicy int
+
+const (
+	RoundRobin   BalancePolicy = iota // endpoints in turn
+	LeastPending                      // endpoint with the fewest calls in flight
+)
+
+/*
+WithEndpoints adds endpoints the calls are distributed to, along with the endpoint of NewClient
+*/
+func WithEndpoints(endpoints ...string) ClientOption {
+	return func(c *Client) {
+		c.endpoints = append(c.endpoints, endpoints...)
+	}
+}
+
+/*
+WithBalancePolicy sets the policy distributing calls to endpoints, the default one is RoundRobin
+*/
+func WithBalancePolicy(policy BalancePolicy) ClientOption {
+	return func(c *Client) {
+		c.balancer.policy = policy
+	}
+}
+
+/*
+WithEjection ejects an endpoint for the duration d after the number of consecutive failures.
+Failures are classified by DefaultRetryable, so application errors don't eject endpoints.
+*/
+func WithEjection(failures int, d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.balancer.ejectAfter = failures
+		c.balancer.ejectFor = d
+	}
+}
+
+// endpoint is an endpoint of a Client with its state.
+type endpoint struct {
+	url          string
+	pending      int       // calls in flight
+	failures     int       // consecutive failures
+	ejectedUntil time.Time // time the endpoint is ejected until
+}
+
+// balancer distributes calls to endpoints.
+type balancer struct {
+	policy     BalancePolicy
+	ejectAfter int           // consecutive failures ejecting an endpoint, zero if disabled
+	ejectFor   time.Duration // duration of ejection
+
+	mutex     sync.Mutex
+	endpoints []*endpoint
+	next      int // next endpoint of round robin
+}
+
+/*
+parseEndpoint validates an endpoint url
+*/
+func parseEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("rpc: invalid endpoint: %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("rpc: invalid endpoint %q", endpoint)
+	}
+	return u.String(), nil
+}
+
+/*
+setEndpoints replaces the endpoints, keeping the state of the ones already known
+*/
+func (b *balancer) setEndpoints(urls []string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	known := make(map[string]*endpoint, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		known[ep.url] = ep
+	}
+	endpoints := make([]*endpoint, 0, len(urls))
+	for _, u := range urls {
+		ep := known[u]
+		if ep == nil {
+			ep = &endpoint{url: u}
+		}
+		endpoints = append(endpoints, ep)
+	}
+	b.endpoints = endpoints
+}
+
+/*
+pick selects the endpoint of a call, and returns the func to call with its result.
+Ejected endpoints are skipped, unless all of them are ejected.
+*/
+func (b *balancer) pick() (string, func(error), error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.endpoints) == 0 {
+		return "", nil, fmt.Errorf("rpc: no endpoint available")
+	}
+
+	now := time.Now()
+	pickedIdx := -1
+	for i := 0; i < len(b.endpoints); i++ {
+		idx := (b.next + i) % len(b.endpoints)
+		ep := b.endpoints[idx]
+		if now.Before(ep.ejectedUntil) {
+			continue
+		}
+		if pickedIdx == -1 || b.policy == LeastPending && ep.pending < b.endpoints[pickedIdx].pending {
+			pickedIdx = idx
+			if b.policy == RoundRobin {
+				break
+			}
+		}
+	}
+	if pickedIdx == -1 {
+		// All endpoints are ejected, pick the one ejected for the shortest time.
+		pickedIdx = 0
+		for idx, ep := range b.endpoints {
+			if ep.ejectedUntil.Before(b.endpoints[pickedIdx].ejectedUntil) {
+				pickedIdx = idx
+			}
+		}
+	}
+	b.next = (pickedIdx + 1) % len(b.endpoints)
+	picked := b.endpoints[pickedIdx]
+
+	picked.pending++
+	return picked.url, func(err error) {
+		b.done(picked, err)
+	}, nil
+}
+
+/*
+done records the result of a call to the endpoint
+*/
+func (b *balancer) done(ep *endpoint, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ep.pending--
+	if err == nil || !DefaultRetryable(err) {
+		ep.failures = 0
+		return
+	}
+	ep.failures++
+	if b.ejectAfter > 0 && ep.failures >= b.ejectAfter {
+		ep.ejectedUntil = time.Now().Add(b.ejectFor)
+		ep.failures = 0
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxBatchSize is the default limit of the calls of a batch request.
+const DefaultMaxBatchSize = 1000
+
+// ErrBatchTooLarge is the error of batch requests exceeding the limit of the server. The batch
+// fails as a whole, none of its calls is served.
+var ErrBatchTooLarge = errors.New("rpc: too many calls in batch")
+
+/*
+SetMaxBatchSize limits the calls of a batch request, DefaultMaxBatchSize if n is not positive.
+Larger batches fail with a single ErrBatchTooLarge error, e.g. an invalid request error of the
+JSON codec, without serving any call.
+*/
+func (s *Server) SetMaxBatchSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxBatchSize
+	}
+	s.maxBatchSize = n
+}
+
+/*
+checkBatch returns an error if the batch of n calls exceeds the limit of the server
+*/
+func (s *Server) checkBatch(n int) error {
+	if n > s.maxBatchSize {
+		return fmt.Errorf("%w: %d calls, at most %d", ErrBatchTooLarge, n, s.maxBatchSize)
+	}
+	return nil
+}
+
+// BatchCall is a call of a batch sent by Client.CallBatch.
+type BatchCall struct {
+	Method string      // method in dotted notation, "Service.Method"
+	Args   interface{} // args of the method
+	Reply  interface{} // filled with the result of the call
+	Err    error       // error of the call, set after CallBatch returns
+}
+
+// BatchClientCodec is implemented by client codecs supporting batch requests.
+type BatchClientCodec interface {
+	ClientCodec
+	// Encodes the requests of the calls in a single batch.
+	EncodeBatch(calls []BatchCall) ([]byte, error)
+	// Decodes the batch response body, filling the reply or the error of each call.
+	DecodeBatch(r io.Reader, calls []BatchCall) error
+}
+
+/*
+CallBatch sends the calls in a single request, and fills the Reply or Err of each call.
+
+The returned error is the failure of the whole batch; errors of single calls are set in their Err.
+The codec of the client must implement BatchClientCodec.
+*/
+func (c *Client) CallBatch(ctx context.Context, calls []BatchCall) error {
+	codec, ok := c.codec.(BatchClientCodec)
+	if !ok {
+		return fmt.Errorf("rpc: codec does not support batch")
+	}
+	if len(calls) == 0 {
+		return nil
+	}
+	body, err := codec.EncodeBatch(calls)
+	if err != nil {
+		return err
+	}
+
+	idempotent := true
+	for _, call := range calls {
+		idempotent = idempotent && c.retryPolicy.idempotent(call.Method)
+	}
+	return c.do(ctx, "", idempotent, body, func(r io.Reader) error {
+		return codec.DecodeBatch(r, calls)
+	})
+}
+
+// bufferWriter is a http.ResponseWriter keeping the response in memory, used
+// to collect the responses of a batch.
+type bufferWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func newBufferWriter() *bufferWriter {
+	return &bufferWriter{header: make(http.Header), status: 200}
+}
+
+func (bw *bufferWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *bufferWriter) WriteHeader(status int) {
+	bw.status = status
+}
+
+func (bw *bufferWriter) Write(p []byte) (int, error) {
+	return bw.buf.Write(p)
+}
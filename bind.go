@@ -0,0 +1,82 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+/*
+BindClient fills the func fields of the struct pointed by proxy with calls of the RPC methods of a service.
+
+Each exported func field must be of type func(context.Context, *Args) (*Reply, error), and
+calls the method "[service].[field name]", or the name set by the tag `rpc:"Method"`.
+Fields tagged `rpc:"-"` are ignored.
+
+	var hello struct {
+		Hello func(context.Context, *HelloArgs) (*HelloReply, error)
+	}
+	err := rpc.BindClient(client, "MyService", &hello)
+*/
+func BindClient(c *Client, service string, proxy interface{}) error {
+	if c == nil {
+		return fmt.Errorf("rpc: client is nil")
+	}
+	pValue := reflect.ValueOf(proxy)
+	if pValue.Kind() != reflect.Ptr || pValue.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("rpc: proxy is not pointer to struct")
+	}
+	sValue := pValue.Elem()
+	sType := sValue.Type()
+
+	for i := 0; i < sType.NumField(); i++ {
+		field := sType.Field(i)
+		if field.PkgPath != "" || field.Type.Kind() != reflect.Func {
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("rpc"); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		if err := validProxyFunc(field.Type); err != nil {
+			return fmt.Errorf("rpc: proxy field %s: %v", field.Name, err)
+		}
+
+		method := service + "." + name
+		replyType := field.Type.Out(0).Elem()
+		sValue.Field(i).Set(reflect.MakeFunc(field.Type, func(in []reflect.Value) []reflect.Value {
+			reply := reflect.New(replyType)
+			err := c.Call(in[0].Interface().(context.Context), method, in[1].Interface(), reply.Interface())
+			if err != nil {
+				return []reflect.Value{reflect.Zero(reply.Type()), reflect.ValueOf(&err).Elem()}
+			}
+			return []reflect.Value{reply, reflect.Zero(errorType)}
+		}))
+	}
+	return nil
+}
+
+/*
+validProxyFunc validates the type of a proxy func, func(context.Context, *Args) (*Reply, error)
+*/
+func validProxyFunc(t reflect.Type) error {
+	if t.NumIn() != 2 || t.In(0) != contextType || t.In(1).Kind() != reflect.Ptr {
+		return fmt.Errorf("params must be (context.Context, *Args)")
+	}
+	if t.NumOut() != 2 || t.Out(0).Kind() != reflect.Ptr || t.Out(1) != errorType {
+		return fmt.Errorf("results must be (*Reply, error)")
+	}
+	return nil
+}
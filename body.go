@@ -0,0 +1,51 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxBodyBytes is the default size limit of the request bodies read by the server before
+// being decoded.
+const DefaultMaxBodyBytes = 8 << 20
+
+/*
+SetMaxBodyBytes limits the size of the request bodies read by the server before they are decoded,
+e.g. by webhooks, idempotency keys and gateways, DefaultMaxBodyBytes if n is not positive. Larger
+bodies are rejected with status 413 and ErrBodyTooLarge.
+*/
+func (s *Server) SetMaxBodyBytes(n int64) {
+	if n <= 0 {
+		n = DefaultMaxBodyBytes
+	}
+	s.maxBodyBytes = n
+}
+
+/*
+readBody reads the body, failing with ErrBodyTooLarge if it is longer than limit bytes
+*/
+func readBody(body io.Reader, limit int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("rpc: reading body: %w", err)
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrBodyTooLarge, limit)
+	}
+	return b, nil
+}
+
+/*
+bodyStatus returns the http status of a request whose body can't be read with err
+*/
+func bodyStatus(err error) int {
+	if errors.Is(err, ErrBodyTooLarge) {
+		return 413
+	}
+	return 400
+}
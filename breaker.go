@@ -0,0 +1,154 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by a Client when the circuit breaker of the
+// endpoint is open.
+var ErrCircuitOpen = errors.New("rpc: circuit breaker is open")
+
+// CircuitBreakerPolicy configures the circuit breakers of a Client, one per
+// endpoint.
+type CircuitBreakerPolicy struct {
+	// FailureThreshold is the number of consecutive failures opening the circuit.
+	FailureThreshold int
+
+	// OpenTimeout is the time the circuit stays open before probe calls are let through.
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is the number of concurrent probe calls allowed while half-open.
+	// A successful probe closes the circuit, a failed one opens it again.
+	HalfOpenProbes int
+
+	// IsFailure reports whether an error counts as a failure of the endpoint.
+	// DefaultRetryable is used if nil, so application errors don't open the circuit.
+	IsFailure func(err error) bool
+}
+
+/*
+WithCircuitBreaker enables a circuit breaker per endpoint
+*/
+func WithCircuitBreaker(p *CircuitBreakerPolicy) ClientOption {
+	return func(c *Client) {
+		c.breakers = &breakerSet{policy: p, breakers: make(map[string]*circuitBreaker)}
+	}
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerSet holds the circuit breakers of endpoints.
+type breakerSet struct {
+	policy   *CircuitBreakerPolicy
+	mutex    sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+/*
+get returns the circuit breaker of the endpoint
+*/
+func (bs *breakerSet) get(endpoint string) *circuitBreaker {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	b := bs.breakers[endpoint]
+	if b == nil {
+		b = &circuitBreaker{policy: bs.policy}
+		bs.breakers[endpoint] = b
+	}
+	return b
+}
+
+// circuitBreaker is the circuit breaker of an endpoint.
+type circuitBreaker struct {
+	policy   *CircuitBreakerPolicy
+	mutex    sync.Mutex
+	state    breakerState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // time the circuit was opened
+	probes   int       // probe calls in flight while half-open
+}
+
+/*
+allow reports whether a call can be made, and returns the func to call with its result
+*/
+func (b *circuitBreaker) allow() (func(error), error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == breakerOpen {
+		if time.Since(b.openedAt) < b.policy.OpenTimeout {
+			return nil, ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probes = 0
+	}
+	probe := false
+	if b.state == breakerHalfOpen {
+		limit := b.policy.HalfOpenProbes
+		if limit < 1 {
+			limit = 1
+		}
+		if b.probes >= limit {
+			return nil, ErrCircuitOpen
+		}
+		b.probes++
+		probe = true
+	}
+	return func(err error) {
+		b.done(probe, err)
+	}, nil
+}
+
+/*
+done records the result of a call
+*/
+func (b *circuitBreaker) done(probe bool, err error) {
+	isFailure := b.policy.IsFailure
+	if isFailure == nil {
+		isFailure = DefaultRetryable
+	}
+	failed := err != nil && isFailure(err)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if probe {
+		b.probes--
+		if b.state != breakerHalfOpen {
+			return
+		}
+		if failed {
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+		} else {
+			b.state = breakerClosed
+			b.failures = 0
+		}
+		return
+	}
+
+	if b.state != breakerClosed {
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.policy.FailureThreshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// maxPooledBuffer is the capacity above which buffers are dropped rather than
+// pooled, so that a few large responses don't pin their memory.
+const maxPooledBuffer = 64 << 10
+
+// Header values shared by responses rather than allocated for each one, they
+// must not be modified in place.
+var (
+	textPlainHeader      = []string{"text/plain; charset=utf-8"}
+	contentLengthHeaders [1024][]string
+)
+
+func init() {
+	for n := range contentLengthHeaders {
+		contentLengthHeaders[n] = []string{strconv.Itoa(n)}
+	}
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+/*
+GetBuffer returns an empty buffer to encode a response into, to be released with PutBuffer once
+written
+*/
+func GetBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+/*
+PutBuffer releases a buffer returned by GetBuffer, which must not be used afterwards
+*/
+func PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+/*
+WriteBody writes the encoded response through the encoder. With the DefaultEncoder, which leaves
+the body as is, the Content-Length is set so that the response is sent in one piece rather
+than chunked.
+*/
+func WriteBody(w http.ResponseWriter, encoder Encoder, body []byte) error {
+	if encoder == nil || encoder == Encoder(DefaultEncoder) {
+		SetContentLength(w.Header(), len(body))
+		_, err := w.Write(body)
+		return err
+	}
+	_, err := encoder.Encode(w).Write(body)
+	return err
+}
+
+/*
+SetContentLength sets the Content-Length header, without allocating for lengths below 1024
+*/
+func SetContentLength(header http.Header, n int) {
+	if n >= 0 && n < len(contentLengthHeaders) {
+		header["Content-Length"] = contentLengthHeaders[n]
+		return
+	}
+	header["Content-Length"] = []string{strconv.Itoa(n)}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// CacheStore stores replies of cached methods.
+type CacheStore interface {
+	// Get returns the reply stored for key, and whether it was found.
+	Get(key string) (interface{}, bool)
+	// Set stores the reply for key for the duration of ttl.
+	Set(key string, reply interface{}, ttl time.Duration)
+}
+
+/*
+NewMemoryCacheStore returns a CacheStore keeping replies in memory
+*/
+func NewMemoryCacheStore() CacheStore {
+	return &memoryCacheStore{entries: make(map[string]*memoryCacheEntry)}
+}
+
+type memoryCacheEntry struct {
+	reply   interface{}
+	expires time.Time
+}
+
+type memoryCacheStore struct {
+	mutex   sync.Mutex
+	entries map[string]*memoryCacheEntry
+}
+
+func (m *memoryCacheStore) Get(key string) (interface{}, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e := m.entries[key]
+	if e == nil {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(m.entries, key)
+		return nil, false
+	}
+	return e.reply, true
+}
+
+func (m *memoryCacheStore) Set(key string, reply interface{}, ttl time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for k, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[key] = &memoryCacheEntry{reply: reply, expires: now.Add(ttl)}
+}
+
+/*
+cacheKey computes the cache key of a call from the method name and the canonical encoding of args
+*/
+func cacheKey(method string, args interface{}) (string, error) {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	return method + "\x00" + string(b), nil
+}
@@ -0,0 +1,776 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package cbor provides a codec encoding requests and responses with CBOR (RFC 8949), a compact
+binary encoding suited to constrained devices.
+
+Values are encoded like encoding/json would: structs are maps keyed by the field names, or by
+the name of their "cbor" tag, which supports "-" and the "omitempty" option. []byte values
+are byte strings, and types implementing encoding.TextMarshaler are text strings.
+*/
+package cbor
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Major types of CBOR data items.
+const (
+	majorUint   = 0
+	majorNegInt = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+)
+
+// maxDepth is the maximum nesting of the decoded data items.
+const maxDepth = 1000
+
+// RawMessage is a raw encoded CBOR data item, decoded later or encoded as is.
+type RawMessage []byte
+
+var (
+	errTruncated = errors.New("cbor: unexpected end of data")
+
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	rawMessageType      = reflect.TypeOf(RawMessage(nil))
+)
+
+// ----------------------------------------------------------------------------
+// Encoding
+// ----------------------------------------------------------------------------
+
+/*
+Marshal returns the CBOR encoding of v. Map keys are sorted by their encoding, so equal values
+have equal encodings.
+*/
+func Marshal(v interface{}) ([]byte, error) {
+	var e encoder
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// encoder appends the encodings of values to buf.
+type encoder struct {
+	buf []byte
+}
+
+/*
+head appends the head of a data item of the major type with the argument n
+*/
+func (e *encoder) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, major|26), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, major|27), n)
+	}
+}
+
+/*
+encode appends the encoding of v
+*/
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xf6) // null
+		return nil
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			e.buf = append(e.buf, 0xf6)
+		} else {
+			e.buf = append(e.buf, v.Bytes()...)
+		}
+		return nil
+	}
+	if v.Type().Implements(textMarshalerType) && (v.Kind() != reflect.Pointer || !v.IsNil()) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.head(majorText, uint64(len(text)))
+		e.buf = append(e.buf, text...)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xf5)
+		} else {
+			e.buf = append(e.buf, 0xf4)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n >= 0 {
+			e.head(majorUint, uint64(n))
+		} else {
+			e.head(majorNegInt, uint64(-1-n))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.head(majorUint, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xfb), math.Float64bits(v.Float()))
+	case reflect.String:
+		e.head(majorText, uint64(v.Len()))
+		e.buf = append(e.buf, v.String()...)
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xf6)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.head(majorBytes, uint64(v.Len()))
+			e.buf = append(e.buf, v.Bytes()...)
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xf6)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xf6)
+			return nil
+		}
+		return e.encode(v.Elem())
+	default:
+		return fmt.Errorf("cbor: unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+func (e *encoder) encodeArray(v reflect.Value) error {
+	e.head(majorArray, uint64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeMap(v reflect.Value) error {
+	type entry struct {
+		key, value []byte
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		var key, value encoder
+		if err := key.encode(iter.Key()); err != nil {
+			return err
+		}
+		if err := value.encode(iter.Value()); err != nil {
+			return err
+		}
+		entries = append(entries, entry{key.buf, value.buf})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	e.head(majorMap, uint64(len(entries)))
+	for _, en := range entries {
+		e.buf = append(e.buf, en.key...)
+		e.buf = append(e.buf, en.value...)
+	}
+	return nil
+}
+
+func (e *encoder) encodeStruct(v reflect.Value) error {
+	fields := structFields(v.Type())
+	values := make([]reflect.Value, 0, len(fields))
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		fv, err := v.FieldByIndexErr(f.index)
+		if err != nil {
+			// Field of a nil embedded pointer.
+			continue
+		}
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		values = append(values, fv)
+		names = append(names, f.name)
+	}
+
+	e.head(majorMap, uint64(len(values)))
+	for i, fv := range values {
+		e.head(majorText, uint64(len(names[i])))
+		e.buf = append(e.buf, names[i]...)
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// field is an encoded field of a struct.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+/*
+structFields returns the encoded fields of the struct type t, including the fields promoted from
+its embedded structs
+*/
+func structFields(t reflect.Type) []field {
+	var fields []field
+	for _, sf := range reflect.VisibleFields(t) {
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("cbor")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				// Its fields are promoted.
+				continue
+			}
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{name: name, index: sf.Index, omitEmpty: opts == "omitempty"})
+	}
+	return fields
+}
+
+// ----------------------------------------------------------------------------
+// Decoding
+// ----------------------------------------------------------------------------
+
+/*
+Unmarshal decodes the CBOR data item of data into the value pointed to by v. Map keys are
+matched to struct fields like encoding/json does, preferring an exact match.
+*/
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cbor: Unmarshal of non-pointer %T", v)
+	}
+	d := &decoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return errors.New("cbor: data after the top-level item")
+	}
+	return nil
+}
+
+// decoder decodes the data items of data.
+type decoder struct {
+	data  []byte
+	off   int
+	depth int
+}
+
+// head is the head of a data item.
+type head struct {
+	major      byte
+	info       byte   // additional information
+	n          uint64 // argument
+	indefinite bool   // indefinite length string, array or map
+}
+
+/*
+readHead reads the head of the next data item
+*/
+func (d *decoder) readHead() (head, error) {
+	if d.off >= len(d.data) {
+		return head{}, errTruncated
+	}
+	b := d.data[d.off]
+	d.off++
+	h := head{major: b >> 5, info: b & 0x1f}
+	switch {
+	case h.info < 24:
+		h.n = uint64(h.info)
+	case h.info <= 27:
+		size := 1 << (h.info - 24)
+		if len(d.data)-d.off < size {
+			return head{}, errTruncated
+		}
+		for _, c := range d.data[d.off : d.off+size] {
+			h.n = h.n<<8 | uint64(c)
+		}
+		d.off += size
+	case h.info == 31 && h.major >= majorBytes && h.major <= majorMap:
+		h.indefinite = true
+	case h.info == 31 && h.major == majorSimple:
+		return head{}, errors.New("cbor: unexpected break")
+	default:
+		return head{}, fmt.Errorf("cbor: invalid additional information %d", h.info)
+	}
+	return h, nil
+}
+
+/*
+isBreak consumes the break ending an indefinite length item, if it is next
+*/
+func (d *decoder) isBreak() (bool, error) {
+	if d.off >= len(d.data) {
+		return false, errTruncated
+	}
+	if d.data[d.off] == 0xff {
+		d.off++
+		return true, nil
+	}
+	return false, nil
+}
+
+/*
+readString reads the content of a byte or text string, concatenating the chunks of indefinite
+length strings
+*/
+func (d *decoder) readString(h head) ([]byte, error) {
+	if !h.indefinite {
+		if h.n > uint64(len(d.data)-d.off) {
+			return nil, errTruncated
+		}
+		s := d.data[d.off : d.off+int(h.n)]
+		d.off += int(h.n)
+		return s, nil
+	}
+	var s []byte
+	for {
+		end, err := d.isBreak()
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			return s, nil
+		}
+		chunk, err := d.readHead()
+		if err != nil {
+			return nil, err
+		}
+		if chunk.major != h.major || chunk.indefinite {
+			return nil, errors.New("cbor: invalid chunk of indefinite length string")
+		}
+		b, err := d.readString(chunk)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, b...)
+	}
+}
+
+/*
+items calls fn for each item of an array, or each key of a map, until fn returns an error
+*/
+func (d *decoder) items(h head, fn func(i int) error) error {
+	if !h.indefinite && h.n > uint64(len(d.data)-d.off) {
+		// Every item takes at least a byte.
+		return errTruncated
+	}
+	for i := 0; h.indefinite || uint64(i) < h.n; i++ {
+		if h.indefinite {
+			end, err := d.isBreak()
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
+		}
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+skip skips the next data item
+*/
+func (d *decoder) skip() error {
+	var v interface{}
+	return d.decode(reflect.ValueOf(&v).Elem())
+}
+
+/*
+float returns the value of a floating-point simple value
+*/
+func float(h head) float64 {
+	switch h.info {
+	case 25:
+		return halfFloat(uint16(h.n))
+	case 26:
+		return float64(math.Float32frombits(uint32(h.n)))
+	}
+	return math.Float64frombits(h.n)
+}
+
+/*
+halfFloat converts an IEEE 754 half-precision float
+*/
+func halfFloat(bits uint16) float64 {
+	exp := int(bits>>10) & 0x1f
+	mant := float64(bits & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if bits&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+/*
+decode decodes the next data item into v
+*/
+func (d *decoder) decode(v reflect.Value) error {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxDepth {
+		return errors.New("cbor: exceeded max depth")
+	}
+	if v.Type() == rawMessageType {
+		start := d.off
+		if err := d.skip(); err != nil {
+			return err
+		}
+		v.SetBytes(append(RawMessage(nil), d.data[start:d.off]...))
+		return nil
+	}
+
+	h, err := d.readHead()
+	if err != nil {
+		return err
+	}
+	for h.major == majorTag {
+		// Tags are ignored, decoding the tagged item.
+		if h, err = d.readHead(); err != nil {
+			return err
+		}
+	}
+
+	if h.major == majorSimple && (h.info == 22 || h.info == 23) {
+		// null and undefined
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	return d.decodeHead(h, v)
+}
+
+/*
+decodeHead decodes the data item of head h into v
+*/
+func (d *decoder) decodeHead(h head, v reflect.Value) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeHead(h, v.Elem())
+	}
+	if h.major == majorText && v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		s, err := d.readString(h)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(s)
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		value, err := d.decodeAny(h)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+	}
+
+	switch h.major {
+	case majorUint, majorNegInt:
+		return setInt(v, h)
+	case majorBytes, majorText:
+		s, err := d.readString(h)
+		if err != nil {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(s))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte(nil), s...))
+		default:
+			return typeError(h, v)
+		}
+	case majorArray:
+		return d.decodeArray(h, v)
+	case majorMap:
+		switch v.Kind() {
+		case reflect.Map:
+			return d.decodeMap(h, v)
+		case reflect.Struct:
+			return d.decodeStruct(h, v)
+		}
+		return typeError(h, v)
+	case majorSimple:
+		switch {
+		case (h.info == 20 || h.info == 21) && v.Kind() == reflect.Bool:
+			v.SetBool(h.info == 21)
+		case h.info >= 25 && h.info <= 27 && (v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64):
+			v.SetFloat(float(h))
+		default:
+			return typeError(h, v)
+		}
+	}
+	return nil
+}
+
+/*
+setInt sets v to the integer of head h, checking for overflows
+*/
+func setInt(v reflect.Value, h head) error {
+	negative := h.major == majorNegInt
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if h.n > math.MaxInt64 {
+			return typeError(h, v)
+		}
+		n := int64(h.n)
+		if negative {
+			n = -1 - n
+		}
+		if v.OverflowInt(n) {
+			return typeError(h, v)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if negative || v.OverflowUint(h.n) {
+			return typeError(h, v)
+		}
+		v.SetUint(h.n)
+	case reflect.Float32, reflect.Float64:
+		f := float64(h.n)
+		if negative {
+			f = -1 - f
+		}
+		v.SetFloat(f)
+	default:
+		return typeError(h, v)
+	}
+	return nil
+}
+
+func (d *decoder) decodeArray(h head, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		if !h.indefinite {
+			v.Set(reflect.MakeSlice(v.Type(), 0, int(min(h.n, uint64(len(d.data)-d.off)))))
+		} else {
+			v.Set(v.Slice(0, 0))
+		}
+		return d.items(h, func(int) error {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(elem); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, elem))
+			return nil
+		})
+	case reflect.Array:
+		err := d.items(h, func(i int) error {
+			if i >= v.Len() {
+				return d.skip()
+			}
+			return d.decode(v.Index(i))
+		})
+		return err
+	}
+	return typeError(h, v)
+}
+
+func (d *decoder) decodeMap(h head, v reflect.Value) error {
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	return d.items(h, func(int) error {
+		key := reflect.New(v.Type().Key()).Elem()
+		if err := d.decode(key); err != nil {
+			return err
+		}
+		value := reflect.New(v.Type().Elem()).Elem()
+		if err := d.decode(value); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, value)
+		return nil
+	})
+}
+
+func (d *decoder) decodeStruct(h head, v reflect.Value) error {
+	fields := structFields(v.Type())
+	return d.items(h, func(int) error {
+		var name string
+		if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+			return err
+		}
+		var f *field
+		for i := range fields {
+			if fields[i].name == name {
+				f = &fields[i]
+				break
+			}
+			if f == nil && strings.EqualFold(fields[i].name, name) {
+				f = &fields[i]
+			}
+		}
+		if f == nil {
+			return d.skip()
+		}
+		fv, err := v.FieldByIndexErr(f.index)
+		if err != nil {
+			// Allocate the nil embedded pointers on the way to the field.
+			fv = v
+			for _, i := range f.index {
+				if fv.Kind() == reflect.Pointer {
+					if fv.IsNil() {
+						fv.Set(reflect.New(fv.Type().Elem()))
+					}
+					fv = fv.Elem()
+				}
+				fv = fv.Field(i)
+			}
+		}
+		return d.decode(fv)
+	})
+}
+
+/*
+decodeAny decodes the data item of head h into a generic value: int64 or uint64 for integers
+out of the int64 range, float64, bool, string, []byte, []interface{}, map[string]interface{} or
+map[interface{}]interface{} if some keys aren't strings, and nil
+*/
+func (d *decoder) decodeAny(h head) (interface{}, error) {
+	switch h.major {
+	case majorUint:
+		if h.n > math.MaxInt64 {
+			return h.n, nil
+		}
+		return int64(h.n), nil
+	case majorNegInt:
+		if h.n > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(h.n), nil
+	case majorBytes:
+		s, err := d.readString(h)
+		return append([]byte(nil), s...), err
+	case majorText:
+		s, err := d.readString(h)
+		return string(s), err
+	case majorArray:
+		var items []interface{}
+		err := d.items(h, func(int) error {
+			var item interface{}
+			if err := d.decode(reflect.ValueOf(&item).Elem()); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+		if items == nil {
+			items = []interface{}{}
+		}
+		return items, err
+	case majorMap:
+		m := make(map[interface{}]interface{})
+		stringKeys := true
+		err := d.items(h, func(int) error {
+			var key, value interface{}
+			if err := d.decode(reflect.ValueOf(&key).Elem()); err != nil {
+				return err
+			}
+			if err := d.decode(reflect.ValueOf(&value).Elem()); err != nil {
+				return err
+			}
+			if key == nil || !reflect.TypeOf(key).Comparable() {
+				return errors.New("cbor: invalid map key")
+			}
+			_, isString := key.(string)
+			stringKeys = stringKeys && isString
+			m[key] = value
+			return nil
+		})
+		if err != nil || !stringKeys {
+			return m, err
+		}
+		sm := make(map[string]interface{}, len(m))
+		for key, value := range m {
+			sm[key.(string)] = value
+		}
+		return sm, nil
+	case majorSimple:
+		switch {
+		case h.info == 20 || h.info == 21:
+			return h.info == 21, nil
+		case h.info >= 25 && h.info <= 27:
+			return float(h), nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", h.n)
+	}
+	return nil, fmt.Errorf("cbor: invalid major type %d", h.major)
+}
+
+func typeError(h head, v reflect.Value) error {
+	return fmt.Errorf("cbor: cannot decode item of major type %d into %v", h.major, v.Type())
+}
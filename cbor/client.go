@@ -0,0 +1,52 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"github.com/antenna3mt/rpc"
+	"io"
+)
+
+// ClientCodec encodes requests and decodes responses of an rpc.Client.
+type ClientCodec struct {
+}
+
+// NewClientCodec returns a new CBOR ClientCodec.
+func NewClientCodec() *ClientCodec {
+	return &ClientCodec{}
+}
+
+// ContentType returns the Content-Type of CBOR requests.
+func (c *ClientCodec) ContentType() string {
+	return ContentType
+}
+
+// EncodeRequest encodes the request of the RPC method with args.
+func (c *ClientCodec) EncodeRequest(method string, args interface{}) ([]byte, error) {
+	params, err := Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(&request{Method: method, Params: params})
+}
+
+// DecodeResponse decodes the response body filling the RPC method reply.
+func (c *ClientCodec) DecodeResponse(r io.Reader, reply interface{}) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var res clientResponse
+	if err := Unmarshal(data, &res); err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return &rpc.Error{Code: res.Error.Code, Message: res.Error.Message}
+	}
+	if len(res.Result) == 0 {
+		return nil
+	}
+	return Unmarshal(res.Result, reply)
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"github.com/antenna3mt/rpc"
+	"io"
+	"net/http"
+)
+
+const (
+	// ContentType is the Content-Type of CBOR requests and responses.
+	ContentType = "application/cbor"
+
+	// MethodHeader names the RPC method of a request whose body holds only
+	// the encoded args, as sent by transports carrying the method apart,
+	// e.g. in the MQTT topic.
+	MethodHeader = "X-Rpc-Method"
+)
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// request is a CBOR-encoded request.
+type request struct {
+	Method string     `cbor:"method"`
+	Params RawMessage `cbor:"params"`
+}
+
+// serverResponse is a CBOR-encoded response written by the server.
+type serverResponse struct {
+	Result interface{}  `cbor:"result,omitempty"`
+	Error  *errorObject `cbor:"error,omitempty"`
+}
+
+// clientResponse is a CBOR-encoded response read by the client.
+type clientResponse struct {
+	Result RawMessage   `cbor:"result"`
+	Error  *errorObject `cbor:"error"`
+}
+
+// errorObject is the error of a response.
+type errorObject struct {
+	Code    int    `cbor:"code"`
+	Message string `cbor:"message"`
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new CBOR Codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+}
+
+/*
+NewRequest returns a CodecRequest. The body is a map of the "method" and its "params", or only
+the params if the method is given by the MethodHeader header.
+*/
+func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
+	defer r.Body.Close()
+	req := new(request)
+	data, err := io.ReadAll(r.Body)
+	if err == nil {
+		if method := r.Header.Get(MethodHeader); method != "" {
+			req.Method = method
+			req.Params = data
+		} else {
+			err = Unmarshal(data, req)
+		}
+	}
+	return &CodecRequest{request: req, err: err}
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	request *request
+	err     error
+}
+
+// Method returns the RPC method for the current request.
+func (c *CodecRequest) Method() (string, error) {
+	if c.err == nil {
+		return c.request.Method, nil
+	}
+	return "", c.err
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil && len(c.request.Params) > 0 {
+		c.err = Unmarshal(c.request.Params, args)
+	}
+	return c.err
+}
+
+// WriteResponse encodes the response and writes it to the ResponseWriter.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	c.writeResponse(w, &serverResponse{Result: reply})
+}
+
+// WriteError encodes the error and writes it to the ResponseWriter.
+func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	res := &serverResponse{Error: &errorObject{Message: err.Error()}}
+	if rpcErr, ok := err.(*rpc.Error); ok {
+		res.Error.Code = rpcErr.Code
+	}
+	c.writeResponse(w, res)
+}
+
+func (c *CodecRequest) writeResponse(w http.ResponseWriter, res *serverResponse) {
+	data, err := Marshal(res)
+	if err != nil {
+		rpc.WriteError(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	rpc.WriteBody(w, nil, data)
+}
@@ -0,0 +1,383 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ClientCodec encodes requests and decodes responses of a Client using a
+// specific serialization scheme. It mirrors the Codec registered on the
+// server for the same content type.
+type ClientCodec interface {
+	// Returns the Content-Type of requests, e.g. "application/json".
+	ContentType() string
+	// Encodes the request of the RPC method with args.
+	EncodeRequest(method string, args interface{}) ([]byte, error)
+	// Decodes the response body filling the RPC method reply.
+	DecodeResponse(r io.Reader, reply interface{}) error
+}
+
+// HTTPError is returned by a Client when the server responds with a non-2xx
+// status.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("rpc: http status %d: %s", e.StatusCode, e.Message)
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+/*
+WithHTTPClient sets the http.Client used to send requests, the default one is http.DefaultClient
+*/
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+/*
+WithHeader sets a header sent with every request
+*/
+func WithHeader(key, value string) ClientOption {
+	return func(c *Client) {
+		c.header.Set(key, value)
+	}
+}
+
+/*
+WithContentType overrides the Content-Type of requests given by the codec
+*/
+func WithContentType(contentType string) ClientOption {
+	return func(c *Client) {
+		c.contentType = contentType
+	}
+}
+
+type callHeaderKey struct{}
+
+/*
+WithCallHeader returns a copy of ctx carrying a header sent with the calls made with it
+*/
+func WithCallHeader(ctx context.Context, key, value string) context.Context {
+	header := make(http.Header)
+	if parent, ok := ctx.Value(callHeaderKey{}).(http.Header); ok {
+		for k, v := range parent {
+			header[k] = v
+		}
+	}
+	header.Set(key, value)
+	return context.WithValue(ctx, callHeaderKey{}, header)
+}
+
+/*
+NewClient returns a new RPC client sending requests to the endpoint url, encoded with codec.
+The endpoint is ignored if the client has a resolver.
+*/
+func NewClient(endpoint string, codec ClientCodec, opts ...ClientOption) (*Client, error) {
+	if codec == nil {
+		return nil, fmt.Errorf("rpc: codec is nil")
+	}
+
+	c := &Client{
+		endpoints:   []string{endpoint},
+		balancer:    new(balancer),
+		codec:       codec,
+		httpClient:  http.DefaultClient,
+		header:      make(http.Header),
+		contentType: codec.ContentType(),
+		closed:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	var err error
+	if c.resolver != nil {
+		if err = c.resolve(); err != nil {
+			return nil, err
+		}
+		if err = c.watchResolver(); err != nil {
+			return nil, err
+		}
+	} else {
+		urls := make([]string, 0, len(c.endpoints))
+		for _, e := range c.endpoints {
+			u, err := parseEndpoint(e)
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, u)
+		}
+		c.balancer.setEndpoints(urls)
+	}
+	if c.httpClient, err = c.transport.apply(c.httpClient); err != nil {
+		return nil, err
+	}
+	c.invoke = c.chain(c.call)
+	return c, nil
+}
+
+/*
+chain wraps the innermost CallFunc of the client with its interceptors
+*/
+func (c *Client) chain(call CallFunc) CallFunc {
+	interceptors := c.interceptors
+	if c.logger != nil {
+		// Log calls as sent, after the other interceptors.
+		interceptors = append(interceptors[:len(interceptors):len(interceptors)], c.logCalls)
+	}
+	return chainInterceptors(interceptors, call)
+}
+
+/*
+calls RPC methods of a server over HTTP.
+*/
+type Client struct {
+	endpoints    []string           // urls requests are sent to
+	balancer     *balancer          // distributes calls to endpoints
+	codec        ClientCodec        // codec of requests and responses
+	httpClient   *http.Client       // client sending requests
+	header       http.Header        // headers sent with every request
+	contentType  string             // Content-Type of requests
+	retryPolicy  *RetryPolicy       // retries of failed calls, nil if disabled
+	interceptors []Interceptor      // wrap calls, the first one is the outermost
+	invoke       CallFunc           // call wrapped by interceptors
+	transport    transportSettings  // settings of the transport of httpClient
+	signers      []requestSigner    // authenticate requests, e.g. by signing the body
+	breakers     *breakerSet        // circuit breakers of endpoints, nil if disabled
+	statsHandler ClientStatsHandler // receives the stats of calls, nil if disabled
+	hedging      *hedging           // hedging of calls, nil if disabled
+	logger       *log.Logger        // logs calls, nil if disabled
+	logBodies    bool               // logs args and replies of calls
+	inproc       *Server            // server the calls are dispatched to, nil if sent over HTTP
+
+	compress          bool // gzip request bodies
+	compressThreshold int  // minimum size of gzipped request bodies
+
+	resolver        Resolver      // resolves the endpoints, nil if static
+	resolverService string        // service resolved by the resolver
+	resolverRefresh time.Duration // period of resolution
+	closed          chan struct{} // closed by Close
+	closeOnce       sync.Once
+}
+
+/*
+Close stops the background work of the client, e.g. endpoint resolution
+*/
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+/*
+Call calls the RPC method with args, and fills reply with the result.
+
+The method uses a dotted notation as in "Service.Method". ctx controls the lifetime of the
+HTTP request, and carries the headers set with WithCallHeader. The remaining time before the
+deadline of ctx is sent in the X-RPC-Timeout header, so the server gives up in time too.
+*/
+func (c *Client) Call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return c.invoke(ctx, method, args, reply)
+}
+
+/*
+call encodes the request, sends it and decodes the response, it is the innermost CallFunc
+*/
+func (c *Client) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	body, err := c.codec.EncodeRequest(method, args)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, c.retryPolicy.idempotent(method), body, func(r io.Reader) error {
+		return c.codec.DecodeResponse(r, reply)
+	})
+}
+
+/*
+do sends the encoded request body of the method with the retry policy, and decodes the response
+with decode
+*/
+func (c *Client) do(ctx context.Context, method string, idempotent bool, body []byte, decode func(io.Reader) error) error {
+	return c.attempt(ctx, method, idempotent, body, func(body []byte, header http.Header, stats *ClientCallStats) error {
+		return c.send(ctx, body, header, stats, idempotent, decode)
+	})
+}
+
+/*
+attempt prepares the headers and the encoded request body of the method, and runs send with the
+retry policy, reporting the stats of the call
+*/
+func (c *Client) attempt(ctx context.Context, method string, idempotent bool, body []byte,
+	send func([]byte, http.Header, *ClientCallStats) error) (err error) {
+	header := c.requestHeader(ctx)
+	if c.compress && len(body) >= c.compressThreshold {
+		gzipped, err := gzipBody(body)
+		if err != nil {
+			return err
+		}
+		body = gzipped
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	var stats *ClientCallStats
+	if c.statsHandler != nil {
+		stats = &ClientCallStats{
+			Method:      method,
+			Start:       time.Now(),
+			Header:      header,
+			RequestSize: int64(len(body)),
+		}
+		c.statsHandler.CallStart(stats)
+		defer func() {
+			stats.Duration = time.Since(stats.Start)
+			stats.Err = err
+			if err != nil {
+				c.statsHandler.CallError(stats)
+			} else {
+				c.statsHandler.CallResponse(stats)
+			}
+		}()
+	}
+
+	sendAttempt := func() error {
+		stats.nextAttempt(c.statsHandler)
+		err := send(body, header, stats)
+		if stats != nil {
+			stats.Err = err
+		}
+		return err
+	}
+	if c.retryPolicy == nil {
+		return sendAttempt()
+	}
+	return c.retryPolicy.do(ctx, idempotent, header, sendAttempt)
+}
+
+/*
+requestHeader returns the headers of a request: those of the client, and those set on ctx with
+WithCallHeader
+*/
+func (c *Client) requestHeader(ctx context.Context) http.Header {
+	header := make(http.Header, len(c.header)+2)
+	for k, v := range c.header {
+		header[k] = v
+	}
+	if callHeader, ok := ctx.Value(callHeaderKey{}).(http.Header); ok {
+		for k, v := range callHeader {
+			header[k] = v
+		}
+	}
+	return header
+}
+
+/*
+send posts the encoded request body, hedged if idempotent, and decodes the response with decode
+*/
+func (c *Client) send(ctx context.Context, body []byte, header http.Header, stats *ClientCallStats,
+	idempotent bool, decode func(io.Reader) error) (err error) {
+	resp, done, err := c.hedgedRoundTrip(ctx, body, header, stats, idempotent)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		resp.Body.Close()
+		done(err)
+	}()
+	return decode(resp.Body)
+}
+
+/*
+roundTrip posts the encoded request body, and returns the successful response along with the
+func to call with the result of reading its body
+*/
+func (c *Client) roundTrip(ctx context.Context, body []byte, header http.Header, stats *ClientCallStats) (resp *http.Response, done func(error), err error) {
+	return c.roundTripBody(ctx, bytes.NewReader(body), body, header, stats)
+}
+
+/*
+roundTripBody posts the request body read from r, signed with body, to an endpoint, and returns
+its 2xx response along with a func releasing the endpoint with the result of the call
+*/
+func (c *Client) roundTripBody(ctx context.Context, r io.Reader, body []byte, header http.Header,
+	stats *ClientCallStats) (resp *http.Response, done func(error), err error) {
+	var release func(error)
+	endpoint, endpointDone, err := c.balancer.pick()
+	if err != nil {
+		return nil, nil, err
+	}
+	release = endpointDone
+	stats.setEndpoint(endpoint)
+	if c.breakers != nil {
+		breakerDone, errOpen := c.breakers.get(endpoint).allow()
+		if errOpen != nil {
+			endpointDone(errOpen)
+			return nil, nil, errOpen
+		}
+		release = func(err error) {
+			breakerDone(err)
+			endpointDone(err)
+		}
+	}
+	defer func() {
+		if err != nil {
+			release(err)
+		}
+	}()
+
+	req, err := http.NewRequest("POST", endpoint, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil, context.DeadlineExceeded
+		}
+		// A budget rounded to zero would be rejected by the server.
+		timeout := remaining.Round(time.Millisecond)
+		if timeout < time.Millisecond {
+			timeout = time.Millisecond
+		}
+		req.Header.Set(TimeoutHeader, timeout.String())
+	}
+	for _, sign := range c.signers {
+		if err = sign(req, body); err != nil {
+			return nil, nil, err
+		}
+	}
+	req.Header.Set("Content-Type", c.contentType)
+
+	resp, err = c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats.response(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		err = &HTTPError{StatusCode: resp.StatusCode, Message: string(msg)}
+		return nil, nil, err
+	}
+	return resp, release, nil
+}
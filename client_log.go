@@ -0,0 +1,79 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+WithLogger logs every call made with Call to logger, with its method, duration, status and error.
+
+If logBodies is set, the args and reply are logged too, with the fields tagged `redact:"true"`
+replaced by Redacted, so secrets don't leak into logs. Calls are logged after the interceptors
+have run.
+*/
+func WithLogger(logger *log.Logger, logBodies bool) ClientOption {
+	return func(c *Client) {
+		c.logger = logger
+		c.logBodies = logBodies
+	}
+}
+
+/*
+logCalls is the Interceptor logging calls
+*/
+func (c *Client) logCalls(next CallFunc) CallFunc {
+	return func(ctx context.Context, method string, args interface{}, reply interface{}) error {
+		start := time.Now()
+		err := next(ctx, method, args, reply)
+
+		var line strings.Builder
+		fmt.Fprintf(&line, "rpc: call %s status=%d duration=%s", method, callStatus(err), time.Since(start))
+		if err != nil {
+			fmt.Fprintf(&line, " error=%q", err.Error())
+		}
+		if c.logBodies {
+			fmt.Fprintf(&line, " args=%s", logBody(args))
+			if err == nil {
+				fmt.Fprintf(&line, " reply=%s", logBody(reply))
+			}
+		}
+		c.logger.Print(line.String())
+		return err
+	}
+}
+
+/*
+callStatus returns the http status of a call given its error, zero if no response was received
+*/
+func callStatus(err error) int {
+	var httpErr *HTTPError
+	var rpcErr *Error
+	switch {
+	case err == nil, errors.As(err, &rpcErr):
+		return 200
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode
+	}
+	return 0
+}
+
+/*
+logBody returns the redacted JSON encoding of v
+*/
+func logBody(v interface{}) string {
+	b, err := json.Marshal(Redact(v))
+	if err != nil {
+		return fmt.Sprintf("%q", "!"+err.Error())
+	}
+	return string(b)
+}
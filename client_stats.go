@@ -0,0 +1,86 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"time"
+)
+
+// ClientCallStats collects the stats of a call made by a Client. The same
+// ClientCallStats is passed to every callback of a ClientStatsHandler for a
+// call.
+type ClientCallStats struct {
+	Method         string        // method in dotted notation, empty for batches
+	Start          time.Time     // time the call started
+	Duration       time.Duration // total time spent, retries included
+	Attempts       int           // number of attempts sent
+	Endpoint       string        // endpoint of the last attempt
+	RequestSize    int64         // bytes of the encoded request body
+	Status         int           // http status of the last response, zero if none
+	Header         http.Header   // headers of the request, e.g. to inject trace headers
+	ResponseHeader http.Header   // headers of the last response, e.g. to extract trace headers
+	Err            error         // error of the last attempt, then of the call
+
+	// Tag can be set by the ClientStatsHandler to carry its own data across callbacks.
+	Tag interface{}
+}
+
+// ClientStatsHandler receives the stats of every call of a Client at each
+// stage.
+type ClientStatsHandler interface {
+	// CallStart is called before the first attempt, Header can be modified.
+	CallStart(*ClientCallStats)
+	// CallRetry is called before each retry, Err is the error of the previous attempt.
+	CallRetry(*ClientCallStats)
+	// CallResponse is called when the call has succeeded.
+	CallResponse(*ClientCallStats)
+	// CallError is called when the call has failed.
+	CallError(*ClientCallStats)
+}
+
+/*
+WithStatsHandler reports the stats of every call to h, e.g. to record latencies or propagate
+traces
+*/
+func WithStatsHandler(h ClientStatsHandler) ClientOption {
+	return func(c *Client) {
+		c.statsHandler = h
+	}
+}
+
+/*
+nextAttempt counts an attempt, and reports the retry if it isn't the first one
+*/
+func (cs *ClientCallStats) nextAttempt(h ClientStatsHandler) {
+	if cs == nil {
+		return
+	}
+	cs.Attempts++
+	if cs.Attempts > 1 {
+		h.CallRetry(cs)
+	}
+}
+
+/*
+setEndpoint records the endpoint of the attempt
+*/
+func (cs *ClientCallStats) setEndpoint(endpoint string) {
+	if cs == nil {
+		return
+	}
+	cs.Endpoint = endpoint
+}
+
+/*
+response records the response of the attempt
+*/
+func (cs *ClientCallStats) response(resp *http.Response) {
+	if cs == nil {
+		return
+	}
+	cs.Status = resp.StatusCode
+	cs.ResponseHeader = resp.Header
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Command rpccall calls a method of an RPC server and pretty-prints the reply.
+
+Usage:
+
+	rpccall [flags] endpoint method [args]
+	rpccall -list [flags] endpoint
+
+args is the JSON encoded args of the method, "{}" if omitted. The -list flag prints the methods
+of the server, which must have introspection enabled.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	rpcjson "github.com/antenna3mt/rpc/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// codecs are the client codecs selectable with the -codec flag. Only codecs
+// able to encode args decoded from JSON into generic values are usable.
+var codecs = map[string]func() rpc.ClientCodec{
+	"json": func() rpc.ClientCodec { return rpcjson.NewClientCodec() },
+}
+
+// headers is a flag collecting "Key: Value" headers.
+type headers []string
+
+func (h *headers) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headers) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header %q is not \"Key: Value\"", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+func main() {
+	var header headers
+	codecName := flag.String("codec", "json", "codec of the requests")
+	contentType := flag.String("content-type", "", "overrides the Content-Type of the codec")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of the call")
+	list := flag.Bool("list", false, "list the methods of the server")
+	flag.Var(&header, "H", "header \"Key: Value\" sent with the request, may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: rpccall [flags] endpoint method [args]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       rpccall -list [flags] endpoint\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(*codecName, *contentType, header, *timeout, *list, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "rpccall:", err)
+		os.Exit(1)
+	}
+}
+
+func run(codecName, contentType string, header headers, timeout time.Duration, list bool, args []string) error {
+	newCodec, ok := codecs[codecName]
+	if !ok {
+		return fmt.Errorf("unknown codec %q", codecName)
+	}
+
+	var method string
+	params := json.RawMessage("{}")
+	switch {
+	case list && len(args) == 1:
+		method = rpc.IntrospectionMethod
+	case !list && (len(args) == 2 || len(args) == 3):
+		method = args[1]
+		if len(args) == 3 {
+			params = json.RawMessage(args[2])
+			if !json.Valid(params) {
+				return fmt.Errorf("args are not valid JSON")
+			}
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := make([]rpc.ClientOption, 0, len(header)+1)
+	for _, h := range header {
+		kv := strings.SplitN(h, ":", 2)
+		opts = append(opts, rpc.WithHeader(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])))
+	}
+	if contentType != "" {
+		opts = append(opts, rpc.WithContentType(contentType))
+	}
+	client, err := rpc.NewClient(args[0], newCodec(), opts...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var reply json.RawMessage
+	if err := client.Call(ctx, method, params, &reply); err != nil {
+		var rpcErr *rpc.Error
+		if errors.As(err, &rpcErr) {
+			return fmt.Errorf("error %d: %s", rpcErr.Code, rpcErr.Message)
+		}
+		return err
+	}
+
+	out, err := json.MarshalIndent(reply, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package example is the service generated by rpcgen in its tests.
+package example
+
+//go:generate go run github.com/antenna3mt/rpc/cmd/rpcgen -type Greeter
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrEmpty is returned by Greeter.Hello for an empty name.
+var ErrEmpty = errors.New("example: empty name")
+
+type Context struct {
+	User string
+}
+
+type HelloArgs struct {
+	Name string
+}
+
+type HelloReply struct {
+	Greeting string
+}
+
+type Greeter struct {
+	Greeting string
+}
+
+// Hello greets the name, failing if it is empty.
+func (g *Greeter) Hello(ctx *Context, args *HelloArgs, reply *HelloReply) error {
+	if args.Name == "" {
+		return ErrEmpty
+	}
+	reply.Greeting = g.Greeting + ", " + args.Name
+	return nil
+}
+
+// Later returns the time args after the epoch.
+func (*Greeter) Later(ctx *Context, args *time.Duration, reply *time.Time) error {
+	*reply = time.Unix(0, 0).Add(*args).UTC()
+	return nil
+}
+
+// Reset is not a RPC method, lacking the reply.
+func (g *Greeter) Reset(ctx *Context, args *HelloArgs) error {
+	g.Greeting = args.Name
+	return nil
+}
+
+func (g *Greeter) hidden(ctx *Context, args *HelloArgs, reply *HelloReply) error {
+	return nil
+}
@@ -0,0 +1,42 @@
+// Code generated by rpcgen; DO NOT EDIT.
+
+package example
+
+import (
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"time"
+)
+
+// RegisterGreeter adds the methods of svc to server as the service name, "Greeter" if empty.
+func RegisterGreeter(server *rpc.Server, svc *Greeter, name string) error {
+	if name == "" {
+		name = "Greeter"
+	}
+	if err := rpc.RegisterFunc(server, name+".Hello", svc.Hello); err != nil {
+		return err
+	}
+	if err := rpc.RegisterFunc(server, name+".Later", svc.Later); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DispatchGreeter calls the method of svc, decoding its args with decode, and returns its reply.
+func DispatchGreeter(svc *Greeter, ctx *Context, method string, decode func(args interface{}) error) (interface{}, error) {
+	switch method {
+	case "Hello":
+		args, reply := new(HelloArgs), new(HelloReply)
+		if err := decode(args); err != nil {
+			return nil, err
+		}
+		return reply, svc.Hello(ctx, args, reply)
+	case "Later":
+		args, reply := new(time.Duration), new(time.Time)
+		if err := decode(args); err != nil {
+			return nil, err
+		}
+		return reply, svc.Later(ctx, args, reply)
+	}
+	return nil, fmt.Errorf("rpc: can't find method %q", "Greeter."+method)
+}
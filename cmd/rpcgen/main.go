@@ -0,0 +1,286 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Command rpcgen generates the reflection-free registration and dispatch of services.
+
+Usage:
+
+	rpcgen -type T[,T...] [-output file] [dir]
+
+For each service type T of the package in dir, "." if omitted, rpcgen emits:
+
+	// RegisterT adds the methods of svc to server as the service name, "T" if empty.
+	func RegisterT(server *rpc.Server, svc *T, name string) error
+
+	// DispatchT calls the method of svc, decoding its args with decode, and returns its reply.
+	func DispatchT(svc *T, ctx *C, method string, decode func(args interface{}) error) (interface{}, error)
+
+The methods are those RegisterService would find: exported methods of *T taking the pointers to
+the context, args and reply, and returning an error. RegisterT adds them with rpc.RegisterFunc,
+so the server calls them directly rather than with reflect.Value.Call, and DispatchT switches on
+the method name to call them with their args decoded by a codec. The output is written to
+"t_rpcgen.go" in dir by default, for the first type T. It is typically run by go generate:
+
+	//go:generate rpcgen -type MyService
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// method is a method of a service matching the signature of RPC methods.
+type method struct {
+	name  string
+	ctx   string // type of the context pointer, e.g. "*Context"
+	args  string // type of the args pointer
+	reply string // type of the reply pointer
+}
+
+func main() {
+	typeNames := flag.String("type", "", "comma-separated list of service type names, required")
+	output := flag.String("output", "", "output file name, dir/<type>_rpcgen.go by default")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: rpcgen -type T[,T...] [-output file] [dir]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *typeNames == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := "."
+	if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+	types := strings.Split(*typeNames, ",")
+	if *output == "" {
+		*output = filepath.Join(dir, strings.ToLower(types[0])+"_rpcgen.go")
+	}
+
+	src, err := generate(dir, types, filepath.Base(*output))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rpcgen:", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*output, src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "rpcgen:", err)
+		os.Exit(1)
+	}
+}
+
+/*
+generate returns the formatted source of the registration and dispatch of the types of the
+package in dir, ignoring the previous output file
+*/
+func generate(dir string, types []string, output string) ([]byte, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != output
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("%d packages in %s, expected one", len(pkgs), dir)
+	}
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+
+	// Collect the methods of the types, and the imports their signatures use.
+	methods := make(map[string][]method)
+	imports := map[string]string{"fmt": `"fmt"`, "rpc": `"github.com/antenna3mt/rpc"`}
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || !fn.Name.IsExported() {
+				continue
+			}
+			recv := receiverType(fn.Recv.List[0].Type)
+			if !contains(types, recv) {
+				continue
+			}
+			m, ok := rpcMethod(fset, fn)
+			if !ok {
+				continue
+			}
+			if err := addImports(imports, file, fn.Type.Params); err != nil {
+				return nil, err
+			}
+			methods[recv] = append(methods[recv], m)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by rpcgen; DO NOT EDIT.\n\npackage %s\n\nimport (\n", pkg.Name)
+	paths := make([]string, 0, len(imports))
+	for name, path := range imports {
+		if unquoted, _ := strconv.Unquote(path); filepath.Base(unquoted) == name {
+			paths = append(paths, path)
+		} else {
+			paths = append(paths, name+" "+path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(&buf, "\t%s\n", path)
+	}
+	buf.WriteString(")\n")
+
+	for _, typ := range types {
+		ms := methods[typ]
+		if len(ms) == 0 {
+			return nil, fmt.Errorf("type %s has no exported methods of suitable type", typ)
+		}
+		sort.Slice(ms, func(i, j int) bool { return ms[i].name < ms[j].name })
+		for _, m := range ms[1:] {
+			if m.ctx != ms[0].ctx {
+				return nil, fmt.Errorf("methods of %s take different contexts: %s and %s", typ, ms[0].ctx, m.ctx)
+			}
+		}
+		writeService(&buf, typ, ms)
+	}
+	return format.Source(buf.Bytes())
+}
+
+/*
+writeService writes the registration and dispatch of a service type
+*/
+func writeService(buf *bytes.Buffer, typ string, methods []method) {
+	fmt.Fprintf(buf, `
+// Register%[1]s adds the methods of svc to server as the service name, %[1]q if empty.
+func Register%[1]s(server *rpc.Server, svc *%[1]s, name string) error {
+	if name == "" {
+		name = %[1]q
+	}
+`, typ)
+	for _, m := range methods {
+		fmt.Fprintf(buf, "\tif err := rpc.RegisterFunc(server, name+%q, svc.%s); err != nil {\n\t\treturn err\n\t}\n",
+			"."+m.name, m.name)
+	}
+	buf.WriteString("\treturn nil\n}\n")
+
+	fmt.Fprintf(buf, `
+// Dispatch%[1]s calls the method of svc, decoding its args with decode, and returns its reply.
+func Dispatch%[1]s(svc *%[1]s, ctx %[2]s, method string, decode func(args interface{}) error) (interface{}, error) {
+	switch method {
+`, typ, methods[0].ctx)
+	for _, m := range methods {
+		fmt.Fprintf(buf, `	case %q:
+		args, reply := new(%s), new(%s)
+		if err := decode(args); err != nil {
+			return nil, err
+		}
+		return reply, svc.%s(ctx, args, reply)
+`, m.name, strings.TrimPrefix(m.args, "*"), strings.TrimPrefix(m.reply, "*"), m.name)
+	}
+	fmt.Fprintf(buf, "\t}\n\treturn nil, fmt.Errorf(\"rpc: can't find method %%q\", %q+method)\n}\n", typ+".")
+}
+
+/*
+receiverType returns the name of the type of a receiver, T or *T
+*/
+func receiverType(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if ident, ok := expr.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+/*
+rpcMethod returns the method if it takes three pointers and returns an error
+*/
+func rpcMethod(fset *token.FileSet, fn *ast.FuncDecl) (method, bool) {
+	var params []string
+	for _, field := range fn.Type.Params.List {
+		if _, ok := field.Type.(*ast.StarExpr); !ok {
+			return method{}, false
+		}
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			params = append(params, exprString(fset, field.Type))
+		}
+	}
+	results := fn.Type.Results
+	if len(params) != 3 || results == nil || len(results.List) != 1 || len(results.List[0].Names) > 1 {
+		return method{}, false
+	}
+	if ident, ok := results.List[0].Type.(*ast.Ident); !ok || ident.Name != "error" {
+		return method{}, false
+	}
+	return method{name: fn.Name.Name, ctx: params[0], args: params[1], reply: params[2]}, true
+}
+
+/*
+addImports adds the imports of file used by the params
+*/
+func addImports(imports map[string]string, file *ast.File, params *ast.FieldList) error {
+	var err error
+	ast.Inspect(params, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		ident, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		for _, spec := range file.Imports {
+			path, _ := strconv.Unquote(spec.Path.Value)
+			name := filepath.Base(path)
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			if name != ident.Name {
+				continue
+			}
+			if other, ok := imports[name]; ok && other != spec.Path.Value {
+				err = fmt.Errorf("package name %s refers to both %s and %s", name, other, spec.Path.Value)
+			}
+			imports[name] = spec.Path.Value
+			return false
+		}
+		return false
+	})
+	return err
+}
+
+/*
+exprString returns the source of an expression
+*/
+func exprString(fset *token.FileSet, expr ast.Expr) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, fset, expr)
+	return buf.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/antenna3mt/rpc"
+	"github.com/antenna3mt/rpc/cmd/rpcgen/internal/example"
+	rpcjson "github.com/antenna3mt/rpc/json"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	// The generated file of the example is the golden file, kept up to date by go generate.
+	dir := filepath.Join("internal", "example")
+	golden, err := os.ReadFile(filepath.Join(dir, "greeter_rpcgen.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate(dir, []string{"Greeter"}, "greeter_rpcgen.go")
+	assert.NoError(t, err)
+	assert.Equal(t, string(golden), string(src))
+
+	_, err = generate(dir, []string{"Context"}, "greeter_rpcgen.go")
+	assert.Error(t, err)
+	_, err = generate(dir, []string{"Missing"}, "greeter_rpcgen.go")
+	assert.Error(t, err)
+}
+
+func TestGeneratedDispatch(t *testing.T) {
+	reflected, err := rpc.NewServer(new(example.Context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reflected.RegisterCodec(rpcjson.NewCodec(), "application/json")
+	assert.NoError(t, reflected.RegisterService(&example.Greeter{Greeting: "Hello"}, ""))
+
+	generated, err := rpc.NewServer(new(example.Context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated.RegisterCodec(rpcjson.NewCodec(), "application/json")
+	assert.NoError(t, example.RegisterGreeter(generated, &example.Greeter{Greeting: "Hello"}, ""))
+
+	// The generated registration serves the calls as reflection does.
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"Greeter.Hello","params":{"Name":"Yi"},"id":1}`,
+		`{"jsonrpc":"2.0","method":"Greeter.Hello","params":{"Name":""},"id":2}`,
+		`{"jsonrpc":"2.0","method":"Greeter.Hello","params":{"Name":1},"id":3}`,
+		`{"jsonrpc":"2.0","method":"Greeter.Later","params":1000000000,"id":4}`,
+		`{"jsonrpc":"2.0","method":"Greeter.Reset","params":{"Name":"Hi"},"id":5}`,
+		`{"jsonrpc":"2.0","method":"Greeter.hidden","params":{},"id":6}`,
+	} {
+		serve := func(server *rpc.Server) string {
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+			return w.Body.String()
+		}
+		assert.Equal(t, serve(reflected), serve(generated), body)
+	}
+
+	// The generated dispatch calls the methods with their args decoded.
+	svc := &example.Greeter{Greeting: "Hello"}
+	decode := func(params string) func(interface{}) error {
+		return func(args interface{}) error {
+			return json.Unmarshal([]byte(params), args)
+		}
+	}
+	reply, err := example.DispatchGreeter(svc, new(example.Context), "Hello", decode(`{"Name":"Yi"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &example.HelloReply{Greeting: "Hello, Yi"}, reply)
+
+	_, err = example.DispatchGreeter(svc, new(example.Context), "Hello", decode(`{}`))
+	assert.Equal(t, example.ErrEmpty, err)
+
+	reply, err = example.DispatchGreeter(svc, new(example.Context), "Later", decode(`60000000000`))
+	assert.NoError(t, err)
+	later := time.Unix(60, 0).UTC()
+	assert.Equal(t, &later, reply)
+
+	_, err = example.DispatchGreeter(svc, new(example.Context), "Hello", decode(`[]`))
+	assert.Error(t, err)
+	_, err = example.DispatchGreeter(svc, new(example.Context), "Reset", decode(`{}`))
+	assert.EqualError(t, err, `rpc: can't find method "Greeter.Reset"`)
+}
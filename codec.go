@@ -19,3 +19,14 @@ type CodecRequest interface {
 	// Writes an error produced by the server.
 	WriteError(w http.ResponseWriter, status int, err error)
 }
+
+// BatchCodecRequest is implemented by codec requests which may carry a batch
+// of calls. Each call is served separately, and the responses are written
+// together.
+type BatchCodecRequest interface {
+	CodecRequest
+	// Returns the codec requests of the calls, and whether the request is a batch.
+	Batch() ([]CodecRequest, bool)
+	// Writes the encoded responses of the calls, notifications excluded.
+	WriteBatch(w http.ResponseWriter, responses [][]byte)
+}
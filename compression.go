@@ -0,0 +1,103 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxDecompressedBytes is the default size limit of decompressed request bodies.
+const DefaultMaxDecompressedBytes = 8 << 20
+
+// ErrBodyTooLarge is the error of requests whose body exceeds a size limit. The request fails
+// with status 413.
+var ErrBodyTooLarge = errors.New("rpc: request body too large")
+
+/*
+WithRequestCompression gzips request bodies of at least threshold bytes, and sets their
+Content-Encoding. The server decompresses gzip and deflate request bodies, up to
+SetMaxDecompressedBytes.
+*/
+func WithRequestCompression(threshold int) ClientOption {
+	return func(c *Client) {
+		c.compressThreshold = threshold
+		c.compress = true
+	}
+}
+
+/*
+gzipBody returns the gzipped body
+*/
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+SetMaxDecompressedBytes limits the size of decompressed request bodies, DefaultMaxDecompressedBytes
+if n is not positive. Larger bodies, e.g. decompression bombs, are rejected with status 413 and
+ErrBodyTooLarge before being decoded.
+*/
+func (s *Server) SetMaxDecompressedBytes(n int64) {
+	if n <= 0 {
+		n = DefaultMaxDecompressedBytes
+	}
+	s.maxDecompressed = n
+}
+
+/*
+decompressRequest replaces the body of the request by its decompressed content, according to
+the Content-Encoding header, reading at most limit bytes of it. It returns the http status of
+the request if it fails.
+*/
+func decompressRequest(r *http.Request, limit int64) (int, error) {
+	var reader io.Reader
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+		return 0, nil
+	case "gzip":
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return 415, fmt.Errorf("rpc: invalid gzip body: %v", err)
+		}
+		reader = gr
+	case "deflate":
+		// The deflate encoding is zlib-wrapped, RFC 9110 section 8.4.1.2.
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			return 415, fmt.Errorf("rpc: invalid deflate body: %v", err)
+		}
+		reader = zr
+	default:
+		return 415, fmt.Errorf("rpc: unsupported Content-Encoding: %s", enc)
+	}
+
+	// The body is decompressed before the request is authenticated, so its size is bounded.
+	body, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	r.Body.Close()
+	if err != nil {
+		return 400, fmt.Errorf("rpc: invalid %s body: %v", r.Header.Get("Content-Encoding"), err)
+	}
+	if int64(len(body)) > limit {
+		return 413, fmt.Errorf("%w: more than %d bytes decompressed", ErrBodyTooLarge, limit)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.Header.Del("Content-Encoding")
+	r.ContentLength = int64(len(body))
+	return 0, nil
+}
@@ -8,56 +8,95 @@ package rpc
 import (
 	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"unicode"
 )
 
-// gzipWriter writes and closes the gzip writer.
-type gzipWriter struct {
-	w *gzip.Writer
-}
-
-func (gw *gzipWriter) Write(p []byte) (n int, err error) {
-	defer gw.w.Close()
-	return gw.w.Write(p)
-}
+// DefaultCompressionMinSize is the size of the smallest response bodies
+// compressed by a CompressionSelector, smaller ones don't get much smaller.
+const DefaultCompressionMinSize = 1024
 
-// gzipEncoder implements the gzip compressed http encoder.
-type gzipEncoder struct {
-}
+// Pools of compressors by level, from HuffmanOnly to BestCompression.
+var (
+	gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+	zlibWriters [zlib.BestCompression - zlib.HuffmanOnly + 1]sync.Pool
+)
 
-func (enc *gzipEncoder) Encode(w http.ResponseWriter) io.Writer {
-	w.Header().Set("Content-Encoding", "gzip")
-	return &gzipWriter{gzip.NewWriter(w)}
+// compressWriter compresses the body written at once, unless it is smaller
+// than minSize. The Content-Encoding is set only if the body is compressed.
+type compressWriter struct {
+	w        http.ResponseWriter
+	encoding string
+	level    int
+	minSize  int
 }
 
-// flateWriter writes and closes the flate writer.
-type flateWriter struct {
-	w *flate.Writer
+func (cw *compressWriter) Write(p []byte) (n int, err error) {
+	if len(p) < cw.minSize {
+		return cw.w.Write(p)
+	}
+	cw.w.Header().Set("Content-Encoding", cw.encoding)
+	cw.w.Header().Del("Content-Length")
+	if cw.encoding == "gzip" {
+		pool := &gzipWriters[cw.level-gzip.HuffmanOnly]
+		gw, ok := pool.Get().(*gzip.Writer)
+		if ok {
+			gw.Reset(cw.w)
+		} else {
+			gw, _ = gzip.NewWriterLevel(cw.w, cw.level)
+		}
+		defer pool.Put(gw)
+		return writeAndClose(gw, p)
+	}
+	// The deflate encoding is zlib-wrapped, RFC 9110 section 8.4.1.2.
+	pool := &zlibWriters[cw.level-zlib.HuffmanOnly]
+	zw, ok := pool.Get().(*zlib.Writer)
+	if ok {
+		zw.Reset(cw.w)
+	} else {
+		zw, _ = zlib.NewWriterLevel(cw.w, cw.level)
+	}
+	defer pool.Put(zw)
+	return writeAndClose(zw, p)
 }
 
-func (fw *flateWriter) Write(p []byte) (n int, err error) {
-	defer fw.w.Close()
-	return fw.w.Write(p)
+/*
+writeAndClose writes p to the compressor and closes it, flushing the compressed body
+*/
+func writeAndClose(w io.WriteCloser, p []byte) (int, error) {
+	n, err := w.Write(p)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
 }
 
-// flateEncoder implements the flate compressed http encoder.
-type flateEncoder struct {
+// compressEncoder implements the compressed http encoders.
+type compressEncoder struct {
+	encoding string
+	level    int
+	minSize  int
 }
 
-func (enc *flateEncoder) Encode(w http.ResponseWriter) io.Writer {
-	fw, err := flate.NewWriter(w, flate.DefaultCompression)
-	if err != nil {
-		return w
-	}
-	w.Header().Set("Content-Encoding", "deflate")
-	return &flateWriter{fw}
+func (enc *compressEncoder) Encode(w http.ResponseWriter) io.Writer {
+	return &compressWriter{w: w, encoding: enc.encoding, level: enc.level, minSize: enc.minSize}
 }
 
-// CompressionSelector generates the compressed http encoder.
+/*
+CompressionSelector generates the compressed http encoder, gzip or deflate as accepted by the
+client. Compressors are pooled, and bodies smaller than MinSize are sent uncompressed.
+*/
 type CompressionSelector struct {
+	// Level is the compression level, from flate.HuffmanOnly to
+	// flate.BestCompression, flate.DefaultCompression if zero.
+	Level int
+	// MinSize is the size of the smallest compressed bodies,
+	// DefaultCompressionMinSize if zero.
+	MinSize int
 }
 
 // acceptedEnc returns the first compression type in "Accept-Encoding" header
@@ -79,12 +118,18 @@ func acceptedEnc(req *http.Request) string {
 }
 
 // Select method selects the correct compression encoder based on http HEADER.
-func (_ *CompressionSelector) Select(r *http.Request) Encoder {
-	switch acceptedEnc(r) {
-	case "gzip":
-		return &gzipEncoder{}
-	case "flate":
-		return &flateEncoder{}
+func (cs *CompressionSelector) Select(r *http.Request) Encoder {
+	enc := acceptedEnc(r)
+	if enc == "" {
+		return DefaultEncoder
+	}
+	level := cs.Level
+	if level == 0 || level < flate.HuffmanOnly || level > flate.BestCompression {
+		level = flate.DefaultCompression
+	}
+	minSize := cs.MinSize
+	if minSize == 0 {
+		minSize = DefaultCompressionMinSize
 	}
-	return DefaultEncoder
+	return &compressEncoder{encoding: enc, level: level, minSize: minSize}
 }
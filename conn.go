@@ -0,0 +1,200 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// MaxFrameSize is the maximum size of a frame of a connection.
+const MaxFrameSize = 16 << 20
+
+// framer reads and writes the frames of a connection, each one holding an
+// encoded request or response.
+type framer interface {
+	ReadFrame() ([]byte, error)
+	WriteFrame(payload []byte) error
+}
+
+// lengthFramer prefixes frames with their length, as a 4 bytes big endian
+// integer.
+type lengthFramer struct {
+	reader *bufio.Reader
+	writer io.Writer
+}
+
+func newLengthFramer(rw io.ReadWriter) *lengthFramer {
+	return &lengthFramer{reader: bufio.NewReader(rw), writer: rw}
+}
+
+func (f *lengthFramer) ReadFrame() ([]byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(f.reader, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("rpc: frame of %d bytes too large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(f.reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (f *lengthFramer) WriteFrame(payload []byte) error {
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	_, err := f.writer.Write(append(frame, payload...))
+	return err
+}
+
+/*
+SetConnContentType sets the Content-Type of the requests received on connections served without
+HTTP, selecting their codec. If empty, the default, the only registered codec is used.
+*/
+func (s *Server) SetConnContentType(contentType string) {
+	s.connContentType = contentType
+}
+
+/*
+ServeListener accepts connections on the listener, and serves each one with ServeConn.
+*/
+func (s *Server) ServeListener(l net.Listener) error {
+	s.events.publish(&Event{Type: EventServeStart, Addr: l.Addr()})
+	var err error
+	for {
+		var conn net.Conn
+		if conn, err = l.Accept(); err != nil {
+			break
+		}
+		go s.ServeConn(conn)
+	}
+	s.events.publish(&Event{Type: EventServeStop, Addr: l.Addr(), Err: err})
+	return err
+}
+
+/*
+ServeConn serves the requests received on conn, e.g. a pipe, serial link or SSH channel, until it
+is closed, and closes it.
+
+The connection carries no HTTP: every request and response is a frame prefixed by its length, as
+a 4 bytes big endian integer. The requests are served in order, an empty frame answering a
+notification. NewConnClient calls the methods served on the other end.
+*/
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	s.serveFrames(conn, newLengthFramer(conn))
+}
+
+/*
+serveFrames serves the frames of a connection in order, until it is closed
+*/
+func (s *Server) serveFrames(conn io.Closer, f framer) error {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	header := make(http.Header)
+	if s.connContentType != "" {
+		header.Set("Content-Type", s.connContentType)
+	}
+	for {
+		payload, err := f.ReadFrame()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		resp := s.serveMessage(ctx, header, payload)
+		if err := f.WriteFrame(resp.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// ConnClient calls RPC methods of a server over a connection without HTTP,
+// as served by Server.ServeListener. Calls are sent one at a time.
+type ConnClient struct {
+	conn  io.Closer
+	f     framer
+	codec ClientCodec
+	mutex sync.Mutex
+}
+
+/*
+NewConnClient returns a client calling RPC methods over the connection, encoded with codec
+*/
+func NewConnClient(conn io.ReadWriteCloser, codec ClientCodec) *ConnClient {
+	return &ConnClient{conn: conn, f: newLengthFramer(conn), codec: codec}
+}
+
+/*
+Call calls the RPC method with args, and fills reply with the result. The connection is closed if
+ctx is done before the response is received, as it can't be used anymore.
+*/
+func (c *ConnClient) Call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	body, err := c.codec.EncodeRequest(method, args)
+	if err != nil {
+		return err
+	}
+	payload, err := c.roundTrip(ctx, body)
+	if err != nil {
+		return err
+	}
+	return c.codec.DecodeResponse(bytes.NewReader(payload), reply)
+}
+
+/*
+Close closes the connection
+*/
+func (c *ConnClient) Close() error {
+	return c.conn.Close()
+}
+
+/*
+roundTrip sends a request frame, and returns the response frame
+*/
+func (c *ConnClient) roundTrip(ctx context.Context, body []byte) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.Close()
+	})
+	defer stop()
+
+	if err := c.f.WriteFrame(body); err != nil {
+		return nil, ctxError(ctx, err)
+	}
+	payload, err := c.f.ReadFrame()
+	if err != nil {
+		return nil, ctxError(ctx, err)
+	}
+	return payload, nil
+}
+
+/*
+ctxError returns the error of ctx if it is done, err otherwise
+*/
+func ctxError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// Defaults of a CSRFPolicy.
+const (
+	DefaultCSRFCookie = "rpc_csrf"
+	DefaultCSRFHeader = "X-CSRF-Token"
+)
+
+// ErrCSRF is the error of the requests failing the CSRF check.
+var ErrCSRF = errors.New("rpc: invalid csrf token")
+
+// CSRFPolicy protects the browsers calling the server with session cookies against cross-site
+// request forgery.
+//
+// Without Secret, tokens are double-submitted: the token issued in the cookie of the policy must
+// be sent back in the header. With Secret, the token is the HMAC of the value of the session
+// cookie, so no cookie is issued.
+type CSRFPolicy struct {
+	SessionCookie string // cookie authenticating the browsers, any cookie if empty, required with Secret
+	Secret        []byte // key of the tokens bound to the session cookie, nil to double-submit
+	CookieName    string // cookie of the double-submitted token, DefaultCSRFCookie if empty
+	HeaderName    string // header of the token, DefaultCSRFHeader if empty
+	Secure        bool   // issues the cookie for HTTPS only
+}
+
+/*
+SetCSRFPolicy rejects the requests carrying cookies without the CSRF token of the policy with
+status 403, before decoding them. Requests without the session cookie, e.g. of clients
+authenticated by header, are not checked. A nil policy disables the check.
+*/
+func (s *Server) SetCSRFPolicy(policy *CSRFPolicy) {
+	if policy != nil {
+		p := *policy
+		if p.CookieName == "" {
+			p.CookieName = DefaultCSRFCookie
+		}
+		if p.HeaderName == "" {
+			p.HeaderName = DefaultCSRFHeader
+		}
+		policy = &p
+	}
+	s.csrf = policy
+}
+
+/*
+CSRFTokenHandler returns a handler issuing the CSRF token of the browser to send in the header of
+its calls, as JSON {"header": name, "token": token}, e.g. fetched by the page on load
+*/
+func (s *Server) CSRFTokenHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.csrf == nil {
+			WriteError(w, 404, "rpc: no csrf policy")
+			return
+		}
+		token, err := s.csrf.issue(w, r)
+		if err != nil {
+			WriteError(w, 400, err.Error())
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeAdminJSON(w, map[string]string{"header": s.csrf.HeaderName, "token": token})
+	})
+}
+
+/*
+checkCSRF writes status 403 and returns false if the request fails the CSRF check
+*/
+func (s *Server) checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if s.csrf == nil {
+		return true
+	}
+	if err := s.csrf.check(r); err != nil {
+		WriteError(w, 403, err.Error())
+		return false
+	}
+	return true
+}
+
+/*
+issue returns the token of the browser, setting the cookie of a new double-submitted token
+*/
+func (p *CSRFPolicy) issue(w http.ResponseWriter, r *http.Request) (string, error) {
+	if p.Secret != nil {
+		session, err := r.Cookie(p.SessionCookie)
+		if err != nil || session.Value == "" {
+			return "", errors.New("rpc: no session cookie")
+		}
+		return p.sign(session.Value), nil
+	}
+	if c, err := r.Cookie(p.CookieName); err == nil && c.Value != "" {
+		return c.Value, nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.CookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   p.Secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+/*
+check verifies the token of the request, if it carries the session cookie
+*/
+func (p *CSRFPolicy) check(r *http.Request) error {
+	var session string
+	if p.SessionCookie == "" {
+		if len(r.Cookies()) == 0 {
+			return nil
+		}
+	} else {
+		c, err := r.Cookie(p.SessionCookie)
+		if err != nil {
+			return nil
+		}
+		session = c.Value
+	}
+
+	token := r.Header.Get(p.HeaderName)
+	var expected string
+	if p.Secret != nil {
+		if session == "" {
+			return ErrCSRF
+		}
+		expected = p.sign(session)
+	} else if c, err := r.Cookie(p.CookieName); err == nil {
+		expected = c.Value
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return ErrCSRF
+	}
+	return nil
+}
+
+/*
+sign returns the token bound to the session
+*/
+func (p *CSRFPolicy) sign(session string) string {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write([]byte(session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
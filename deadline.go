@@ -0,0 +1,79 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// TimeoutHeader is the request header carrying the time budget of a call.
+// The value is either a duration, e.g. "1.5s", or a number of milliseconds.
+const TimeoutHeader = "X-RPC-Timeout"
+
+// ErrDeadlineExceeded is returned when a call does not complete within the
+// budget given by TimeoutHeader.
+var ErrDeadlineExceeded = errors.New("rpc: deadline exceeded")
+
+// ContextSetter is implemented by context types that want to receive the
+// context.Context of the request, which is canceled when the deadline expires.
+type ContextSetter interface {
+	SetContext(context.Context)
+}
+
+/*
+parseTimeout parses the value of TimeoutHeader
+*/
+func parseTimeout(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		ms, errInt := strconv.ParseInt(v, 10, 64)
+		if errInt != nil {
+			return 0, fmt.Errorf("rpc: invalid %s %q", TimeoutHeader, v)
+		}
+		// Longer budgets than time.Duration holds are as good as none.
+		if ms > math.MaxInt64/int64(time.Millisecond) {
+			ms = math.MaxInt64 / int64(time.Millisecond)
+		}
+		d = time.Duration(ms) * time.Millisecond
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("rpc: invalid %s %q", TimeoutHeader, v)
+	}
+	return d, nil
+}
+
+/*
+callWithContext executes call, and gives up waiting with ErrDeadlineExceeded when the deadline of ctx expires
+*/
+func callWithContext(ctx context.Context, call func() error) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return call()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+/*
+contextError returns the error of a done ctx, ErrDeadlineExceeded once its deadline expired
+*/
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrDeadlineExceeded
+	}
+	return ctx.Err()
+}
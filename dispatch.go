@@ -0,0 +1,114 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+/*
+Dispatch calls the registered method with ctx, a pointer to the context type of the server, and
+returns its reply. The args are filled by decode, given a pointer to a new args value, or when
+the method needs them if they are Lazy. It runs the before and after hooks around the call,
+and applies the error translator, so transports not based on HTTP reuse the method lookup and
+invocation of ServeHTTP:
+
+	reply, err := server.Dispatch(&Context{}, "Service.Method", func(args interface{}) error {
+		return json.Unmarshal(params, args)
+	})
+
+The hooks receive an empty POST request. There is no caller to authenticate, so methods requiring
+roles or restricted by ACLs fail with ErrForbidden unless dispatched with DispatchAs. Methods with
+streams can't be dispatched. A panicking method fails with ErrInternal.
+*/
+func (s *Server) Dispatch(ctx interface{}, method string, decode func(args interface{}) error) (interface{}, error) {
+	return s.DispatchAs(ctx, nil, method, decode)
+}
+
+/*
+DispatchAs is Dispatch on behalf of the principal, authenticated by the transport. The principal is
+authorized against the roles and ACLs of the method, attached to the request of the hooks, and set
+to ctx if it implements PrincipalSetter.
+*/
+func (s *Server) DispatchAs(ctx interface{}, principal Principal, method string, decode func(args interface{}) error) (interface{}, error) {
+	ctxValue := reflect.ValueOf(ctx)
+	if !ctxValue.IsValid() || ctxValue.Type() != reflect.PointerTo(s.ctxType) || ctxValue.IsNil() {
+		return nil, fmt.Errorf("rpc: ctx must be a non-nil *%s", s.ctxType)
+	}
+	r := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/"},
+		Header: make(http.Header),
+	}
+	if principal != nil {
+		r = withPrincipal(r, principal)
+		if setter, ok := ctxValue.Interface().(PrincipalSetter); ok {
+			setter.SetPrincipal(principal)
+		}
+	}
+
+	for _, h := range s.beforeFns.load() {
+		if err := h.call(r, ctxValue); err != nil {
+			return nil, err
+		}
+	}
+
+	methodSpec, err := s.services.get(method)
+	if err != nil {
+		return nil, err
+	}
+	if methodSpec.takesStreams() {
+		return nil, fmt.Errorf("rpc: method %q takes streams, it can't be dispatched", method)
+	}
+	if err := authorize(principal, methodSpec.roles); err != nil {
+		return nil, err
+	}
+	if s.aclTable != nil {
+		if err := s.aclTable.authorize(principal, method); err != nil {
+			return nil, err
+		}
+	}
+
+	args := methodSpec.args.get(false)
+	if lazy, ok := args.Interface().(lazyArgs); ok {
+		lazy.setDecoder(decode)
+		defer lazy.close()
+	} else if err := decode(args.Interface()); err != nil {
+		return nil, err
+	}
+	reply := methodSpec.reply.get(false)
+	start := time.Now()
+	err = func() (err error) {
+		// A panic fails the call rather than the transport.
+		defer recoverCall(&err)
+		return methodSpec.invoke(context.Background(), ctxValue, args, reply)
+	}()
+	elapsed := time.Since(start)
+	methodSpec.counters.record(elapsed, err)
+	if s.slowCalls != nil {
+		s.slowCalls.logSlowCall(context.Background(), method, methodSpec, elapsed, args, err)
+	}
+	if err != nil {
+		err = s.translateError(method, err)
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			err = ErrInternal
+		}
+		return nil, err
+	}
+
+	for _, h := range s.afterFns.load() {
+		if err := h.call(r, ctxValue); err != nil {
+			return nil, err
+		}
+	}
+	return reply.Interface(), nil
+}
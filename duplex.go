@@ -0,0 +1,263 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// StreamMethodHeader names the RPC method of a streamed call, whose request
+// body is a sequence of items rather than a single request.
+const StreamMethodHeader = "X-Rpc-Stream"
+
+// StreamCodec is implemented by codecs supporting streamed calls.
+type StreamCodec interface {
+	Codec
+	// NewStreamRequest returns a CodecRequest of a streamed call of the
+	// method: ReadRequest decodes the next item of the body, returning io.EOF
+	// after the last one, and WriteResponse encodes an item of the response.
+	NewStreamRequest(r *http.Request, method string) CodecRequest
+}
+
+// DuplexClientCodec is implemented by client codecs supporting streamed calls.
+type DuplexClientCodec interface {
+	StreamClientCodec
+	// Encodes an item of the request of a streamed call.
+	EncodeItem(item interface{}) ([]byte, error)
+}
+
+/*
+RequestStream is the args of a method reading its request item by item, as the client sends
+them, e.g. to transform an upload while it is received:
+
+	func (*Service) Upper(ctx *Context, args *rpc.RequestStream, reply *rpc.ResponseStream) error
+
+Such methods are reached by streamed calls only, made with Client.CallDuplex.
+*/
+type RequestStream struct {
+	mutex    sync.Mutex
+	codecReq CodecRequest
+	closed   bool
+}
+
+/*
+Recv fills item with the next item of the request, and returns io.EOF after the last one
+*/
+func (rs *RequestStream) Recv(item interface{}) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if rs.closed {
+		return fmt.Errorf("rpc: stream is closed")
+	}
+	return rs.codecReq.ReadRequest(item)
+}
+
+/*
+close ends the stream once the method returned or timed out
+*/
+func (rs *RequestStream) close() {
+	rs.mutex.Lock()
+	rs.closed = true
+	rs.mutex.Unlock()
+}
+
+/*
+ResponseStream is the reply of a method sending its response item by item, each one written
+and flushed as it is sent. An error returned by the method is sent after the items. The items
+are read with Client.CallStream, or Client.CallDuplex for streamed calls.
+*/
+type ResponseStream struct {
+	mutex    sync.Mutex
+	ctx      context.Context
+	w        http.ResponseWriter
+	codecReq CodecRequest
+	closed   bool
+}
+
+/*
+Send writes the item of the response, and fails once the client went away
+*/
+func (rs *ResponseStream) Send(item interface{}) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if rs.closed {
+		return fmt.Errorf("rpc: stream is closed")
+	}
+	if err := rs.ctx.Err(); err != nil {
+		return err
+	}
+	rs.codecReq.WriteResponse(rs.w, item)
+	if flusher, ok := rs.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+/*
+close ends the stream once the method returned or timed out
+*/
+func (rs *ResponseStream) close() {
+	rs.mutex.Lock()
+	rs.closed = true
+	rs.mutex.Unlock()
+}
+
+// streamWriter writes the items of a ResponseStream, dropping the
+// Content-Length codecs set from the length of the first item.
+type streamWriter struct {
+	http.ResponseWriter
+}
+
+func (sw streamWriter) WriteHeader(status int) {
+	sw.Header().Del("Content-Length")
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw streamWriter) Write(p []byte) (int, error) {
+	sw.Header().Del("Content-Length")
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw streamWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sw streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// DuplexStream is a streamed call made with Client.CallDuplex.
+type DuplexStream interface {
+	// Send sends an item of the request.
+	Send(item interface{}) error
+	// CloseSend ends the request, the method then receives io.EOF.
+	CloseSend() error
+	// Recv fills reply with the next item of the response, and returns io.EOF
+	// after the last one.
+	Recv(reply interface{}) error
+	// Close cancels the call if it is not over, it must be called once done.
+	Close() error
+}
+
+/*
+CallDuplex starts a streamed call of the RPC method, whose request and response are sent item by
+item at the same time, e.g. to upload and transform data. The method takes a RequestStream
+and replies with a ResponseStream. Both ways are open at once over HTTP/2, while over HTTP/1.1
+the server must support full-duplex responses.
+
+Streamed calls are neither retried nor hedged, and can't be signed. The codec of the client
+must implement DuplexClientCodec, and the codec of the server StreamCodec.
+*/
+func (c *Client) CallDuplex(ctx context.Context, method string) (DuplexStream, error) {
+	codec, ok := c.codec.(DuplexClientCodec)
+	if !ok {
+		return nil, fmt.Errorf("rpc: codec does not support streamed calls")
+	}
+	if len(c.signers) > 0 {
+		return nil, fmt.Errorf("rpc: streamed calls can't be signed")
+	}
+	header := c.requestHeader(ctx)
+	header.Set(StreamMethodHeader, method)
+
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	s := &duplexStream{codec: codec, pw: pw, cancel: cancel, ready: make(chan struct{})}
+	go func() {
+		defer close(s.ready)
+		resp, done, err := c.roundTripBody(ctx, pr, nil, header, nil)
+		if err != nil {
+			s.err = err
+			pr.CloseWithError(err)
+			return
+		}
+		s.body = resp.Body
+		s.decoder = codec.NewStreamDecoder(resp.Body)
+		s.done = done
+	}()
+	return s, nil
+}
+
+// duplexStream sends the items of a streamed call through a pipe, and reads
+// the items of the response once received.
+type duplexStream struct {
+	codec  DuplexClientCodec
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	ready  chan struct{} // closed once the response is received or failed
+
+	// Set before ready is closed.
+	body    io.ReadCloser
+	decoder StreamDecoder
+	done    func(error) // records the result of the call
+
+	mutex sync.Mutex
+	err   error // error of the call, io.EOF at the end of the response
+}
+
+func (s *duplexStream) Send(item interface{}) error {
+	data, err := s.codec.EncodeItem(item)
+	if err != nil {
+		return err
+	}
+	_, err = s.pw.Write(data)
+	return err
+}
+
+func (s *duplexStream) CloseSend() error {
+	return s.pw.Close()
+}
+
+func (s *duplexStream) Recv(reply interface{}) error {
+	<-s.ready
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	err := s.decoder.Decode(reply)
+	if err == nil {
+		return nil
+	}
+	s.err = err
+	if err == io.EOF {
+		s.close(nil)
+	} else {
+		s.close(err)
+	}
+	return err
+}
+
+func (s *duplexStream) Close() error {
+	s.cancel()
+	s.pw.CloseWithError(fmt.Errorf("rpc: stream is closed"))
+	<-s.ready
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err == nil {
+		s.err = fmt.Errorf("rpc: stream is closed")
+	}
+	s.close(nil)
+	return nil
+}
+
+/*
+close releases the response once
+*/
+func (s *duplexStream) close(err error) {
+	if s.done == nil {
+		return
+	}
+	s.body.Close()
+	s.done(err)
+	s.done = nil
+}
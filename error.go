@@ -0,0 +1,55 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// Error is a structured error of an RPC method. Methods may return it to send
+// a specific code, and clients decode the errors of the server into it, so
+// they can branch on the code:
+//
+//	var rpcErr *rpc.Error
+//	if errors.As(err, &rpcErr) && rpcErr.Code == CodeNotFound {
+//		...
+//	}
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"` // additional information, if any
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrInternal is the error sent to the clients of calls whose service method
+// panicked, so that the panic value, e.g. a runtime error, is not disclosed.
+var ErrInternal = errors.New("rpc: internal error")
+
+// PanicError is the error of a call whose service method panicked. The panic
+// is recovered, so it fails the call with status 500 rather than the process.
+// Its value and stack are given to logs, stats and hooks, while the client
+// receives ErrInternal.
+type PanicError struct {
+	Value interface{} // value passed to panic
+	Stack []byte      // stack of the goroutine when it panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("rpc: panic: %v", e.Value)
+}
+
+/*
+recoverCall recovers the panic of a call into a PanicError set to err
+*/
+func recoverCall(err *error) {
+	if v := recover(); v != nil {
+		*err = &PanicError{Value: v, Stack: debug.Stack()}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// errorBuckets is the number of buckets the sliding window of error rates is
+// divided into.
+const errorBuckets = 10
+
+// ErrorSpikePolicy configures the alerts on the rates of the errors of calls.
+type ErrorSpikePolicy struct {
+	Window     time.Duration          // length of the sliding window of the rates, a minute if zero
+	Thresholds map[ErrorClass]float64 // fraction of the calls failing with a class above which it spikes
+	MinCalls   int                    // calls in the window below which rates don't spike
+	// OnErrorSpike is called when the rate of a class exceeds its threshold, then again only once
+	// the rate fell back to the threshold and exceeded it anew. It is called by the goroutine
+	// serving the call, and should not block.
+	OnErrorSpike func(class ErrorClass, rate float64)
+}
+
+/*
+SetErrorSpikes counts the calls failing with each ErrorClass in a sliding window, and reports the
+classes whose rate exceeds their threshold to the OnErrorSpike func of the policy, e.g. to send
+an alert or open a circuit. A nil policy disables the counting.
+*/
+func (s *Server) SetErrorSpikes(policy *ErrorSpikePolicy) {
+	if policy == nil {
+		s.errorSpikes = nil
+		return
+	}
+	s.errorSpikes = newErrorWindow(policy)
+}
+
+/*
+ErrorRates returns the fraction of the calls of the sliding window failing with each class, nil
+if SetErrorSpikes wasn't called
+*/
+func (s *Server) ErrorRates() map[ErrorClass]float64 {
+	if s.errorSpikes == nil {
+		return nil
+	}
+	return s.errorSpikes.rates()
+}
+
+// errorBucket counts the calls of a slice of the window.
+type errorBucket struct {
+	epoch  int64 // index of the slice since the unix epoch
+	calls  int
+	errors map[ErrorClass]int
+}
+
+// errorWindow counts the calls and their errors in a sliding window.
+type errorWindow struct {
+	policy  ErrorSpikePolicy
+	width   time.Duration // length of the slice of a bucket
+	mutex   sync.Mutex
+	buckets [errorBuckets]errorBucket
+	spiking map[ErrorClass]bool
+}
+
+/*
+newErrorWindow returns the window of the policy
+*/
+func newErrorWindow(policy *ErrorSpikePolicy) *errorWindow {
+	w := &errorWindow{policy: *policy, spiking: make(map[ErrorClass]bool)}
+	if w.policy.Window <= 0 {
+		w.policy.Window = time.Minute
+	}
+	w.width = w.policy.Window / errorBuckets
+	if w.width <= 0 {
+		w.width = 1
+	}
+	return w
+}
+
+/*
+observe counts a call failing with class, ClassNone if it succeeded, and reports the spikes
+*/
+func (w *errorWindow) observe(class ErrorClass) {
+	type spike struct {
+		class ErrorClass
+		rate  float64
+	}
+	var spikes []spike
+
+	w.mutex.Lock()
+	epoch := time.Now().UnixNano() / int64(w.width)
+	b := &w.buckets[epoch%errorBuckets]
+	if b.epoch != epoch {
+		*b = errorBucket{epoch: epoch}
+	}
+	b.calls++
+	if class != ClassNone {
+		if b.errors == nil {
+			b.errors = make(map[ErrorClass]int)
+		}
+		b.errors[class]++
+	}
+	calls, errors := w.count(epoch)
+	for class, threshold := range w.policy.Thresholds {
+		rate := 0.0
+		if calls > 0 {
+			rate = float64(errors[class]) / float64(calls)
+		}
+		switch {
+		case rate > threshold && calls >= w.policy.MinCalls && !w.spiking[class]:
+			w.spiking[class] = true
+			spikes = append(spikes, spike{class, rate})
+		case rate <= threshold:
+			w.spiking[class] = false
+		}
+	}
+	w.mutex.Unlock()
+
+	if w.policy.OnErrorSpike != nil {
+		for _, spike := range spikes {
+			w.policy.OnErrorSpike(spike.class, spike.rate)
+		}
+	}
+}
+
+/*
+rates returns the fraction of the calls of the window failing with each class
+*/
+func (w *errorWindow) rates() map[ErrorClass]float64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	calls, errors := w.count(time.Now().UnixNano() / int64(w.width))
+	rates := make(map[ErrorClass]float64, len(errors))
+	for class, n := range errors {
+		rates[class] = float64(n) / float64(calls)
+	}
+	return rates
+}
+
+/*
+count returns the calls and errors of the buckets of the window ending at epoch, the mutex is held
+*/
+func (w *errorWindow) count(epoch int64) (int, map[ErrorClass]int) {
+	calls := 0
+	errors := make(map[ErrorClass]int)
+	for i := range w.buckets {
+		b := &w.buckets[i]
+		if b.epoch <= epoch-errorBuckets || b.epoch > epoch {
+			continue
+		}
+		calls += b.calls
+		for class, n := range b.errors {
+			errors[class] += n
+		}
+	}
+	return calls, errors
+}
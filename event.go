@@ -0,0 +1,76 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net"
+	"sync"
+)
+
+// EventType is the type of a server lifecycle event.
+type EventType string
+
+const (
+	EventServiceRegistered EventType = "service_registered" // a service has been registered
+	EventCodecRegistered   EventType = "codec_registered"   // a codec has been registered
+	EventServeStart        EventType = "serve_start"        // the server starts serving a listener
+	EventServeStop         EventType = "serve_stop"         // the server stops serving a listener
+)
+
+// Event is a server lifecycle event. Only the fields relevant to its type are set.
+type Event struct {
+	Type        EventType
+	Service     string   // name of the registered service
+	Methods     []string // methods of the registered service
+	ContentType string   // content type of the registered codec
+	Addr        net.Addr // address of the served listener
+	Err         error    // error that stopped serving
+}
+
+// eventBus delivers events to subscribers synchronously, in subscription order.
+type eventBus struct {
+	mutex       sync.Mutex
+	nextId      int
+	subscribers []*subscriber
+}
+
+type subscriber struct {
+	id int
+	fn func(*Event)
+}
+
+/*
+subscribe adds a subscriber and returns the func to remove it
+*/
+func (b *eventBus) subscribe(fn func(*Event)) func() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	id := b.nextId
+	b.nextId++
+	b.subscribers = append(b.subscribers, &subscriber{id: id, fn: fn})
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		for i, sub := range b.subscribers {
+			if sub.id == id {
+				b.subscribers = append(b.subscribers[:i:i], b.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+/*
+publish delivers e to all subscribers
+*/
+func (b *eventBus) publish(e *Event) {
+	b.mutex.Lock()
+	subscribers := b.subscribers
+	b.mutex.Unlock()
+
+	for _, sub := range subscribers {
+		sub.fn(e)
+	}
+}
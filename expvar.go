@@ -0,0 +1,73 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"time"
+)
+
+// DebugVars are the stats of a server, scraped by dashboards as JSON.
+type DebugVars struct {
+	Uptime  float64               `json:"uptime_seconds"` // seconds since the server was created
+	Methods map[string]MethodVars `json:"methods"`        // stats of the registered methods
+	Codecs  map[string]uint64     `json:"codecs"`         // requests by media type of their codec
+}
+
+// MethodVars are the stats of a method in DebugVars.
+type MethodVars struct {
+	Calls       uint64  `json:"calls"`                // calls of the method
+	Errors      uint64  `json:"errors"`               // calls returning an error or timing out
+	ErrorRate   float64 `json:"error_rate"`           // fraction of the calls failing
+	MeanLatency float64 `json:"mean_latency_seconds"` // mean time spent in the method
+}
+
+/*
+DebugVars returns the stats of the server: uptime, calls, errors and latency of every method, and
+requests decoded by every codec
+*/
+func (s *Server) DebugVars() *DebugVars {
+	vars := &DebugVars{
+		Uptime:  time.Since(s.started).Seconds(),
+		Methods: make(map[string]MethodVars),
+		Codecs:  make(map[string]uint64, len(s.codecs)),
+	}
+	for method, stats := range s.Stats() {
+		mv := MethodVars{Calls: stats.Calls, Errors: stats.Errors}
+		if stats.Calls > 0 {
+			mv.ErrorRate = float64(stats.Errors) / float64(stats.Calls)
+			mv.MeanLatency = stats.Latency.Seconds() / float64(stats.Calls)
+		}
+		vars.Methods[method] = mv
+	}
+	for contentType, codec := range s.codecs {
+		vars.Codecs[contentType] = codec.requests.Load()
+	}
+	return vars
+}
+
+/*
+PublishVars publishes the DebugVars of the server as the expvar name, served by expvar.Handler
+and at /debug/vars of http.DefaultServeMux. Like expvar.Publish, it panics if name is already
+published.
+*/
+func (s *Server) PublishVars(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return s.DebugVars()
+	}))
+}
+
+/*
+DebugVarsHandler returns a handler serving the DebugVars of the server as JSON, for servers not
+using expvar
+*/
+func (s *Server) DebugVarsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(s.DebugVars())
+	})
+}
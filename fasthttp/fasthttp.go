@@ -0,0 +1,143 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package fasthttp serves an rpc.Server behind a github.com/valyala/fasthttp server.
+
+The request context and headers of fasthttp satisfy the interfaces of the package as they are,
+so no conversion shim is needed and the package doesn't depend on fasthttp:
+
+	h := rpcfasthttp.NewHandler(server)
+	fasthttp.ListenAndServe(addr, func(ctx *fasthttp.RequestCtx) {
+		h.Serve(ctx, &ctx.Request.Header, &ctx.Response.Header)
+	})
+
+The body is handed to the codec without copy, and the response is written to the fasthttp
+response from a pooled buffer. Only the request headers are copied, as codecs and hooks read
+them from an http.Header.
+*/
+package fasthttp
+
+import (
+	"bytes"
+	"context"
+	"github.com/antenna3mt/rpc"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// RequestCtx is the part of a *fasthttp.RequestCtx used by the handler.
+type RequestCtx interface {
+	context.Context
+	Method() []byte
+	PostBody() []byte
+	RemoteAddr() net.Addr
+	SetStatusCode(status int)
+	SetBody(body []byte)
+}
+
+// RequestHeader is the part of a *fasthttp.RequestHeader used by the handler.
+type RequestHeader interface {
+	VisitAll(f func(key, value []byte))
+}
+
+// ResponseHeader is the part of a *fasthttp.ResponseHeader used by the handler.
+type ResponseHeader interface {
+	Add(key, value string)
+}
+
+// Handler serves fasthttp requests with an rpc.Server.
+type Handler struct {
+	server *rpc.Server
+}
+
+// NewHandler returns a Handler serving the requests with server.
+func NewHandler(server *rpc.Server) *Handler {
+	return &Handler{server: server}
+}
+
+// responseWriters pools the writers of the responses.
+var responseWriters = sync.Pool{
+	New: func() interface{} {
+		return &responseWriter{header: make(http.Header)}
+	},
+}
+
+/*
+Serve serves the request of ctx, going through the same codecs, hooks and services as
+Server.ServeHTTP
+*/
+func (h *Handler) Serve(ctx RequestCtx, reqHeader RequestHeader, respHeader ResponseHeader) {
+	header := make(http.Header)
+	reqHeader.VisitAll(func(key, value []byte) {
+		header.Add(string(key), string(value))
+	})
+	body := ctx.PostBody()
+	r := (&http.Request{
+		Method:        string(ctx.Method()),
+		URL:           &url.URL{Path: "/"},
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Host:          header.Get("Host"),
+		RemoteAddr:    ctx.RemoteAddr().String(),
+		RequestURI:    "/",
+	}).WithContext(ctx)
+
+	rw := responseWriters.Get().(*responseWriter)
+	defer rw.reset()
+	h.server.ServeHTTP(rw, r)
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	for k, vs := range rw.header {
+		for _, v := range vs {
+			respHeader.Add(k, v)
+		}
+	}
+	ctx.SetStatusCode(rw.status)
+	// The body is copied by fasthttp.
+	ctx.SetBody(rw.buf.Bytes())
+}
+
+// responseWriter keeps a response in memory.
+type responseWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.buf.Write(b)
+}
+
+/*
+reset clears the writer and puts it back to the pool
+*/
+func (rw *responseWriter) reset() {
+	for k := range rw.header {
+		delete(rw.header, k)
+	}
+	rw.status = 0
+	rw.buf.Reset()
+	responseWriters.Put(rw)
+}
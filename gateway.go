@@ -0,0 +1,248 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// hopHeaders are the headers of a request not forwarded by a Gateway.
+var hopHeaders = []string{
+	"Accept-Encoding", "Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length", "Content-Encoding",
+	"Content-Type", IdempotencyKeyHeader,
+}
+
+/*
+Gateway is a single endpoint fronting a server and upstream RPC servers. Calls of the services
+registered to the server are served by it, while calls of the other services are forwarded to
+the upstream routed for their service.
+
+Forwarded requests go through the Client of the upstream, with its retries, balancing and
+signing, and carry the headers of the incoming request. The codec of the client should match
+the Content-Type of the requests, as they are forwarded as is. Batches are served by the server.
+
+If the server has introspection enabled, the IntrospectionMethod returns the methods of the
+server and of the upstreams, once the caller is authenticated.
+*/
+type Gateway struct {
+	server *Server
+
+	mutex  sync.RWMutex
+	routes map[string]*Client // upstream of each service
+}
+
+/*
+NewGateway returns a Gateway serving the calls of the services of server, and forwarding the
+other ones to the upstreams added with Route
+*/
+func NewGateway(server *Server) *Gateway {
+	return &Gateway{server: server, routes: make(map[string]*Client)}
+}
+
+/*
+Route forwards the calls of the service to the upstream called by client
+*/
+func (g *Gateway) Route(service string, client *Client) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.routes[service] = client
+}
+
+/*
+upstream returns the client of the upstream of the method, nil if the method is served locally
+*/
+func (g *Gateway) upstream(method string) *Client {
+	service, _, _ := strings.Cut(method, ".")
+	if _, err := g.server.services.get(method); err == nil {
+		return nil
+	}
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.routes[service]
+}
+
+/*
+ServeHTTP serves the call locally or forwards it to its upstream. Forwarded calls are checked
+as the calls served locally: the signature of the request is verified, its caller authenticated
+and its tenant resolved, then the rate limits and the ACL table of the server are applied to the
+method before forwarding it.
+*/
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		g.server.ServeHTTP(w, r)
+		return
+	}
+	g.server.setSecurityHeaders(w, r)
+	if !g.server.filterIP(w, r) || !g.server.checkCSRF(w, r) || !g.server.verifySignature(w, r) {
+		return
+	}
+	if status, err := decompressRequest(r, g.server.maxDecompressed); err != nil {
+		WriteError(w, status, err.Error())
+		return
+	}
+	body, err := readBody(r.Body, g.server.maxBodyBytes)
+	r.Body.Close()
+	if err != nil {
+		WriteError(w, bodyStatus(err), err.Error())
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	codec, err := g.server.codecFor(r)
+	if err != nil {
+		writeContentTypeError(w, r)
+		return
+	}
+
+	// Peek the method of the call.
+	peek := r.Clone(r.Context())
+	peek.Body = io.NopCloser(bytes.NewReader(body))
+	codecReq := codec.NewRequest(peek)
+	method, err := codecReq.Method()
+	isBatch := false
+	if batchReq, ok := codecReq.(BatchCodecRequest); ok {
+		_, isBatch = batchReq.Batch()
+	}
+	if err != nil || isBatch {
+		g.server.serveVerified(w, r)
+		return
+	}
+
+	if method == IntrospectionMethod && g.server.introspection {
+		if r, _ = g.server.admit(w, r, codecReq); r != nil {
+			g.writeIntrospection(r.Context(), w, codecReq)
+		}
+		return
+	}
+	client := g.upstream(method)
+	if client == nil {
+		g.server.serveVerified(w, r)
+		return
+	}
+	r, principal := g.server.admit(w, r, codecReq)
+	if r == nil {
+		return
+	}
+	if g.server.rateLimits != nil {
+		if err := g.server.rateLimits.allow(w, r, method); err != nil {
+			codecReq.WriteError(w, 429, err)
+			return
+		}
+	}
+	if g.server.aclTable != nil {
+		if err := g.server.aclTable.authorize(principal, method); err != nil {
+			codecReq.WriteError(w, 403, err)
+			return
+		}
+	}
+	g.forward(w, r, client, method, body)
+}
+
+/*
+admit authenticates the caller of a request not served by the server, and resolves its tenant,
+applying the rate limit of the tenant. It returns the request carrying the principal and tenant,
+or nil if it is rejected, having written the error with the codec request.
+*/
+func (s *Server) admit(w http.ResponseWriter, r *http.Request, codecReq CodecRequest) (*http.Request, Principal) {
+	var principal Principal
+	if s.authenticator != nil {
+		var err error
+		if principal, err = s.authenticate(w, r); err != nil {
+			codecReq.WriteError(w, authStatus(err), err)
+			return nil, nil
+		}
+		r = withPrincipal(r, principal)
+	}
+	if s.tenants != nil {
+		tenant, status, err := s.tenants.resolve(r)
+		if err != nil {
+			codecReq.WriteError(w, status, err)
+			return nil, nil
+		}
+		if tenant != "" {
+			r = withTenant(r, tenant)
+			if err := s.tenants.allow(w, r, tenant); err != nil {
+				codecReq.WriteError(w, 429, err)
+				return nil, nil
+			}
+		}
+	}
+	return r, principal
+}
+
+/*
+forward sends the encoded request body to the upstream, and copies its response
+*/
+func (g *Gateway) forward(w http.ResponseWriter, r *http.Request, client *Client, method string, body []byte) {
+	header := r.Header.Clone()
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	if callHeader, ok := r.Context().Value(callHeaderKey{}).(http.Header); ok {
+		for k, v := range callHeader {
+			header[k] = v
+		}
+	}
+	ctx := context.WithValue(r.Context(), callHeaderKey{}, header)
+
+	var resp bytes.Buffer
+	err := client.do(ctx, method, client.retryPolicy.idempotent(method), body, func(r io.Reader) error {
+		resp.Reset()
+		_, err := io.Copy(&resp, r)
+		return err
+	})
+	if err != nil {
+		status := 502
+		if httpErr, ok := err.(*HTTPError); ok {
+			status = httpErr.StatusCode
+		}
+		WriteError(w, status, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", client.contentType)
+	w.Header().Set("x-content-type-options", "nosniff")
+	w.Write(resp.Bytes())
+}
+
+/*
+writeIntrospection writes the methods of the server and of the upstreams, skipping the upstreams
+failing to list them
+*/
+func (g *Gateway) writeIntrospection(ctx context.Context, w http.ResponseWriter, codecReq CodecRequest) {
+	services := g.server.services.Map()
+
+	g.mutex.RLock()
+	clients := make(map[*Client]bool, len(g.routes))
+	routed := make(map[string]*Client, len(g.routes))
+	for service, client := range g.routes {
+		clients[client] = true
+		routed[service] = client
+	}
+	g.mutex.RUnlock()
+
+	for client := range clients {
+		var upstream map[string][]string
+		if err := client.Call(ctx, IntrospectionMethod, &struct{}{}, &upstream); err != nil {
+			continue
+		}
+		for service, methods := range upstream {
+			// Only the routed services of an upstream are reachable.
+			if _, local := services[service]; !local && routed[service] == client {
+				services[service] = methods
+			}
+		}
+	}
+	for _, methods := range services {
+		sort.Strings(methods)
+	}
+	w.Header().Set("x-content-type-options", "nosniff")
+	codecReq.WriteResponse(w, services)
+}
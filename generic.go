@@ -0,0 +1,20 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+)
+
+/*
+Call calls the RPC method of the client with args, and returns the reply of type R.
+
+	reply, err := rpc.Call[*HelloArgs, HelloReply](ctx, client, "MyService.Hello", &HelloArgs{})
+*/
+func Call[A, R any](ctx context.Context, c *Client, method string, args A) (R, error) {
+	var reply R
+	err := c.Call(ctx, method, args, &reply)
+	return reply, err
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gob
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/antenna3mt/rpc"
+	"io"
+)
+
+// ClientCodec encodes requests and decodes responses of an rpc.Client.
+type ClientCodec struct {
+}
+
+// NewClientCodec returns a new gob ClientCodec.
+func NewClientCodec() *ClientCodec {
+	return &ClientCodec{}
+}
+
+// ContentType returns the Content-Type of gob requests.
+func (c *ClientCodec) ContentType() string {
+	return ContentType
+}
+
+// EncodeRequest encodes the request of the RPC method with args.
+func (c *ClientCodec) EncodeRequest(method string, args interface{}) ([]byte, error) {
+	var params bytes.Buffer
+	if err := gob.NewEncoder(&params).Encode(args); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&request{Method: method, Params: params.Bytes()}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeResponse decodes the response body filling the RPC method reply.
+func (c *ClientCodec) DecodeResponse(r io.Reader, reply interface{}) error {
+	var res response
+	if err := gob.NewDecoder(r).Decode(&res); err != nil {
+		return err
+	}
+	if res.Error != "" {
+		return &rpc.Error{Code: res.Code, Message: res.Error}
+	}
+	return gob.NewDecoder(bytes.NewReader(res.Result)).Decode(reply)
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gob
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/antenna3mt/rpc"
+	"net/http"
+)
+
+// ContentType is the Content-Type of gob requests and responses.
+const ContentType = "application/x-gob"
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// request is a gob-encoded request. Params holds the gob-encoded args, so
+// they can be decoded once the type of args is known.
+type request struct {
+	Method string
+	Params []byte
+}
+
+// response is a gob-encoded response. Result holds the gob-encoded reply.
+type response struct {
+	Result []byte
+	Error  string
+	Code   int // code of the error, set by methods returning an *rpc.Error
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new gob Codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
+	req := new(request)
+	err := gob.NewDecoder(r.Body).Decode(req)
+	r.Body.Close()
+	return &CodecRequest{request: req, err: err}
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	request *request
+	err     error
+}
+
+// Method returns the RPC method for the current request.
+func (c *CodecRequest) Method() (string, error) {
+	if c.err == nil {
+		return c.request.Method, nil
+	}
+	return "", c.err
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil && c.request.Params != nil {
+		c.err = gob.NewDecoder(bytes.NewReader(c.request.Params)).Decode(args)
+	}
+	return c.err
+}
+
+// WriteResponse encodes the response and writes it to the ResponseWriter.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	buf := rpc.GetBuffer()
+	defer rpc.PutBuffer(buf)
+	if err := gob.NewEncoder(buf).Encode(reply); err != nil {
+		c.WriteError(w, 500, err)
+		return
+	}
+	c.writeResponse(w, &response{Result: buf.Bytes()})
+}
+
+// WriteError encodes the error and writes it to the ResponseWriter.
+func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	res := &response{Error: err.Error()}
+	if rpcErr, ok := err.(*rpc.Error); ok {
+		res.Code = rpcErr.Code
+	}
+	c.writeResponse(w, res)
+}
+
+func (c *CodecRequest) writeResponse(w http.ResponseWriter, res *response) {
+	buf := rpc.GetBuffer()
+	defer rpc.PutBuffer(buf)
+	if err := gob.NewEncoder(buf).Encode(res); err != nil {
+		rpc.WriteError(w, 400, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	rpc.WriteBody(w, nil, buf.Bytes())
+}
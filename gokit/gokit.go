@@ -0,0 +1,82 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package gokit composes the services of an rpc.Server with go-kit stacks: every registered method
+is exposed as an endpoint.Endpoint, and go-kit middleware wrap the calls served by the server:
+
+	var sum endpoint.Endpoint = gokit.NewEndpoint(server, "Arith.Add")
+	handler := httptransport.NewServer(sum, decodeAddRequest, encodeResponse)
+
+	err := server.SetMiddleware("Arith.Add", gokit.Middleware(circuitbreaker.Gobreaker(cb)))
+
+Endpoint and Middleware have the underlying types of the ones of go-kit, so they are assignable
+to each other, while go-kit middleware are converted by Middleware. This keeps the package free
+of a dependency on go-kit.
+*/
+package gokit
+
+import (
+	"context"
+	"github.com/antenna3mt/rpc"
+)
+
+// Endpoint is an endpoint.Endpoint of go-kit.
+type Endpoint = func(ctx context.Context, request interface{}) (response interface{}, err error)
+
+/*
+NewEndpoint returns the endpoint calling the method of the server in process, through its
+authenticator, hooks and policies as a call received by the server. The request is the args of
+the method, and the response a pointer to its reply. The headers set on ctx by rpc.WithCallHeader
+are the headers of the call, e.g. its credentials.
+*/
+func NewEndpoint(server *rpc.Server, method string) Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return server.Invoke(ctx, method, request)
+	}
+}
+
+/*
+Endpoints returns the endpoints of the methods registered on the server, by method in dotted
+notation
+*/
+func Endpoints(server *rpc.Server) map[string]Endpoint {
+	endpoints := make(map[string]Endpoint)
+	for service, methods := range server.ServiceMap() {
+		for _, method := range methods {
+			name := service + "." + method
+			endpoints[name] = NewEndpoint(server, name)
+		}
+	}
+	return endpoints
+}
+
+/*
+Middleware returns the rpc.Middleware of the go-kit middleware, whose endpoints are of type E,
+inferred from the type of mw
+*/
+func Middleware[E ~func(context.Context, interface{}) (interface{}, error)](mw func(E) E) rpc.Middleware {
+	return func(next rpc.Handler) rpc.Handler {
+		return rpc.Handler(mw(E(next)))
+	}
+}
+
+/*
+Use wraps the calls of every method registered on the server with the go-kit middleware, composed
+in order as by endpoint.Chain, replacing their middleware
+*/
+func Use[E ~func(context.Context, interface{}) (interface{}, error)](server *rpc.Server, mw ...func(E) E) error {
+	middleware := make([]rpc.Middleware, len(mw))
+	for i, m := range mw {
+		middleware[i] = Middleware(m)
+	}
+	for service, methods := range server.ServiceMap() {
+		for _, method := range methods {
+			if err := server.SetMiddleware(service+"."+method, middleware...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
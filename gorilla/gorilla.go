@@ -0,0 +1,55 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package gorilla registers the codecs of gorilla/rpc/v2, e.g. json2 and protorpc or codecs of your
+own written for it, on an rpc.Server unchanged:
+
+	import (
+		v2 "github.com/gorilla/rpc/v2"
+		"github.com/gorilla/rpc/v2/json2"
+	)
+
+	server.RegisterCodec(gorilla.NewCodec[v2.CodecRequest](json2.NewCodec()), "application/json")
+
+The CodecRequest of gorilla/rpc/v2 has the methods of rpc.CodecRequest, but its codecs return
+their own interface type from NewRequest, so they don't implement rpc.Codec themselves. The type
+parameter of NewCodec is that interface type, which keeps this package free of a dependency on
+gorilla.
+
+The methods of the services still take the context of the server rather than the *http.Request
+taken by gorilla services, which hooks read with the request of the call.
+*/
+package gorilla
+
+import (
+	"github.com/antenna3mt/rpc"
+	"net/http"
+)
+
+// Codec is a gorilla/rpc/v2 codec returning requests of type R, e.g. *json2.Codec returning
+// v2.CodecRequest.
+type Codec[R rpc.CodecRequest] interface {
+	NewRequest(*http.Request) R
+}
+
+// codec adapts a Codec to rpc.Codec.
+type codec[R rpc.CodecRequest] struct {
+	codec Codec[R]
+}
+
+/*
+NewCodec returns the rpc.Codec of the gorilla/rpc/v2 codec
+*/
+func NewCodec[R rpc.CodecRequest](c Codec[R]) rpc.Codec {
+	return codec[R]{codec: c}
+}
+
+/*
+NewRequest returns the request of the gorilla codec, keeping its dynamic type so the server sees
+the optional interfaces it implements
+*/
+func (c codec[R]) NewRequest(r *http.Request) rpc.CodecRequest {
+	return c.codec.NewRequest(r)
+}
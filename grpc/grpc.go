@@ -0,0 +1,404 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package grpc serves the services of an rpc.Server to gRPC clients.
+
+Unary gRPC calls of "/[service]/[method]" are mapped onto the method "[service].[method]", and go
+through the hooks of the server like HTTP requests do. Services have no protobuf schema, so the
+messages are marshaled generically, as told by the content subtype of the call:
+"application/grpc+cbor" for CBOR, which requires the codec of package cbor registered for
+cbor.ContentType, or "application/grpc+json" for JSON, which requires the codec of package json
+registered for "application/json". The error of a call is sent as its grpc-message, along with
+its code in the x-rpc-error-code trailer.
+
+The list_services request of server reflection, v1 and v1alpha, lists the registered services
+if the server has introspection enabled. Other reflection requests are unimplemented, as there
+are no file descriptors.
+
+gRPC requires HTTP/2: the handler is served over TLS by an http.Server. A grpc-go client calls
+the services with a codec of the matching name:
+
+	type cborCodec struct{}
+
+	func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cbor.Marshal(v) }
+	func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+	func (cborCodec) Name() string                               { return "cbor" }
+
+	err := conn.Invoke(ctx, "/MyService/Hello", args, reply, grpc.ForceCodec(cborCodec{}))
+*/
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"github.com/antenna3mt/rpc/cbor"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType is the Content-Type of gRPC calls; it is followed by "+" and the content subtype.
+const ContentType = "application/grpc"
+
+// Status codes of gRPC.
+const (
+	OK                = 0
+	Canceled          = 1
+	Unknown           = 2
+	InvalidArgument   = 3
+	DeadlineExceeded  = 4
+	NotFound          = 5
+	PermissionDenied  = 7
+	ResourceExhausted = 8
+	Unimplemented     = 12
+	Internal          = 13
+	Unavailable       = 14
+	Unauthenticated   = 16
+)
+
+// maxMessageSize is the size of the largest message accepted, as grpc-go defaults to.
+const maxMessageSize = 4 << 20
+
+// marshaler wraps the messages of a content subtype into the requests and responses of a codec.
+type marshaler interface {
+	// contentType returns the Content-Type of the codec.
+	contentType() string
+	// encodeRequest returns the request of the method with the encoded args, and its headers.
+	encodeRequest(method string, args []byte, header http.Header) []byte
+	// decodeResponse returns the encoded result of the response, or its error.
+	decodeResponse(resp []byte) ([]byte, error)
+}
+
+var marshalers = map[string]marshaler{
+	"cbor": cborMarshaler{},
+	"json": jsonMarshaler{},
+}
+
+/*
+Handler serves unary gRPC calls, and server reflection, with the services of a server
+*/
+type Handler struct {
+	server *rpc.Server
+}
+
+/*
+NewHandler returns a Handler serving gRPC calls with the services of server
+*/
+func NewHandler(server *rpc.Server) *Handler {
+	return &Handler{server: server}
+}
+
+/*
+ServeHTTP serves a gRPC call
+*/
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ProtoMajor < 2 {
+		rpc.WriteError(w, 400, "grpc: requires POST over HTTP/2")
+		return
+	}
+	subtype, ok := contentSubtype(r.Header.Get("Content-Type"))
+	if !ok {
+		rpc.WriteError(w, 415, fmt.Sprintf("grpc: unsupported Content-Type: %s", r.Header.Get("Content-Type")))
+		return
+	}
+	w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+
+	service, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok {
+		writeStatus(w, Unimplemented, fmt.Sprintf("malformed method name: %q", r.URL.Path))
+		return
+	}
+	if (service == reflectionV1 || service == reflectionV1Alpha) && method == "ServerReflectionInfo" {
+		h.serveReflection(w, r)
+		return
+	}
+	m, ok := marshalers[subtype]
+	if !ok {
+		writeStatus(w, Unimplemented, fmt.Sprintf("unsupported content subtype %q", subtype))
+		return
+	}
+
+	args, err := readMessage(r.Body)
+	if err != nil {
+		writeStatus(w, InvalidArgument, err.Error())
+		return
+	}
+	header := callHeader(r)
+	if header == nil {
+		writeStatus(w, InvalidArgument, fmt.Sprintf("invalid grpc-timeout %q", r.Header.Get("Grpc-Timeout")))
+		return
+	}
+	header.Set("Content-Type", m.contentType())
+	resp, err := h.server.ServeMessage(r.Context(), header, m.encodeRequest(service+"."+method, args, header))
+	if err == nil {
+		resp, err = m.decodeResponse(resp)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Write(frame(resp))
+	writeStatus(w, OK, "")
+}
+
+/*
+contentSubtype returns the content subtype of a gRPC Content-Type, "proto" if it has none
+*/
+func contentSubtype(contentType string) (string, bool) {
+	if contentType == ContentType {
+		return "proto", true
+	}
+	subtype, ok := strings.CutPrefix(contentType, ContentType)
+	if !ok || len(subtype) < 2 || subtype[0] != '+' && subtype[0] != ';' {
+		return "", false
+	}
+	return subtype[1:], true
+}
+
+/*
+callHeader returns the headers of the call seen by hooks, with the grpc-timeout translated into
+rpc.TimeoutHeader, nil if it is invalid
+*/
+func callHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	for _, h := range []string{"Te", "Content-Length", "Grpc-Timeout", "Grpc-Encoding", "Grpc-Accept-Encoding"} {
+		header.Del(h)
+	}
+	if v := r.Header.Get("Grpc-Timeout"); v != "" {
+		timeout, err := parseTimeout(v)
+		if err != nil {
+			return nil
+		}
+		header.Set(rpc.TimeoutHeader, timeout.String())
+	}
+	return header
+}
+
+/*
+parseTimeout parses a grpc-timeout, an integer of at most 8 digits followed by a unit
+*/
+func parseTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, fmt.Errorf("grpc: invalid timeout %q", v)
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[v[len(v)-1]]
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("grpc: invalid timeout %q", v)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+/*
+readMessage reads the single length-prefixed message of a unary call
+*/
+func readMessage(r io.Reader) ([]byte, error) {
+	msg, err := nextMessage(r)
+	if err == io.EOF {
+		return nil, fmt.Errorf("grpc: missing request message")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := nextMessage(r); err != io.EOF {
+		return nil, fmt.Errorf("grpc: unary call with several request messages")
+	}
+	return msg, nil
+}
+
+/*
+nextMessage reads a length-prefixed message of a stream, io.EOF at the end of the stream
+*/
+func nextMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("grpc: truncated message")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("grpc: compressed messages are unsupported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("grpc: message of %d bytes exceeds %d", size, maxMessageSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("grpc: truncated message")
+	}
+	return msg, nil
+}
+
+/*
+frame prefixes the message with its flag and length
+*/
+func frame(msg []byte) []byte {
+	buf := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(msg)))
+	return append(buf, msg...)
+}
+
+/*
+writeStatus ends the response with the status trailers
+*/
+func writeStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeMessage(message))
+	}
+}
+
+/*
+writeError ends the response with the status of the error: the code of an *rpc.Error is sent in
+the x-rpc-error-code trailer, while an *rpc.HTTPError maps its status to a gRPC code
+*/
+func writeError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *rpc.Error:
+		if e.Code != 0 {
+			w.Header().Set(http.TrailerPrefix+"X-Rpc-Error-Code", strconv.Itoa(e.Code))
+		}
+		writeStatus(w, Unknown, e.Message)
+	case *rpc.HTTPError:
+		writeStatus(w, codeOf(e.StatusCode), strings.TrimSpace(e.Message))
+	default:
+		writeStatus(w, Internal, err.Error())
+	}
+}
+
+/*
+codeOf returns the gRPC code of an HTTP status
+*/
+func codeOf(status int) int {
+	switch status {
+	case 400:
+		return InvalidArgument
+	case 401:
+		return Unauthenticated
+	case 403:
+		return PermissionDenied
+	case 404:
+		return NotFound
+	case 408, 504:
+		return DeadlineExceeded
+	case 413, 429:
+		return ResourceExhausted
+	case 415, 501:
+		return Unimplemented
+	case 499:
+		return Canceled
+	case 502, 503:
+		return Unavailable
+	}
+	return Unknown
+}
+
+/*
+encodeMessage percent-encodes a grpc-message
+*/
+func encodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// cborMarshaler marshals the messages with the codec of package cbor.
+type cborMarshaler struct{}
+
+func (cborMarshaler) contentType() string { return cbor.ContentType }
+
+func (cborMarshaler) encodeRequest(method string, args []byte, header http.Header) []byte {
+	header.Set(cbor.MethodHeader, method)
+	return args
+}
+
+func (cborMarshaler) decodeResponse(resp []byte) ([]byte, error) {
+	var res struct {
+		Result cbor.RawMessage `cbor:"result"`
+		Error  *rpc.Error      `cbor:"error"`
+	}
+	if err := cbor.Unmarshal(resp, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return res.Result, nil
+}
+
+// jsonMarshaler marshals the messages with the JSON-RPC codec of package json.
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) contentType() string { return "application/json" }
+
+func (jsonMarshaler) encodeRequest(method string, args []byte, header http.Header) []byte {
+	params := json.RawMessage(args)
+	if len(bytes.TrimSpace(args)) == 0 {
+		params = json.RawMessage("{}")
+	}
+	req, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+		"id":      0,
+	})
+	return req
+}
+
+func (jsonMarshaler) decodeResponse(resp []byte) ([]byte, error) {
+	var res struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpc.Error      `json:"error"`
+	}
+	if err := json.Unmarshal(resp, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return res.Result, nil
+}
+
+/*
+introspect returns the services of the server, listed with the IntrospectionMethod under the
+headers of the request
+*/
+func (h *Handler) introspect(ctx context.Context, r *http.Request) (map[string][]string, error) {
+	header := callHeader(r)
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Type", cbor.ContentType)
+	resp, err := h.server.ServeMessage(ctx, header, cborMarshaler{}.encodeRequest(rpc.IntrospectionMethod, nil, header))
+	if err == nil {
+		resp, err = cborMarshaler{}.decodeResponse(resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var services map[string][]string
+	if err := cbor.Unmarshal(resp, &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
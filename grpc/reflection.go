@@ -0,0 +1,155 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// Services of server reflection.
+const (
+	reflectionV1      = "grpc.reflection.v1.ServerReflection"
+	reflectionV1Alpha = "grpc.reflection.v1alpha.ServerReflection"
+)
+
+// Fields of the protobuf messages of server reflection.
+const (
+	requestHost         = 1 // ServerReflectionRequest.host
+	requestListServices = 7 // ServerReflectionRequest.list_services
+
+	responseValidHost       = 1 // ServerReflectionResponse.valid_host
+	responseOriginalRequest = 2 // ServerReflectionResponse.original_request
+	responseListServices    = 6 // ServerReflectionResponse.list_services_response
+	responseError           = 7 // ServerReflectionResponse.error_response
+
+	listServicesService = 1 // ListServiceResponse.service
+	serviceName         = 1 // ServiceResponse.name
+	errorCode           = 1 // ErrorResponse.error_code
+	errorMessage        = 2 // ErrorResponse.error_message
+)
+
+/*
+serveReflection serves the bidirectional stream of server reflection, answering each request as
+it is received. The services are listed with the IntrospectionMethod of the server.
+*/
+func (h *Handler) serveReflection(w http.ResponseWriter, r *http.Request) {
+	flusher, _ := w.(http.Flusher)
+	for {
+		req, err := nextMessage(r.Body)
+		if err == io.EOF {
+			writeStatus(w, OK, "")
+			return
+		}
+		if err != nil {
+			writeStatus(w, InvalidArgument, err.Error())
+			return
+		}
+		host, listServices, err := parseReflectionRequest(req)
+		if err != nil {
+			writeStatus(w, InvalidArgument, err.Error())
+			return
+		}
+
+		resp := appendBytes(nil, responseValidHost, []byte(host))
+		resp = appendBytes(resp, responseOriginalRequest, req)
+		if listServices {
+			services, err := h.introspect(r.Context(), r)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			var list []byte
+			for _, name := range serviceNames(services) {
+				list = appendBytes(list, listServicesService, appendBytes(nil, serviceName, []byte(name)))
+			}
+			resp = appendBytes(resp, responseListServices, list)
+		} else {
+			e := appendVarint(appendTag(nil, errorCode, 0), Unimplemented)
+			e = appendBytes(e, errorMessage, []byte("only list_services is supported"))
+			resp = appendBytes(resp, responseError, e)
+		}
+		w.Write(frame(resp))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+/*
+serviceNames returns the sorted names of the services, along with the services of reflection
+*/
+func serviceNames(services map[string][]string) []string {
+	names := []string{reflectionV1, reflectionV1Alpha}
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+parseReflectionRequest returns the host of a ServerReflectionRequest, and whether it is a
+list_services request
+*/
+func parseReflectionRequest(msg []byte) (host string, listServices bool, err error) {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", false, fmt.Errorf("grpc: malformed reflection request")
+		}
+		msg = msg[n:]
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0: // varint
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return "", false, fmt.Errorf("grpc: malformed reflection request")
+			}
+			msg = msg[n:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return "", false, fmt.Errorf("grpc: malformed reflection request")
+			}
+			value := msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+			switch field {
+			case requestHost:
+				host = string(value)
+			case requestListServices:
+				listServices = true
+			}
+		default:
+			return "", false, fmt.Errorf("grpc: unexpected wire type %d in reflection request", wireType)
+		}
+	}
+	return host, listServices, nil
+}
+
+/*
+appendTag appends the key of a protobuf field
+*/
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+/*
+appendVarint appends a varint value
+*/
+func appendVarint(b []byte, v int) []byte {
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+/*
+appendBytes appends a length-delimited protobuf field
+*/
+func appendBytes(b []byte, field int, value []byte) []byte {
+	b = appendTag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Healther is implemented by services reporting their health, e.g. the state
+// of their database connection, to the readiness endpoint.
+type Healther interface {
+	Health(ctx context.Context) error
+}
+
+// HealthCheck is the result of the health check of a service.
+type HealthCheck struct {
+	Service     string     `json:"service"`                 // name of the service
+	Healthy     bool       `json:"healthy"`                 // the check returned no error
+	Latency     float64    `json:"latency_seconds"`         // time spent in the check
+	Error       string     `json:"error,omitempty"`         // error of the check, if unhealthy
+	LastError   string     `json:"last_error,omitempty"`    // last error of the check, kept once healthy again
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"` // time of the last error
+}
+
+// Readiness is the result of the health checks of the services of a server.
+type Readiness struct {
+	Ready  bool          `json:"ready"`  // all the checks are healthy
+	Checks []HealthCheck `json:"checks"` // checks of the services, by service name
+}
+
+// healthError is the last error of a health check.
+type healthError struct {
+	msg string
+	at  time.Time
+}
+
+/*
+CheckReadiness runs at once the health checks of the registered services implementing Healther,
+and returns their results. The server is ready if all of them are healthy.
+*/
+func (s *Server) CheckReadiness(ctx context.Context) *Readiness {
+	var services []*service
+	for _, svc := range s.services.load() {
+		if _, ok := svc.healther(); ok {
+			services = append(services, svc)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].name < services[j].name })
+
+	readiness := &Readiness{Ready: true, Checks: make([]HealthCheck, len(services))}
+	var wg sync.WaitGroup
+	for i, svc := range services {
+		wg.Add(1)
+		go func(check *HealthCheck, svc *service) {
+			defer wg.Done()
+			healther, _ := svc.healther()
+			start := time.Now()
+			err := healther.Health(ctx)
+			*check = HealthCheck{Service: svc.name, Healthy: err == nil, Latency: time.Since(start).Seconds()}
+			if err != nil {
+				check.Error = err.Error()
+				s.healthErrors.Store(svc.name, &healthError{msg: check.Error, at: time.Now()})
+			}
+			if last, ok := s.healthErrors.Load(svc.name); ok {
+				last := last.(*healthError)
+				check.LastError, check.LastErrorAt = last.msg, &last.at
+			}
+		}(&readiness.Checks[i], svc)
+	}
+	wg.Wait()
+	for _, check := range readiness.Checks {
+		readiness.Ready = readiness.Ready && check.Healthy
+	}
+	return readiness
+}
+
+/*
+ReadinessHandler returns the readiness endpoint of the server, serving the result of
+CheckReadiness as JSON with status 200 if ready, 503 otherwise. The checks are given up to
+timeout, if positive.
+*/
+func (s *Server) ReadinessHandler(timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		readiness := s.CheckReadiness(ctx)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if !readiness.Ready {
+			w.WriteHeader(503)
+		}
+		json.NewEncoder(w).Encode(readiness)
+	})
+}
+
+/*
+healther returns the receiver of the service if it implements Healther
+*/
+func (s *service) healther() (Healther, bool) {
+	if !s.rValue.IsValid() {
+		return nil, false
+	}
+	h, ok := s.rValue.Interface().(Healther)
+	return h, ok
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	hedgeWindow     = 100 // latencies the hedge delay is computed from
+	hedgeMinSamples = 10  // latencies required before using the percentile
+)
+
+// HedgePolicy configures the hedging of calls: when an attempt hasn't
+// responded after a delay, a second one is sent to another endpoint, and the
+// first response is used. Only idempotent methods are hedged, as classified
+// by the RetryPolicy.
+type HedgePolicy struct {
+	// Percentile of the recent latencies the hedge is sent after, e.g. 95.
+	Percentile float64
+	// MinDelay bounds the delay below, and is used until enough latencies are known.
+	MinDelay time.Duration
+	// MaxDelay bounds the delay above, if not zero.
+	MaxDelay time.Duration
+}
+
+/*
+WithHedging enables the hedging of calls with the policy
+*/
+func WithHedging(p *HedgePolicy) ClientOption {
+	return func(c *Client) {
+		c.hedging = &hedging{policy: p}
+	}
+}
+
+// hedging computes the hedge delay from the recent latencies of a Client.
+type hedging struct {
+	policy *HedgePolicy
+
+	mutex     sync.Mutex
+	latencies []time.Duration // ring of recent latencies
+	next      int             // next index of the ring
+}
+
+/*
+observe records the latency of a response
+*/
+func (h *hedging) observe(latency time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.latencies) < hedgeWindow {
+		h.latencies = append(h.latencies, latency)
+		return
+	}
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % hedgeWindow
+}
+
+/*
+delay returns the time to wait for an attempt before sending the hedge
+*/
+func (h *hedging) delay() time.Duration {
+	h.mutex.Lock()
+	sorted := append([]time.Duration(nil), h.latencies...)
+	h.mutex.Unlock()
+
+	d := h.policy.MinDelay
+	if len(sorted) >= hedgeMinSamples {
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		idx := int(math.Ceil(h.policy.Percentile/100*float64(len(sorted)))) - 1
+		if idx < 0 {
+			idx = 0
+		} else if idx >= len(sorted) {
+			idx = len(sorted) - 1
+		}
+		if sorted[idx] > d {
+			d = sorted[idx]
+		}
+	}
+	if h.policy.MaxDelay > 0 && d > h.policy.MaxDelay {
+		d = h.policy.MaxDelay
+	}
+	return d
+}
+
+// hedgeResult is the result of an attempt of a hedged call.
+type hedgeResult struct {
+	resp  *http.Response
+	done  func(error)
+	err   error
+	idx   int       // index of the attempt
+	start time.Time // time the attempt was sent
+}
+
+/*
+hedgedRoundTrip runs roundTrip, and hedges it if enabled and the method is idempotent. The losing
+attempt is canceled.
+*/
+func (c *Client) hedgedRoundTrip(ctx context.Context, body []byte, header http.Header, stats *ClientCallStats,
+	idempotent bool) (*http.Response, func(error), error) {
+	if c.hedging == nil || !idempotent {
+		return c.roundTrip(ctx, body, header, stats)
+	}
+
+	results := make(chan *hedgeResult, 2)
+	var cancels []context.CancelFunc
+	launch := func() {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		start := time.Now()
+		go func() {
+			// The stats are recorded for the winner only, as attempts run concurrently.
+			resp, done, err := c.roundTrip(attemptCtx, body, header, nil)
+			results <- &hedgeResult{resp: resp, done: done, err: err, idx: idx, start: start}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(c.hedging.delay())
+	defer timer.Stop()
+	pending := 1
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			pending++
+			launch()
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				cancels[r.idx]()
+				if pending == 0 {
+					return nil, nil, firstErr
+				}
+				continue
+			}
+
+			c.hedging.observe(time.Since(r.start))
+			for idx, cancel := range cancels {
+				if idx != r.idx {
+					cancel()
+				}
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if loser := <-results; loser.err == nil {
+						loser.resp.Body.Close()
+						loser.done(nil)
+					}
+				}
+			}(pending)
+			stats.setEndpoint(r.resp.Request.URL.String())
+			stats.response(r.resp)
+			return r.resp, func(err error) {
+				r.done(err)
+				cancels[r.idx]()
+			}, nil
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultPriority is the priority of hooks registered without an explicit one.
+const DefaultPriority = 0
+
+// HookID identifies a registered before or after func, to remove it.
+type HookID uint64
+
+// lastHookID is the id of the last registered hook.
+var lastHookID atomic.Uint64
+
+// hook is a validated context func with its execution priority.
+type hook struct {
+	id       HookID        // returned by the registration
+	fn       reflect.Value // func(*http.Request, *[Context Type]) error
+	priority int           // lower priority runs first
+
+	// call calls fn with the request and the context pointer, built once at
+	// registration.
+	call func(r *http.Request, ctx reflect.Value) error
+}
+
+/*
+HookFunc is a before or after func of a server with context type C. Funcs registered as a
+HookFunc are called directly, while other funcs are called with reflection:
+
+	server.RegisterBeforeFunc(rpc.HookFunc[Context](FetchAuthToken))
+*/
+type HookFunc[C any] func(r *http.Request, ctx *C) error
+
+func (fn HookFunc[C]) adapter() func(*http.Request, reflect.Value) error {
+	return func(r *http.Request, ctx reflect.Value) error {
+		return fn(r, ctx.Interface().(*C))
+	}
+}
+
+// hookAdapter is implemented by funcs providing a typed call, e.g. HookFunc.
+type hookAdapter interface {
+	adapter() func(*http.Request, reflect.Value) error
+}
+
+/*
+newHook returns the hook of a validated context func
+*/
+func newHook(fn interface{}, priority int) *hook {
+	h := &hook{id: HookID(lastHookID.Add(1)), fn: reflect.ValueOf(fn), priority: priority}
+	if a, ok := fn.(hookAdapter); ok {
+		h.call = a.adapter()
+		return h
+	}
+	h.call = func(r *http.Request, ctx reflect.Value) error {
+		out := h.fn.Call([]reflect.Value{reflect.ValueOf(r), ctx})
+		if out[0].IsNil() {
+			return nil
+		}
+		return out[0].Interface().(error)
+	}
+	return h
+}
+
+// name returns the fully qualified name of the hook func.
+func (h *hook) name() string {
+	if f := runtime.FuncForPC(h.fn.Pointer()); f != nil {
+		return f.Name()
+	}
+	return h.fn.Type().String()
+}
+
+// hookList is a list of hooks ordered by priority. Hooks of equal priority
+// keep their registration order.
+type hookList []*hook
+
+/*
+insert returns a copy of the list with the hook, ordered
+*/
+func (l hookList) insert(h *hook) hookList {
+	ret := make(hookList, len(l), len(l)+1)
+	copy(ret, l)
+	ret = append(ret, h)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].priority < ret[j].priority
+	})
+	return ret
+}
+
+/*
+remove returns a copy of the list without the hooks matching, and reports whether any was removed
+*/
+func (l hookList) remove(match func(h *hook) bool) (hookList, bool) {
+	ret := make(hookList, 0, len(l))
+	for _, h := range l {
+		if !match(h) {
+			ret = append(ret, h)
+		}
+	}
+	return ret, len(ret) != len(l)
+}
+
+/*
+funcMatcher returns the matcher of the hooks with the same func as fn, nil if fn is not a func
+*/
+func funcMatcher(fn interface{}) func(h *hook) bool {
+	if fn == nil {
+		return nil
+	}
+	fnValue := reflect.ValueOf(fn)
+	if fnValue.Kind() != reflect.Func {
+		return nil
+	}
+	return func(h *hook) bool {
+		return h.fn.Pointer() == fnValue.Pointer()
+	}
+}
+
+/*
+names returns the names of hooks in execution order
+*/
+func (l hookList) names() []string {
+	ret := make([]string, 0, len(l))
+	for _, h := range l {
+		ret = append(ret, h.name())
+	}
+	return ret
+}
+
+// hookSet is a hookList replaced by a copy when it changes, so that requests iterate over it
+// while hooks are added or removed.
+type hookSet struct {
+	mutex sync.Mutex               // serializes the changes
+	hooks atomic.Pointer[hookList] // never modified once stored
+}
+
+/*
+load returns the current list of hooks
+*/
+func (hs *hookSet) load() hookList {
+	if l := hs.hooks.Load(); l != nil {
+		return *l
+	}
+	return nil
+}
+
+/*
+insert adds the hook
+*/
+func (hs *hookSet) insert(h *hook) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	l := hs.load().insert(h)
+	hs.hooks.Store(&l)
+}
+
+/*
+remove deletes the hooks matching, and reports whether any was removed
+*/
+func (hs *hookSet) remove(match func(h *hook) bool) bool {
+	if match == nil {
+		return false
+	}
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	l, ok := hs.load().remove(match)
+	if ok {
+		hs.hooks.Store(&l)
+	}
+	return ok
+}
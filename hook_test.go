@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func hookA(r *http.Request, ctx *Context) error { return nil }
+func hookB(r *http.Request, ctx *Context) error { return nil }
+func hookC(r *http.Request, ctx *Context) error { return nil }
+
+func TestHookPriority(t *testing.T) {
+	server, err := NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	assert.NoError(t, server.RegisterBeforeFunc(hookA))
+	assert.NoError(t, server.RegisterBeforeFuncWithPriority(hookB, -1))
+	assert.NoError(t, server.RegisterBeforeFunc(hookC))
+	assert.Error(t, server.RegisterBeforeFuncWithPriority(func() {}, 0))
+
+	names := server.BeforeFuncs()
+	assert.Len(t, names, 3)
+	assert.True(t, strings.HasSuffix(names[0], ".hookB"))
+	assert.True(t, strings.HasSuffix(names[1], ".hookA"))
+	assert.True(t, strings.HasSuffix(names[2], ".hookC"))
+
+	assert.True(t, server.RemoveBeforeFunc(hookA))
+	assert.False(t, server.RemoveBeforeFunc(hookA))
+	assert.Len(t, server.BeforeFuncs(), 2)
+
+	assert.NoError(t, server.RegisterAfterFunc(hookC))
+	assert.Len(t, server.AfterFuncs(), 1)
+	assert.Len(t, server.BeforeFuncs(), 2)
+}
+
+func TestHookFunc(t *testing.T) {
+	server, err := NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := errors.New("failed")
+	assert.NoError(t, server.RegisterBeforeFunc(HookFunc[Context](hookA)))
+	assert.NoError(t, server.RegisterAfterFunc(func(r *http.Request, ctx *Context) error { return failed }))
+	assert.Error(t, server.RegisterBeforeFunc(HookFunc[struct{}](func(r *http.Request, ctx *struct{}) error { return nil })))
+	assert.True(t, strings.HasSuffix(server.BeforeFuncs()[0], ".hookA"))
+
+	// Typed and reflected hooks are called alike.
+	r := httptest.NewRequest("POST", "/", nil)
+	ctx := reflect.ValueOf(new(Context))
+	assert.NoError(t, server.beforeFns.load()[0].call(r, ctx))
+	assert.Equal(t, failed, server.afterFns.load()[0].call(r, ctx))
+
+	assert.True(t, server.RemoveBeforeFunc(hookA))
+	assert.Len(t, server.BeforeFuncs(), 0)
+}
+
+func TestRemoveHook(t *testing.T) {
+	server, err := NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Closures of the same func literal are removed by id.
+	var calls []string
+	makeHook := func(name string) func(r *http.Request, ctx *Context) error {
+		return func(r *http.Request, ctx *Context) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+	idA, err := server.AddBeforeFunc(makeHook("a"), 0)
+	assert.NoError(t, err)
+	_, err = server.AddBeforeFunc(makeHook("b"), 0)
+	assert.NoError(t, err)
+	idC, err := server.AddAfterFunc(makeHook("c"), 0)
+	assert.NoError(t, err)
+	_, err = server.AddAfterFunc(func() {}, 0)
+	assert.Error(t, err)
+
+	assert.True(t, server.RemoveHook(idA))
+	assert.False(t, server.RemoveHook(idA))
+	assert.True(t, server.RemoveHook(idC))
+	assert.Len(t, server.BeforeFuncs(), 1)
+	assert.Len(t, server.AfterFuncs(), 0)
+	r := httptest.NewRequest("POST", "/", nil)
+	assert.NoError(t, server.beforeFns.load()[0].call(r, reflect.ValueOf(new(Context))))
+	assert.Equal(t, []string{"b"}, calls)
+}
+
+func TestHooksWhileServing(t *testing.T) {
+	server, err := NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			id, _ := server.AddBeforeFunc(hookA, i%3)
+			server.RemoveHook(id)
+		}
+	}()
+	r := httptest.NewRequest("POST", "/", nil)
+	ctx := reflect.ValueOf(new(Context))
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		for _, h := range server.beforeFns.load() {
+			assert.NoError(t, h.call(r, ctx))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// altSvcMaxAge is the time in seconds clients remember the HTTP/3 endpoint advertised by Alt-Svc.
+const altSvcMaxAge = 24 * 60 * 60
+
+// HTTP3Server serves HTTP/3 over QUIC, e.g. a *http3.Server of github.com/quic-go/quic-go/http3.
+type HTTP3Server interface {
+	ListenAndServe() error
+	Close() error
+}
+
+/*
+NewHTTP3Server creates the HTTP/3 server listening on the UDP address addr, serving handler with
+the TLS configuration cfg. With quic-go:
+
+	func(addr string, handler http.Handler, cfg *tls.Config) rpc.HTTP3Server {
+		return &http3.Server{Addr: addr, Handler: handler, TLSConfig: cfg}
+	}
+*/
+type NewHTTP3Server func(addr string, handler http.Handler, cfg *tls.Config) HTTP3Server
+
+/*
+ListenAndServeHTTP3 serves HTTP/3 requests on the UDP address addr, and HTTP/1.1 and HTTP/2
+requests over TLS on the TCP address addr. Responses over TCP advertise the HTTP/3 endpoint in
+the Alt-Svc header, so clients switch to QUIC. cfg holds the certificates of the server; TLS 1.3
+is required over QUIC, as per RFC 9001. It returns when either server fails, closing the other.
+*/
+func (s *Server) ListenAndServeHTTP3(addr string, cfg *tls.Config, newServer NewHTTP3Server) error {
+	if cfg == nil || len(cfg.Certificates) == 0 && cfg.GetCertificate == nil {
+		return fmt.Errorf("rpc: HTTP/3 requires a certificate")
+	}
+
+	tcpConfig := cfg.Clone()
+	if tcpConfig.MinVersion < tls.VersionTLS12 {
+		tcpConfig.MinVersion = tls.VersionTLS12
+	}
+	tcpConfig.NextProtos = []string{"h2", "http/1.1"}
+	l, err := tls.Listen("tcp", addr, tcpConfig)
+	if err != nil {
+		return err
+	}
+
+	// Serve QUIC on the port of the listener, known even if addr has none.
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		l.Close()
+		return err
+	}
+	quicConfig := cfg.Clone()
+	quicConfig.MinVersion = tls.VersionTLS13
+	quicConfig.NextProtos = []string{"h3"}
+	h3 := newServer(net.JoinHostPort(host, port), s, quicConfig)
+
+	altSvc := fmt.Sprintf(`h3=":%s"; ma=%d`, port, altSvcMaxAge)
+	hs := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Alt-Svc", altSvc)
+			s.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	s.events.publish(&Event{Type: EventServeStart, Addr: l.Addr()})
+	errs := make(chan error, 2)
+	go func() {
+		errs <- hs.Serve(l)
+	}()
+	go func() {
+		errs <- h3.ListenAndServe()
+	}()
+	err = <-errs
+	hs.Close()
+	h3.Close()
+	<-errs
+	s.events.publish(&Event{Type: EventServeStop, Addr: l.Addr(), Err: err})
+	return err
+}
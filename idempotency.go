@@ -0,0 +1,280 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the request header carrying the idempotency key.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// StoredResponse is a response recorded for an idempotency key.
+type StoredResponse struct {
+	Status      int
+	Header      http.Header
+	Body        []byte
+	RequestHash []byte // SHA-256 of the request body
+}
+
+// IdempotencyStore stores the first response for each idempotency key.
+// Implementations backed by a shared cache, e.g. Redis, allow replay across
+// server instances.
+type IdempotencyStore interface {
+	// Get returns the response stored for key, or nil if there is none.
+	Get(key string) (*StoredResponse, error)
+	// Set stores the response for key for the duration of ttl.
+	Set(key string, resp *StoredResponse, ttl time.Duration) error
+}
+
+/*
+NewMemoryIdempotencyStore returns an IdempotencyStore keeping responses in memory
+*/
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{entries: make(map[string]*memoryIdempotencyEntry)}
+}
+
+type memoryIdempotencyEntry struct {
+	resp    *StoredResponse
+	expires time.Time
+}
+
+// memoryIdempotencySweep is the interval between the removals of the expired responses of the
+// memory store.
+const memoryIdempotencySweep = time.Minute
+
+type memoryIdempotencyStore struct {
+	mutex     sync.Mutex
+	entries   map[string]*memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+func (m *memoryIdempotencyStore) Get(key string) (*StoredResponse, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e := m.entries[key]
+	if e == nil {
+		return nil, nil
+	}
+	if time.Now().After(e.expires) {
+		delete(m.entries, key)
+		return nil, nil
+	}
+	return e.resp, nil
+}
+
+func (m *memoryIdempotencyStore) Set(key string, resp *StoredResponse, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.sweep(now)
+	m.entries[key] = &memoryIdempotencyEntry{resp: resp, expires: now.Add(ttl)}
+	return nil
+}
+
+// idempotency replays stored responses for requests carrying an idempotency key.
+type idempotency struct {
+	store IdempotencyStore
+	ttl   time.Duration
+
+	mutex sync.Mutex
+	locks map[string]*idempotencyLock // serializes requests with the same key
+}
+
+// idempotencyLock is the lock of a key, deleted once its last holder releases it.
+type idempotencyLock struct {
+	sync.Mutex
+	refs int
+}
+
+/*
+lock locks the key, waiting for the requests holding it
+*/
+func (idem *idempotency) lock(key string) *idempotencyLock {
+	idem.mutex.Lock()
+	if idem.locks == nil {
+		idem.locks = make(map[string]*idempotencyLock)
+	}
+	lock := idem.locks[key]
+	if lock == nil {
+		lock = new(idempotencyLock)
+		idem.locks[key] = lock
+	}
+	lock.refs++
+	idem.mutex.Unlock()
+	lock.Lock()
+	return lock
+}
+
+/*
+unlock unlocks the key, deleting its lock if no other request holds or waits for it
+*/
+func (idem *idempotency) unlock(key string, lock *idempotencyLock) {
+	lock.Unlock()
+	idem.mutex.Lock()
+	defer idem.mutex.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(idem.locks, key)
+	}
+}
+
+// idempotentCall is carried by the context of a request served with an
+// idempotency key, and records whether one of its calls was rejected.
+type idempotentCall struct {
+	mutex    sync.Mutex
+	rejected bool
+}
+
+type idempotentCallKey struct{}
+
+/*
+noteStatus records the status of a call failing, if its request has an idempotency key
+*/
+func noteStatus(r *http.Request, status int) {
+	if call, ok := r.Context().Value(idempotentCallKey{}).(*idempotentCall); ok && isRejection(status) {
+		call.mutex.Lock()
+		call.rejected = true
+		call.mutex.Unlock()
+	}
+}
+
+/*
+isRejection reports whether the response of the status is not stored, as a retry of the request
+may succeed, e.g. once its credentials are fixed
+*/
+func isRejection(status int) bool {
+	switch status {
+	case 401, 403, 408, 425, 429:
+		return true
+	}
+	return status >= 500
+}
+
+/*
+serve replays the response stored for key, or calls next and stores its response. A request
+whose body hash differs from the one of the stored response fails with status 422.
+*/
+func (idem *idempotency) serve(w http.ResponseWriter, r *http.Request, key string, hash []byte, next http.HandlerFunc) {
+	lock := idem.lock(key)
+	defer idem.unlock(key, lock)
+
+	stored, err := idem.store.Get(key)
+	if err != nil {
+		WriteError(w, 500, "rpc: idempotency store: "+err.Error())
+		return
+	}
+	if stored != nil {
+		if !bytes.Equal(stored.RequestHash, hash) {
+			WriteError(w, 422, "rpc: idempotency key reused with a different request")
+			return
+		}
+		for k, v := range stored.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+		return
+	}
+
+	call := new(idempotentCall)
+	r = r.WithContext(context.WithValue(r.Context(), idempotentCallKey{}, call))
+	rec := &responseRecorder{ResponseWriter: w, status: 200}
+	next(rec, r)
+	if !call.rejected && !isRejection(rec.status) {
+		idem.store.Set(key, &StoredResponse{
+			Status:      rec.status,
+			Header:      w.Header().Clone(),
+			Body:        rec.body.Bytes(),
+			RequestHash: hash,
+		}, idem.ttl)
+	}
+}
+
+/*
+sweep removes the expired responses, at most once per memoryIdempotencySweep. The mutex is held.
+*/
+func (m *memoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < memoryIdempotencySweep {
+		return
+	}
+	m.lastSweep = now
+	for k, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+}
+
+/*
+serveIdempotent authenticates the caller, then replays the response stored for the idempotency
+key of the caller and method, or serves the request and stores its response
+*/
+func (s *Server) serveIdempotent(w http.ResponseWriter, r *http.Request, codec Codec, key string, stats *CallStats) {
+	// The body is read before the caller is authenticated, so its size is bounded.
+	body, err := readBody(r.Body, s.maxBodyBytes)
+	r.Body.Close()
+	if err != nil {
+		WriteError(w, bodyStatus(err), err.Error())
+		stats.fail(err, ClassClient)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Peek at the method, the codec request writing the errors of the caller.
+	peek := r.Clone(r.Context())
+	peek.Body = io.NopCloser(bytes.NewReader(body))
+	codecReq := codec.NewRequest(peek)
+	method, _ := codecReq.Method()
+
+	var principal Principal
+	if s.authenticator != nil {
+		if principal, err = s.authenticate(w, r); err != nil {
+			stats.fail(err, ClassClient)
+			codecReq.WriteError(w, authStatus(err), err)
+			return
+		}
+	}
+	r = withAuthenticated(r, principal)
+
+	// Callers never share responses, even with the same key.
+	name := ""
+	if principal != nil {
+		name = principal.Name()
+	}
+	hash := sha256.Sum256(body)
+	s.idempotency.serve(w, r, name+"\x00"+method+"\x00"+key, hash[:], func(w http.ResponseWriter, r *http.Request) {
+		s.serveCodec(w, r, codec, stats)
+	})
+}
+
+// responseRecorder writes through to the ResponseWriter and keeps a copy of
+// the status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
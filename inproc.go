@@ -0,0 +1,139 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+)
+
+/*
+NewInprocClient returns a client calling the services of server in the same process, without
+any network.
+
+With a nil codec, calls are dispatched directly: args and replies are handed over without
+encoding, copied if their types match the ones of the method, converted through JSON otherwise.
+The headers, authentication, hooks, caching and auditing of the server still apply, while
+the options of the client about HTTP, e.g. retries or compression, don't. Notify, CallStream and
+batches require a codec.
+
+With a codec, requests are encoded and served by ServeHTTP as if they were sent over HTTP.
+*/
+func NewInprocClient(server *Server, codec ClientCodec, opts ...ClientOption) (*Client, error) {
+	if server == nil {
+		return nil, fmt.Errorf("rpc: server is nil")
+	}
+	if codec != nil {
+		opts = append([]ClientOption{WithRoundTripper(&inprocTransport{server: server})}, opts...)
+		return NewClient("http://inproc", codec, opts...)
+	}
+
+	c := &Client{
+		balancer:   new(balancer),
+		httpClient: http.DefaultClient,
+		header:     make(http.Header),
+		closed:     make(chan struct{}),
+		inproc:     server,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.invoke = c.chain(c.callInproc)
+	return c, nil
+}
+
+/*
+callInproc dispatches the call to the server of the client, it is the innermost CallFunc of
+clients without codec
+*/
+func (c *Client) callInproc(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	r, err := http.NewRequestWithContext(ctx, "POST", "/", http.NoBody)
+	if err != nil {
+		return err
+	}
+	r.Header = c.requestHeader(ctx)
+	req := &inprocRequest{method: method, args: args, reply: reply}
+	c.inproc.serveRequest(newBufferWriter(), r, req, nil)
+	return req.err
+}
+
+// inprocRequest is the CodecRequest of a call dispatched in process.
+type inprocRequest struct {
+	method string
+	args   interface{}
+	reply  interface{}
+	err    error // error of the call
+}
+
+func (r *inprocRequest) Method() (string, error) {
+	return r.method, nil
+}
+
+func (r *inprocRequest) ReadRequest(args interface{}) error {
+	return assign(args, r.args)
+}
+
+func (r *inprocRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	r.err = assign(r.reply, reply)
+}
+
+func (r *inprocRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	r.err = err
+}
+
+/*
+assign copies the value of src to the value pointed to by dst, converting it through JSON if
+their types differ
+*/
+func assign(dst, src interface{}) error {
+	if dst == nil || src == nil {
+		return nil
+	}
+	dv, sv := reflect.ValueOf(dst), reflect.ValueOf(src)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() {
+		return fmt.Errorf("rpc: reply of type %T is not a pointer", dst)
+	}
+	if sv.Type() == dv.Type() {
+		if !sv.IsNil() {
+			dv.Elem().Set(sv.Elem())
+		}
+		return nil
+	}
+	if sv.Type().AssignableTo(dv.Elem().Type()) {
+		dv.Elem().Set(sv)
+		return nil
+	}
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// inprocTransport is a http.RoundTripper serving the requests with a server.
+type inprocTransport struct {
+	server *Server
+}
+
+func (t *inprocTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bw := newBufferWriter()
+	// The server may replace the body of the request.
+	t.server.ServeHTTP(bw, req.Clone(req.Context()))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", bw.status, http.StatusText(bw.status)),
+		StatusCode:    bw.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        bw.header,
+		Body:          io.NopCloser(&bw.buf),
+		ContentLength: int64(bw.buf.Len()),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+)
+
+// CallFunc calls an RPC method, as Client.Call does.
+type CallFunc func(ctx context.Context, method string, args interface{}, reply interface{}) error
+
+// Interceptor wraps the calls of a Client, e.g. for logging, metrics, auth
+// header injection or retries. It calls next to continue the call.
+type Interceptor func(next CallFunc) CallFunc
+
+/*
+WithInterceptors adds interceptors wrapping every call of the client.
+Interceptors are composed in order: the first one is the outermost.
+*/
+func WithInterceptors(interceptors ...Interceptor) ClientOption {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
+
+/*
+chainInterceptors wraps call with the interceptors, the first one being the outermost
+*/
+func chainInterceptors(interceptors []Interceptor, call CallFunc) CallFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		call = interceptors[i](call)
+	}
+	return call
+}
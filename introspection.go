@@ -0,0 +1,34 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"sort"
+)
+
+// IntrospectionMethod is the built-in method returning the services of a
+// server with their methods, as a map[string][]string, if enabled.
+const IntrospectionMethod = "rpc.Methods"
+
+/*
+SetIntrospection enables the IntrospectionMethod, so clients can list the registered methods.
+Requests to it go through the authenticator and before funcs like any other call.
+*/
+func (s *Server) SetIntrospection(enabled bool) {
+	s.introspection = enabled
+}
+
+/*
+writeIntrospection writes the reply of the IntrospectionMethod, the sorted service map
+*/
+func (s *Server) writeIntrospection(w http.ResponseWriter, codecReq CodecRequest) {
+	services := s.services.Map()
+	for _, methods := range services {
+		sort.Strings(methods)
+	}
+	w.Header().Set("x-content-type-options", "nosniff")
+	codecReq.WriteResponse(w, services)
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPFilter rejects the requests of clients outside of the allowed networks.
+type IPFilter struct {
+	allow   []netip.Prefix // networks allowed, every one if empty
+	deny    []netip.Prefix // networks denied, even if allowed
+	proxies []netip.Prefix // networks of the proxies trusted to set X-Forwarded-For
+}
+
+/*
+NewIPFilter returns a filter of the networks of the lists, CIDR prefixes or single addresses.
+
+Clients are rejected if they belong to a denied network, or if allow isn't empty and they
+belong to none of its networks. The client of a request is its remote address, unless it
+belongs to trustedProxies: X-Forwarded-For is then walked from the last address appended, the
+client being the first one not belonging to trustedProxies.
+*/
+func NewIPFilter(allow, deny, trustedProxies []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	var err error
+	if f.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	if f.proxies, err = parsePrefixes(trustedProxies); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+/*
+SetIPFilter rejects the requests of the clients refused by the filter with status 403, before
+their body is read. A nil filter accepts every client.
+*/
+func (s *Server) SetIPFilter(filter *IPFilter) {
+	s.ipFilter = filter
+}
+
+/*
+ClientIP returns the address of the client of the request, invalid if it can't be parsed
+*/
+func (f *IPFilter) ClientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+	if !containsAddr(f.proxies, addr) {
+		return addr
+	}
+	forwarded := r.Header.Values("X-Forwarded-For")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hops := strings.Split(forwarded[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[j]))
+			if err != nil {
+				return netip.Addr{}
+			}
+			addr = hop.Unmap()
+			if !containsAddr(f.proxies, addr) {
+				return addr
+			}
+		}
+	}
+	return addr
+}
+
+/*
+Allowed reports whether the client of the request is allowed
+*/
+func (f *IPFilter) Allowed(r *http.Request) bool {
+	addr := f.ClientIP(r)
+	if !addr.IsValid() || containsAddr(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || containsAddr(f.allow, addr)
+}
+
+/*
+filterIP writes status 403 and returns false if the client of the request isn't allowed
+*/
+func (s *Server) filterIP(w http.ResponseWriter, r *http.Request) bool {
+	if s.ipFilter == nil || s.ipFilter.Allowed(r) {
+		return true
+	}
+	WriteError(w, 403, "rpc: client address not allowed")
+	return false
+}
+
+/*
+parsePrefixes parses CIDR prefixes and single addresses
+*/
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("rpc: invalid address %q", s)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("rpc: invalid network %q", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+/*
+containsAddr reports whether one of the prefixes contains the address
+*/
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -7,6 +7,8 @@ package json
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/antenna3mt/rpc"
 	"io"
 	"math/rand"
 )
@@ -31,13 +33,25 @@ type clientRequest struct {
 	Id uint64 `json:"id"`
 }
 
+// clientNotification represents a JSON-RPC notification sent by a client,
+// a request without id.
+type clientNotification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
 // clientResponse represents a JSON-RPC response returned to a client.
 type clientResponse struct {
 	Version string           `json:"jsonrpc"`
 	Result  *json.RawMessage `json:"result"`
 	Error   *json.RawMessage `json:"error"`
+	Id      *uint64          `json:"id"`
 }
 
+// ErrNoResponse is set to the calls of a batch missing from the response.
+var ErrNoResponse = errors.New("no response for the call")
+
 // EncodeClientRequest encodes parameters for a JSON-RPC client request.
 func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
 	c := &clientRequest{
@@ -56,6 +70,11 @@ func DecodeClientResponse(r io.Reader, reply interface{}) error {
 	if err := json.NewDecoder(r).Decode(&c); err != nil {
 		return err
 	}
+	return c.decode(reply)
+}
+
+// decode fills reply with the result, or returns the error of the response.
+func (c *clientResponse) decode(reply interface{}) error {
 	if c.Error != nil {
 		jsonErr := &Error{}
 		if err := json.Unmarshal(*c.Error, jsonErr); err != nil {
@@ -73,3 +92,103 @@ func DecodeClientResponse(r io.Reader, reply interface{}) error {
 
 	return json.Unmarshal(*c.Result, reply)
 }
+
+// ClientCodec encodes requests and decodes responses of an rpc.Client.
+type ClientCodec struct {
+}
+
+// NewClientCodec returns a new JSON ClientCodec.
+func NewClientCodec() *ClientCodec {
+	return &ClientCodec{}
+}
+
+// ContentType returns the Content-Type of JSON-RPC requests.
+func (c *ClientCodec) ContentType() string {
+	return "application/json"
+}
+
+// EncodeRequest encodes parameters for a JSON-RPC client request.
+func (c *ClientCodec) EncodeRequest(method string, args interface{}) ([]byte, error) {
+	return EncodeClientRequest(method, args)
+}
+
+// EncodeNotification encodes parameters for a JSON-RPC client notification.
+func (c *ClientCodec) EncodeNotification(method string, args interface{}) ([]byte, error) {
+	return json.Marshal(&clientNotification{
+		Version: "2.0",
+		Method:  method,
+		Params:  args,
+	})
+}
+
+// EncodeItem encodes an item of the request of a streamed call, followed by a
+// newline.
+func (c *ClientCodec) EncodeItem(item interface{}) ([]byte, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// DecodeResponse decodes the response body of a client request into
+// the interface reply.
+func (c *ClientCodec) DecodeResponse(r io.Reader, reply interface{}) error {
+	return DecodeClientResponse(r, reply)
+}
+
+// EncodeBatch encodes the calls in a JSON-RPC batch, using the index of each
+// call as its id.
+func (c *ClientCodec) EncodeBatch(calls []rpc.BatchCall) ([]byte, error) {
+	reqs := make([]*clientRequest, len(calls))
+	for i, call := range calls {
+		reqs[i] = &clientRequest{
+			Version: "2.0",
+			Method:  call.Method,
+			Params:  call.Args,
+			Id:      uint64(i),
+		}
+	}
+	return json.Marshal(reqs)
+}
+
+// DecodeBatch decodes the response body of a batch, filling the reply or the
+// error of each call.
+func (c *ClientCodec) DecodeBatch(r io.Reader, calls []rpc.BatchCall) error {
+	var responses []*clientResponse
+	if err := json.NewDecoder(r).Decode(&responses); err != nil {
+		return err
+	}
+	for i := range calls {
+		calls[i].Err = ErrNoResponse
+	}
+	for _, res := range responses {
+		if res.Id == nil || *res.Id >= uint64(len(calls)) {
+			continue
+		}
+		call := &calls[*res.Id]
+		call.Err = res.decode(call.Reply)
+	}
+	return nil
+}
+
+// NewStreamDecoder returns a decoder of streamed responses, a sequence of
+// JSON-RPC responses, e.g. newline delimited, each one holding an item.
+func (c *ClientCodec) NewStreamDecoder(r io.Reader) rpc.StreamDecoder {
+	return &streamDecoder{decoder: json.NewDecoder(r)}
+}
+
+// streamDecoder decodes the responses of a stream.
+type streamDecoder struct {
+	decoder *json.Decoder
+}
+
+// Decode fills reply with the result of the next response, or returns its
+// error. It returns io.EOF after the last response.
+func (d *streamDecoder) Decode(reply interface{}) error {
+	var res clientResponse
+	if err := d.decoder.Decode(&res); err != nil {
+		return err
+	}
+	return res.decode(reply)
+}
@@ -7,6 +7,7 @@ package json
 
 import (
 	"errors"
+	"github.com/antenna3mt/rpc"
 )
 
 type ErrorCode int
@@ -18,6 +19,8 @@ const (
 	E_BAD_PARAMS  ErrorCode = -32602
 	E_INTERNAL    ErrorCode = -32603
 	E_SERVER      ErrorCode = -32000
+	E_DEADLINE    ErrorCode = -32001
+	E_FORBIDDEN   ErrorCode = -32003
 )
 
 var ErrNullResult = errors.New("result is null")
@@ -37,3 +40,13 @@ type Error struct {
 func (e *Error) Error() string {
 	return e.Message
 }
+
+// As converts the error to an *rpc.Error, so errors returned by clients of any
+// codec can be matched with errors.As.
+func (e *Error) As(target interface{}) bool {
+	if t, ok := target.(**rpc.Error); ok {
+		*t = &rpc.Error{Code: int(e.Code), Message: e.Message, Data: e.Data}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NewEthereumCodec returns a JSON Codec in the Ethereum compatibility mode,
+// serving the clients of Ethereum-style JSON-RPC APIs:
+//
+//   - lowercase namespaced methods are mapped to services, e.g. eth_getBalance
+//     calls Eth.GetBalance, while dotted methods are kept as is;
+//   - an array of params fills the exported fields of the args in order, e.g.
+//     ["0x407d73d8a49eeb85d32cf465507dd71d507100c1", "latest"] the Address and
+//     Block fields, the missing trailing fields being left zero;
+//   - eth_subscribe, or the subscribe method of any namespace, subscribes to
+//     the topic named by its first param, and replies with the id of the
+//     subscription. Over a websocket connection, the events published to the
+//     topic are pushed as eth_subscription notifications, until the
+//     subscription is cancelled with eth_unsubscribe, which replies true.
+//
+// Subscriptions require rpc.Server.SetSubscriptions.
+func NewEthereumCodec() *Codec {
+	c := NewCodec()
+	c.ethereum = true
+	return c
+}
+
+// ethereumMethod returns the method in dotted notation of an Ethereum-style
+// method, the built-in methods of subscriptions for subscribe and unsubscribe.
+func ethereumMethod(method string) string {
+	namespace, name, ok := strings.Cut(method, "_")
+	if !ok || namespace == "" || name == "" || strings.Contains(method, ".") {
+		return method
+	}
+	switch name {
+	case "subscribe":
+		return rpc.SubscribeMethod
+	case "unsubscribe":
+		return rpc.UnsubscribeMethod
+	}
+	return upperFirst(namespace) + "." + upperFirst(name)
+}
+
+// upperFirst returns s with its first letter in upper case.
+func upperFirst(s string) string {
+	r, n := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[n:]
+}
+
+// ethereumReply returns the reply written for the Ethereum-style method: the
+// id of a subscription, and true once unsubscribed.
+func ethereumReply(method string, reply interface{}) interface{} {
+	switch ethereumMethod(method) {
+	case rpc.SubscribeMethod:
+		if sub, ok := reply.(*rpc.SubscribeReply); ok {
+			return sub.ID
+		}
+	case rpc.UnsubscribeMethod:
+		return true
+	}
+	return reply
+}
+
+// decodePositional unmarshals an array of params into the exported fields of
+// the struct args points to, in order. It reports false if the params are not
+// an array or args is not a struct.
+func decodePositional(data []byte, args interface{}) (bool, error) {
+	v := reflect.ValueOf(args)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return false, nil
+	}
+	var params []json.RawMessage
+	if json.Unmarshal(data, &params) != nil {
+		return false, nil
+	}
+
+	// The first param of a subscription is the name of its topic, the others
+	// its options.
+	if sub, ok := args.(*rpc.SubscribeArgs); ok {
+		var topic string
+		if len(params) == 0 {
+			return true, errors.New("missing subscription name")
+		}
+		if err := json.Unmarshal(params[0], &topic); err != nil {
+			return true, fmt.Errorf("invalid subscription name: %v", err)
+		}
+		sub.Topics = []string{topic}
+		return true, nil
+	}
+
+	v = v.Elem()
+	var fields []int
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); f.IsExported() && f.Tag.Get("json") != "-" {
+			fields = append(fields, i)
+		}
+	}
+	if len(params) > len(fields) {
+		return true, fmt.Errorf("too many params, want at most %d", len(fields))
+	}
+	for i, param := range params {
+		if err := json.Unmarshal(param, v.Field(fields[i]).Addr().Interface()); err != nil {
+			return true, fmt.Errorf("invalid param %d: %v", i, err)
+		}
+	}
+	return true, nil
+}
+
+// ethereumCodecRequest is a CodecRequest in the Ethereum compatibility mode,
+// pushing the events of subscriptions.
+type ethereumCodecRequest struct {
+	*CodecRequest
+}
+
+// newEthereumCodecRequest returns the request, and the calls of its batch, in
+// the Ethereum compatibility mode.
+func newEthereumCodecRequest(c *CodecRequest) *ethereumCodecRequest {
+	c.ethereum = true
+	for _, call := range c.batch {
+		call.(*CodecRequest).ethereum = true
+	}
+	return &ethereumCodecRequest{CodecRequest: c}
+}
+
+// ethereumNotification is the notification of an event of a subscription.
+type ethereumNotification struct {
+	Version string                    `json:"jsonrpc"`
+	Method  string                    `json:"method"`
+	Params  ethereumSubscriptionEvent `json:"params"`
+}
+
+// ethereumSubscriptionEvent is the event of a subscription.
+type ethereumSubscriptionEvent struct {
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result"`
+}
+
+// EncodeNotification implements rpc.SubscriptionNotifier, returning the
+// notification of the event, e.g. eth_subscription for eth_subscribe.
+func (c *ethereumCodecRequest) EncodeNotification(subscription string, event rpc.SubscriptionEvent) ([]byte, error) {
+	namespace, _, _ := strings.Cut(c.request.Method, "_")
+	return json.Marshal(&ethereumNotification{
+		Version: Version,
+		Method:  namespace + "_subscription",
+		Params:  ethereumSubscriptionEvent{Subscription: subscription, Result: event.Data},
+	})
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"encoding/json"
+	"github.com/antenna3mt/rpc"
+)
+
+// NewLegacyCodec returns a JSON Codec serving JSON-RPC 1.0 requests, e.g. of
+// embedded clients predating JSON-RPC 2.0:
+//
+//   - requests have no jsonrpc member, and a request with a null id is a
+//     notification, which has no response;
+//   - responses have no jsonrpc member, and both a result and an error member,
+//     the error being null on success and the result null on error;
+//   - batches are not supported.
+func NewLegacyCodec() *Codec {
+	c := NewCodec()
+	c.legacy = true
+	return c
+}
+
+// legacyResponse represents a JSON-RPC 1.0 response returned by the server.
+type legacyResponse struct {
+	// The Object that was returned by the invoked method, null on error.
+	Result interface{} `json:"result"`
+
+	// An Error object if there was an error invoking the method, null
+	// otherwise.
+	Error *Error `json:"error"`
+
+	// This must be the same id as the request it is responding to.
+	Id *json.RawMessage `json:"id"`
+}
+
+// newLegacyBatchCodecRequest returns the request of a batch, whose error is
+// written with a null id.
+func newLegacyBatchCodecRequest(encoder rpc.Encoder) rpc.CodecRequest {
+	return &CodecRequest{
+		request: &serverRequest{Id: &null},
+		err:     &Error{Code: E_INVALID_REQ, Message: "batches are not supported by JSON-RPC 1.0"},
+		encoder: encoder,
+		legacy:  true,
+	}
+}
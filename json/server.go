@@ -6,12 +6,22 @@
 package json
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/antenna3mt/rpc"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 var null = json.RawMessage([]byte("null"))
+
+// contentTypeHeader is the Content-Type of responses, shared by all of them.
+var contentTypeHeader = []string{"application/json; charset=utf-8"}
 var Version = "2.0"
 
 // ----------------------------------------------------------------------------
@@ -70,39 +80,249 @@ func NewCodec() *Codec {
 
 // Codec creates a CodecRequest to process each request.
 type Codec struct {
-	encSel rpc.EncoderSelector
+	encSel   rpc.EncoderSelector
+	ethereum bool // serves the requests in the Ethereum compatibility mode
+	legacy   bool // serves JSON-RPC 1.0 requests
 }
 
 // NewRequest returns a CodecRequest.
 func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
-	return newCodecRequest(r, c.encSel.Select(r))
+	req := newCodecRequest(r, c.encSel.Select(r), c.legacy)
+	if c.ethereum {
+		return newEthereumCodecRequest(req.(*CodecRequest))
+	}
+	return req
+}
+
+// NewStreamRequest returns a CodecRequest of a streamed call of the method,
+// whose body is a sequence of JSON values, e.g. newline delimited, each one an
+// item of the request. Each item of the response is a JSON-RPC response.
+func (c *Codec) NewStreamRequest(r *http.Request, method string) rpc.CodecRequest {
+	id := json.RawMessage("0")
+	req := &serverRequest{Version: Version, Method: method, Id: &id}
+	stream := &streamCodecRequest{
+		CodecRequest: newSingleCodecRequest(req, nil, c.encSel.Select(r)),
+		decoder:      json.NewDecoder(r.Body),
+	}
+	stream.legacy = c.legacy
+	return stream
 }
 
 // ----------------------------------------------------------------------------
 // CodecRequest
 // ----------------------------------------------------------------------------
 
-// newCodecRequest returns a new CodecRequest.
-func newCodecRequest(r *http.Request, encoder rpc.Encoder) rpc.CodecRequest {
-	// Decode the request body and check if RPC method is valid.
-	req := new(serverRequest)
-	err := json.NewDecoder(r.Body).Decode(req)
+// newCodecRequest returns a new CodecRequest, of JSON-RPC 1.0 if legacy is
+// set.
+func newCodecRequest(r *http.Request, encoder rpc.Encoder, legacy bool) rpc.CodecRequest {
+	// A batch is an array of requests.
+	body := bufio.NewReader(r.Body)
+	if isBatch(body) {
+		defer r.Body.Close()
+		if legacy {
+			return newLegacyBatchCodecRequest(encoder)
+		}
+		return newBatchCodecRequest(body, encoder)
+	}
+
+	// Decode the members of the request up to its params, which are decoded
+	// straight from the body into the args once the method is known.
+	c := &CodecRequest{request: new(serverRequest), encoder: encoder, decoder: json.NewDecoder(body), legacy: legacy}
+	if err := c.readMembers(false, true); err != nil {
+		c.err = parseError(c.request, err)
+	} else if !c.pending {
+		c.err = c.checkProtocol()
+	}
+	return c
+}
+
+// readMembers decodes the members of the request object, from its start or
+// resuming after its params. If stopAtParams is set and the method has been
+// read, it stops at the params, leaving them pending; params preceding the
+// method are kept raw.
+func (c *CodecRequest) readMembers(resume, stopAtParams bool) error {
+	dec := c.decoder
+	if !resume {
+		if t, err := dec.Token(); err != nil {
+			return err
+		} else if t != json.Delim('{') {
+			return fmt.Errorf("json: cannot unmarshal %v into a request", t)
+		}
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		// Members are matched case-insensitively, as json.Unmarshal does.
+		key, _ := t.(string)
+		switch {
+		case strings.EqualFold(key, "jsonrpc"):
+			err = dec.Decode(&c.request.Version)
+		case strings.EqualFold(key, "method"):
+			err = dec.Decode(&c.request.Method)
+		case strings.EqualFold(key, "id"):
+			err = dec.Decode(&c.request.Id)
+		case strings.EqualFold(key, "params") && stopAtParams && c.request.Method != "":
+			c.pending = true
+			return nil
+		case strings.EqualFold(key, "params"):
+			err = dec.Decode(&c.request.Params)
+		default:
+			err = skipValue(dec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// finish skips pending params, and decodes the members following them. It
+// is a no-op if the request has been read.
+func (c *CodecRequest) finish() {
+	if !c.pending {
+		return
+	}
+	c.pending = false
+	err := skipValue(c.decoder)
+	if err == nil {
+		err = c.readMembers(true, false)
+	}
 	if err != nil {
-		err = &Error{
-			Code:    E_PARSE,
-			Message: err.Error(),
-			Data:    req,
+		c.err = parseError(c.request, err)
+	} else {
+		c.err = c.checkProtocol()
+	}
+}
+
+// skipValue reads the next value of the decoder without keeping it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
 		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// paramsDecoder unmarshals params into args, by name or by position.
+type paramsDecoder struct {
+	args     interface{}
+	ethereum bool
+}
+
+func (p *paramsDecoder) UnmarshalJSON(data []byte) error {
+	return decodeParams(data, p.args, p.ethereum)
+}
+
+// decodeParams unmarshals params into args, by name or by position. In the
+// Ethereum mode, an array of params fills the fields of args in order.
+func decodeParams(data []byte, args interface{}, ethereum bool) error {
+	if ethereum {
+		if ok, err := decodePositional(data, args); ok {
+			return err
+		}
+	}
+	// Clearly JSON params is not a structured object, fallback and attempt
+	// an unmarshal with JSON params as array value and RPC params is struct.
+	if err := json.Unmarshal(data, args); err != nil {
+		params := [1]interface{}{args}
+		return json.Unmarshal(data, &params)
+	}
+	return nil
+}
+
+// isBatch reports whether the first non-space byte of the body opens an array.
+func isBatch(body *bufio.Reader) bool {
+	for {
+		b, err := body.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		body.UnreadByte()
+		return b == '['
+	}
+}
+
+// newBatchCodecRequest decodes a batch of requests.
+func newBatchCodecRequest(body io.Reader, encoder rpc.Encoder) rpc.CodecRequest {
+	var raws []json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raws); err != nil {
+		return newSingleCodecRequest(new(serverRequest), err, encoder)
+	}
+	if len(raws) == 0 {
+		return &CodecRequest{
+			request: &serverRequest{Id: &null},
+			err:     &Error{Code: E_INVALID_REQ, Message: "empty batch"},
+			encoder: encoder,
+		}
+	}
+	batch := make([]rpc.CodecRequest, 0, len(raws))
+	for _, raw := range raws {
+		req := new(serverRequest)
+		err := json.Unmarshal(raw, req)
+		// Responses of the calls are written together by the batch.
+		batch = append(batch, newSingleCodecRequest(req, err, rpc.DefaultEncoder))
+	}
+	// Errors of the batch as a whole are written with a null id.
+	return &CodecRequest{request: &serverRequest{Id: &null}, batch: batch, encoder: encoder}
+}
+
+// newSingleCodecRequest checks a decoded request and returns its CodecRequest.
+func newSingleCodecRequest(req *serverRequest, err error, encoder rpc.Encoder) *CodecRequest {
+	if err != nil {
+		err = parseError(req, err)
+	}
+	if errVersion := checkVersion(req); errVersion != nil {
+		err = errVersion
 	}
+	return &CodecRequest{request: req, err: err, encoder: encoder}
+}
+
+// parseError returns the error of a request failing to decode.
+func parseError(req *serverRequest, err error) error {
+	return &Error{
+		Code:    E_PARSE,
+		Message: err.Error(),
+		Data:    req,
+	}
+}
+
+// checkVersion returns an error if the request is not JSON-RPC 2.0.
+func checkVersion(req *serverRequest) error {
 	if req.Version != Version {
-		err = &Error{
+		return &Error{
 			Code:    E_INVALID_REQ,
 			Message: "jsonrpc must be " + Version,
 			Data:    req,
 		}
 	}
-	r.Body.Close()
-	return &CodecRequest{request: req, err: err, encoder: encoder}
+	return nil
+}
+
+// checkProtocol returns an error if the request is not of the protocol of the
+// codec. JSON-RPC 1.0 requests have no version.
+func (c *CodecRequest) checkProtocol() error {
+	if c.legacy {
+		return nil
+	}
+	return checkVersion(c.request)
 }
 
 // CodecRequest decodes and encodes a single request.
@@ -110,16 +330,55 @@ type CodecRequest struct {
 	request *serverRequest
 	err     error
 	encoder rpc.Encoder
+	batch   []rpc.CodecRequest
+
+	// decoder reads the body of a request decoded as it is read, and pending
+	// is set while its params are not read yet.
+	decoder *json.Decoder
+	pending bool
+
+	// ethereum is set in the Ethereum compatibility mode, legacy for JSON-RPC
+	// 1.0.
+	ethereum bool
+	legacy   bool
+}
+
+// Batch returns the codec requests of the calls if the request is a batch.
+func (c *CodecRequest) Batch() ([]rpc.CodecRequest, bool) {
+	return c.batch, c.batch != nil
+}
+
+// WriteBatch writes the responses of the calls of a batch as an array.
+// Nothing is written if all the calls are notifications.
+func (c *CodecRequest) WriteBatch(w http.ResponseWriter, responses [][]byte) {
+	if len(responses) == 0 {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	buf := rpc.GetBuffer()
+	defer rpc.PutBuffer(buf)
+	buf.WriteByte('[')
+	for i, res := range responses {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(bytes.TrimSpace(res))
+	}
+	buf.WriteString("]\n")
+	rpc.WriteBody(w, c.encoder, buf.Bytes())
 }
 
 // Method returns the RPC method for the current request.
 //
 // The method uses a dotted notation as in "Service.Method".
 func (c *CodecRequest) Method() (string, error) {
-	if c.err == nil {
-		return c.request.Method, nil
+	if c.err != nil {
+		return "", c.err
+	}
+	if c.ethereum {
+		return ethereumMethod(c.request.Method), nil
 	}
-	return "", c.err
+	return c.request.Method, nil
 }
 
 // ReadRequest fills the request object for the RPC method.
@@ -136,21 +395,32 @@ func (c *CodecRequest) Method() (string, error) {
 // generated. The names MUST match exactly, including
 // case, to the method's expected parameters.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil && c.pending {
+		// Decode the params straight from the body, then the members following
+		// them, e.g. the id, even if the params don't fit the args.
+		c.pending = false
+		errParams := c.decoder.Decode(&paramsDecoder{args: args, ethereum: c.ethereum})
+		if err := c.readMembers(true, false); err != nil {
+			c.err = parseError(c.request, err)
+		} else {
+			c.err = c.checkProtocol()
+		}
+		if errParams != nil && c.err == nil {
+			c.err = &Error{
+				Code:    E_INVALID_REQ,
+				Message: errParams.Error(),
+			}
+		}
+		return c.err
+	}
 	if c.err == nil && c.request.Params != nil {
 		// Note: if c.request.Params is nil it's not an error, it's an optional member.
 		// JSON params structured object. Unmarshal to the args object.
-		if err := json.Unmarshal(*c.request.Params, args); err != nil {
-			// Clearly JSON params is not a structured object,
-			// fallback and attempt an unmarshal with JSON params as
-			// array value and RPC params is struct. Unmarshal into
-			// array containing the request struct.
-			params := [1]interface{}{args}
-			if err = json.Unmarshal(*c.request.Params, &params); err != nil {
-				c.err = &Error{
-					Code:    E_INVALID_REQ,
-					Message: err.Error(),
-					Data:    c.request.Params,
-				}
+		if err := decodeParams(*c.request.Params, args, c.ethereum); err != nil {
+			c.err = &Error{
+				Code:    E_INVALID_REQ,
+				Message: err.Error(),
+				Data:    c.request.Params,
 			}
 		}
 	}
@@ -159,6 +429,14 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 
 // WriteResponse encodes the response and writes it to the ResponseWriter.
 func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	c.finish()
+	if c.ethereum {
+		reply = ethereumReply(c.request.Method, reply)
+	}
+	if c.legacy {
+		c.writeServerResponse(w, &legacyResponse{Result: reply, Id: c.request.Id})
+		return
+	}
 	res := &serverResponse{
 		Version: Version,
 		Result:  reply,
@@ -168,13 +446,25 @@ func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
 }
 
 func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	// The id of the request may follow its params.
+	c.finish()
+	code, message, data := errorFields(err)
+	if data == nil && !c.legacy && c.writeErrorResponse(w, code, message) {
+		return
+	}
 	jsonErr, ok := err.(*Error)
 	if !ok {
+		// The data of service errors may hold the secrets of the args.
 		jsonErr = &Error{
-			Code:    E_SERVER,
-			Message: err.Error(),
+			Code:    code,
+			Message: message,
+			Data:    rpc.Redact(data),
 		}
 	}
+	if c.legacy {
+		c.writeServerResponse(w, &legacyResponse{Error: jsonErr, Id: c.request.Id})
+		return
+	}
 	res := &serverResponse{
 		Version: Version,
 		Error:   jsonErr,
@@ -183,19 +473,130 @@ func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error)
 	c.writeServerResponse(w, res)
 }
 
-func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, res *serverResponse) {
+// errorFields returns the code, message and data of the JSON-RPC error of err.
+func errorFields(err error) (ErrorCode, string, interface{}) {
+	switch e := err.(type) {
+	case *Error:
+		return e.Code, e.Message, e.Data
+	case *rpc.Error:
+		return ErrorCode(e.Code), e.Message, e.Data
+	}
+	if errors.Is(err, rpc.ErrBatchTooLarge) {
+		return E_INVALID_REQ, err.Error(), nil
+	}
+	code := E_SERVER
+	switch err {
+	case rpc.ErrDeadlineExceeded:
+		code = E_DEADLINE
+	case rpc.ErrForbidden:
+		code = E_FORBIDDEN
+	}
+	return code, err.Error(), nil
+}
+
+// Preformatted parts of error responses.
+var (
+	errorPrefix  = []byte(`{"jsonrpc":`)
+	errorCode    = []byte(`,"error":{"code":`)
+	errorMessage = []byte(`,"message":`)
+	errorSuffix  = []byte(`,"data":null},"id":`)
+)
+
+// writeErrorResponse writes an error response without data by writing its
+// parts into a pooled buffer, so that rejecting calls doesn't allocate. It
+// returns false if the version, message or id must be escaped, leaving them to
+// the encoder.
+func (c *CodecRequest) writeErrorResponse(w http.ResponseWriter, code ErrorCode, message string) bool {
+	if c.request.Id == nil {
+		return true
+	}
+	id := []byte(*c.request.Id)
+	if !isPlainJSON(Version) || !isPlainJSON(message) || !isPlainJSONValue(id) {
+		return false
+	}
+	buf := rpc.GetBuffer()
+	defer rpc.PutBuffer(buf)
+	buf.Write(errorPrefix)
+	writePlainString(buf, Version)
+	buf.Write(errorCode)
+	buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(code), 10))
+	buf.Write(errorMessage)
+	writePlainString(buf, message)
+	buf.Write(errorSuffix)
+	buf.Write(id)
+	buf.WriteString("}\n")
+	w.Header()["Content-Type"] = contentTypeHeader
+	rpc.WriteBody(w, c.encoder, buf.Bytes())
+	return true
+}
+
+// isPlainJSON reports whether the string is encoded as is, but for quotes
+// and backslashes.
+func isPlainJSON(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '<' || c == '>' || c == '&' {
+			return false
+		}
+	}
+	return true
+}
+
+// isPlainJSONValue reports whether the raw value is encoded as is, without
+// spaces to compact.
+func isPlainJSONValue(v []byte) bool {
+	for _, c := range v {
+		if c <= ' ' || c > 0x7e || c == '<' || c == '>' || c == '&' {
+			return false
+		}
+	}
+	return true
+}
+
+// writePlainString writes the quoted plain string.
+func writePlainString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(s[i])
+	}
+	buf.WriteByte('"')
+}
+
+func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, res interface{}) {
 	// Id is null for notifications and they don't have a response.
 	if c.request.Id != nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		encoder := json.NewEncoder(c.encoder.Encode(w))
-		err := encoder.Encode(res)
+		// Encode into a pooled buffer, so that the length of the response is
+		// known before writing it.
+		buf := rpc.GetBuffer()
+		defer rpc.PutBuffer(buf)
+		err := json.NewEncoder(buf).Encode(res)
 
 		// Not sure in which case will this happen. But seems harmless.
 		if err != nil {
 			rpc.WriteError(w, 400, err.Error())
+			return
 		}
+		w.Header()["Content-Type"] = contentTypeHeader
+		rpc.WriteBody(w, c.encoder, buf.Bytes())
 	}
 }
 
 type EmptyResponse struct {
 }
+
+// streamCodecRequest reads the items of a streamed call one by one.
+type streamCodecRequest struct {
+	*CodecRequest
+	decoder *json.Decoder
+}
+
+// ReadRequest fills args with the next item, and returns io.EOF after the last one.
+func (c *streamCodecRequest) ReadRequest(args interface{}) error {
+	err := c.decoder.Decode(args)
+	if err != nil && err != io.EOF {
+		return &Error{Code: E_INVALID_REQ, Message: err.Error()}
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/antenna3mt/rpc"
+	"net/http"
+	"sync"
+)
+
+// Notify sends a JSON-RPC notification to the peer of a websocket connection,
+// e.g. from a service to the client it received a request from:
+//
+//	json.Notify(rpc.WebsocketConnFromContext(ctx.Context()), "Progress", &progress)
+func Notify(conn *rpc.WebsocketConn, method string, params interface{}) error {
+	if conn == nil {
+		return rpc.ErrWebsocketClosed
+	}
+	msg, err := json.Marshal(&clientNotification{
+		Version: Version,
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(msg)
+}
+
+// websocketMessage is a message received by a WebsocketClient, either a
+// response or a notification of the server.
+type websocketMessage struct {
+	clientResponse
+	Method string           `json:"method"`
+	Params *json.RawMessage `json:"params"`
+}
+
+// WebsocketClient calls JSON-RPC methods over a websocket connection, and
+// receives the notifications of the server.
+type WebsocketClient struct {
+	conn     *rpc.WebsocketConn
+	onNotify func(method string, params json.RawMessage)
+
+	mutex   sync.Mutex
+	nextId  uint64
+	pending map[uint64]chan *clientResponse // calls waiting for their response
+	err     error                           // error closing the connection
+}
+
+// DialWebsocket connects to the websocket url of a server, "ws://" or
+// "wss://", sending header with the handshake. onNotify, if not nil, is
+// called with the notifications of the server, in order. Responses are not
+// read while it runs, so it must not block.
+func DialWebsocket(ctx context.Context, url string, header http.Header,
+	onNotify func(method string, params json.RawMessage)) (*WebsocketClient, error) {
+	conn, err := rpc.DialWebsocket(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	c := &WebsocketClient{
+		conn:     conn,
+		onNotify: onNotify,
+		pending:  make(map[uint64]chan *clientResponse),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// Call calls the method with args, and fills reply with the result.
+func (c *WebsocketClient) Call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	ch := make(chan *clientResponse, 1)
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return c.err
+	}
+	id := c.nextId
+	c.nextId++
+	c.pending[id] = ch
+	c.mutex.Unlock()
+
+	msg, err := json.Marshal(&clientRequest{
+		Version: Version,
+		Method:  method,
+		Params:  args,
+		Id:      id,
+	})
+	if err == nil {
+		err = c.conn.WriteMessage(msg)
+	}
+	if err != nil {
+		c.forget(id)
+		return err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return c.closeErr()
+		}
+		return res.decode(reply)
+	case <-ctx.Done():
+		c.forget(id)
+		return ctx.Err()
+	}
+}
+
+// Notify sends a notification of the method with args to the server.
+func (c *WebsocketClient) Notify(method string, args interface{}) error {
+	return Notify(c.conn, method, args)
+}
+
+// Close closes the connection, failing the pending calls.
+func (c *WebsocketClient) Close() error {
+	return c.conn.Close()
+}
+
+// readLoop dispatches the messages of the connection until it is closed.
+func (c *WebsocketClient) readLoop() {
+	for {
+		data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.conn.Close()
+			c.mutex.Lock()
+			c.err = rpc.ErrWebsocketClosed
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mutex.Unlock()
+			return
+		}
+
+		var msg websocketMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		if msg.Method != "" {
+			if c.onNotify != nil {
+				var params json.RawMessage
+				if msg.Params != nil {
+					params = *msg.Params
+				}
+				c.onNotify(msg.Method, params)
+			}
+			continue
+		}
+		if msg.Id == nil {
+			continue
+		}
+		c.mutex.Lock()
+		ch := c.pending[*msg.Id]
+		delete(c.pending, *msg.Id)
+		c.mutex.Unlock()
+		if ch != nil {
+			ch <- &msg.clientResponse
+		}
+	}
+}
+
+// forget removes a pending call.
+func (c *WebsocketClient) forget(id uint64) {
+	c.mutex.Lock()
+	delete(c.pending, id)
+	c.mutex.Unlock()
+}
+
+// closeErr returns the error closing the connection.
+func (c *WebsocketClient) closeErr() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"math/big"
+)
+
+// algorithm is a signing algorithm of tokens.
+type algorithm struct {
+	family string         // HS, RS, PS or ES
+	hash   crypto.Hash    // hash of the signed part
+	curve  elliptic.Curve // curve of the ES keys
+}
+
+// algorithms are the supported algorithms by name.
+var algorithms = map[string]*algorithm{
+	"HS256": {family: "HS", hash: crypto.SHA256},
+	"HS384": {family: "HS", hash: crypto.SHA384},
+	"HS512": {family: "HS", hash: crypto.SHA512},
+	"RS256": {family: "RS", hash: crypto.SHA256},
+	"RS384": {family: "RS", hash: crypto.SHA384},
+	"RS512": {family: "RS", hash: crypto.SHA512},
+	"PS256": {family: "PS", hash: crypto.SHA256},
+	"PS384": {family: "PS", hash: crypto.SHA384},
+	"PS512": {family: "PS", hash: crypto.SHA512},
+	"ES256": {family: "ES", hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {family: "ES", hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {family: "ES", hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+/*
+verify verifies the signature of signed with the key, which must be of the type of the
+algorithm, so a public key can't be used as an HMAC secret
+*/
+func (alg *algorithm) verify(key interface{}, signed, sig []byte) error {
+	h := alg.hash.New()
+	switch alg.family {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrUnknownKey
+		}
+		mac := hmac.New(alg.hash.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrSignature
+		}
+		return nil
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrUnknownKey
+		}
+		h.Write(signed)
+		var err error
+		if alg.family == "RS" {
+			err = rsa.VerifyPKCS1v15(pub, alg.hash, h.Sum(nil), sig)
+		} else {
+			err = rsa.VerifyPSS(pub, alg.hash, h.Sum(nil), sig, nil)
+		}
+		if err != nil {
+			return ErrSignature
+		}
+		return nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != alg.curve {
+			return ErrUnknownKey
+		}
+		size := (alg.curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrSignature
+		}
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return ErrSignature
+		}
+		return nil
+	}
+	return ErrAlgorithm
+}
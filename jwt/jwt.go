@@ -0,0 +1,428 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package jwt authenticates the callers of an rpc.Server with JSON Web Tokens sent as bearer
+tokens. Tokens signed with HMAC (HS256, HS384, HS512), RSA (RS256, RS384, RS512, PS256, PS384,
+PS512) or ECDSA (ES256, ES384, ES512) are verified with static keys or with the JSON Web Key Set
+of their issuer, and their expiry, issuer and audience are checked:
+
+	server.SetAuthenticator(jwt.NewAuthenticator(jwt.Options{
+		JWKSURL:  "https://issuer.example.com/.well-known/jwks.json",
+		Issuer:   "https://issuer.example.com/",
+		Audience: "api",
+	}))
+	server.RegisterBeforeFunc(jwt.ClaimsHook[Context]())
+
+The principal of a request is a *Principal holding the claims of its token, and its roles for
+the ACLs of methods. The claims are given to services whose context type implements
+ClaimsSetter. Rejected tokens fail the request with status 401 and one of the errors of the
+package.
+*/
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors of rejected tokens.
+var (
+	ErrMissingToken   = errors.New("jwt: missing bearer token")
+	ErrMalformedToken = errors.New("jwt: malformed token")
+	ErrAlgorithm      = errors.New("jwt: algorithm not accepted")
+	ErrUnknownKey     = errors.New("jwt: unknown signing key")
+	ErrSignature      = errors.New("jwt: invalid signature")
+	ErrExpired        = errors.New("jwt: token is expired")
+	ErrNotYetValid    = errors.New("jwt: token is not valid yet")
+	ErrIssuer         = errors.New("jwt: invalid issuer")
+	ErrAudience       = errors.New("jwt: invalid audience")
+)
+
+// Options configures an Authenticator.
+type Options struct {
+	// Keys verifies the tokens by key id, the empty id for tokens without one:
+	// []byte for HMAC, *rsa.PublicKey for RSA and *ecdsa.PublicKey for ECDSA.
+	Keys       map[string]interface{}
+	JWKSURL    string        // url of the key set of the issuer, fetched for the keys not in Keys
+	JWKSTTL    time.Duration // lifetime of the fetched key set, an hour if zero
+	Client     *http.Client  // fetches the key set, http.DefaultClient if nil
+	Algorithms []string      // accepted algorithms, all the supported ones if empty
+	Issuer     string        // required iss claim, unchecked if empty
+	Audience   string        // required in the aud claim, unchecked if empty
+	Leeway     time.Duration // clock skew tolerated when checking exp and nbf
+	RolesClaim string        // claim listing the roles of the caller, "roles" if empty
+	Optional   bool          // requests without token are anonymous rather than rejected
+}
+
+// Claims are the claims of a token.
+type Claims map[string]interface{}
+
+/*
+String returns the claim of the name if it is a string, "" otherwise
+*/
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+/*
+Subject returns the sub claim
+*/
+func (c Claims) Subject() string {
+	return c.String("sub")
+}
+
+/*
+Strings returns the claim of the name as a list, split on spaces if it is a string
+*/
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		ret := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+// Principal is the caller authenticated by a token.
+type Principal struct {
+	Claims Claims
+	Roles  []string
+}
+
+// Name returns the subject of the token.
+func (p *Principal) Name() string {
+	return p.Claims.Subject()
+}
+
+// HasRole reports whether the token grants the role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ClaimsSetter is implemented by context types that want to receive the claims
+// of the token of the request.
+type ClaimsSetter interface {
+	SetClaims(Claims)
+}
+
+/*
+ClaimsHook returns the before func giving the claims of the token to contexts of type C
+implementing ClaimsSetter
+*/
+func ClaimsHook[C any]() rpc.HookFunc[C] {
+	return func(r *http.Request, ctx *C) error {
+		p, ok := rpc.PrincipalFromRequest(r).(*Principal)
+		if !ok {
+			return nil
+		}
+		if setter, ok := interface{}(ctx).(ClaimsSetter); ok {
+			setter.SetClaims(p.Claims)
+		}
+		return nil
+	}
+}
+
+// Authenticator is an rpc.Authenticator verifying the bearer token of requests.
+type Authenticator struct {
+	opts       Options
+	algorithms map[string]bool
+
+	mutex   sync.Mutex             // guards the fetched key set
+	jwks    map[string]interface{} // keys of the fetched key set by id
+	fetched time.Time              // time of the last fetch of the key set
+}
+
+/*
+NewAuthenticator returns an Authenticator verifying tokens with the options
+*/
+func NewAuthenticator(opts Options) *Authenticator {
+	if opts.JWKSTTL <= 0 {
+		opts.JWKSTTL = time.Hour
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.RolesClaim == "" {
+		opts.RolesClaim = "roles"
+	}
+	a := &Authenticator{opts: opts, algorithms: make(map[string]bool)}
+	for alg := range algorithms {
+		a.algorithms[alg] = len(opts.Algorithms) == 0
+	}
+	for _, alg := range opts.Algorithms {
+		if _, ok := algorithms[alg]; ok {
+			a.algorithms[alg] = true
+		}
+	}
+	return a
+}
+
+/*
+Authenticate verifies the bearer token of the request, and returns its Principal
+*/
+func (a *Authenticator) Authenticate(r *http.Request) (rpc.Principal, error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		if a.opts.Optional && r.Header.Get("Authorization") == "" {
+			return nil, nil
+		}
+		return nil, rpc.Unauthenticated(ErrMissingToken)
+	}
+	claims, err := a.Verify(r.Context(), token)
+	if err != nil {
+		return nil, authError(err)
+	}
+	return &Principal{Claims: claims, Roles: claims.Strings(a.opts.RolesClaim)}, nil
+}
+
+// rejections are the errors of the tokens rejected by Verify, unlike the failures to fetch the
+// key set.
+var rejections = []error{
+	ErrMalformedToken, ErrAlgorithm, ErrUnknownKey, ErrSignature, ErrExpired, ErrNotYetValid, ErrIssuer, ErrAudience,
+}
+
+/*
+authError marks the error of a rejected token with rpc.Unauthenticated
+*/
+func authError(err error) error {
+	for _, rejection := range rejections {
+		if errors.Is(err, rejection) {
+			return rpc.Unauthenticated(err)
+		}
+	}
+	return err
+}
+
+/*
+Verify verifies the signature and the claims of the token, and returns its claims
+*/
+func (a *Authenticator) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	alg, ok := algorithms[header.Alg]
+	if !ok || !a.algorithms[header.Alg] {
+		return nil, fmt.Errorf("%w: %q", ErrAlgorithm, header.Alg)
+	}
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if err := alg.verify(key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+/*
+checkClaims checks the time, issuer and audience of the claims
+*/
+func (a *Authenticator) checkClaims(claims Claims) error {
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(unixTime(exp).Add(a.opts.Leeway)) {
+		return ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.opts.Leeway).Before(unixTime(nbf)) {
+		return ErrNotYetValid
+	}
+	if a.opts.Issuer != "" && claims.String("iss") != a.opts.Issuer {
+		return ErrIssuer
+	}
+	if a.opts.Audience != "" {
+		for _, aud := range claims.Strings("aud") {
+			if aud == a.opts.Audience {
+				return nil
+			}
+		}
+		return ErrAudience
+	}
+	return nil
+}
+
+/*
+key returns the key of the id, from Keys or the key set of the issuer
+*/
+func (a *Authenticator) key(ctx context.Context, kid string) (interface{}, error) {
+	if key, ok := a.opts.Keys[kid]; ok {
+		return key, nil
+	}
+	if a.opts.JWKSURL == "" {
+		return nil, ErrUnknownKey
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	key, ok := a.jwks[kid]
+	// Fetch the key set once expired, or for an unknown key as the issuer may have rotated its
+	// keys, at most every minute.
+	if age := time.Since(a.fetched); age > a.opts.JWKSTTL || !ok && age > time.Minute {
+		keys, err := a.fetchJWKS(ctx)
+		if err != nil {
+			if a.jwks == nil {
+				return nil, err
+			}
+		} else {
+			a.jwks = keys
+		}
+		a.fetched = time.Now()
+		key, ok = a.jwks[kid]
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+/*
+fetchJWKS fetches the key set of the issuer, skipping the keys not used for signatures
+*/
+func (a *Authenticator) fetchJWKS(ctx context.Context) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.opts.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.opts.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: fetching key set: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("jwt: fetching key set: %s", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("jwt: decoding key set: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// jwk is a JSON Web Key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+/*
+publicKey returns the key verifying the signatures of the jwk
+*/
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, errN := decodeInt(k.N)
+		e, errE := decodeInt(k.E)
+		if errN != nil || errE != nil || !e.IsInt64() {
+			return nil, ErrMalformedToken
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		x, errX := decodeInt(k.X)
+		y, errY := decodeInt(k.Y)
+		if errX != nil || errY != nil {
+			return nil, ErrMalformedToken
+		}
+		for _, alg := range algorithms {
+			if alg.curve != nil && alg.curve.Params().Name == k.Crv {
+				return &ecdsa.PublicKey{Curve: alg.curve, X: x, Y: y}, nil
+			}
+		}
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("jwt: unsupported key type %q", k.Kty)
+}
+
+/*
+decodeSegment decodes a base64url segment of a token into v
+*/
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+/*
+decodeInt decodes a base64url big-endian integer
+*/
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+/*
+unixTime converts a NumericDate claim to a time
+*/
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package kafka serves the services of an rpc.Server to the requests consumed from a Kafka topic,
+producing the responses to a reply topic, keyed by the correlation id of the requests.
+
+The binding depends on small Reader and Writer interfaces rather than on a Kafka client library.
+The *kafka.Reader and *kafka.Writer of github.com/segmentio/kafka-go are adapted by converting
+their kafka.Message to Message, which has the same fields.
+*/
+package kafka
+
+import (
+	"context"
+	"github.com/antenna3mt/rpc"
+	"net/http"
+)
+
+// Default headers of the messages.
+const (
+	CorrelationHeader = "correlation-id" // correlation id of a request, copied to its response
+	ReplyTopicHeader  = "reply-topic"    // topic of the response of a request, overriding the default one
+)
+
+// Header is a header of a message.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Message is a message consumed or produced.
+type Message struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+}
+
+// header returns the value of the header key of the message.
+func (m *Message) header(key string) (string, bool) {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+// Reader consumes the requests, committing their offsets once served.
+type Reader interface {
+	FetchMessage(ctx context.Context) (Message, error)
+	CommitMessages(ctx context.Context, msgs ...Message) error
+}
+
+// Writer produces the responses.
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...Message) error
+}
+
+// Options configures the binding.
+type Options struct {
+	ReplyTopic  string // topic of the responses, unless set by the ReplyTopicHeader of the request
+	ContentType string // Content-Type of the requests, selecting their codec
+}
+
+/*
+Serve serves the requests fetched from r until ctx is done or r fails, and returns the error.
+
+Requests are served in order. The response of a request is produced with w to its reply topic,
+with the correlation id of the request as key and CorrelationHeader, then the request is
+committed. Requests without reply topic are notifications. The headers of a request are seen by
+hooks.
+*/
+func Serve(ctx context.Context, server *rpc.Server, r Reader, w Writer, opts *Options) error {
+	var replyTopic, contentType string
+	if opts != nil {
+		replyTopic, contentType = opts.ReplyTopic, opts.ContentType
+	}
+
+	for {
+		msg, err := r.FetchMessage(ctx)
+		if err != nil {
+			return err
+		}
+
+		header := make(http.Header, len(msg.Headers)+1)
+		for _, h := range msg.Headers {
+			header.Add(h.Key, string(h.Value))
+		}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		resp, err := server.ServeMessage(ctx, header, msg.Value)
+		if err != nil {
+			resp = []byte(err.Error())
+		}
+
+		topic := replyTopic
+		if t, ok := msg.header(ReplyTopicHeader); ok {
+			topic = t
+		}
+		if topic != "" {
+			correlationId, _ := msg.header(CorrelationHeader)
+			reply := Message{
+				Topic:   topic,
+				Key:     []byte(correlationId),
+				Value:   resp,
+				Headers: []Header{{Key: CorrelationHeader, Value: []byte(correlationId)}},
+			}
+			if err := w.WriteMessages(ctx, reply); err != nil {
+				return err
+			}
+		}
+		if err := r.CommitMessages(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package lambda runs an rpc.Server on AWS Lambda, behind API Gateway or an Application Load
+Balancer, converting their events to requests served by ServeHTTP.
+
+Handler implements the Handler interface of github.com/aws/aws-lambda-go/lambda, so no
+dependency on the AWS libraries is needed:
+
+	lambda.StartHandler(rpclambda.NewHandler(server))
+
+The events are mirrored from github.com/aws/aws-lambda-go/events, with the fields used here.
+*/
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"unicode/utf8"
+)
+
+// APIGatewayProxyRequest is the event of an API Gateway proxy integration.
+type APIGatewayProxyRequest struct {
+	Resource                        string                        `json:"resource"`
+	Path                            string                        `json:"path"`
+	HTTPMethod                      string                        `json:"httpMethod"`
+	Headers                         map[string]string             `json:"headers"`
+	MultiValueHeaders               map[string][]string           `json:"multiValueHeaders"`
+	QueryStringParameters           map[string]string             `json:"queryStringParameters"`
+	MultiValueQueryStringParameters map[string][]string           `json:"multiValueQueryStringParameters"`
+	PathParameters                  map[string]string             `json:"pathParameters"`
+	StageVariables                  map[string]string             `json:"stageVariables"`
+	RequestContext                  APIGatewayProxyRequestContext `json:"requestContext"`
+	Body                            string                        `json:"body"`
+	IsBase64Encoded                 bool                          `json:"isBase64Encoded"`
+}
+
+// APIGatewayProxyRequestContext is the context of an API Gateway proxy request.
+type APIGatewayProxyRequestContext struct {
+	AccountID  string                 `json:"accountId"`
+	RequestID  string                 `json:"requestId"`
+	Stage      string                 `json:"stage"`
+	Identity   APIGatewayIdentity     `json:"identity"`
+	Authorizer map[string]interface{} `json:"authorizer"`
+}
+
+// APIGatewayIdentity is the identity of the caller of an API Gateway proxy request.
+type APIGatewayIdentity struct {
+	SourceIP  string `json:"sourceIp"`
+	UserAgent string `json:"userAgent"`
+}
+
+// APIGatewayProxyResponse is the response of an API Gateway proxy integration.
+type APIGatewayProxyResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// ALBTargetGroupRequest is the event of an Application Load Balancer target group.
+type ALBTargetGroupRequest struct {
+	HTTPMethod                      string                       `json:"httpMethod"`
+	Path                            string                       `json:"path"`
+	QueryStringParameters           map[string]string            `json:"queryStringParameters,omitempty"`
+	MultiValueQueryStringParameters map[string][]string          `json:"multiValueQueryStringParameters,omitempty"`
+	Headers                         map[string]string            `json:"headers,omitempty"`
+	MultiValueHeaders               map[string][]string          `json:"multiValueHeaders,omitempty"`
+	RequestContext                  ALBTargetGroupRequestContext `json:"requestContext"`
+	IsBase64Encoded                 bool                         `json:"isBase64Encoded"`
+	Body                            string                       `json:"body"`
+}
+
+// ALBTargetGroupRequestContext is the context of an Application Load Balancer request.
+type ALBTargetGroupRequestContext struct {
+	ELB struct {
+		TargetGroupArn string `json:"targetGroupArn"`
+	} `json:"elb"`
+}
+
+// ALBTargetGroupResponse is the response to an Application Load Balancer.
+type ALBTargetGroupResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	StatusDescription string              `json:"statusDescription"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// Handler serves the events of API Gateway and Application Load Balancers with an http.Handler,
+// usually an *rpc.Server.
+type Handler struct {
+	handler http.Handler
+}
+
+// NewHandler returns a Handler serving the events with handler.
+func NewHandler(handler http.Handler) *Handler {
+	return &Handler{handler: handler}
+}
+
+/*
+Invoke serves the JSON-encoded event of an API Gateway proxy integration or of an Application
+Load Balancer, and returns the JSON-encoded response
+*/
+func (h *Handler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	var probe struct {
+		RequestContext struct {
+			ELB *json.RawMessage `json:"elb"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, err
+	}
+
+	if probe.RequestContext.ELB != nil {
+		req := new(ALBTargetGroupRequest)
+		if err := json.Unmarshal(payload, req); err != nil {
+			return nil, err
+		}
+		resp, err := h.TargetGroupRequest(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	}
+
+	req := new(APIGatewayProxyRequest)
+	if err := json.Unmarshal(payload, req); err != nil {
+		return nil, err
+	}
+	resp, err := h.ProxyRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+/*
+ProxyRequest serves the request of an API Gateway proxy integration
+*/
+func (h *Handler) ProxyRequest(ctx context.Context, event *APIGatewayProxyRequest) (*APIGatewayProxyResponse, error) {
+	r, err := newRequest(ctx, event.HTTPMethod, event.Path, event.Headers, event.MultiValueHeaders,
+		event.QueryStringParameters, event.MultiValueQueryStringParameters, event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	if event.RequestContext.Identity.SourceIP != "" {
+		r.RemoteAddr = event.RequestContext.Identity.SourceIP
+	}
+
+	rw := h.serve(r)
+	resp := &APIGatewayProxyResponse{StatusCode: rw.status}
+	resp.Body, resp.IsBase64Encoded = rw.body()
+	if event.MultiValueHeaders != nil {
+		resp.MultiValueHeaders = rw.header
+	} else {
+		resp.Headers = singleValues(rw.header)
+	}
+	return resp, nil
+}
+
+/*
+TargetGroupRequest serves the request of an Application Load Balancer. The headers of the response
+are multi-value if those of the request are.
+*/
+func (h *Handler) TargetGroupRequest(ctx context.Context, event *ALBTargetGroupRequest) (*ALBTargetGroupResponse, error) {
+	r, err := newRequest(ctx, event.HTTPMethod, event.Path, event.Headers, event.MultiValueHeaders,
+		event.QueryStringParameters, event.MultiValueQueryStringParameters, event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	rw := h.serve(r)
+	resp := &ALBTargetGroupResponse{
+		StatusCode:        rw.status,
+		StatusDescription: fmt.Sprintf("%d %s", rw.status, http.StatusText(rw.status)),
+	}
+	resp.Body, resp.IsBase64Encoded = rw.body()
+	if event.MultiValueHeaders != nil {
+		resp.MultiValueHeaders = rw.header
+	} else {
+		resp.Headers = singleValues(rw.header)
+	}
+	return resp, nil
+}
+
+/*
+newRequest builds the request of an event, preferring multi-value headers and query parameters
+*/
+func newRequest(ctx context.Context, method, path string, headers map[string]string,
+	multiValueHeaders map[string][]string, query map[string]string, multiValueQuery map[string][]string,
+	body string, isBase64Encoded bool) (*http.Request, error) {
+	data := []byte(body)
+	if isBase64Encoded {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(body); err != nil {
+			return nil, err
+		}
+	}
+
+	u := &url.URL{Path: path}
+	values := make(url.Values)
+	for k, v := range query {
+		values.Set(k, v)
+	}
+	for k, vs := range multiValueQuery {
+		values[k] = vs
+	}
+	u.RawQuery = values.Encode()
+
+	if method == "" {
+		method = "POST"
+	}
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	for k, vs := range multiValueHeaders {
+		r.Header[http.CanonicalHeaderKey(k)] = vs
+	}
+	r.Host = r.Header.Get("Host")
+	return r, nil
+}
+
+/*
+serve serves the request, recording the response
+*/
+func (h *Handler) serve(r *http.Request) *responseWriter {
+	rw := &responseWriter{header: make(http.Header)}
+	h.handler.ServeHTTP(rw, r)
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw
+}
+
+// responseWriter records a response.
+type responseWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.buf.Write(b)
+}
+
+/*
+body returns the body of the response, base64 encoded unless it is valid UTF-8
+*/
+func (rw *responseWriter) body() (string, bool) {
+	if utf8.Valid(rw.buf.Bytes()) {
+		return rw.buf.String(), false
+	}
+	return base64.StdEncoding.EncodeToString(rw.buf.Bytes()), true
+}
+
+/*
+singleValues returns the first value of each header
+*/
+func singleValues(header http.Header) map[string]string {
+	ret := make(map[string]string, len(header))
+	for k := range header {
+		ret[k] = header.Get(k)
+	}
+	return ret
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+/*
+Lazy is the args of a method decoding them only when it needs them, so that calls rejected by the
+method, e.g. for lack of quota, don't pay for decoding large args:
+
+	func (*Service) Upload(ctx *Context, args *rpc.Lazy[UploadArgs], reply *UploadReply) error {
+		if !ctx.Allowed() {
+			return ErrQuota
+		}
+		upload, err := args.Get()
+		...
+	}
+
+The args are decoded by the first call of Get, which must be made before the method returns.
+Cached methods decode them before the call, to compute the cache key.
+*/
+type Lazy[T any] struct {
+	mutex  sync.Mutex
+	decode func(args interface{}) error
+	value  T
+	err    error
+	done   bool
+	closed bool
+}
+
+// lazyArgs is implemented by Lazy args, whatever their type.
+type lazyArgs interface {
+	setDecoder(decode func(args interface{}) error)
+	close()
+}
+
+/*
+Get decodes the args on the first call, and returns them or the error of decoding
+*/
+func (l *Lazy[T]) Get() (*T, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.done {
+		if l.closed {
+			return nil, fmt.Errorf("rpc: call is over, args can't be decoded")
+		}
+		l.done = true
+		if l.decode != nil {
+			l.err = l.decode(&l.value)
+		}
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	return &l.value, nil
+}
+
+/*
+MarshalJSON encodes the decoded args, for cache keys
+*/
+func (l *Lazy[T]) MarshalJSON() ([]byte, error) {
+	value, err := l.Get()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func (l *Lazy[T]) setDecoder(decode func(args interface{}) error) {
+	l.decode = decode
+}
+
+/*
+close prevents decoding once the method returned or timed out, as the request is then over
+*/
+func (l *Lazy[T]) close() {
+	l.mutex.Lock()
+	l.closed = true
+	l.mutex.Unlock()
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrLockedOut is the error of the requests of callers banned for failing authentication too
+// many times. The request fails with status 429.
+var ErrLockedOut = errors.New("rpc: too many authentication failures")
+
+// LockoutState is the record of the authentication failures of a caller.
+type LockoutState struct {
+	Failures    int       // failures since First
+	First       time.Time // time of the first failure of the window
+	BannedUntil time.Time // end of the ban of the caller, zero if not banned
+}
+
+// LockoutStore keeps the authentication failures of the callers, in memory or shared by the
+// servers of a cluster.
+type LockoutStore interface {
+	// Get returns the state of the key, the zero state if it has none.
+	Get(ctx context.Context, key string) (LockoutState, error)
+	// Set stores the state of the key for the duration of ttl.
+	Set(ctx context.Context, key string, state LockoutState, ttl time.Duration) error
+	// Fail atomically counts a failure of the key, in a new window if its window ended, keeps
+	// the state for at least the duration of window, and returns it.
+	Fail(ctx context.Context, key string, window time.Duration) (LockoutState, error)
+	// Delete removes the state of the key.
+	Delete(ctx context.Context, key string) error
+}
+
+// LockoutPolicy throttles and bans the callers repeatedly failing authentication, e.g. guessing
+// credentials.
+type LockoutPolicy struct {
+	Key      RateKeyFunc   // caller of a request, e.g. its API key or address, RateKeyByIP(nil) if nil
+	Window   time.Duration // period the failures are counted in, 15 minutes if zero
+	Delay    time.Duration // delay of the response to the first failure, doubled by each failure, none if zero
+	MaxDelay time.Duration // bound of the delays, 10 seconds if zero
+	BanAfter int           // failures in the window banning the caller, never if zero
+	BanFor   time.Duration // duration of a ban, Window if zero
+	Store    LockoutStore  // failures of the callers, in memory if nil
+
+	// OnFailure is called for every authentication failure, with the failures of the caller in
+	// the window, e.g. to alert on credential stuffing.
+	OnFailure func(key string, failures int, err error)
+	// OnBan is called when a caller is banned.
+	OnBan func(key string, failures int, until time.Time)
+}
+
+/*
+SetLockoutPolicy counts the authentication failures of every caller, delaying the response to
+each failure longer than the previous one, and banning the caller for BanFor once it failed
+BanAfter times in the window: its requests then fail with ErrLockedOut and status 429 without
+being authenticated. Only the errors wrapping ErrUnauthenticated are failures, so that the
+callers are not banned while the Authenticator can't verify credentials. An authenticated request
+resets the count of the caller, while anonymous ones don't. A nil policy disables the lockout.
+*/
+func (s *Server) SetLockoutPolicy(policy *LockoutPolicy) {
+	if policy == nil {
+		s.lockout = nil
+		return
+	}
+	p := *policy
+	if p.Key == nil {
+		p.Key = RateKeyByIP(nil)
+	}
+	if p.Window <= 0 {
+		p.Window = 15 * time.Minute
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 10 * time.Second
+	}
+	if p.BanFor <= 0 {
+		p.BanFor = p.Window
+	}
+	if p.Store == nil {
+		p.Store = NewMemoryLockoutStore()
+	}
+	s.lockout = &p
+}
+
+/*
+authenticate authenticates the request with the authenticator, applying the lockout policy
+*/
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (Principal, error) {
+	p := s.lockout
+	if p == nil {
+		return s.authenticator.Authenticate(r)
+	}
+	key := p.Key(r)
+	if key == "" {
+		return s.authenticator.Authenticate(r)
+	}
+	ctx := r.Context()
+	now := time.Now()
+	state, err := p.Store.Get(ctx, key)
+	if err == nil && now.Before(state.BannedUntil) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(state.BannedUntil.Sub(now).Seconds()))))
+		return nil, ErrLockedOut
+	}
+
+	principal, authErr := s.authenticator.Authenticate(r)
+	if err != nil {
+		return principal, authErr
+	}
+	if authErr == nil {
+		if principal != nil && state.Failures > 0 {
+			p.Store.Delete(ctx, key)
+		}
+		return principal, nil
+	}
+	// Only the rejections of credentials count, not the outages of identity providers.
+	if !errors.Is(authErr, ErrUnauthenticated) {
+		return nil, authErr
+	}
+
+	if state, err = p.Store.Fail(ctx, key, p.Window); err != nil {
+		return nil, authErr
+	}
+	// Concurrent failures may follow the one banning the caller.
+	banned := p.BanAfter > 0 && state.Failures >= p.BanAfter && !now.Before(state.BannedUntil)
+	if banned {
+		state.BannedUntil = now.Add(p.BanFor)
+		p.Store.Set(ctx, key, state, p.BanFor)
+	}
+	if p.OnFailure != nil {
+		p.OnFailure(key, state.Failures, authErr)
+	}
+	if banned && p.OnBan != nil {
+		p.OnBan(key, state.Failures, state.BannedUntil)
+	}
+
+	if p.Delay > 0 {
+		delay := p.MaxDelay
+		if state.Failures < 32 && p.Delay<<(state.Failures-1) < delay {
+			delay = p.Delay << (state.Failures - 1)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	return nil, authErr
+}
+
+/*
+NewMemoryLockoutStore returns a LockoutStore keeping the failures in memory
+*/
+func NewMemoryLockoutStore() LockoutStore {
+	return &memoryLockoutStore{entries: make(map[string]*memoryLockoutEntry)}
+}
+
+// memoryLockoutEntry is a state with its expiry.
+type memoryLockoutEntry struct {
+	state   LockoutState
+	expires time.Time
+}
+
+// memoryLockoutStore keeps the states in a map until they expire.
+type memoryLockoutStore struct {
+	mutex   sync.Mutex
+	entries map[string]*memoryLockoutEntry
+	sweep   time.Time // next removal of the expired states
+}
+
+func (m *memoryLockoutStore) Get(ctx context.Context, key string) (LockoutState, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, ok := m.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return LockoutState{}, nil
+	}
+	return e.state, nil
+}
+
+func (m *memoryLockoutStore) Set(ctx context.Context, key string, state LockoutState, ttl time.Duration) error {
+	now := time.Now()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeExpired(now)
+	m.entries[key] = &memoryLockoutEntry{state: state, expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *memoryLockoutStore) Fail(ctx context.Context, key string, window time.Duration) (LockoutState, error) {
+	now := time.Now()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeExpired(now)
+	e, ok := m.entries[key]
+	if !ok || now.After(e.expires) {
+		e = &memoryLockoutEntry{state: LockoutState{First: now}}
+		m.entries[key] = e
+	} else if now.Sub(e.state.First) > window {
+		e.state = LockoutState{First: now, BannedUntil: e.state.BannedUntil}
+	}
+	e.state.Failures++
+	if expires := now.Add(window); expires.After(e.expires) {
+		e.expires = expires
+	}
+	return e.state, nil
+}
+
+/*
+removeExpired removes the expired states, at most once a minute. The mutex is held.
+*/
+func (m *memoryLockoutStore) removeExpired(now time.Time) {
+	if now.Before(m.sweep) {
+		return
+	}
+	for k, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.sweep = now.Add(time.Minute)
+}
+
+func (m *memoryLockoutStore) Delete(ctx context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.entries, key)
+	return nil
+}
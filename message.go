@@ -0,0 +1,56 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+/*
+ServeMessage serves an encoded request received by a message transport, e.g. a broker binding, and
+returns the encoded response, empty for notifications. header carries the Content-Type selecting
+the codec, and the headers seen by hooks. The request goes through the same codecs, hooks and
+services as ServeHTTP. A response with a non-2xx status is returned as an *HTTPError.
+*/
+func (s *Server) ServeMessage(ctx context.Context, header http.Header, body []byte) ([]byte, error) {
+	resp := s.serveMessage(ctx, header, body)
+	if resp.status < 200 || resp.status > 299 {
+		return nil, &HTTPError{StatusCode: resp.status, Message: resp.buf.String()}
+	}
+	return resp.buf.Bytes(), nil
+}
+
+// messageKey marks the context of the requests served by serveMessage.
+type messageKey struct{}
+
+/*
+fromMessage reports whether the request was received by a transport other than plain HTTP, whose
+panics net/http doesn't recover
+*/
+func fromMessage(r *http.Request) bool {
+	return r.Context().Value(messageKey{}) != nil
+}
+
+/*
+serveMessage serves an encoded request received by a transport other than plain HTTP, going
+through the same codecs, hooks and services as ServeHTTP. header carries the Content-Type of the
+request and the headers seen by hooks. The returned response is empty for notifications.
+*/
+func (s *Server) serveMessage(ctx context.Context, header http.Header, body []byte) *bufferWriter {
+	bw := newBufferWriter()
+	ctx = context.WithValue(ctx, messageKey{}, true)
+	r, err := http.NewRequestWithContext(ctx, "POST", "/", bytes.NewReader(body))
+	if err != nil {
+		WriteError(bw, 400, err.Error())
+		return bw
+	}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	s.ServeHTTP(bw, r)
+	return bw
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+)
+
+// Metadata carries opaque per-request values, e.g. tracing or tenant
+// headers, separately from the typed context. Keys are canonical header keys.
+type Metadata map[string]string
+
+// Get returns the value of key, or "" if it is not set.
+func (md Metadata) Get(key string) string {
+	return md[http.CanonicalHeaderKey(key)]
+}
+
+// Set sets the value of key.
+func (md Metadata) Set(key, value string) {
+	md[http.CanonicalHeaderKey(key)] = value
+}
+
+// MetadataSetter is implemented by context types that want to receive the
+// request metadata before hooks and service call are executed.
+type MetadataSetter interface {
+	SetMetadata(Metadata)
+}
+
+type metadataKey struct{}
+
+/*
+MetadataFromRequest returns the metadata attached to the request by the server, used by hooks
+*/
+func MetadataFromRequest(r *http.Request) Metadata {
+	md, _ := r.Context().Value(metadataKey{}).(Metadata)
+	return md
+}
+
+/*
+newMetadata collects the values of headers from the request
+*/
+func newMetadata(r *http.Request, headers []string) Metadata {
+	md := make(Metadata, len(headers))
+	for _, h := range headers {
+		if v := r.Header.Get(h); v != "" {
+			md.Set(h, v)
+		}
+	}
+	return md
+}
+
+/*
+withMetadata returns a shallow copy of r carrying md in its context
+*/
+func withMetadata(r *http.Request, md Metadata) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), metadataKey{}, md))
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+)
+
+// Handler calls a method with a pointer to its args, and returns a pointer to its reply.
+type Handler func(ctx context.Context, args interface{}) (reply interface{}, err error)
+
+// Middleware wraps the calls of a method of a Server, e.g. with the middleware of another
+// framework. It calls next to continue the call.
+type Middleware func(next Handler) Handler
+
+/*
+SetMiddleware wraps the calls of a registered method with the middleware, composed in order: the
+first one is the outermost. They run once the call is authorized and its args decoded, in place
+of the method. Args and replies replaced by a middleware are copied if their types match the ones
+of the method, converted through JSON otherwise, and the ctx given to next is given to the method
+if the context type implements ContextSetter. No middleware removes them.
+*/
+func (s *Server) SetMiddleware(method string, middleware ...Middleware) error {
+	return s.services.updateMethod(method, func(sm *serviceMethod) {
+		sm.middleware = middleware
+	})
+}
+
+/*
+invoke calls the method with the ctx, args and reply pointers through its middleware
+*/
+func (sm *serviceMethod) invoke(c context.Context, ctx, args, reply reflect.Value) error {
+	if len(sm.middleware) == 0 {
+		return sm.call(ctx, args, reply)
+	}
+	h := Handler(func(c context.Context, a interface{}) (interface{}, error) {
+		if a != args.Interface() {
+			if err := assign(args.Interface(), a); err != nil {
+				return nil, err
+			}
+		}
+		if setter, ok := ctx.Interface().(ContextSetter); ok {
+			setter.SetContext(c)
+		}
+		if err := sm.call(ctx, args, reply); err != nil {
+			return nil, err
+		}
+		return reply.Interface(), nil
+	})
+	for i := len(sm.middleware) - 1; i >= 0; i-- {
+		h = sm.middleware[i](h)
+	}
+	out, err := h(c, args.Interface())
+	if err != nil {
+		return err
+	}
+	if out != reply.Interface() {
+		return assign(reply.Interface(), out)
+	}
+	return nil
+}
+
+/*
+Invoke calls the registered method in process with args, and returns a pointer to a new reply, as
+a client returned by NewInprocClient without codec does. The headers set on ctx by WithCallHeader
+are the headers of the request, e.g. its credentials.
+*/
+func (s *Server) Invoke(ctx context.Context, method string, args interface{}) (interface{}, error) {
+	methodSpec, err := s.services.get(method)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", "/", http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	if header, ok := ctx.Value(callHeaderKey{}).(http.Header); ok {
+		r.Header = header.Clone()
+	}
+	req := &inprocRequest{method: method, args: args, reply: reflect.New(methodSpec.replyType).Interface()}
+	s.serveRequest(newBufferWriter(), r, req, nil)
+	if req.err != nil {
+		return nil, req.err
+	}
+	return req.reply, nil
+}
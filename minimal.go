@@ -0,0 +1,140 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+)
+
+/*
+SetMinimal serves requests with a minimal path, for deployments needing raw throughput: calls
+are decoded, dispatched and encoded, skipping every optional feature rather than checking for
+each one. Hooks, timeouts, request decompression, stats, tracing, logging, method counters,
+auditing, caching, idempotency, webhooks, worker pools, arenas, introspection and subscriptions
+are ignored. Methods requiring roles fail with ErrForbidden, and methods with streams can't be
+called, nor methods the ACL table requires roles for. Batches, Lazy args, pooling and the error
+translator still apply.
+
+Panics are not recovered from calls over HTTP, net/http recovering the panics of handlers, but
+are for the calls received by other transports, e.g. ServeConn, WebSockets and brokers, which
+fail with ErrInternal.
+
+Security is never skipped: while an Authenticator, a signature, rate, tenant or lockout policy is
+set, requests are served with the full path.
+*/
+func (s *Server) SetMinimal(enabled bool) {
+	s.minimal = enabled
+}
+
+/*
+secured reports whether a security feature the minimal path doesn't apply is set
+*/
+func (s *Server) secured() bool {
+	return s.authenticator != nil || s.signatures != nil || s.rateLimits != nil ||
+		s.tenants != nil || s.lockout != nil
+}
+
+/*
+serveMinimal serves the request with the minimal path
+*/
+func (s *Server) serveMinimal(w http.ResponseWriter, r *http.Request) {
+	codec, err := s.codecFor(r)
+	if err != nil {
+		writeContentTypeError(w, r)
+		return
+	}
+	recovering := fromMessage(r)
+	codecReq := codec.NewRequest(r)
+	if batchReq, ok := codecReq.(BatchCodecRequest); ok {
+		if reqs, isBatch := batchReq.Batch(); isBatch {
+			if err := s.checkBatch(len(reqs)); err != nil {
+				codecReq.WriteError(w, 400, err)
+				return
+			}
+			responses := make([][]byte, 0, len(reqs))
+			for _, req := range reqs {
+				bw := newBufferWriter()
+				s.serveMinimalRequest(bw, req, recovering)
+				if bw.buf.Len() > 0 {
+					responses = append(responses, bw.buf.Bytes())
+				}
+			}
+			w.Header().Set("x-content-type-options", "nosniff")
+			batchReq.WriteBatch(w, responses)
+			return
+		}
+	}
+	s.serveMinimalRequest(w, codecReq, recovering)
+}
+
+/*
+serveMinimalRequest serves a single call with the minimal path, recovering its panics if
+recovering is set
+*/
+func (s *Server) serveMinimalRequest(w http.ResponseWriter, codecReq CodecRequest, recovering bool) {
+	method, err := codecReq.Method()
+	if err != nil {
+		codecReq.WriteError(w, 400, err)
+		return
+	}
+	methodSpec, err := s.services.get(method)
+	if err != nil {
+		codecReq.WriteError(w, 400, err)
+		return
+	}
+	if err := authorize(nil, methodSpec.roles); err != nil {
+		codecReq.WriteError(w, 403, err)
+		return
+	}
+	if s.aclTable != nil {
+		if err := s.aclTable.authorize(nil, method); err != nil {
+			codecReq.WriteError(w, 403, err)
+			return
+		}
+	}
+	if methodSpec.takesStreams() {
+		codecReq.WriteError(w, 400, fmt.Errorf("rpc: %s takes streams, not served by the minimal server", method))
+		return
+	}
+
+	ctx := s.contexts.get(s.pooling)
+	args := methodSpec.args.get(s.pooling)
+	reply := methodSpec.reply.get(s.pooling)
+	reusable := true
+	defer func() {
+		s.contexts.put(ctx, s.pooling && reusable)
+		methodSpec.args.put(args, s.pooling && reusable)
+		methodSpec.reply.put(reply, s.pooling && reusable)
+	}()
+
+	if lazy, ok := args.Interface().(lazyArgs); ok {
+		lazy.setDecoder(codecReq.ReadRequest)
+		defer lazy.close()
+	} else if err := codecReq.ReadRequest(args.Interface()); err != nil {
+		codecReq.WriteError(w, 400, err)
+		return
+	}
+	if !recovering {
+		err = methodSpec.call(ctx, args, reply)
+	} else {
+		err = func() (err error) {
+			defer recoverCall(&err)
+			return methodSpec.call(ctx, args, reply)
+		}()
+	}
+	if _, panicked := err.(*PanicError); panicked {
+		// The method may have left the values inconsistent.
+		reusable = false
+		codecReq.WriteError(w, 500, ErrInternal)
+		return
+	}
+	if err != nil {
+		codecReq.WriteError(w, 400, s.translateError(method, err))
+		return
+	}
+	w.Header().Set("x-content-type-options", "nosniff")
+	codecReq.WriteResponse(w, reply.Interface())
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package mqtt serves the services of an rpc.Server to devices over MQTT.
+
+Devices publish the CBOR-encoded args of a call to the topic "rpc/[service]/[method]", and
+receive the CBOR-encoded response, as written by the cbor codec, on their reply topic: the
+response topic of the message with MQTT 5, or "rpc-reply/[device]" for devices publishing to
+"rpc/[service]/[method]/[device]". Messages without a reply topic are notifications.
+The server must have the codec of package cbor registered for cbor.ContentType.
+
+The binding depends on a small Client interface rather than on an MQTT client library. A
+paho.Client of github.com/eclipse/paho.golang is adapted with:
+
+	type pahoClient struct{ *paho.Client }
+
+	func (c pahoClient) Subscribe(filter string, qos byte, handler func(*mqtt.Message)) (func() error, error) {
+		c.Client.AddOnPublishReceived(func(pr paho.PublishReceived) (bool, error) {
+			p := pr.Packet
+			msg := &mqtt.Message{Topic: p.Topic, QoS: p.QoS, Payload: p.Payload}
+			if p.Properties != nil {
+				msg.ResponseTopic = p.Properties.ResponseTopic
+				msg.CorrelationData = p.Properties.CorrelationData
+			}
+			handler(msg)
+			return true, nil
+		})
+		_, err := c.Client.Subscribe(context.Background(), &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: qos}},
+		})
+		return func() error {
+			_, err := c.Client.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: []string{filter}})
+			return err
+		}, err
+	}
+
+	func (c pahoClient) Publish(msg *mqtt.Message) error {
+		_, err := c.Client.Publish(context.Background(), &paho.Publish{
+			Topic: msg.Topic, QoS: msg.QoS, Payload: msg.Payload,
+			Properties: &paho.PublishProperties{CorrelationData: msg.CorrelationData},
+		})
+		return err
+	}
+*/
+package mqtt
+
+import (
+	"context"
+	"github.com/antenna3mt/rpc"
+	"github.com/antenna3mt/rpc/cbor"
+	"net/http"
+	"strings"
+)
+
+// Message is an MQTT message.
+type Message struct {
+	Topic           string
+	QoS             byte
+	Payload         []byte
+	ResponseTopic   string            // MQTT 5 response topic
+	CorrelationData []byte            // MQTT 5 correlation data, copied to the response
+	Properties      map[string]string // MQTT 5 user properties, seen by hooks as headers
+}
+
+// Client is the part of an MQTT client used by the binding.
+type Client interface {
+	// Subscribe calls handler with the messages of the topics matching filter.
+	Subscribe(filter string, qos byte, handler func(*Message)) (unsubscribe func() error, err error)
+	// Publish publishes the message.
+	Publish(msg *Message) error
+}
+
+// Options configures the binding.
+type Options struct {
+	Prefix      string // prefix of the request topics, "rpc/" if empty
+	ReplyPrefix string // prefix of the reply topics of devices, "rpc-reply/" if empty
+	QoS         byte   // QoS of the subscription and the responses
+}
+
+/*
+Serve subscribes to the request topics, and serves each request received concurrently, going
+through the hooks of server like HTTP requests do. The returned func unsubscribes.
+*/
+func Serve(server *rpc.Server, client Client, opts *Options) (stop func() error, err error) {
+	b := &binding{server: server, client: client, prefix: "rpc/", replyPrefix: "rpc-reply/"}
+	if opts != nil {
+		if opts.Prefix != "" {
+			b.prefix = opts.Prefix
+		}
+		if opts.ReplyPrefix != "" {
+			b.replyPrefix = opts.ReplyPrefix
+		}
+		b.qos = opts.QoS
+	}
+
+	// "#" also matches the parent level, so topics without a device match.
+	return client.Subscribe(b.prefix+"+/+/#", b.qos, func(msg *Message) {
+		go b.serve(msg)
+	})
+}
+
+// binding serves the requests received by an MQTT client.
+type binding struct {
+	server      *rpc.Server
+	client      Client
+	prefix      string
+	replyPrefix string
+	qos         byte
+}
+
+/*
+serve serves the request of a message, and publishes the response to the reply topic
+*/
+func (b *binding) serve(msg *Message) {
+	levels := strings.Split(strings.TrimPrefix(msg.Topic, b.prefix), "/")
+	if len(levels) < 2 || len(levels) > 3 {
+		return
+	}
+	replyTopic := msg.ResponseTopic
+	if replyTopic == "" && len(levels) == 3 && levels[2] != "" {
+		replyTopic = b.replyPrefix + levels[2]
+	}
+
+	header := make(http.Header)
+	for k, v := range msg.Properties {
+		header.Set(k, v)
+	}
+	header.Set("Content-Type", cbor.ContentType)
+	header.Set(cbor.MethodHeader, levels[0]+"."+levels[1])
+
+	resp, err := b.server.ServeMessage(context.Background(), header, msg.Payload)
+	if err != nil {
+		resp = errorResponse(err)
+	}
+	if replyTopic == "" {
+		return
+	}
+	b.client.Publish(&Message{
+		Topic:           replyTopic,
+		QoS:             b.qos,
+		Payload:         resp,
+		CorrelationData: msg.CorrelationData,
+	})
+}
+
+/*
+errorResponse encodes an error rejecting the request before it reached the codec, with the HTTP
+status as its code, as the cbor codec encodes errors
+*/
+func errorResponse(err error) []byte {
+	type errorObject struct {
+		Code    int    `cbor:"code"`
+		Message string `cbor:"message"`
+	}
+	e := errorObject{Message: err.Error()}
+	if httpErr, ok := err.(*rpc.HTTPError); ok {
+		e.Code = httpErr.StatusCode
+		e.Message = httpErr.Message
+	}
+	resp, _ := cbor.Marshal(map[string]interface{}{"error": e})
+	return resp
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+)
+
+// ErrNoClientCertificate is returned by the CertAuthenticator for requests without a verified
+// client certificate.
+var ErrNoClientCertificate = errors.New("rpc: no verified client certificate")
+
+// CertPrincipal is the workload identity of a verified client certificate. Its identities are
+// not roles: the roles required by ACLs are granted to them by CertAuthenticator.Roles.
+type CertPrincipal struct {
+	Certificate *x509.Certificate // leaf certificate of the client
+	CommonName  string            // CN of the subject
+	DNSNames    []string          // DNS SANs
+	SPIFFEID    string            // spiffe:// URI SAN, empty if none
+	Roles       []string          // roles granted by the CertAuthenticator
+}
+
+/*
+Name returns the SPIFFE ID of the certificate, or its common name if it has none
+*/
+func (p *CertPrincipal) Name() string {
+	if p.SPIFFEID != "" {
+		return p.SPIFFEID
+	}
+	return p.CommonName
+}
+
+/*
+HasRole reports whether the role is granted to the certificate. Its SPIFFE ID, common name and DNS
+names are not roles, as anyone able to get a certificate may choose them.
+*/
+func (p *CertPrincipal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if role == r {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+NewCertPrincipal returns the identity of a client certificate
+*/
+func NewCertPrincipal(cert *x509.Certificate) *CertPrincipal {
+	p := &CertPrincipal{
+		Certificate: cert,
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			p.SPIFFEID = uri.String()
+			break
+		}
+	}
+	return p
+}
+
+// CertAuthenticator authenticates the requests served over mutual TLS by their verified client
+// certificate.
+type CertAuthenticator struct {
+	// Roles returns the roles granted to a certificate, e.g. by its SPIFFE trust domain, or by
+	// an explicit mapping of its SPIFFE ID, common name or DNS names. Nil grants none.
+	Roles func(*CertPrincipal) []string
+	// Optional lets requests without certificate through as anonymous rather than rejected.
+	Optional bool
+}
+
+/*
+Authenticate returns the CertPrincipal of the leaf certificate verified by the TLS handshake.
+
+Certificates are only verified if the tls.Config of the server sets ClientAuth to
+tls.VerifyClientCertIfGiven or tls.RequireAndVerifyClientCert, unverified ones are ignored.
+*/
+func (a *CertAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		if a.Optional {
+			return nil, nil
+		}
+		return nil, Unauthenticated(ErrNoClientCertificate)
+	}
+	p := NewCertPrincipal(r.TLS.VerifiedChains[0][0])
+	if a.Roles != nil {
+		p.Roles = a.Roles(p)
+	}
+	return p, nil
+}
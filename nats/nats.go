@@ -0,0 +1,126 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package nats serves the services of an rpc.Server over NATS, with a subject per service.
+
+The binding depends on a small Conn interface rather than on a NATS client library. A
+*nats.Conn of github.com/nats-io/nats.go is adapted with:
+
+	type natsConn struct{ *nats.Conn }
+
+	func (c natsConn) QueueSubscribe(subject, queue string, handler func(*rpcnats.Msg)) (func() error, error) {
+		sub, err := c.Conn.QueueSubscribe(subject, queue, func(m *nats.Msg) {
+			handler(&rpcnats.Msg{Subject: m.Subject, Reply: m.Reply, Header: m.Header, Data: m.Data})
+		})
+		if err != nil {
+			return nil, err
+		}
+		return sub.Unsubscribe, nil
+	}
+
+	func (c natsConn) Publish(subject string, data []byte) error {
+		return c.Conn.Publish(subject, data)
+	}
+*/
+package nats
+
+import (
+	"context"
+	"github.com/antenna3mt/rpc"
+	"net/http"
+	"sort"
+)
+
+// Msg is a message received from NATS.
+type Msg struct {
+	Subject string
+	Reply   string              // subject the response is published to, empty for notifications
+	Header  map[string][]string // headers of the message, seen by hooks
+	Data    []byte              // encoded request
+}
+
+// Conn is the part of a NATS connection used by the binding.
+type Conn interface {
+	// QueueSubscribe calls handler with the messages of the subject, load
+	// balanced among the subscribers of the queue group.
+	QueueSubscribe(subject, queue string, handler func(*Msg)) (unsubscribe func() error, err error)
+	// Publish publishes data to the subject.
+	Publish(subject string, data []byte) error
+}
+
+// Options configures the binding.
+type Options struct {
+	Prefix      string // prefix of the subjects, "rpc." if empty
+	Queue       string // queue group of the subscriptions, "rpc" if empty
+	ContentType string // Content-Type of the messages, selecting their codec
+}
+
+/*
+Serve subscribes to the subject "[Prefix][Service]" of every service registered to server, and
+serves the requests received, publishing the responses to the reply subject of the messages.
+Services registered later are not served. The returned func unsubscribes.
+*/
+func Serve(server *rpc.Server, conn Conn, opts *Options) (stop func() error, err error) {
+	prefix, queue := "rpc.", "rpc"
+	var contentType string
+	if opts != nil {
+		if opts.Prefix != "" {
+			prefix = opts.Prefix
+		}
+		if opts.Queue != "" {
+			queue = opts.Queue
+		}
+		contentType = opts.ContentType
+	}
+
+	services := make([]string, 0)
+	for service := range server.ServiceMap() {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	var unsubscribes []func() error
+	stop = func() error {
+		var firstErr error
+		for _, unsubscribe := range unsubscribes {
+			if err := unsubscribe(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	for _, service := range services {
+		unsubscribe, err := conn.QueueSubscribe(prefix+service, queue, func(msg *Msg) {
+			go serveMsg(server, conn, contentType, msg)
+		})
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		unsubscribes = append(unsubscribes, unsubscribe)
+	}
+	return stop, nil
+}
+
+/*
+serveMsg serves the request of a message, and publishes the response to its reply subject
+*/
+func serveMsg(server *rpc.Server, conn Conn, contentType string, msg *Msg) {
+	header := http.Header(msg.Header).Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	resp, err := server.ServeMessage(context.Background(), header, msg.Data)
+	if err != nil {
+		resp = []byte(err.Error())
+	}
+	if msg.Reply != "" {
+		conn.Publish(msg.Reply, resp)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	netrpc "net/rpc"
+	"reflect"
+	"sync"
+)
+
+/*
+ServeNetRPCCodec serves the calls read from the net/rpc codec until it fails or is closed, and
+closes it, e.g. with the codec of net/rpc/jsonrpc on the connections of a net/rpc listener, so
+legacy net/rpc clients call the services of the server.
+
+The args of every call are read before it is served by the services, hooks, authenticator and
+policies of the server, concurrently with the next calls as net/rpc does. The requests carry no
+HTTP headers, so authenticators reading them reject these calls unless they are optional.
+*/
+func (s *Server) ServeNetRPCCodec(codec netrpc.ServerCodec) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sending := new(sync.Mutex)
+	var wg sync.WaitGroup
+	for {
+		var header netrpc.Request
+		if err := codec.ReadRequestHeader(&header); err != nil {
+			break
+		}
+		cr := &netRPCRequest{codec: codec, sending: sending, method: header.ServiceMethod, seq: header.Seq}
+		spec, err := s.services.get(header.ServiceMethod)
+		if err != nil {
+			codec.ReadRequestBody(nil)
+			cr.WriteError(nil, 400, err)
+			continue
+		}
+		args := reflect.New(spec.argsType)
+		if err := codec.ReadRequestBody(args.Interface()); err != nil {
+			cr.WriteError(nil, 400, err)
+			continue
+		}
+		cr.args = args
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveNetRPCCall(ctx, cr)
+		}()
+	}
+	wg.Wait()
+	codec.Close()
+}
+
+/*
+serveNetRPCCall serves a call read from a net/rpc codec
+*/
+func (s *Server) serveNetRPCCall(ctx context.Context, cr *netRPCRequest) {
+	r, err := http.NewRequestWithContext(ctx, "POST", "/", http.NoBody)
+	if err != nil {
+		cr.WriteError(nil, 400, err)
+		return
+	}
+	s.serveRequest(newBufferWriter(), r, cr, nil)
+	if !cr.written {
+		cr.WriteError(nil, 500, fmt.Errorf("rpc: %s wrote no response", cr.method))
+	}
+}
+
+// netRPCRequest is the CodecRequest of a call read from a net/rpc codec, whose args are already
+// read.
+type netRPCRequest struct {
+	codec   netrpc.ServerCodec
+	sending *sync.Mutex // serializes the responses of the codec
+	method  string
+	seq     uint64
+	args    reflect.Value // pointer to the args
+	written bool
+}
+
+func (cr *netRPCRequest) Method() (string, error) {
+	return cr.method, nil
+}
+
+func (cr *netRPCRequest) ReadRequest(args interface{}) error {
+	dst := reflect.ValueOf(args)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() || !cr.args.Elem().Type().AssignableTo(dst.Elem().Type()) {
+		return fmt.Errorf("rpc: args of %s are not %T", cr.method, args)
+	}
+	dst.Elem().Set(cr.args.Elem())
+	return nil
+}
+
+func (cr *netRPCRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	cr.write(&netrpc.Response{ServiceMethod: cr.method, Seq: cr.seq}, reply)
+}
+
+func (cr *netRPCRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	msg := err.Error()
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	cr.write(&netrpc.Response{ServiceMethod: cr.method, Seq: cr.seq, Error: msg}, struct{}{})
+}
+
+/*
+write writes the response with the codec
+*/
+func (cr *netRPCRequest) write(resp *netrpc.Response, body interface{}) {
+	cr.sending.Lock()
+	defer cr.sending.Unlock()
+	cr.written = true
+	cr.codec.WriteResponse(resp, body)
+}
+
+/*
+RegisterNetRPCService adds a service whose methods have the signature of net/rpc, e.g. the
+receiver already registered on a net/rpc server, so its methods are also served by this server
+without a context:
+
+	func (t *T) MethodName(args T1, reply *T2) error
+
+The args may be a pointer or a value. The name parameter is optional: if empty it will be
+inferred from the receiver type name. Methods are added to the service if it is already
+registered.
+*/
+func (s *Server) RegisterNetRPCService(receiver interface{}, name string) error {
+	if receiver == nil {
+		return errors.New("rpc: nil rcvr is not allowed")
+	}
+	rValue := reflect.ValueOf(receiver)
+	if name == "" {
+		name = reflect.Indirect(rValue).Type().Name()
+	}
+	if name == "" {
+		return fmt.Errorf("rpc: no service name for type %q", rValue.String())
+	}
+
+	methods := make(map[string]*serviceMethod)
+	var names []string
+	for i := 0; i < rValue.Type().NumMethod(); i++ {
+		m := rValue.Type().Method(i)
+		if m.PkgPath != "" || m.Type.NumIn() != 3 || m.Type.NumOut() != 1 {
+			continue
+		}
+		args, reply := m.Type.In(1), m.Type.In(2)
+		if reply.Kind() != reflect.Ptr || m.Type.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+			continue
+		}
+		argsPtr := args.Kind() == reflect.Ptr
+		if argsPtr {
+			args = args.Elem()
+		}
+		fn := rValue.Method(i)
+		methods[m.Name] = &serviceMethod{
+			argsType:  args,
+			replyType: reply.Elem(),
+			args:      newAllocator(args, nil),
+			reply:     newAllocator(reply.Elem(), nil),
+			call: func(ctx, args, reply reflect.Value) error {
+				if !argsPtr {
+					args = args.Elem()
+				}
+				out := fn.Call([]reflect.Value{args, reply})
+				if out[0].IsNil() {
+					return nil
+				}
+				return out[0].Interface().(error)
+			},
+			counters: new(callCounters),
+		}
+		names = append(names, m.Name)
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("rpc: %q has no exported methods of suitable type", name)
+	}
+
+	for _, methodName := range names {
+		if _, err := s.services.addMethod(name, methodName, methods[methodName]); err != nil {
+			return err
+		}
+	}
+	s.events.publish(&Event{
+		Type:    EventServiceRegistered,
+		Service: name,
+		Methods: names,
+	})
+	return nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// NotifyClientCodec is implemented by client codecs supporting notifications,
+// requests the server doesn't respond to.
+type NotifyClientCodec interface {
+	ClientCodec
+	// Encodes the notification of the RPC method with args.
+	EncodeNotification(method string, args interface{}) ([]byte, error)
+}
+
+/*
+Notify sends a notification of the RPC method with args, without waiting for a result.
+
+It returns once the server accepts the request, the errors of the method are not reported.
+The codec of the client must implement NotifyClientCodec.
+*/
+func (c *Client) Notify(ctx context.Context, method string, args interface{}) error {
+	codec, ok := c.codec.(NotifyClientCodec)
+	if !ok {
+		return fmt.Errorf("rpc: codec does not support notifications")
+	}
+	body, err := codec.EncodeNotification(method, args)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, c.retryPolicy.idempotent(method), body, func(r io.Reader) error {
+		// Drain the body so the connection can be reused.
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package oauth2 authenticates the callers of an rpc.Server with opaque OAuth2 bearer tokens,
+validated by the introspection endpoint of their authorization server (RFC 7662):
+
+	server.SetAuthenticator(oauth2.NewAuthenticator(oauth2.Options{
+		URL:          "https://auth.example.com/oauth2/introspect",
+		ClientID:     "api",
+		ClientSecret: secret,
+	}))
+	server.RegisterBeforeFunc(oauth2.TokenHook[Context]())
+
+The results of the endpoint are cached, so a token is introspected once per CacheTTL rather than
+once per call. The principal of a request is a *Principal holding the introspection of its
+token, whose scopes are its roles for the ACLs of methods. The introspection is given to
+services whose context type implements TokenSetter. Rejected tokens fail the request with status
+401 and one of the errors of the package.
+*/
+package oauth2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors of rejected tokens.
+var (
+	ErrMissingToken  = errors.New("oauth2: missing bearer token")
+	ErrInactiveToken = errors.New("oauth2: token is not active")
+	ErrAudience      = errors.New("oauth2: invalid audience")
+	ErrScope         = errors.New("oauth2: missing required scope")
+)
+
+// Options configures an Authenticator.
+type Options struct {
+	URL          string        // introspection endpoint
+	ClientID     string        // id of the server authenticating to the endpoint, none if empty
+	ClientSecret string        // secret of the server authenticating to the endpoint
+	Client       *http.Client  // calls the endpoint, http.DefaultClient if nil
+	CacheTTL     time.Duration // lifetime of the cached results, bounded by the expiry of tokens, a minute if zero
+	Audience     string        // required in the aud of tokens, unchecked if empty
+	Scopes       []string      // scopes required of every token
+	Optional     bool          // requests without token are anonymous rather than rejected
+}
+
+// Introspection is the response of the introspection endpoint for a token.
+type Introspection struct {
+	Active    bool            `json:"active"`
+	Scope     string          `json:"scope,omitempty"`
+	ClientID  string          `json:"client_id,omitempty"`
+	Username  string          `json:"username,omitempty"`
+	Subject   string          `json:"sub,omitempty"`
+	Audience  json.RawMessage `json:"aud,omitempty"` // string or list of strings
+	Issuer    string          `json:"iss,omitempty"`
+	TokenType string          `json:"token_type,omitempty"`
+	Expiry    int64           `json:"exp,omitempty"`
+	IssuedAt  int64           `json:"iat,omitempty"`
+}
+
+/*
+Scopes returns the scopes granted to the token
+*/
+func (i *Introspection) Scopes() []string {
+	return strings.Fields(i.Scope)
+}
+
+/*
+Audiences returns the audiences of the token
+*/
+func (i *Introspection) Audiences() []string {
+	var list []string
+	if json.Unmarshal(i.Audience, &list) == nil {
+		return list
+	}
+	var aud string
+	if json.Unmarshal(i.Audience, &aud) == nil && aud != "" {
+		return []string{aud}
+	}
+	return nil
+}
+
+// Principal is the caller authenticated by a token.
+type Principal struct {
+	Token  *Introspection
+	scopes []string
+}
+
+// Name returns the subject of the token, or its username or client id if it has none.
+func (p *Principal) Name() string {
+	switch {
+	case p.Token.Subject != "":
+		return p.Token.Subject
+	case p.Token.Username != "":
+		return p.Token.Username
+	}
+	return p.Token.ClientID
+}
+
+// HasRole reports whether the token grants the scope.
+func (p *Principal) HasRole(scope string) bool {
+	for _, s := range p.scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenSetter is implemented by context types that want to receive the introspection of the
+// token of the request.
+type TokenSetter interface {
+	SetToken(*Introspection)
+}
+
+/*
+TokenHook returns the before func giving the introspection of the token to contexts of type C
+implementing TokenSetter
+*/
+func TokenHook[C any]() rpc.HookFunc[C] {
+	return func(r *http.Request, ctx *C) error {
+		p, ok := rpc.PrincipalFromRequest(r).(*Principal)
+		if !ok {
+			return nil
+		}
+		if setter, ok := interface{}(ctx).(TokenSetter); ok {
+			setter.SetToken(p.Token)
+		}
+		return nil
+	}
+}
+
+// cacheEntry is a cached result of the endpoint.
+type cacheEntry struct {
+	token   *Introspection
+	expires time.Time
+}
+
+// Authenticator is an rpc.Authenticator introspecting the bearer token of requests.
+type Authenticator struct {
+	opts Options
+
+	mutex sync.Mutex
+	cache map[[sha256.Size]byte]*cacheEntry // results by hash of the token
+	sweep time.Time                         // next removal of the expired results
+}
+
+/*
+NewAuthenticator returns an Authenticator introspecting tokens with the options
+*/
+func NewAuthenticator(opts Options) *Authenticator {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = time.Minute
+	}
+	return &Authenticator{opts: opts, cache: make(map[[sha256.Size]byte]*cacheEntry)}
+}
+
+/*
+Authenticate introspects the bearer token of the request, and returns its Principal
+*/
+func (a *Authenticator) Authenticate(r *http.Request) (rpc.Principal, error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		if a.opts.Optional && r.Header.Get("Authorization") == "" {
+			return nil, nil
+		}
+		return nil, rpc.Unauthenticated(ErrMissingToken)
+	}
+	info, err := a.Introspect(r.Context(), token)
+	if err != nil {
+		// Only inactive tokens are rejected, the failures to introspect them are not.
+		if errors.Is(err, ErrInactiveToken) || errors.Is(err, ErrAudience) {
+			return nil, rpc.Unauthenticated(err)
+		}
+		return nil, err
+	}
+	p := &Principal{Token: info, scopes: info.Scopes()}
+	for _, scope := range a.opts.Scopes {
+		if !p.HasRole(scope) {
+			return nil, rpc.Unauthenticated(fmt.Errorf("%w: %q", ErrScope, scope))
+		}
+	}
+	return p, nil
+}
+
+/*
+Introspect returns the introspection of the token, cached or from the endpoint, and an error if
+it isn't active or valid for the audience
+*/
+func (a *Authenticator) Introspect(ctx context.Context, token string) (*Introspection, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	a.mutex.Lock()
+	entry, ok := a.cache[key]
+	a.mutex.Unlock()
+	if !ok || now.After(entry.expires) {
+		info, err := a.fetch(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		entry = &cacheEntry{token: info, expires: now.Add(a.opts.CacheTTL)}
+		if exp := time.Unix(info.Expiry, 0); info.Expiry > 0 && exp.Before(entry.expires) {
+			entry.expires = exp
+		}
+		a.store(key, entry, now)
+	}
+
+	info := entry.token
+	if !info.Active || info.Expiry > 0 && now.After(time.Unix(info.Expiry, 0)) {
+		return nil, ErrInactiveToken
+	}
+	if a.opts.Audience != "" {
+		for _, aud := range info.Audiences() {
+			if aud == a.opts.Audience {
+				return info, nil
+			}
+		}
+		return nil, ErrAudience
+	}
+	return info, nil
+}
+
+/*
+store caches the entry, removing the expired ones every CacheTTL
+*/
+func (a *Authenticator) store(key [sha256.Size]byte, entry *cacheEntry, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if now.After(a.sweep) {
+		for k, e := range a.cache {
+			if now.After(e.expires) {
+				delete(a.cache, k)
+			}
+		}
+		a.sweep = now.Add(a.opts.CacheTTL)
+	}
+	a.cache[key] = entry
+}
+
+/*
+fetch posts the token to the introspection endpoint
+*/
+func (a *Authenticator) fetch(ctx context.Context, token string) (*Introspection, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.opts.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.opts.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.opts.ClientID), url.QueryEscape(a.opts.ClientSecret))
+	}
+	resp, err := a.opts.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oauth2: introspecting token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("oauth2: introspecting token: %s", resp.Status)
+	}
+	info := new(Introspection)
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("oauth2: decoding introspection: %w", err)
+	}
+	return info, nil
+}
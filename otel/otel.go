@@ -0,0 +1,228 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package otel traces the calls of an rpc.Server with OpenTelemetry. Each call gets a span named
+after its method, with the rpc.system, rpc.service and rpc.method attributes, recording the
+error of the call. The span is the child of the span of the W3C traceparent header of the
+request, and its context is given to services whose context type implements
+rpc.ContextSetter, so that the calls they make with ClientInterceptor continue the trace:
+
+	http.Handle("/rpc", rpcotel.Instrument(server, tracer))
+
+The package depends on small Tracer and Span interfaces rather than on the OpenTelemetry API. A
+trace.Tracer of go.opentelemetry.io/otel/trace is adapted with:
+
+	type otelTracer struct{ trace.Tracer }
+
+	func (t otelTracer) Start(ctx context.Context, name string, parent rpcotel.SpanContext, attrs []rpcotel.Attribute) (context.Context, rpcotel.Span) {
+		if parent.IsValid() {
+			ctx = trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    parent.TraceID,
+				SpanID:     parent.SpanID,
+				TraceFlags: trace.TraceFlags(parent.Flags),
+				Remote:     true,
+			}))
+		}
+		kvs := make([]attribute.KeyValue, len(attrs))
+		for i, attr := range attrs {
+			kvs[i] = attribute.String(attr.Key, attr.Value)
+		}
+		ctx, span := t.Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(kvs...))
+		return ctx, otelSpan{span}
+	}
+
+	type otelSpan struct{ trace.Span }
+
+	func (s otelSpan) SpanContext() rpcotel.SpanContext {
+		sc := s.Span.SpanContext()
+		return rpcotel.SpanContext{TraceID: sc.TraceID(), SpanID: sc.SpanID(), Flags: byte(sc.TraceFlags())}
+	}
+
+	func (s otelSpan) RecordError(err error) {
+		s.Span.RecordError(err)
+		s.Span.SetStatus(codes.Error, err.Error())
+	}
+
+	func (s otelSpan) End() {
+		s.Span.End()
+	}
+*/
+package otel
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"net/http"
+	"strings"
+)
+
+// Headers of the W3C trace context.
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+)
+
+// SpanContext identifies a span, as carried by the W3C trace context.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte   // trace flags, 1 if sampled
+	TraceState string // vendor-specific trace state
+}
+
+/*
+IsValid reports whether the trace and span IDs are set
+*/
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+/*
+Traceparent returns the value of the traceparent header of the span context
+*/
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+/*
+ParseTraceparent parses the value of a traceparent header
+*/
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("otel: invalid traceparent %q", value)
+	}
+	var version, flags [1]byte
+	if !decodeHex(version[:], parts[0]) || !decodeHex(sc.TraceID[:], parts[1]) ||
+		!decodeHex(sc.SpanID[:], parts[2]) || !decodeHex(flags[:], parts[3]) || !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("otel: invalid traceparent %q", value)
+	}
+	sc.Flags = flags[0]
+	return sc, nil
+}
+
+/*
+decodeHex decodes the lowercase hex string s filling dst
+*/
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// Attribute is an attribute of a span.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SpanContext returns the identifiers of the span.
+	SpanContext() SpanContext
+	// RecordError records the error of the call and marks the span as failed.
+	RecordError(err error)
+	// End ends the span.
+	End()
+}
+
+// Tracer starts the spans of calls.
+type Tracer interface {
+	// Start starts a span of the server, the child of parent if valid, and
+	// returns it along with a context carrying it.
+	Start(ctx context.Context, name string, parent SpanContext, attrs []Attribute) (context.Context, Span)
+}
+
+type remoteKey struct{}
+
+type spanKey struct{}
+
+/*
+SpanFromContext returns the span of the call carried by ctx, nil if none
+*/
+func SpanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanKey{}).(Span)
+	return span
+}
+
+/*
+Instrument sets the tracer of the server, and returns a handler serving its requests with the
+trace context of their headers
+*/
+func Instrument(server *rpc.Server, tracer Tracer) http.Handler {
+	server.SetTracer(&serverTracer{tracer: tracer})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sc, err := ParseTraceparent(r.Header.Get(TraceparentHeader)); err == nil {
+			sc.TraceState = r.Header.Get(TracestateHeader)
+			r = r.WithContext(context.WithValue(r.Context(), remoteKey{}, sc))
+		}
+		server.ServeHTTP(w, r)
+	})
+}
+
+// serverTracer starts a span for the dispatch of every call.
+type serverTracer struct {
+	tracer Tracer
+}
+
+func (t *serverTracer) Start(ctx context.Context, stage rpc.TraceStage, method string) (context.Context, func(error)) {
+	if stage != rpc.StageDispatch {
+		return ctx, nil
+	}
+	// The span of a caller in the same process, e.g. over the inproc
+	// transport, prevails over the headers.
+	parent, _ := ctx.Value(remoteKey{}).(SpanContext)
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.SpanContext()
+	}
+	service, name, _ := strings.Cut(method, ".")
+	ctx, span := t.tracer.Start(ctx, method, parent, []Attribute{
+		{Key: "rpc.system", Value: "antenna3mt/rpc"},
+		{Key: "rpc.service", Value: service},
+		{Key: "rpc.method", Value: name},
+	})
+	return context.WithValue(ctx, spanKey{}, span), func(err error) {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+}
+
+/*
+Inject returns a copy of ctx whose calls carry the trace context of its span, if any
+*/
+func Inject(ctx context.Context) context.Context {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return ctx
+	}
+	sc := span.SpanContext()
+	if !sc.IsValid() {
+		return ctx
+	}
+	ctx = rpc.WithCallHeader(ctx, TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		ctx = rpc.WithCallHeader(ctx, TracestateHeader, sc.TraceState)
+	}
+	return ctx
+}
+
+/*
+ClientInterceptor returns an interceptor sending the trace context of the span of the context of
+every call, so the server of the call continues the trace
+*/
+func ClientInterceptor() rpc.Interceptor {
+	return func(next rpc.CallFunc) rpc.CallFunc {
+		return func(ctx context.Context, method string, args interface{}, reply interface{}) error {
+			return next(Inject(ctx), method, args, reply)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"reflect"
+	"sync"
+)
+
+/*
+SetPooling enables the reuse of the context, args and reply of calls: once a call is over, they
+are zeroed and kept for the next calls of the method, sparing an allocation per call. Methods
+and hooks must then not retain them, e.g. in a goroutine outliving the call. Calls timing out,
+audited calls, cached replies and streams are never reused.
+*/
+func (s *Server) SetPooling(enabled bool) {
+	s.pooling = enabled
+}
+
+// allocator allocates the values of a type with a constructor precomputed at
+// registration, and pools them if the type allows it.
+type allocator struct {
+	typ      reflect.Type
+	new      func() interface{} // returns a pointer to a new zero value
+	poolable bool
+	pool     sync.Pool
+}
+
+/*
+newAllocator returns an allocator of the type, with constructor new if not nil
+*/
+func newAllocator(t reflect.Type, new func() interface{}) *allocator {
+	if new == nil {
+		new = func() interface{} {
+			return reflect.New(t).Interface()
+		}
+	}
+	// Streams are used by the method until the end of the request.
+	poolable := t != reflect.TypeOf(RequestStream{}) && t != reflect.TypeOf(ResponseStream{})
+	return &allocator{typ: t, new: new, poolable: poolable}
+}
+
+/*
+get returns a pointer to a zero value, reused from the pool if pooled
+*/
+func (a *allocator) get(pooled bool) reflect.Value {
+	if pooled && a.poolable {
+		if p := a.pool.Get(); p != nil {
+			return reflect.ValueOf(p)
+		}
+	}
+	return reflect.ValueOf(a.new())
+}
+
+/*
+getIn returns a pointer to a zero value allocated in the arena if not nil, as get does otherwise
+*/
+func (a *allocator) getIn(arena requestArena, pooled bool) reflect.Value {
+	if arena != nil && a.poolable {
+		return arena.new(a.typ)
+	}
+	return a.get(pooled)
+}
+
+/*
+put zeroes the value of the pointer and keeps it for reuse, if pooled
+*/
+func (a *allocator) put(v reflect.Value, pooled bool) {
+	if !pooled || !a.poolable {
+		return
+	}
+	v.Elem().SetZero()
+	a.pool.Put(v.Interface())
+}
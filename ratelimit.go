@@ -0,0 +1,256 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateGroup is the group of the methods of no RateGroup of a RatePolicy.
+const DefaultRateGroup = "default"
+
+// RateLimit is the token bucket of a caller: Burst calls at once, refilled at Rate calls per second.
+type RateLimit struct {
+	Rate  float64 // tokens added per second, unlimited if zero
+	Burst int     // capacity of the bucket, the rate rounded up if zero
+}
+
+// RateGroup limits a group of methods with a bucket shared by their calls.
+type RateGroup struct {
+	Name    string   // name of the group, part of the keys of its buckets
+	Methods []string // methods of the group, "Service.Method" or "Service.*"
+	Limit   RateLimit
+}
+
+// RateDecision is the result of taking a token from a bucket.
+type RateDecision struct {
+	Allowed   bool          // a token was taken
+	Remaining int           // tokens left in the bucket
+	Reset     time.Duration // time until the bucket is full again
+}
+
+// RateLimitStore keeps the token buckets of the callers, in memory or shared by the servers of
+// a cluster, e.g. with a Redis script updating the bucket atomically.
+type RateLimitStore interface {
+	// Take takes a token from the bucket of the key, created full if it doesn't exist.
+	Take(ctx context.Context, key string, limit RateLimit) (RateDecision, error)
+}
+
+// RateKeyFunc returns the key of the caller of a request, whose calls share buckets. An empty key
+// exempts the request from the limits.
+type RateKeyFunc func(r *http.Request) string
+
+// RatePolicy configures the limits of the rates of calls by caller.
+type RatePolicy struct {
+	Key     RateKeyFunc    // caller of a request, RateKeyByPrincipal if nil
+	Default RateLimit      // limit of the methods of no group
+	Groups  []RateGroup    // limits of groups of methods
+	Store   RateLimitStore // buckets of the callers, in memory if nil
+}
+
+/*
+RateKeyByPrincipal keys requests by the name of their principal, e.g. an API key or a JWT
+subject, exempting anonymous requests
+*/
+func RateKeyByPrincipal(r *http.Request) string {
+	if p := PrincipalFromRequest(r); p != nil {
+		return "principal:" + p.Name()
+	}
+	return ""
+}
+
+/*
+RateKeyByIP returns a RateKeyFunc keying requests by the address of their client, resolved by
+the filter behind trusted proxies, or by their remote address if filter is nil
+*/
+func RateKeyByIP(filter *IPFilter) RateKeyFunc {
+	if filter == nil {
+		filter = &IPFilter{}
+	}
+	return func(r *http.Request) string {
+		if addr := filter.ClientIP(r); addr.IsValid() {
+			return "ip:" + addr.String()
+		}
+		return ""
+	}
+}
+
+/*
+RateKeyByMetadata returns a RateKeyFunc keying requests by a value of their Metadata, e.g. the
+tenant header collected by SetMetadataHeaders
+*/
+func RateKeyByMetadata(key string) RateKeyFunc {
+	return func(r *http.Request) string {
+		if v := MetadataFromRequest(r).Get(key); v != "" {
+			return key + ":" + v
+		}
+		return ""
+	}
+}
+
+/*
+SetRatePolicy limits the rate of the calls of every caller with token buckets, by group of
+methods. Calls over the limit fail with ErrRateLimited and status 429.
+
+The RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of the responses describe
+the bucket of the last call, with Retry-After once it is empty. A store failing doesn't reject
+calls. A nil policy disables the limits.
+*/
+func (s *Server) SetRatePolicy(policy *RatePolicy) {
+	if policy == nil {
+		s.rateLimits = nil
+		return
+	}
+	s.rateLimits = newRateLimiter(policy)
+}
+
+// rateLimiter applies a RatePolicy.
+type rateLimiter struct {
+	policy  RatePolicy
+	methods map[string]*RateGroup // groups by method, or by "Service.*"
+}
+
+/*
+newRateLimiter returns the limiter of the policy
+*/
+func newRateLimiter(policy *RatePolicy) *rateLimiter {
+	l := &rateLimiter{policy: *policy, methods: make(map[string]*RateGroup)}
+	if l.policy.Key == nil {
+		l.policy.Key = RateKeyByPrincipal
+	}
+	if l.policy.Store == nil {
+		l.policy.Store = NewMemoryRateLimitStore()
+	}
+	for i := range l.policy.Groups {
+		group := &l.policy.Groups[i]
+		for _, method := range group.Methods {
+			l.methods[method] = group
+		}
+	}
+	return l
+}
+
+/*
+group returns the name and limit of the group of the method
+*/
+func (l *rateLimiter) group(method string) (string, RateLimit) {
+	group, ok := l.methods[method]
+	if !ok {
+		if dot := strings.LastIndex(method, "."); dot >= 0 {
+			group, ok = l.methods[method[:dot]+".*"]
+		}
+	}
+	if !ok {
+		return DefaultRateGroup, l.policy.Default
+	}
+	return group.Name, group.Limit
+}
+
+/*
+allow takes a token for the call of the method, setting the rate limit headers, and returns
+ErrRateLimited if the bucket of the caller is empty
+*/
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request, method string) error {
+	name, limit := l.group(method)
+	if limit.Rate <= 0 {
+		return nil
+	}
+	key := l.policy.Key(r)
+	if key == "" {
+		return nil
+	}
+	return takeToken(w, r, l.policy.Store, name+"|"+key, limit)
+}
+
+/*
+takeToken takes a token of the bucket of the key from the store, setting the rate limit headers,
+and returns ErrRateLimited if the bucket is empty
+*/
+func takeToken(w http.ResponseWriter, r *http.Request, store RateLimitStore, key string, limit RateLimit) error {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	decision, err := store.Take(r.Context(), key, limit)
+	if err != nil {
+		return nil
+	}
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(limit.burst()))
+	header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(decision.Reset.Seconds()))))
+	if !decision.Allowed {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(1/limit.Rate))))
+		return ErrRateLimited
+	}
+	return nil
+}
+
+/*
+burst returns the capacity of the bucket
+*/
+func (limit RateLimit) burst() int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return int(math.Ceil(limit.Rate))
+}
+
+/*
+NewMemoryRateLimitStore returns a RateLimitStore keeping the buckets in memory, dropping the
+buckets left full
+*/
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+}
+
+// tokenBucket is the bucket of a caller.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // time tokens was computed
+	full   time.Time // time the bucket is full again
+}
+
+// memoryRateLimitStore keeps the buckets in a map.
+type memoryRateLimitStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	sweep   time.Time // next removal of the full buckets
+}
+
+func (m *memoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateDecision, error) {
+	now := time.Now()
+	burst := float64(limit.burst())
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if now.After(m.sweep) {
+		for k, b := range m.buckets {
+			if now.After(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+		m.sweep = now.Add(time.Minute)
+	}
+
+	b := m.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: burst, last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	reset := time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second))
+	b.full = now.Add(reset)
+	return RateDecision{Allowed: allowed, Remaining: int(b.tokens), Reset: reset}, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Redacted replaces the value of fields tagged with `redact:"true"`.
+const Redacted = "[REDACTED]"
+
+// Redactor is implemented by types redacting their own values, e.g. a token type whose values
+// are always secret. Redact returns the value to record instead.
+type Redactor interface {
+	Redact() interface{}
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	redactorType      = reflect.TypeOf((*Redactor)(nil)).Elem()
+)
+
+/*
+Redact returns a copy of v made of maps, slices and basic values, with the fields tagged
+`redact:"true"` replaced by Redacted, and the values implementing Redactor by their Redact result.
+Struct fields are keyed by their json name, the fields of embedded structs being promoted as by
+encoding/json, and values implementing json.Marshaler or encoding.TextMarshaler are kept as is.
+
+The args, replies and error data recorded by the logging, auditing and sampling of the server
+and client are redacted, and codecs writing the data of errors should redact it, so secrets
+never land in a sink.
+*/
+func Redact(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return redactValue(reflect.ValueOf(v))
+}
+
+func redactValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil
+	}
+	if v.Type().Implements(redactorType) {
+		return v.Interface().(Redactor).Redact()
+	}
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface &&
+		(v.Type().Implements(marshalerType) || v.Type().Implements(textMarshalerType)) {
+		return v.Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return redactValue(v.Elem())
+	case reflect.Struct:
+		ret := make(map[string]interface{}, v.NumField())
+		redactFields(v, ret)
+		return ret
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		ret := make([]interface{}, v.Len())
+		for i := range ret {
+			ret[i] = redactValue(v.Index(i))
+		}
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		ret := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			ret[fmt.Sprint(iter.Key().Interface())] = redactValue(iter.Value())
+		}
+		return ret
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	}
+	return v.Interface()
+}
+
+/*
+redactFields adds the redacted fields of the struct to ret, the fields of untagged embedded
+structs being promoted unless shadowed by the fields of the struct
+*/
+func redactFields(v reflect.Value, ret map[string]interface{}) {
+	t := v.Type()
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.Anonymous || f.Tag.Get("json") != "" {
+			fields = append(fields, i)
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Ptr && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() != reflect.Struct || fv.Type().Implements(redactorType) ||
+			fv.Type().Implements(marshalerType) || fv.Type().Implements(textMarshalerType) {
+			fields = append(fields, i)
+		} else if f.Tag.Get("redact") != "true" {
+			redactFields(fv, ret)
+		}
+	}
+
+	for _, i := range fields {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if idx := strings.Index(tag, ","); idx != -1 {
+				tag = tag[:idx]
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		if f.Tag.Get("redact") == "true" {
+			ret[name] = Redacted
+		} else {
+			ret[name] = redactValue(v.Field(i))
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type Credentials struct {
+	User     string `json:"user"`
+	Password string `json:"password" redact:"true"`
+	Tokens   map[string]string
+	Created  time.Time
+	secret   string
+}
+
+func TestRedact(t *testing.T) {
+	created := time.Unix(0, 0)
+	ret := Redact(&struct {
+		Creds []*Credentials
+	}{
+		Creds: []*Credentials{{
+			User:     "admin",
+			Password: "hunter2",
+			Tokens:   map[string]string{"a": "b"},
+			Created:  created,
+			secret:   "secret",
+		}},
+	})
+
+	assert.Equal(t, map[string]interface{}{
+		"Creds": []interface{}{
+			map[string]interface{}{
+				"user":     "admin",
+				"password": Redacted,
+				"Tokens":   map[string]interface{}{"a": "b"},
+				"Created":  created,
+			},
+		},
+	}, ret)
+	assert.Nil(t, Redact(nil))
+}
+
+type Token string
+
+func (Token) Redact() interface{} {
+	return Redacted
+}
+
+type Audit struct {
+	Actor string `json:"actor"`
+	Note  string
+}
+
+type Signup struct {
+	Audit
+	*Credentials `redact:"true"`
+	Actor        string `json:"actor"`
+	Token        Token
+	Raw          json.RawMessage
+}
+
+func TestRedactEmbedded(t *testing.T) {
+	ret := Redact(Signup{
+		Audit:       Audit{Actor: "shadowed", Note: "note"},
+		Credentials: &Credentials{Password: "hunter2"},
+		Actor:       "admin",
+		Token:       "t0ken",
+		Raw:         json.RawMessage(`{"a":1}`),
+	})
+	assert.Equal(t, map[string]interface{}{
+		"actor": "admin",
+		"Note":  "note",
+		"Token": Redacted,
+		"Raw":   json.RawMessage(`{"a":1}`),
+	}, ret)
+	assert.Equal(t, Redacted, Redact(Token("t0ken")))
+}
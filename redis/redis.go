@@ -0,0 +1,234 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package redis distributes calls to workers through Redis lists: clients push the requests to a
+queue list, workers pop and serve them with an rpc.Server, and push each response to a reply
+list keyed by the id of its request, where the client pops it. Any number of workers serving
+the same queue form a worker pool.
+
+Requests and responses are JSON envelopes carrying the body encoded by the codec. The binding
+depends on a small Conn interface rather than on a Redis client library. A *redis.Client of
+github.com/redis/go-redis/v9 is adapted with:
+
+	type redisConn struct{ *redis.Client }
+
+	func (c redisConn) BRPop(ctx context.Context, timeout time.Duration, key string) ([]byte, error) {
+		values, err := c.Client.BRPop(ctx, timeout, key).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []byte(values[1]), nil
+	}
+
+	func (c redisConn) LPush(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+		_, err := c.Client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.LPush(ctx, key, value)
+			if ttl > 0 {
+				p.Expire(ctx, key, ttl)
+			}
+			return nil
+		})
+		return err
+	}
+*/
+package redis
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/antenna3mt/rpc"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultQueue is the list of the requests if none is given.
+const DefaultQueue = "rpc:requests"
+
+// popTimeout bounds the blocking pops, so workers and clients notice canceled contexts.
+const popTimeout = time.Second
+
+// Conn is the part of a Redis connection used by the binding.
+type Conn interface {
+	// BRPop pops the last element of the list, blocking up to timeout while
+	// it is empty. It returns nil if the timeout elapses.
+	BRPop(ctx context.Context, timeout time.Duration, key string) ([]byte, error)
+	// LPush pushes value at the head of the list, which expires after ttl if
+	// not zero.
+	LPush(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// request is the envelope of a request pushed to the queue.
+type request struct {
+	ID          string            `json:"id"`
+	ReplyTo     string            `json:"reply_to,omitempty"` // list of the response, empty for notifications
+	ContentType string            `json:"content_type,omitempty"`
+	Header      map[string]string `json:"header,omitempty"` // headers seen by hooks
+	Body        []byte            `json:"body"`
+}
+
+// response is the envelope of a response pushed to the reply list.
+type response struct {
+	Body  []byte `json:"body,omitempty"`
+	Error string `json:"error,omitempty"` // error of a request rejected before the codec
+}
+
+// Options configures the workers.
+type Options struct {
+	Queue       string        // list of the requests, DefaultQueue if empty
+	Concurrency int           // requests served at the same time, one if zero
+	ReplyTTL    time.Duration // expiration of the reply lists, a minute if zero
+}
+
+/*
+Serve pops the requests of the queue, and serves them until ctx is done. Requests popped are
+served even if ctx is done meanwhile.
+*/
+func Serve(ctx context.Context, server *rpc.Server, conn Conn, opts *Options) error {
+	queue, concurrency, ttl := DefaultQueue, 1, time.Minute
+	if opts != nil {
+		if opts.Queue != "" {
+			queue = opts.Queue
+		}
+		if opts.Concurrency > 0 {
+			concurrency = opts.Concurrency
+		}
+		if opts.ReplyTTL > 0 {
+			ttl = opts.ReplyTTL
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				data, err := conn.BRPop(ctx, popTimeout, queue)
+				if err != nil {
+					if ctx.Err() == nil {
+						errs <- err
+					}
+					return
+				}
+				if data != nil {
+					serveRequest(server, conn, ttl, data)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+/*
+serveRequest serves the request of an envelope, and pushes its response to the reply list
+*/
+func serveRequest(server *rpc.Server, conn Conn, ttl time.Duration, data []byte) {
+	var req request
+	if err := json.Unmarshal(data, &req); err != nil {
+		// Malformed envelopes have nowhere to reply to.
+		return
+	}
+	header := make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		header.Set(k, v)
+	}
+	if req.ContentType != "" {
+		header.Set("Content-Type", req.ContentType)
+	}
+
+	var res response
+	body, err := server.ServeMessage(context.Background(), header, req.Body)
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Body = body
+	}
+	if req.ReplyTo == "" {
+		return
+	}
+	if data, err = json.Marshal(&res); err == nil {
+		conn.LPush(context.Background(), req.ReplyTo, data, ttl)
+	}
+}
+
+// Client calls the services of the workers of a queue.
+type Client struct {
+	conn  Conn
+	queue string
+	codec rpc.ClientCodec
+}
+
+/*
+NewClient returns a client pushing its requests to the queue, DefaultQueue if empty, encoded
+with codec
+*/
+func NewClient(conn Conn, queue string, codec rpc.ClientCodec) *Client {
+	if queue == "" {
+		queue = DefaultQueue
+	}
+	return &Client{conn: conn, queue: queue, codec: codec}
+}
+
+/*
+Call calls the RPC method with args, and fills reply with the result, waiting for a worker to
+serve the request until ctx is done.
+*/
+func (c *Client) Call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	body, err := c.codec.EncodeRequest(method, args)
+	if err != nil {
+		return err
+	}
+	id := newID()
+	replyTo := c.queue + ":reply:" + id
+	data, err := json.Marshal(&request{
+		ID:          id,
+		ReplyTo:     replyTo,
+		ContentType: c.codec.ContentType(),
+		Body:        body,
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.conn.LPush(ctx, c.queue, data, 0); err != nil {
+		return err
+	}
+
+	for {
+		data, err := c.conn.BRPop(ctx, popTimeout, replyTo)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			var res response
+			if err := json.Unmarshal(data, &res); err != nil {
+				return err
+			}
+			if res.Error != "" {
+				return errors.New(res.Error)
+			}
+			return c.codec.DecodeResponse(bytes.NewReader(res.Body), reply)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
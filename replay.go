@@ -0,0 +1,118 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Errors of the requests rejected by a ReplayGuard.
+var (
+	ErrStaleRequest    = errors.New("rpc: request timestamp outside of the validity window")
+	ErrMissingNonce    = errors.New("rpc: missing request nonce")
+	ErrReplayedRequest = errors.New("rpc: replayed request nonce")
+)
+
+// DefaultReplayWindow is the validity window of a ReplayGuard created without one.
+const DefaultReplayWindow = 5 * time.Minute
+
+// NonceCache remembers the nonces of requests until they expire, to reject their replays.
+type NonceCache interface {
+	// Add records the nonce for ttl, and reports false if it was already recorded.
+	Add(nonce string, ttl time.Duration) (bool, error)
+}
+
+// ReplayGuard rejects the requests whose timestamp is outside of the validity window, or whose
+// nonce was already seen in the window, so identical signed requests can't be replayed.
+type ReplayGuard struct {
+	window time.Duration // tolerated difference between the timestamps and the clock
+	nonces NonceCache    // nonces of the window
+}
+
+/*
+NewReplayGuard returns a guard accepting the timestamps within window of the clock, in both
+directions to tolerate skew, DefaultReplayWindow if zero. Nonces are remembered by the cache for
+twice the window, as long as their timestamps are accepted, in memory if nonces is nil. A cache
+shared by the servers of a cluster, e.g. backed by Redis SET NX PX, rejects replays to any of them.
+*/
+func NewReplayGuard(window time.Duration, nonces NonceCache) *ReplayGuard {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	if nonces == nil {
+		nonces = NewMemoryNonceCache()
+	}
+	return &ReplayGuard{window: window, nonces: nonces}
+}
+
+/*
+Check validates the unix timestamp in seconds and the nonce of a request, recording the nonce
+*/
+func (g *ReplayGuard) Check(timestamp, nonce string) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleRequest
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > g.window || skew < -g.window {
+		return ErrStaleRequest
+	}
+	if nonce == "" {
+		return ErrMissingNonce
+	}
+	added, err := g.nonces.Add(nonce, 2*g.window)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrReplayedRequest
+	}
+	return nil
+}
+
+/*
+CheckRequest validates the X-Timestamp and X-Nonce headers of the request, e.g. in an
+Authenticator verifying signatures of its own
+*/
+func (g *ReplayGuard) CheckRequest(r *http.Request) error {
+	return g.Check(r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader))
+}
+
+/*
+NewMemoryNonceCache returns a NonceCache keeping nonces in memory
+*/
+func NewMemoryNonceCache() NonceCache {
+	return &memoryNonceCache{nonces: make(map[string]time.Time)}
+}
+
+// memoryNonceCache keeps nonces in a map until they expire.
+type memoryNonceCache struct {
+	mutex  sync.Mutex
+	nonces map[string]time.Time // expiry by nonce
+	sweep  time.Time            // next removal of the expired nonces
+}
+
+func (c *memoryNonceCache) Add(nonce string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.After(c.sweep) {
+		for n, expiry := range c.nonces {
+			if now.After(expiry) {
+				delete(c.nonces, n)
+			}
+		}
+		c.sweep = now.Add(ttl)
+	}
+	if expiry, ok := c.nonces[nonce]; ok && now.Before(expiry) {
+		return false, nil
+	}
+	c.nonces[nonce] = now.Add(ttl)
+	return true, nil
+}
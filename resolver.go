@@ -0,0 +1,159 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Endpoint is an endpoint of a service found by a Resolver.
+type Endpoint struct {
+	URL string
+}
+
+// Resolver finds the endpoints of a service.
+type Resolver interface {
+	Resolve(service string) ([]Endpoint, error)
+}
+
+// Watcher is implemented by resolvers able to push endpoint updates. The
+// returned channel receives the endpoints of the service every time they
+// change, until stop is called.
+type Watcher interface {
+	Watch(service string) (updates <-chan []Endpoint, stop func(), err error)
+}
+
+/*
+WithResolver distributes calls to the endpoints of the service found by the resolver, instead of
+the endpoints given to NewClient. The endpoints are resolved again every refresh period, or
+updated as they change if the resolver implements Watcher. Close stops the updates.
+*/
+func WithResolver(r Resolver, service string, refresh time.Duration) ClientOption {
+	return func(c *Client) {
+		c.resolver = r
+		c.resolverService = service
+		c.resolverRefresh = refresh
+	}
+}
+
+// StaticResolver resolves services to fixed lists of urls.
+type StaticResolver map[string][]string
+
+// Resolve returns the urls of the service.
+func (sr StaticResolver) Resolve(service string) ([]Endpoint, error) {
+	urls, ok := sr[service]
+	if !ok {
+		return nil, fmt.Errorf("rpc: unknown service %q", service)
+	}
+	ret := make([]Endpoint, 0, len(urls))
+	for _, u := range urls {
+		ret = append(ret, Endpoint{URL: u})
+	}
+	return ret, nil
+}
+
+// DNSSRVResolver resolves services with DNS SRV records, e.g.
+// "_rpc._tcp.example.com", to urls "[Scheme]://[target]:[port][Path]".
+type DNSSRVResolver struct {
+	Scheme string // url scheme, "http" if empty
+	Path   string // url path of the RPC handler
+}
+
+// Resolve looks up the SRV records of the service, ordered by priority and
+// randomized by weight.
+func (dr *DNSSRVResolver) Resolve(service string) ([]Endpoint, error) {
+	_, addrs, err := net.LookupSRV("", "", service)
+	if err != nil {
+		return nil, err
+	}
+	scheme := dr.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	ret := make([]Endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		host := strings.TrimSuffix(addr.Target, ".")
+		ret = append(ret, Endpoint{
+			URL: scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(addr.Port))) + dr.Path,
+		})
+	}
+	return ret, nil
+}
+
+/*
+resolve resolves the endpoints of the service, and updates the balancer
+*/
+func (c *Client) resolve() error {
+	endpoints, err := c.resolver.Resolve(c.resolverService)
+	if err != nil {
+		return err
+	}
+	return c.updateEndpoints(endpoints)
+}
+
+/*
+updateEndpoints validates the endpoints, and updates the balancer
+*/
+func (c *Client) updateEndpoints(endpoints []Endpoint) error {
+	urls := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		u, err := parseEndpoint(e.URL)
+		if err != nil {
+			return err
+		}
+		urls = append(urls, u)
+	}
+	c.balancer.setEndpoints(urls)
+	return nil
+}
+
+/*
+watchResolver keeps the endpoints up to date until the client is closed
+*/
+func (c *Client) watchResolver() error {
+	if w, ok := c.resolver.(Watcher); ok {
+		updates, stop, err := w.Watch(c.resolverService)
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer stop()
+			for {
+				select {
+				case <-c.closed:
+					return
+				case endpoints, ok := <-updates:
+					if !ok {
+						return
+					}
+					c.updateEndpoints(endpoints)
+				}
+			}
+		}()
+		return nil
+	}
+
+	if c.resolverRefresh <= 0 {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(c.resolverRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.closed:
+				return
+			case <-ticker.C:
+				// Keep the known endpoints if the resolver fails.
+				c.resolve()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy configures the retries of failed client calls.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a call, including the first one.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry. Following delays are
+	// multiplied by Multiplier, up to MaxBackoff, with random jitter.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Retryable reports whether an error is transient. DefaultRetryable is used if nil.
+	Retryable func(err error) bool
+
+	// Idempotent reports whether a method can be safely retried. Methods that are
+	// not idempotent are only retried with IdempotencyKey. All methods are
+	// considered idempotent if nil.
+	Idempotent func(method string) bool
+
+	// IdempotencyKey sends the same Idempotency-Key header with every attempt of a
+	// call, so the server can replay the first response instead of calling the
+	// method again.
+	IdempotencyKey bool
+}
+
+/*
+DefaultRetryPolicy returns a RetryPolicy of 3 attempts with exponential backoff starting at 100ms
+*/
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+	}
+}
+
+/*
+WithRetryPolicy sets the retry policy of calls, calls are not retried by default
+*/
+func WithRetryPolicy(p *RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retryPolicy = p
+	}
+}
+
+/*
+DefaultRetryable reports whether err is a transient failure: a network timeout, a refused
+connection, or a 429, 502, 503 or 504 http status
+*/
+func DefaultRetryable(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case 429, 502, 503, 504:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+/*
+idempotent reports whether the method can be safely retried
+*/
+func (p *RetryPolicy) idempotent(method string) bool {
+	return p == nil || p.Idempotent == nil || p.Idempotent(method)
+}
+
+/*
+do calls attempt until it succeeds, fails with a permanent error, or the attempts are exhausted
+*/
+func (p *RetryPolicy) do(ctx context.Context, idempotent bool, header http.Header, attempt func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = DefaultRetryable
+	}
+	if p.IdempotencyKey && header.Get(IdempotencyKeyHeader) == "" {
+		header.Set(IdempotencyKeyHeader, newIdempotencyKey())
+		idempotent = true
+	}
+
+	backoff := p.InitialBackoff
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil || i >= p.MaxAttempts || !idempotent || !retryable(err) {
+			return err
+		}
+
+		delay := backoff
+		if delay > 0 {
+			delay = delay/2 + time.Duration(mrand.Int63n(int64(delay/2)+1))
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		if p.Multiplier > 1 {
+			backoff = time.Duration(float64(backoff) * p.Multiplier)
+		}
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+/*
+newIdempotencyKey returns a random idempotency key
+*/
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"time"
+)
+
+// Sample is the payload of a sampled call, recorded for debugging.
+type Sample struct {
+	Time        time.Time   // time of the call
+	Method      string      // method in dotted notation, "Service.Method"
+	ContentType string      // Content-Type of the request
+	UserAgent   string      // User-Agent of the request, identifying the client
+	Principal   Principal   // authenticated caller, nil if anonymous
+	Args        interface{} // redacted args, as far as they were decoded if decoding failed
+	Reply       interface{} // redacted reply, nil if the call failed
+	Err         error       // error of the call
+}
+
+// SampleSink records the payloads of sampled calls. Fields of args and reply
+// tagged with `redact:"true"` are masked.
+type SampleSink interface {
+	Sample(*Sample)
+}
+
+// SampleSinkFunc is an adapter to allow the use of ordinary functions as
+// SampleSink.
+type SampleSinkFunc func(*Sample)
+
+// Sample calls f(sample).
+func (f SampleSinkFunc) Sample(sample *Sample) {
+	f(sample)
+}
+
+/*
+SetSampleSink sets the SampleSink recording the payloads of the calls sampled by SetSampleRate
+*/
+func (s *Server) SetSampleSink(sink SampleSink) {
+	s.sampleSink = sink
+}
+
+/*
+SetSampleRate sets the fraction of the calls of a registered method, from 0 to 1, whose args and
+reply are recorded by the SampleSink, to diagnose e.g. the decoding issues of a client. It can be
+changed while serving, and zero disables sampling.
+*/
+func (s *Server) SetSampleRate(method string, rate float64) error {
+	return s.services.setSampleRate(method, rate)
+}
@@ -7,12 +7,25 @@
 package rpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	mrand "math/rand"
+	"net"
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// errUnrecognizedContentType is returned for requests whose Content-Type has
+// no codec, the Content-Type is written after it.
+var errUnrecognizedContentType = errors.New("rpc: unrecognized Content-Type")
+
 /*
 NewServer returns a new RPC server.
 param ctx is non-nil, and used to restrict the context param for service registering
@@ -27,9 +40,15 @@ func NewServer(ctx interface{}) (*Server, error) {
 	}
 
 	return &Server{
-		codecs:   make(map[string]Codec),
+		codecs:   make(codecMap),
 		services: new(serviceMap),
 		ctxType:  ctxType.Elem(),
+		contexts: newAllocator(ctxType.Elem(), nil),
+		started:  time.Now(),
+
+		maxDecompressed: DefaultMaxDecompressedBytes,
+		maxBodyBytes:    DefaultMaxBodyBytes,
+		maxBatchSize:    DefaultMaxBatchSize,
 	}, nil
 }
 
@@ -37,33 +56,190 @@ func NewServer(ctx interface{}) (*Server, error) {
 serves registered services with registered codecs.
 */
 type Server struct {
-	codecs    map[string]Codec // codecs
-	services  *serviceMap      // services
-	ctxType   reflect.Type     // context type
-	beforeFns []reflect.Value  // functions executed before service call
-	afterFns  []reflect.Value  // functions executed after service all
+	codecs          codecMap         // codecs by canonical media type
+	soleCodec       *registeredCodec // the codec if only one is registered
+	started         time.Time        // time the server was created
+	services        *serviceMap      // services
+	ctxType         reflect.Type     // context type
+	contexts        *allocator       // allocates the contexts of calls
+	pooling         bool             // reuses the contexts, args and replies of calls
+	arenas          bool             // allocates the contexts, args and replies of calls in arenas
+	minimal         bool             // serves requests with the minimal path
+	maxDecompressed int64            // size limit of decompressed request bodies
+	maxBodyBytes    int64            // size limit of request bodies read before decoding
+	maxBatchSize    int              // limit of the calls of a batch request
+	workers         *WorkerPool      // runs the calls of methods without a pool, nil if disabled
+	beforeFns       hookSet          // functions executed before service call
+	afterFns        hookSet          // functions executed after service all
+	metadataHeaders []string         // request headers copied into metadata
+	authenticator   Authenticator    // authenticates requests before dispatch
+	signatures      *SignaturePolicy // verifies the signatures of requests, nil if disabled
+	ipFilter        *IPFilter        // rejects clients of disallowed networks, nil if disabled
+	rateLimits      *rateLimiter     // limits the rates of calls by caller, nil if disabled
+	csrf            *CSRFPolicy      // checks the csrf tokens of browsers, nil if disabled
+	aclTable        *aclTable        // roles required by method pattern, nil if none
+	secHeaders      *securityHeaders // set on every response, nil if none
+	lockout         *LockoutPolicy   // throttles callers failing authentication, nil if disabled
+	tenants         *tenancy         // resolves the tenants of requests, nil if disabled
+	tenantServices  sync.Map         // services overridden by tenants, *serviceMap by tenant
+	idempotency     *idempotency     // replays responses for idempotency keys
+	cache           CacheStore       // stores replies of cached methods
+	auditSink       AuditSink        // receives an event for every call
+	sampleSink      SampleSink       // records the payloads of sampled calls
+	errorTranslator ErrorTranslator  // maps service errors to wire errors
+	statsHandler    StatsHandler     // receives the stats of every request
+	tracer          Tracer           // brackets the stages of every request
+	logger          *slog.Logger     // logs every call, nil if disabled
+	slowCalls       *SlowCallPolicy  // logs slow calls, nil if disabled
+	errorSpikes     *errorWindow     // rates of the errors of calls, nil if disabled
+	healthErrors    sync.Map         // last error of the health check of every service, by name
+	events          eventBus         // lifecycle event subscribers
+	introspection   bool             // serves IntrospectionMethod
+	connContentType string           // Content-Type of requests served without HTTP
+	subscriptions   *subscriptionHub // subscriptions of clients to topics, nil if disabled
+	topicAuthorizer TopicAuthorizer  // checks the topics subscribed to, nil to allow all
+	webhooks        *WebhookPolicy   // delivers responses to callbacks, nil if disabled
+
+	// adminAuth checks the requests of the admin handler, nil to reject them.
+	adminAuth func(*http.Request) error
+
+	// checkOrigin checks the origins of websocket upgrades, nil for the same origin only.
+	checkOrigin func(*http.Request) bool
+}
+
+/*
+Subscribe adds a func receiving the lifecycle events of the server, and returns the func to unsubscribe.
+Events are delivered synchronously in subscription order.
+*/
+func (s *Server) Subscribe(fn func(*Event)) (unsubscribe func()) {
+	return s.events.subscribe(fn)
+}
+
+/*
+ErrorTranslator maps an error returned by a service method to the error written to the client.
+Returning nil keeps the original error.
+*/
+type ErrorTranslator func(method string, err error) error
+
+/*
+SetAuthenticator sets the Authenticator consulted before hooks and service call.
+
+A request failing authentication is rejected with status 401, or 429 for ErrRateLimited and
+ErrLockedOut. The principal is available to hooks via PrincipalFromRequest, and to services if
+the context type implements PrincipalSetter.
+*/
+func (s *Server) SetAuthenticator(a Authenticator) {
+	s.authenticator = a
+}
+
+/*
+SetMetadataHeaders sets the request headers whose values are collected into the request Metadata.
+
+The metadata is available to hooks via MetadataFromRequest, and to services if the
+context type implements MetadataSetter.
+*/
+func (s *Server) SetMetadataHeaders(headers ...string) {
+	s.metadataHeaders = headers
 }
 
 /*
 RegisterBeforeFunc validate and add a func that will be executed before service call
 */
 func (s *Server) RegisterBeforeFunc(fn interface{}) error {
+	return s.RegisterBeforeFuncWithPriority(fn, DefaultPriority)
+}
+
+/*
+RegisterBeforeFuncWithPriority validate and add a func that will be executed before service call.
+Funcs with lower priority are executed first; funcs with equal priority are executed in registration order.
+*/
+func (s *Server) RegisterBeforeFuncWithPriority(fn interface{}, priority int) error {
+	_, err := s.AddBeforeFunc(fn, priority)
+	return err
+}
+
+/*
+AddBeforeFunc registers a before func as RegisterBeforeFuncWithPriority, and returns the id
+removing it with RemoveHook. Hooks may be added and removed while requests are served.
+*/
+func (s *Server) AddBeforeFunc(fn interface{}, priority int) (HookID, error) {
 	if err := validCtxFunc(fn, s.ctxType); err != nil {
-		return err
+		return 0, err
 	}
-	s.beforeFns = append(s.beforeFns, reflect.ValueOf(fn))
-	return nil
+	h := newHook(fn, priority)
+	s.beforeFns.insert(h)
+	return h.id, nil
+}
+
+/*
+RemoveBeforeFunc removes a registered before func, and reports whether it was registered.
+
+Deprecated: funcs made by the same func literal, e.g. closures returned by a func, are not told
+apart and are all removed. Use RemoveHook with the id returned by AddBeforeFunc.
+*/
+func (s *Server) RemoveBeforeFunc(fn interface{}) bool {
+	return s.beforeFns.remove(funcMatcher(fn))
+}
+
+/*
+BeforeFuncs returns the names of registered before funcs in execution order
+*/
+func (s *Server) BeforeFuncs() []string {
+	return s.beforeFns.load().names()
 }
 
 /*
 RegisterAfterFunc validate and add a func that will be executed after service call
 */
 func (s *Server) RegisterAfterFunc(fn interface{}) error {
+	return s.RegisterAfterFuncWithPriority(fn, DefaultPriority)
+}
+
+/*
+RegisterAfterFuncWithPriority validate and add a func that will be executed after service call.
+Funcs with lower priority are executed first; funcs with equal priority are executed in registration order.
+*/
+func (s *Server) RegisterAfterFuncWithPriority(fn interface{}, priority int) error {
+	_, err := s.AddAfterFunc(fn, priority)
+	return err
+}
+
+/*
+AddAfterFunc registers an after func as RegisterAfterFuncWithPriority, and returns the id
+removing it with RemoveHook. Hooks may be added and removed while requests are served.
+*/
+func (s *Server) AddAfterFunc(fn interface{}, priority int) (HookID, error) {
 	if err := validCtxFunc(fn, s.ctxType); err != nil {
-		return err
+		return 0, err
 	}
-	s.afterFns = append(s.beforeFns, reflect.ValueOf(fn))
-	return nil
+	h := newHook(fn, priority)
+	s.afterFns.insert(h)
+	return h.id, nil
+}
+
+/*
+RemoveAfterFunc removes a registered after func, and reports whether it was registered.
+
+Deprecated: funcs made by the same func literal, e.g. closures returned by a func, are not told
+apart and are all removed. Use RemoveHook with the id returned by AddAfterFunc.
+*/
+func (s *Server) RemoveAfterFunc(fn interface{}) bool {
+	return s.afterFns.remove(funcMatcher(fn))
+}
+
+/*
+AfterFuncs returns the names of registered after funcs in execution order
+*/
+func (s *Server) AfterFuncs() []string {
+	return s.afterFns.load().names()
+}
+
+/*
+RemoveHook removes the before or after func of the id, and reports whether it was registered
+*/
+func (s *Server) RemoveHook(id HookID) bool {
+	match := func(h *hook) bool { return h.id == id }
+	return s.beforeFns.remove(match) || s.afterFns.remove(match)
 }
 
 /*
@@ -71,10 +247,16 @@ RegisterCodec adds a new codec to the server.
 
 Codecs are defined to process a given serialization scheme, e.g., JSON or
 XML. A codec is chosen based on the "Content-Type" header from the request,
-excluding the charset definition.
+excluding the charset definition. Media types are matched case-insensitively.
 */
 func (s *Server) RegisterCodec(codec Codec, contentType string) {
-	s.codecs[strings.ToLower(contentType)] = codec
+	rc := &registeredCodec{Codec: codec}
+	s.codecs[strings.ToLower(mediaType(contentType))] = rc
+	s.soleCodec = nil
+	if len(s.codecs) == 1 {
+		s.soleCodec = rc
+	}
+	s.events.publish(&Event{Type: EventCodecRegistered, ContentType: contentType})
 }
 
 /*
@@ -96,7 +278,67 @@ Methods from the receiver will be extracted if these rules are satisfied:
 All other methods are ignored.
 */
 func (s *Server) RegisterService(receiver interface{}, name string) error {
-	return s.services.add(receiver, name, s.ctxType)
+	return s.RegisterServiceWithACL(receiver, name, nil)
+}
+
+/*
+RegisterServiceWithACL adds a new service to the server, and attaches the roles required to call its methods.
+
+The principal returned by the Authenticator must implement RolePrincipal and hold all the
+required roles, otherwise the call is rejected with status 403 and ErrForbidden.
+*/
+func (s *Server) RegisterServiceWithACL(receiver interface{}, name string, acl ACL) error {
+	service, err := s.services.addWithACL(receiver, name, s.ctxType, acl)
+	if err != nil {
+		return err
+	}
+	s.events.publish(&Event{
+		Type:    EventServiceRegistered,
+		Service: service.name,
+		Methods: service.methodNames(),
+	})
+	return nil
+}
+
+/*
+RegisterFunc adds the method to the server, served by fn. The method uses a dotted notation as
+in "Service.Method", and is added to the service if it is already registered.
+
+Unlike the methods of services registered with RegisterService, fn is called without
+reflection, as its types are known when it is compiled, so hot methods or generated code can
+avoid the cost of reflect.Value.Call. C must be the context type of the server.
+*/
+func RegisterFunc[C, A, R any](s *Server, method string, fn func(ctx *C, args *A, reply *R) error) error {
+	if fn == nil {
+		return fmt.Errorf("rpc: nil func is not allowed")
+	}
+	if ctxType := reflect.TypeOf((*C)(nil)).Elem(); ctxType != s.ctxType {
+		return fmt.Errorf("rpc: context type %s of %q is not %s", ctxType, method, s.ctxType)
+	}
+	serviceName, methodName, ok := strings.Cut(method, ".")
+	if !ok || serviceName == "" || methodName == "" || strings.Contains(methodName, ".") {
+		return fmt.Errorf("rpc: service/method ill-formed: %q", method)
+	}
+
+	service, err := s.services.addMethod(serviceName, methodName, &serviceMethod{
+		argsType:  reflect.TypeOf((*A)(nil)).Elem(),
+		replyType: reflect.TypeOf((*R)(nil)).Elem(),
+		args:      newAllocator(reflect.TypeOf((*A)(nil)).Elem(), func() interface{} { return new(A) }),
+		reply:     newAllocator(reflect.TypeOf((*R)(nil)).Elem(), func() interface{} { return new(R) }),
+		call: func(ctx, args, reply reflect.Value) error {
+			return fn(ctx.Interface().(*C), args.Interface().(*A), reply.Interface().(*R))
+		},
+		counters: new(callCounters),
+	})
+	if err != nil {
+		return err
+	}
+	s.events.publish(&Event{
+		Type:    EventServiceRegistered,
+		Service: service.name,
+		Methods: []string{methodName},
+	})
+	return nil
 }
 
 /*
@@ -116,40 +358,402 @@ func (s *Server) ServiceMap() map[string][]string {
 	return s.services.Map()
 }
 
+/*
+Cache enables caching of the replies of a registered method for the duration of ttl.
+
+The cache key is computed from the method name and the canonical encoding of args, and
+a hit is served without calling the service. Cached replies are shared by all callers.
+A zero ttl disables caching of the method.
+*/
+func (s *Server) Cache(method string, ttl time.Duration) error {
+	if s.cache == nil {
+		s.cache = NewMemoryCacheStore()
+	}
+	return s.services.setCacheTTL(method, ttl)
+}
+
+/*
+SetCacheStore sets the backend of cached replies, the default one keeps replies in memory
+*/
+func (s *Server) SetCacheStore(store CacheStore) {
+	s.cache = store
+}
+
+/*
+SetAuditSink sets the AuditSink receiving an event for every call of a service method
+*/
+func (s *Server) SetAuditSink(sink AuditSink) {
+	s.auditSink = sink
+}
+
+/*
+SetErrorTranslator sets the func applied to every error returned by a service method before it is
+written, so domain errors can be centrally mapped to wire errors
+*/
+func (s *Server) SetErrorTranslator(fn ErrorTranslator) {
+	s.errorTranslator = fn
+}
+
+/*
+SetStatsHandler sets the StatsHandler receiving the stats of every request
+*/
+func (s *Server) SetStatsHandler(h StatsHandler) {
+	s.statsHandler = h
+}
+
+/*
+SetTracer sets the Tracer bracketing the decode, dispatch and encode stages of every request.
+
+The context returned for the dispatch stage is given to services if the context type
+implements ContextSetter.
+*/
+func (s *Server) SetTracer(t Tracer) {
+	s.tracer = t
+}
+
+/*
+SetIdempotencyStore enables replay of responses for requests carrying the Idempotency-Key header.
+
+The first response for a key is kept in store for the duration of ttl, and written back
+for retries with the same key without calling the service again. Keys are scoped to the
+authenticated caller and the method, so the caller is authenticated before a response is
+replayed, and a retry with another body fails with status 422. Rejections, e.g. of
+credentials or rate limits, and server errors are not stored.
+*/
+func (s *Server) SetIdempotencyStore(store IdempotencyStore, ttl time.Duration) {
+	if store == nil {
+		s.idempotency = nil
+		return
+	}
+	s.idempotency = &idempotency{store: store, ttl: ttl}
+}
+
+/*
+Serve accepts incoming HTTP connections on the listener and serves them with the server.
+It publishes EventServeStart and EventServeStop, and always returns a non-nil error.
+*/
+func (s *Server) Serve(l net.Listener) error {
+	s.events.publish(&Event{Type: EventServeStart, Addr: l.Addr()})
+	err := http.Serve(l, s)
+	s.events.publish(&Event{Type: EventServeStop, Addr: l.Addr(), Err: err})
+	return err
+}
+
 /*
 ServeHTTP
 */
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.setSecurityHeaders(w, r)
 	if r.Method != "POST" {
-		WriteError(w, 405, "rpc: POST method required, received "+r.Method)
+		writeError(w, 405, "rpc: POST method required, received ", r.Method)
 		return
 	}
-	contentType := r.Header.Get("Content-Type")
-	idx := strings.Index(contentType, ";")
-	if idx != -1 {
-		contentType = contentType[:idx]
+	if !s.filterIP(w, r) || !s.checkCSRF(w, r) {
+		return
 	}
-	var codec Codec
-	if contentType == "" && len(s.codecs) == 1 {
-		// If Content-Type is not set and only one codec has been registered,
-		// then default to that codec.
-		for _, c := range s.codecs {
-			codec = c
+	if s.minimal && !s.secured() {
+		s.serveMinimal(w, r)
+		return
+	}
+	if !s.verifySignature(w, r) {
+		return
+	}
+	s.serveVerified(w, r)
+}
+
+/*
+serveVerified serves the request whose signature is verified, in the background if it has a
+callback
+*/
+func (s *Server) serveVerified(w http.ResponseWriter, r *http.Request) {
+	if callback := r.Header.Get(CallbackHeader); callback != "" && s.webhooks != nil {
+		s.serveWithCallback(w, r, callback)
+		return
+	}
+	s.serve(w, r)
+}
+
+/*
+verifySignature verifies the signature of the request if the server has a signature policy, and
+reports whether the request may be served, having written the error otherwise
+*/
+func (s *Server) verifySignature(w http.ResponseWriter, r *http.Request) bool {
+	if s.signatures == nil {
+		return true
+	}
+	if err := s.signatures.verifySignature(r); err != nil {
+		status := 401
+		if errors.Is(err, ErrBodyTooLarge) {
+			status = 413
 		}
-	} else if codec = s.codecs[strings.ToLower(contentType)]; codec == nil {
-		WriteError(w, 415, "rpc: unrecognized Content-Type: "+contentType)
+		WriteError(w, status, err.Error())
+		return false
+	}
+	return true
+}
+
+/*
+serve decodes the request, calls the service and writes the response
+*/
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	// Collect the stats of the request.
+	var stats *CallStats
+	if s.statsHandler != nil {
+		stats = &CallStats{Start: time.Now()}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		cw := &countingWriter{ResponseWriter: w, status: 200}
+		w = cw
+		s.statsHandler.RequestStart(stats)
+		defer func() {
+			stats.RequestSize = body.n
+			stats.ResponseSize = cw.n
+			stats.Status = cw.status
+			stats.Duration = time.Since(stats.Start)
+			s.statsHandler.ResponseWritten(stats)
+		}()
+	}
+
+	if status, err := decompressRequest(r, s.maxDecompressed); err != nil {
+		WriteError(w, status, err.Error())
+		stats.fail(err, ClassClient)
+		return
+	}
+
+	codec, err := s.codecFor(r)
+	if err != nil {
+		writeContentTypeError(w, r)
+		stats.fail(err, ClassClient)
+		return
+	}
+
+	// Replay the response of a known idempotency key.
+	if key := r.Header.Get(IdempotencyKeyHeader); key != "" && s.idempotency != nil {
+		s.serveIdempotent(w, r, codec, key, stats)
+		return
+	}
+	s.serveCodec(w, r, codec, stats)
+}
+
+/*
+serveCodec serves the request decoded by the codec
+*/
+func (s *Server) serveCodec(w http.ResponseWriter, r *http.Request, codec Codec, stats *CallStats) {
+	// Serve a streamed call, reading its items as they are received.
+	if method := r.Header.Get(StreamMethodHeader); method != "" {
+		streamCodec, ok := codec.(StreamCodec)
+		if !ok {
+			err := fmt.Errorf("rpc: codec does not support streamed calls")
+			WriteError(w, 415, err.Error())
+			stats.fail(err, ClassClient)
+			return
+		}
+		// HTTP/1.1 needs full duplex to write the response while reading the request.
+		http.NewResponseController(w).EnableFullDuplex()
+		s.serveRequest(w, r, streamCodec.NewStreamRequest(r, method), stats)
 		return
 	}
 
 	// Create a new codec request.
 	codecReq := codec.NewRequest(r)
 
-	rValue := reflect.ValueOf(r)
-	ctx := reflect.New(s.ctxType)
+	// Serve each call of a batch request.
+	if batchReq, ok := codecReq.(BatchCodecRequest); ok {
+		if reqs, isBatch := batchReq.Batch(); isBatch {
+			if err := s.checkBatch(len(reqs)); err != nil {
+				stats.fail(err, ClassClient)
+				codecReq.WriteError(w, 400, err)
+				return
+			}
+			responses := make([][]byte, 0, len(reqs))
+			for _, req := range reqs {
+				bw := newBufferWriter()
+				s.serveRequest(bw, r, req, stats)
+				if bw.buf.Len() > 0 {
+					responses = append(responses, bw.buf.Bytes())
+				}
+			}
+			w.Header().Set("x-content-type-options", "nosniff")
+			batchReq.WriteBatch(w, responses)
+			return
+		}
+	}
+
+	s.serveRequest(w, r, codecReq, stats)
+}
+
+// registeredCodec is a registered codec, counting the requests it decodes.
+type registeredCodec struct {
+	Codec
+	requests atomic.Uint64
+}
+
+// codecMap maps canonical media types to their codecs.
+type codecMap map[string]*registeredCodec
+
+/*
+codecFor returns the codec of the Content-Type of the request, counting its requests
+*/
+func (s *Server) codecFor(r *http.Request) (Codec, error) {
+	contentType := mediaType(r.Header.Get("Content-Type"))
+	if contentType == "" && s.soleCodec != nil {
+		// If Content-Type is not set and only one codec has been registered,
+		// then default to that codec.
+		return s.soleCodec.use(), nil
+	}
+	if codec := s.codecs[contentType]; codec != nil {
+		return codec.use(), nil
+	}
+	// Lower the media type on the stack, the lookup then doesn't allocate.
+	var lower [64]byte
+	if len(contentType) <= len(lower) {
+		for i := 0; i < len(contentType); i++ {
+			c := contentType[i]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			lower[i] = c
+		}
+		if codec := s.codecs[string(lower[:len(contentType)])]; codec != nil {
+			return codec.use(), nil
+		}
+	} else if codec := s.codecs[strings.ToLower(contentType)]; codec != nil {
+		return codec.use(), nil
+	}
+	return nil, errUnrecognizedContentType
+}
+
+/*
+use counts a request of the codec, and returns it
+*/
+func (rc *registeredCodec) use() Codec {
+	rc.requests.Add(1)
+	return rc.Codec
+}
+
+/*
+writeContentTypeError writes the error of a request whose Content-Type has no codec
+*/
+func writeContentTypeError(w http.ResponseWriter, r *http.Request) {
+	writeError(w, 415, errUnrecognizedContentType.Error(), ": ", mediaType(r.Header.Get("Content-Type")))
+}
+
+/*
+mediaType returns the media type of a Content-Type, without its parameters
+*/
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	return strings.TrimSpace(contentType)
+}
+
+/*
+serveRequest serves a single call decoded by the codec request
+*/
+func (s *Server) serveRequest(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, stats *CallStats) {
+	// Log the call and count its errors once it is served.
+	var record *callRecord
+	if s.logger != nil || s.errorSpikes != nil {
+		cw := &countingWriter{ResponseWriter: w, status: 200}
+		w = cw
+		record = &callRecord{start: time.Now(), w: cw}
+		defer func() { s.finishCall(r, record) }()
+	}
+
+	// Apply the time budget sent by the client.
+	if v := r.Header.Get(TimeoutHeader); v != "" {
+		timeout, err := parseTimeout(v)
+		if err != nil {
+			stats.fail(err, ClassClient)
+			record.fail(err, ClassClient)
+			codecReq.WriteError(w, 400, err)
+			return
+		}
+		reqCtx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(reqCtx)
+	}
+
+	md := newMetadata(r, s.metadataHeaders)
+	r = withMetadata(r, md)
+
+	// Authenticate the caller, unless it was before replaying idempotent requests.
+	var principal Principal
+	if authenticated(r) {
+		principal = PrincipalFromRequest(r)
+	} else if s.authenticator != nil {
+		var err error
+		if principal, err = s.authenticate(w, r); err != nil {
+			stats.fail(err, ClassClient)
+			record.fail(err, ClassClient)
+			noteStatus(r, authStatus(err))
+			codecReq.WriteError(w, authStatus(err), err)
+			return
+		}
+		r = withPrincipal(r, principal)
+	}
+
+	// Resolve the tenant of the caller.
+	var tenant string
+	if s.tenants != nil {
+		var status int
+		var err error
+		if tenant, status, err = s.tenants.resolve(r); err != nil {
+			stats.fail(err, ClassClient)
+			record.fail(err, ClassClient)
+			noteStatus(r, status)
+			codecReq.WriteError(w, status, err)
+			return
+		}
+		if tenant != "" {
+			r = withTenant(r, tenant)
+			if stats != nil {
+				stats.Tenant = tenant
+			}
+			if err := s.tenants.allow(w, r, tenant); err != nil {
+				stats.fail(err, ClassClient)
+				record.fail(err, ClassClient)
+				noteStatus(r, 429)
+				codecReq.WriteError(w, 429, err)
+				return
+			}
+		}
+	}
+
+	// The context, args and reply are reused, or freed with the arena of the
+	// call, unless the call is abandoned.
+	arena := s.newArena()
+	pooling := s.pooling && arena == nil
+	reusable := true
+	ctx := s.contexts.getIn(arena, pooling)
+	defer func() {
+		s.contexts.put(ctx, pooling && reusable)
+		if arena != nil && reusable {
+			arena.free()
+		}
+	}()
+	if setter, ok := ctx.Interface().(MetadataSetter); ok {
+		setter.SetMetadata(md)
+	}
+	if setter, ok := ctx.Interface().(ContextSetter); ok {
+		setter.SetContext(r.Context())
+	}
+	if setter, ok := ctx.Interface().(PrincipalSetter); ok && principal != nil {
+		setter.SetPrincipal(principal)
+	}
+	if setter, ok := ctx.Interface().(PublisherSetter); ok && s.subscriptions != nil {
+		setter.SetPublisher(s.subscriptions)
+	}
+	if setter, ok := ctx.Interface().(TenantSetter); ok && tenant != "" {
+		setter.SetTenant(tenant)
+	}
 
 	// execute before functions before service call
-	for _, fn := range s.beforeFns {
-		if err := reflectFuncCall(fn, []reflect.Value{rValue, ctx}); err != nil {
+	for _, h := range s.beforeFns.load() {
+		if err := h.call(r, ctx); err != nil {
+			stats.fail(err, ClassClient)
+			record.fail(err, ClassClient)
 			codecReq.WriteError(w, 400, err)
 			return
 		}
@@ -158,69 +762,315 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Get service method to be called.
 	method, errMethod := codecReq.Method()
 	if errMethod != nil {
+		stats.fail(errMethod, ClassClient)
+		record.fail(errMethod, ClassClient)
 		codecReq.WriteError(w, 400, errMethod)
 		return
 	}
 
-	methodSpec, errGet := s.services.get(method)
+	if stats != nil {
+		stats.Method = method
+	}
+	if record != nil {
+		record.method = method
+	}
+
+	if s.introspection && method == IntrospectionMethod {
+		s.writeIntrospection(w, codecReq)
+		return
+	}
+	if s.isSubscriptionMethod(method) {
+		// The built-in methods are limited and authorized as the other methods.
+		if s.rateLimits != nil {
+			if err := s.rateLimits.allow(w, r, method); err != nil {
+				stats.fail(err, ClassClient)
+				record.fail(err, ClassClient)
+				codecReq.WriteError(w, 429, err)
+				return
+			}
+		}
+		if s.aclTable != nil {
+			if err := s.aclTable.authorize(principal, method); err != nil {
+				stats.fail(err, ClassClient)
+				record.fail(err, ClassClient)
+				codecReq.WriteError(w, 403, err)
+				return
+			}
+		}
+		s.serveSubscription(w, r, codecReq, method, principal)
+		return
+	}
+
+	methodSpec, roles, errGet := s.getMethod(tenant, method)
 	if errGet != nil {
+		stats.fail(errGet, ClassClient)
+		record.fail(errGet, ClassClient)
 		codecReq.WriteError(w, 400, errGet)
 		return
 	}
+	if record != nil {
+		record.level = methodSpec.logLevel
+	}
+	if s.rateLimits != nil {
+		if err := s.rateLimits.allow(w, r, method); err != nil {
+			stats.fail(err, ClassClient)
+			record.fail(err, ClassClient)
+			noteStatus(r, 429)
+			codecReq.WriteError(w, 429, err)
+			return
+		}
+	}
 
-	// Decode the args.
-	args := reflect.New(methodSpec.argsType)
-	if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
-		codecReq.WriteError(w, 400, errRead)
-		return
+	// The audit and sample sinks may retain the args and reply.
+	sampled := s.sampleSink != nil && methodSpec.sampling > 0 && mrand.Float64() < methodSpec.sampling
+	pooled := pooling && s.auditSink == nil && !sampled
+	valuesArena := arena
+	if sampled {
+		valuesArena = nil
 	}
+	args := methodSpec.args.getIn(valuesArena, pooled)
+	defer func() { methodSpec.args.put(args, pooled && reusable) }()
 
-	// create a new reply
-	reply := reflect.New(methodSpec.replyType)
+	// Record the call for auditing.
+	var reply interface{}
+	var callErr error
+	if s.auditSink != nil {
+		start := time.Now()
+		defer func() {
+			event := &AuditEvent{
+				Method:    method,
+				Principal: principal,
+				Args:      Redact(args.Interface()),
+				Err:       callErr,
+				Duration:  time.Since(start),
+			}
+			if callErr == nil {
+				event.Reply = Redact(reply)
+			}
+			s.auditSink.Audit(event)
+		}()
+	}
+	if sampled {
+		sample := &Sample{
+			Time:        time.Now(),
+			Method:      method,
+			ContentType: r.Header.Get("Content-Type"),
+			UserAgent:   r.Header.Get("User-Agent"),
+			Principal:   principal,
+		}
+		defer func() {
+			sample.Args = Redact(args.Interface())
+			sample.Err = callErr
+			if callErr == nil {
+				sample.Reply = Redact(reply)
+			}
+			s.sampleSink.Sample(sample)
+		}()
+	}
 
-	// Call the service method.
-	if err := reflectFuncCall(methodSpec.method.Func, []reflect.Value{
-		methodSpec.service.rValue,
-		ctx,
-		args,
-		reply,
-	}); err != nil {
-		codecReq.WriteError(w, 400, err)
+	// Check the roles required by the method and the ACL table.
+	if callErr = authorize(principal, roles); callErr == nil && s.aclTable != nil {
+		callErr = s.aclTable.authorize(principal, method)
+	}
+	if callErr != nil {
+		stats.fail(callErr, ClassClient)
+		record.fail(callErr, ClassClient)
+		noteStatus(r, 403)
+		codecReq.WriteError(w, 403, callErr)
 		return
 	}
 
+	// Decode the args, or let the method read the items of a streamed call or
+	// decode Lazy args.
+	_, endDecode := s.startStage(r.Context(), StageDecode, method)
+	if stream, ok := args.Interface().(*RequestStream); ok {
+		if r.Header.Get(StreamMethodHeader) == "" {
+			callErr = fmt.Errorf("rpc: %s requires a streamed call", method)
+		}
+		stream.codecReq = codecReq
+		defer stream.close()
+	} else if lazy, ok := args.Interface().(lazyArgs); ok {
+		// The method decodes the args if it needs them.
+		lazy.setDecoder(codecReq.ReadRequest)
+	} else {
+		callErr = codecReq.ReadRequest(args.Interface())
+	}
+	endDecode(callErr)
+	if stats != nil {
+		stats.DecodeTime = time.Since(stats.Start)
+		stats.fail(callErr, ClassClient)
+		s.statsHandler.DecodeComplete(stats)
+	}
+	if callErr != nil {
+		record.fail(callErr, ClassClient)
+		codecReq.WriteError(w, 400, callErr)
+		return
+	}
+
+	// Serve the cached reply if any.
+	var key string
+	cached := false
+	if methodSpec.cacheTTL > 0 && s.cache != nil {
+		if k, err := cacheKey(method, args.Interface()); err == nil {
+			key = k
+			if tenant != "" {
+				// Tenants never share replies.
+				key = tenant + "\x00" + key
+			}
+			reply, cached = s.cache.Get(key)
+		}
+	}
+
+	if !cached {
+		// create a new reply, unless it is cached
+		replyPooled := pooled && key == ""
+		replyArena := valuesArena
+		if key != "" {
+			// Cached replies outlive the call.
+			replyArena = nil
+		}
+		replyValue := methodSpec.reply.getIn(replyArena, replyPooled)
+		defer func() { methodSpec.reply.put(replyValue, replyPooled && reusable) }()
+		if stream, ok := replyValue.Interface().(*ResponseStream); ok {
+			w.Header().Set("x-content-type-options", "nosniff")
+			stream.ctx, stream.w, stream.codecReq = r.Context(), streamWriter{w}, codecReq
+			defer stream.close()
+		}
+
+		// Call the service method, giving up when the deadline expires.
+		dispatchCtx, endDispatch := s.startStage(r.Context(), StageDispatch, method)
+		if setter, ok := ctx.Interface().(ContextSetter); ok && s.tracer != nil {
+			setter.SetContext(dispatchCtx)
+		}
+		handlerStart := time.Now()
+		call := func() (err error) {
+			// A panic fails the call rather than the process.
+			defer recoverCall(&err)
+			return methodSpec.invoke(dispatchCtx, ctx, args, replyValue)
+		}
+		workers := methodSpec.workers
+		if workers == nil {
+			workers = s.workers
+		}
+		if workers != nil {
+			callErr = workers.run(r.Context(), call)
+		} else {
+			callErr = callWithContext(r.Context(), call)
+		}
+		if _, panicked := callErr.(*PanicError); panicked || r.Context().Err() != nil {
+			// The method may still be running, or have left the values inconsistent.
+			reusable = false
+		}
+		if lazy, ok := args.Interface().(lazyArgs); ok {
+			lazy.close()
+		}
+		handlerTime := time.Since(handlerStart)
+		methodSpec.counters.record(handlerTime, callErr)
+		if s.slowCalls != nil {
+			s.slowCalls.logSlowCall(r.Context(), method, methodSpec, handlerTime, args, callErr)
+		}
+		endDispatch(callErr)
+		if stats != nil {
+			stats.HandlerTime = handlerTime
+			stats.fail(callErr, ClassServer)
+			s.statsHandler.HandlerComplete(stats)
+		}
+		if callErr != nil {
+			status := 400
+			if callErr == ErrDeadlineExceeded {
+				status = 504
+			} else if callErr == ErrWorkerPoolClosed {
+				status = 503
+			} else if _, panicked := callErr.(*PanicError); panicked {
+				status = 500
+			}
+			err := s.translateError(method, callErr)
+			record.fail(err, errorClass(callErr, ClassServer))
+			noteStatus(r, status)
+			var panicErr *PanicError
+			if errors.As(err, &panicErr) {
+				err = ErrInternal
+			}
+			codecReq.WriteError(w, status, err)
+			return
+		}
+
+		reply = replyValue.Interface()
+		if key != "" {
+			s.cache.Set(key, reply, methodSpec.cacheTTL)
+		}
+	}
+
 	// execute after functions before service call
-	for _, fn := range s.afterFns {
-		if err := reflectFuncCall(fn, []reflect.Value{rValue, ctx}); err != nil {
-			codecReq.WriteError(w, 400, err)
+	for _, h := range s.afterFns.load() {
+		if callErr = h.call(r, ctx); callErr != nil {
+			stats.fail(callErr, ClassServer)
+			record.fail(callErr, ClassServer)
+			codecReq.WriteError(w, 400, callErr)
 			return
 		}
 	}
 
+	// The items of a streamed reply are already written.
+	if _, ok := reply.(*ResponseStream); ok {
+		return
+	}
+
 	w.Header().Set("x-content-type-options", "nosniff")
-	codecReq.WriteResponse(w, reply.Interface())
+	_, endEncode := s.startStage(r.Context(), StageEncode, method)
+	if streamer, ok := reply.(Streamer); ok && acceptsEventStream(r) {
+		if flusher, ok := w.(http.Flusher); ok {
+			if err := writeEventStream(r.Context(), w, flusher, codecReq, streamer); err != nil {
+				stats.fail(err, ClassServer)
+				record.fail(err, ClassServer)
+			}
+			endEncode(nil)
+			return
+		}
+	}
+	codecReq.WriteResponse(w, reply)
+	endEncode(nil)
 }
 
 /*
-WriteError, a helper function to write error message to ResponseWriter
+translateError applies the error translator to an error returned by a service method
+*/
+func (s *Server) translateError(method string, err error) error {
+	if s.errorTranslator == nil {
+		return err
+	}
+	if translated := s.errorTranslator(method, err); translated != nil {
+		return translated
+	}
+	return err
+}
+
+/*
+WriteError, a helper function to write error message to ResponseWriter, the status text if msg is
+empty. It doesn't allocate, so rejecting requests stays cheap.
 */
 func WriteError(w http.ResponseWriter, status int, msg string) {
-	w.WriteHeader(status)
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	fmt.Fprint(w, msg)
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	writeError(w, status, msg)
 }
 
 /*
-reflectFuncCall, a helper function to call a function in reflect way and return error
+writeError writes the concatenation of the parts as a plain text error, without building it
 */
-func reflectFuncCall(fn reflect.Value, args []reflect.Value) error {
-	errValue := fn.Call(args)
-	var errResult error
-	errInter := errValue[0].Interface()
-	if errInter != nil {
-		errResult = errInter.(error)
+func writeError(w http.ResponseWriter, status int, parts ...string) {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	header := w.Header()
+	header["Content-Type"] = textPlainHeader
+	SetContentLength(header, n)
+	w.WriteHeader(status)
+	for _, part := range parts {
+		io.WriteString(w, part)
 	}
-	return errResult
 }
 
 /*
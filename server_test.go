@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testCodec struct{ name string }
+
+func (*testCodec) NewRequest(*http.Request) CodecRequest {
+	return nil
+}
+
+func TestCodecFor(t *testing.T) {
+	server, err := NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	jsonCodec, cborCodec := &testCodec{"json"}, &testCodec{"cbor"}
+	server.RegisterCodec(jsonCodec, "Application/JSON")
+
+	r := httptest.NewRequest("POST", "/", nil)
+	codec, err := server.codecFor(r)
+	assert.NoError(t, err)
+	assert.Equal(t, jsonCodec, codec)
+
+	server.RegisterCodec(cborCodec, "application/cbor")
+	_, err = server.codecFor(r)
+	assert.Error(t, err)
+
+	for contentType, expected := range map[string]Codec{
+		"application/json":                jsonCodec,
+		"APPLICATION/JSON; charset=utf-8": jsonCodec,
+		" application/cbor ":              cborCodec,
+		"application/cbor;q=1":            cborCodec,
+		"application/xml":                 nil,
+		"application/json-seq; charset=x": nil,
+	} {
+		r.Header.Set("Content-Type", contentType)
+		codec, err := server.codecFor(r)
+		if expected == nil {
+			assert.Error(t, err, contentType)
+		} else {
+			assert.Equal(t, expected, codec, contentType)
+		}
+	}
+
+	// Codec selection doesn't allocate, whatever the case of the media type.
+	r.Header.Set("Content-Type", "Application/Json; charset=utf-8")
+	allocs := testing.AllocsPerRun(100, func() {
+		server.codecFor(r)
+	})
+	assert.Zero(t, allocs)
+}
+
+// discardWriter is a http.ResponseWriter dropping the response, writing
+// strings as the writers of net/http do.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header               { return w.header }
+func (w *discardWriter) WriteHeader(status int)            { w.status = status }
+func (w *discardWriter) Write(p []byte) (int, error)       { return len(p), nil }
+func (w *discardWriter) WriteString(s string) (int, error) { return len(s), nil }
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, 404, "")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "Not Found", w.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "9", w.Header().Get("Content-Length"))
+
+	// Rejecting a request doesn't allocate.
+	server, err := NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(&testCodec{"json"}, "application/json")
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Content-Type", "application/xml")
+	discard := &discardWriter{header: make(http.Header)}
+	allocs := testing.AllocsPerRun(100, func() {
+		server.ServeHTTP(discard, r)
+	})
+	assert.Equal(t, 415, discard.status)
+	assert.Zero(t, allocs)
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	assert.Equal(t, "rpc: unrecognized Content-Type: application/xml", w.Body.String())
+}
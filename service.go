@@ -8,9 +8,12 @@ package rpc
 
 import (
 	"fmt"
+	"log/slog"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type serviceMethod struct {
@@ -18,6 +21,22 @@ type serviceMethod struct {
 	method    reflect.Method // receiver method
 	argsType  reflect.Type   // type of the request argument
 	replyType reflect.Type   // type of the response argument
+	roles     []string       // roles required to call the method
+	cacheTTL  time.Duration  // lifetime of cached replies, zero if not cached
+	workers   *WorkerPool    // runs the calls, nil to use the pool of the server
+	logLevel  slog.Level     // level at which calls are logged
+	slowAfter time.Duration  // time above which calls are slow, zero to use the policy threshold
+	sampling  float64        // fraction of the calls recorded by the sample sink
+	counters  *callCounters  // counts the calls
+	args      *allocator     // allocates the args of calls
+	reply     *allocator     // allocates the replies of calls
+
+	// middleware wraps the calls, the first one being the outermost.
+	middleware []Middleware
+
+	// call calls the method with the ctx, args and reply pointers, built once
+	// at registration.
+	call func(ctx, args, reply reflect.Value) error
 }
 
 type service struct {
@@ -26,18 +45,49 @@ type service struct {
 	rValue  reflect.Value             // receiver of methods for the service
 }
 
-// serviceMap is a registry for services.
+// serviceMap is a registry for services. Lookups read an immutable map
+// without locking, while changes replace it with an updated copy.
 type serviceMap struct {
-	mutex    sync.Mutex
-	services map[string]*service
+	mutex    sync.Mutex   // serializes the changes
+	services atomic.Value // map[string]*service, never modified once stored
+}
+
+/*
+load returns the current map of services
+*/
+func (m *serviceMap) load() map[string]*service {
+	services, _ := m.services.Load().(map[string]*service)
+	return services
+}
+
+/*
+store replaces the map of services by a copy of the current one updated by change, the mutex
+is held
+*/
+func (m *serviceMap) store(change func(services map[string]*service)) {
+	current := m.load()
+	services := make(map[string]*service, len(current)+1)
+	for name, s := range current {
+		services[name] = s
+	}
+	change(services)
+	m.services.Store(services)
 }
 
 /*
 register adds a new service using reflection to extract its methods
 */
 func (m *serviceMap) add(rcvr interface{}, name string, ctxType reflect.Type) error {
+	_, err := m.addWithACL(rcvr, name, ctxType, nil)
+	return err
+}
+
+/*
+addWithACL adds a new service, and attaches the roles in acl to its methods
+*/
+func (m *serviceMap) addWithACL(rcvr interface{}, name string, ctxType reflect.Type, acl ACL) (*service, error) {
 	if rcvr == nil {
-		return fmt.Errorf("rpc: nil rcvr is not allowed")
+		return nil, fmt.Errorf("rpc: nil rcvr is not allowed")
 	}
 
 	s := &service{
@@ -52,7 +102,7 @@ func (m *serviceMap) add(rcvr interface{}, name string, ctxType reflect.Type) er
 	}
 
 	if s.name == "" {
-		return fmt.Errorf("rpc: no service name for type %q", s.rValue.String())
+		return nil, fmt.Errorf("rpc: no service name for type %q", s.rValue.String())
 	}
 
 	// iterate methods
@@ -99,24 +149,43 @@ func (m *serviceMap) add(rcvr interface{}, name string, ctxType reflect.Type) er
 			method:    m,
 			argsType:  args.Elem(),
 			replyType: reply.Elem(),
+			args:      newAllocator(args.Elem(), nil),
+			reply:     newAllocator(reply.Elem(), nil),
+			call:      reflectCall(s.rValue.Method(i)),
+			counters:  new(callCounters),
 		}
 	}
 
 	if len(s.methods) == 0 {
-		return fmt.Errorf("rpc: %q has no exported methods of suitable type", s.name)
+		return nil, fmt.Errorf("rpc: %q has no exported methods of suitable type", s.name)
+	}
+
+	// attach roles
+	for method, roles := range acl {
+		if method == ACLAllMethods {
+			for _, sm := range s.methods {
+				sm.roles = append(sm.roles, roles...)
+			}
+			continue
+		}
+		sm := s.methods[method]
+		if sm == nil {
+			return nil, fmt.Errorf("rpc: acl of %q refers to unknown method %q", s.name, method)
+		}
+		sm.roles = append(sm.roles, roles...)
 	}
 
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if m.services == nil {
-		m.services = make(map[string]*service)
-	} else if _, ok := m.services[s.name]; ok {
-		return fmt.Errorf("rpc: service %q already defined", s.name)
+	if _, ok := m.load()[s.name]; ok {
+		return nil, fmt.Errorf("rpc: service %q already defined", s.name)
 	}
-	m.services[s.name] = s
+	m.store(func(services map[string]*service) {
+		services[s.name] = s
+	})
 
-	return nil
+	return s, nil
 }
 
 /*
@@ -124,19 +193,17 @@ get returns a registered service given a method name.
 The method name uses a dotted notation as in "Service.Method".
 */
 func (m *serviceMap) get(method string) (*serviceMethod, error) {
-	parts := strings.Split(method, ".")
-	if len(parts) != 2 {
+	serviceName, methodName, ok := strings.Cut(method, ".")
+	if !ok || strings.Contains(methodName, ".") {
 		err := fmt.Errorf("rpc: service/method request ill-formed: %q", method)
 		return nil, err
 	}
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	service := m.services[parts[0]]
+	service := m.load()[serviceName]
 	if service == nil {
 		err := fmt.Errorf("rpc: can't find service %q", method)
 		return nil, err
 	}
-	serviceMethod := service.methods[parts[1]]
+	serviceMethod := service.methods[methodName]
 	if serviceMethod == nil {
 		err := fmt.Errorf("rpc: can't find method %q", method)
 		return nil, err
@@ -145,14 +212,152 @@ func (m *serviceMap) get(method string) (*serviceMethod, error) {
 }
 
 /*
-return the map of names of services with its methods
+takesStreams reports whether the method reads a RequestStream or replies with a ResponseStream
 */
-func (m *serviceMap) Map() (ret map[string][]string) {
+func (sm *serviceMethod) takesStreams() bool {
+	return sm.argsType == reflect.TypeOf(RequestStream{}) || sm.replyType == reflect.TypeOf(ResponseStream{})
+}
+
+/*
+reflectCall returns the call of a method bound to its receiver, made with reflection
+*/
+func reflectCall(fn reflect.Value) func(ctx, args, reply reflect.Value) error {
+	return func(ctx, args, reply reflect.Value) error {
+		out := fn.Call([]reflect.Value{ctx, args, reply})
+		if out[0].IsNil() {
+			return nil
+		}
+		return out[0].Interface().(error)
+	}
+}
+
+/*
+addMethod adds a method to a service, created if it is not registered yet
+*/
+func (m *serviceMap) addMethod(serviceName, methodName string, sm *serviceMethod) (*service, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	old := m.load()[serviceName]
+	if old == nil {
+		old = &service{name: serviceName}
+	} else if old.methods[methodName] != nil {
+		return nil, fmt.Errorf("rpc: method \"%s.%s\" already defined", serviceName, methodName)
+	}
+	s := old.update(func(methods map[string]*serviceMethod) {
+		methods[methodName] = sm
+	})
+	m.store(func(services map[string]*service) {
+		services[s.name] = s
+	})
+	return s, nil
+}
+
+/*
+update returns a copy of the service, with copies of its methods changed by change
+*/
+func (s *service) update(change func(methods map[string]*serviceMethod)) *service {
+	methods := make(map[string]*serviceMethod, len(s.methods)+1)
+	for name, sm := range s.methods {
+		methods[name] = sm
+	}
+	change(methods)
+
+	updated := &service{name: s.name, rValue: s.rValue, methods: make(map[string]*serviceMethod, len(methods))}
+	for name, sm := range methods {
+		copied := *sm
+		copied.service = updated
+		updated.methods[name] = &copied
+	}
+	return updated
+}
+
+/*
+methodNames returns the names of the methods of the service
+*/
+func (s *service) methodNames() []string {
+	ret := make([]string, 0, len(s.methods))
+	for method := range s.methods {
+		ret = append(ret, method)
+	}
+	return ret
+}
+
+/*
+setCacheTTL sets the lifetime of cached replies of a method, zero disables caching
+*/
+func (m *serviceMap) setCacheTTL(method string, ttl time.Duration) error {
+	return m.updateMethod(method, func(sm *serviceMethod) {
+		sm.cacheTTL = ttl
+	})
+}
+
+/*
+setWorkerPool sets the pool running the calls of the method
+*/
+func (m *serviceMap) setWorkerPool(method string, pool *WorkerPool) error {
+	return m.updateMethod(method, func(sm *serviceMethod) {
+		sm.workers = pool
+	})
+}
+
+/*
+setLogLevel sets the level at which the calls of the method are logged
+*/
+func (m *serviceMap) setLogLevel(method string, level slog.Level) error {
+	return m.updateMethod(method, func(sm *serviceMethod) {
+		sm.logLevel = level
+	})
+}
+
+/*
+setSlowThreshold sets the time above which the calls of the method are slow
+*/
+func (m *serviceMap) setSlowThreshold(method string, threshold time.Duration) error {
+	return m.updateMethod(method, func(sm *serviceMethod) {
+		sm.slowAfter = threshold
+	})
+}
+
+/*
+setSampleRate sets the fraction of the calls of the method recorded by the sample sink
+*/
+func (m *serviceMap) setSampleRate(method string, rate float64) error {
+	return m.updateMethod(method, func(sm *serviceMethod) {
+		sm.sampling = rate
+	})
+}
+
+/*
+updateMethod applies change to a copy of the method, replacing the service by a copy as requests
+may be reading it
+*/
+func (m *serviceMap) updateMethod(method string, change func(*serviceMethod)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	target, err := m.get(method)
+	if err != nil {
+		return err
+	}
+
+	_, methodName, _ := strings.Cut(method, ".")
+	s := target.service.update(func(methods map[string]*serviceMethod) {
+		updated := *target
+		change(&updated)
+		methods[methodName] = &updated
+	})
+	m.store(func(services map[string]*service) {
+		services[s.name] = s
+	})
+	return nil
+}
+
+/*
+return the map of names of services with its methods
+*/
+func (m *serviceMap) Map() (ret map[string][]string) {
 	ret = make(map[string][]string)
-	for _, s := range m.services {
+	for _, s := range m.load() {
 		ret[s.name] = make([]string, 0, len(s.methods))
 		for method, _ := range s.methods {
 			ret[s.name] = append(ret[s.name], method)
@@ -4,7 +4,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"log"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 type Context struct{}
@@ -52,3 +54,53 @@ func TestServiceMap(t *testing.T) {
 		"Second":      []string{"Hello"},
 	}, m)
 }
+
+func TestServiceMapConcurrent(t *testing.T) {
+	services := new(serviceMap)
+	if err := services.add(new(TestService), "", reflect.TypeOf(Context{})); err != nil {
+		log.Fatal(err)
+	}
+
+	// Lookups run while services are added and updated.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				method, err := services.get("TestService.Hello")
+				assert.NoError(t, err)
+				_ = method.cacheTTL
+			}
+		}()
+	}
+	for _, name := range []string{"A", "B", "C"} {
+		assert.NoError(t, services.add(new(TestService), name, reflect.TypeOf(Context{})))
+		assert.NoError(t, services.setCacheTTL("TestService.Hello", time.Minute))
+	}
+	wg.Wait()
+
+	method, err := services.get("TestService.Hello")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, method.cacheTTL)
+	assert.Equal(t, method.service.methods["Hello"], method)
+	assert.Len(t, services.Map(), 4)
+}
+
+func TestAllocator(t *testing.T) {
+	type args struct{ Text string }
+	a := newAllocator(reflect.TypeOf(args{}), nil)
+
+	v := a.get(true)
+	v.Interface().(*args).Text = "used"
+	a.put(v, true)
+	for i := 0; i < 10; i++ {
+		v := a.get(true)
+		assert.Equal(t, "", v.Interface().(*args).Text)
+		a.put(v, true)
+	}
+
+	// Streams are never pooled.
+	s := newAllocator(reflect.TypeOf(RequestStream{}), nil)
+	assert.False(t, s.poolable)
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers of HMAC signed requests.
+const (
+	SignatureHeader = "X-Signature" // hex encoded HMAC-SHA256 of the timestamp, nonce and body
+	TimestampHeader = "X-Timestamp" // unix time in seconds of the signature
+	NonceHeader     = "X-Nonce"     // random value unique to the request
+)
+
+// requestSigner authenticates a request before it is sent, given its body.
+type requestSigner func(req *http.Request, body []byte) error
+
+/*
+WithBearerToken sends the token in the "Authorization: Bearer" header of every request
+*/
+func WithBearerToken(token string) ClientOption {
+	return WithBearerTokenFunc(func(context.Context) (string, error) {
+		return token, nil
+	})
+}
+
+/*
+WithBearerTokenFunc sends the token returned by fn in the "Authorization: Bearer" header of every
+request, so tokens can be refreshed
+*/
+func WithBearerTokenFunc(fn func(ctx context.Context) (string, error)) ClientOption {
+	return func(c *Client) {
+		c.signers = append(c.signers, func(req *http.Request, body []byte) error {
+			token, err := fn(req.Context())
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			return nil
+		})
+	}
+}
+
+/*
+WithHMACSigning signs the body of every request with secret, setting the X-Timestamp, X-Nonce
+and X-Signature headers verified by Server.SetSignaturePolicy
+*/
+func WithHMACSigning(secret []byte) ClientOption {
+	return func(c *Client) {
+		c.signers = append(c.signers, func(req *http.Request, body []byte) error {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			nonce := newIdempotencyKey()
+			req.Header.Set(TimestampHeader, timestamp)
+			req.Header.Set(NonceHeader, nonce)
+			req.Header.Set(SignatureHeader, Sign(secret, timestamp, nonce, body))
+			return nil
+		})
+	}
+}
+
+/*
+Sign returns the hex encoded HMAC-SHA256 of the timestamp, nonce and body with secret
+*/
+func Sign(secret []byte, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{'\n'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrInvalidSignature is the error of the requests without valid signature.
+var ErrInvalidSignature = errors.New("rpc: invalid request signature")
+
+// DefaultMaxSignedBytes is the default size limit of the bodies of signed requests.
+const DefaultMaxSignedBytes = 8 << 20
+
+// SignaturePolicy configures the verification of the requests signed by WithHMACSigning.
+type SignaturePolicy struct {
+	Secret       []byte       // secret shared with the clients
+	Replay       *ReplayGuard // checks the timestamps and nonces, NewReplayGuard(0, nil) if nil
+	MaxBodyBytes int64        // size limit of the bodies, DefaultMaxSignedBytes if zero
+}
+
+/*
+SetSignaturePolicy verifies the X-Signature header of every request, the HMAC-SHA256 of its
+X-Timestamp, X-Nonce and body computed by Sign, before the body is decompressed and decoded.
+
+Requests without valid signature, or rejected by the ReplayGuard of the policy, are rejected with
+status 401. The body is read before the request is authenticated, so bodies larger than
+MaxBodyBytes are rejected with status 413 and ErrBodyTooLarge. A nil policy disables the
+verification.
+*/
+func (s *Server) SetSignaturePolicy(policy *SignaturePolicy) {
+	if policy != nil && (policy.Replay == nil || policy.MaxBodyBytes <= 0) {
+		p := *policy
+		if p.Replay == nil {
+			p.Replay = NewReplayGuard(0, nil)
+		}
+		if p.MaxBodyBytes <= 0 {
+			p.MaxBodyBytes = DefaultMaxSignedBytes
+		}
+		policy = &p
+	}
+	s.signatures = policy
+}
+
+/*
+verifySignature reads the body of the request and verifies its signature, restoring the body
+to be decoded
+*/
+func (p *SignaturePolicy) verifySignature(r *http.Request) error {
+	timestamp := r.Header.Get(TimestampHeader)
+	nonce := r.Header.Get(NonceHeader)
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return ErrInvalidSignature
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, p.MaxBodyBytes+1))
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > p.MaxBodyBytes {
+		return fmt.Errorf("%w: more than %d bytes signed", ErrBodyTooLarge, p.MaxBodyBytes)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	expected, _ := hex.DecodeString(Sign(p.Secret, timestamp, nonce, body))
+	if !hmac.Equal(signature, expected) {
+		return ErrInvalidSignature
+	}
+	return p.Replay.Check(timestamp, nonce)
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader is the request header whose value is logged as the request ID of the calls.
+const RequestIDHeader = "X-Request-Id"
+
+/*
+SetLogger logs a structured record for every call served, with its method, duration, status,
+error, error class, error code, redacted error data, request ID and principal. The calls of a
+batch are logged separately.
+
+Calls are logged at the level of their method, slog.LevelInfo unless set by SetLogLevel, and
+failed calls one level higher, e.g. slog.LevelWarn rather than slog.LevelInfo. A nil logger
+disables logging.
+*/
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
+/*
+SetLogLevel sets the level at which the calls of a registered method are logged, e.g.
+slog.LevelDebug for a health check polled every second
+*/
+func (s *Server) SetLogLevel(method string, level slog.Level) error {
+	return s.services.setLogLevel(method, level)
+}
+
+// callRecord collects the fields logged for a call.
+type callRecord struct {
+	start  time.Time
+	w      *countingWriter
+	method string
+	level  slog.Level
+	err    error
+	class  ErrorClass
+}
+
+/*
+fail records the error of the call, keeping the first one
+*/
+func (rec *callRecord) fail(err error, class ErrorClass) {
+	if rec != nil && rec.err == nil && err != nil {
+		rec.err = err
+		rec.class = errorClass(err, class)
+	}
+}
+
+/*
+finishCall logs the record of the call and counts its error
+*/
+func (s *Server) finishCall(r *http.Request, rec *callRecord) {
+	if s.logger != nil {
+		s.logCall(r, rec)
+	}
+	if s.errorSpikes != nil {
+		s.errorSpikes.observe(rec.class)
+	}
+}
+
+/*
+logCall logs the record of the call of the request
+*/
+func (s *Server) logCall(r *http.Request, rec *callRecord) {
+	level := rec.level
+	if rec.err != nil {
+		level += 4
+	}
+	if !s.logger.Enabled(r.Context(), level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, 8)
+	attrs = append(attrs,
+		slog.String("method", rec.method),
+		slog.Duration("duration", time.Since(rec.start)),
+		slog.Int("status", rec.w.status),
+	)
+	if rec.err != nil {
+		attrs = append(attrs, slog.String("error", rec.err.Error()), slog.String("error_class", string(rec.class)))
+		var rpcErr *Error
+		if errors.As(rec.err, &rpcErr) {
+			attrs = append(attrs, slog.Int("code", rpcErr.Code))
+			if rpcErr.Data != nil {
+				attrs = append(attrs, slog.Any("error_data", Redact(rpcErr.Data)))
+			}
+		}
+	}
+	if id := r.Header.Get(RequestIDHeader); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	if p := PrincipalFromRequest(r); p != nil {
+		attrs = append(attrs, slog.String("principal", p.Name()))
+	}
+	if tenant := TenantFromRequest(r); tenant != "" {
+		attrs = append(attrs, slog.String("tenant", tenant))
+	}
+	s.logger.LogAttrs(r.Context(), level, "rpc: call", attrs...)
+}
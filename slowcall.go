@@ -0,0 +1,69 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"log/slog"
+	mrand "math/rand"
+	"reflect"
+	"time"
+)
+
+// SlowCallPolicy configures the logging of slow calls.
+type SlowCallPolicy struct {
+	Logger         *slog.Logger  // logs the slow calls, slog.Default() if nil
+	Threshold      time.Duration // time in the method above which a call is slow, none if zero
+	ArgsSampleRate float64       // fraction of the slow calls logged with their args, from 0 to 1
+}
+
+/*
+SetSlowCalls logs the calls spending more than their threshold in the service method at
+slog.LevelWarn, with the method, duration, threshold and error, to catch pathological inputs
+without logging every request. A sample of the slow calls is logged with their args, the fields
+tagged `redact:"true"` replaced by Redacted. A nil policy disables slow-call logging.
+*/
+func (s *Server) SetSlowCalls(policy *SlowCallPolicy) {
+	s.slowCalls = policy
+}
+
+/*
+SetSlowCallThreshold sets the threshold above which the calls of a registered method are slow,
+overriding the threshold of the SlowCallPolicy. A zero threshold reverts the method to the
+threshold of the policy.
+*/
+func (s *Server) SetSlowCallThreshold(method string, threshold time.Duration) error {
+	return s.services.setSlowThreshold(method, threshold)
+}
+
+/*
+logSlowCall logs the call of the method if it took longer than its threshold
+*/
+func (p *SlowCallPolicy) logSlowCall(ctx context.Context, method string, methodSpec *serviceMethod, elapsed time.Duration, args reflect.Value, err error) {
+	threshold := methodSpec.slowAfter
+	if threshold == 0 {
+		threshold = p.Threshold
+	}
+	if threshold <= 0 || elapsed <= threshold {
+		return
+	}
+	logger := p.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	attrs := make([]slog.Attr, 0, 5)
+	attrs = append(attrs,
+		slog.String("method", method),
+		slog.Duration("duration", elapsed),
+		slog.Duration("threshold", threshold),
+	)
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	if p.ArgsSampleRate > 0 && mrand.Float64() < p.ArgsSampleRate {
+		attrs = append(attrs, slog.Any("args", Redact(args.Interface())))
+	}
+	logger.LogAttrs(ctx, slog.LevelWarn, "rpc: slow call", attrs...)
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// EventStreamContentType is the Content-Type of Server-Sent Events.
+const EventStreamContentType = "text/event-stream"
+
+const eventStreamMaxLine = 16 << 20 // maximum size of a line of an event
+
+// Streamer is implemented by replies delivered as a stream of Server-Sent
+// Events, e.g. to report the progress of long-running methods. The method
+// prepares the reply, then the server calls Stream once the after funcs have
+// run, if the client accepts "text/event-stream". Otherwise the reply is
+// written as usual.
+type Streamer interface {
+	// Stream sends the items of the reply with send until it returns. ctx is
+	// canceled when the client goes away.
+	Stream(ctx context.Context, send func(item interface{}) error) error
+}
+
+/*
+acceptsEventStream reports whether the client of the request accepts Server-Sent Events
+*/
+func acceptsEventStream(r *http.Request) bool {
+	return headerContains(r.Header, "Accept", EventStreamContentType)
+}
+
+/*
+writeEventStream streams the items of the reply as Server-Sent Events, each one holding the
+response of the codec for the item. An error of the stream is sent as an "error" event.
+*/
+func writeEventStream(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, codecReq CodecRequest, streamer Streamer) error {
+	w.Header().Set("Content-Type", EventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	writeEvent := func(event string, data []byte) error {
+		var buf bytes.Buffer
+		if event != "" {
+			buf.WriteString("event: " + event + "\n")
+		}
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			buf.WriteString("data: " + line + "\n")
+		}
+		buf.WriteString("\n")
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	err := streamer.Stream(ctx, func(item interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bw := newBufferWriter()
+		codecReq.WriteResponse(bw, item)
+		return writeEvent("", bw.buf.Bytes())
+	})
+	if err != nil && ctx.Err() == nil {
+		bw := newBufferWriter()
+		codecReq.WriteError(bw, 500, err)
+		writeEvent("error", bw.buf.Bytes())
+	}
+	return err
+}
+
+// eventStreamReader reads the data of the events of a Server-Sent Events
+// stream, each event followed by a newline.
+type eventStreamReader struct {
+	scanner *bufio.Scanner
+	buf     bytes.Buffer // data of the current event not read yet
+}
+
+func newEventStreamReader(r io.Reader) *eventStreamReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), eventStreamMaxLine)
+	return &eventStreamReader{scanner: scanner}
+}
+
+func (er *eventStreamReader) Read(p []byte) (int, error) {
+	for er.buf.Len() == 0 {
+		if !er.scanner.Scan() {
+			if err := er.scanner.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		line := er.scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			er.buf.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			er.buf.WriteByte('\n')
+		}
+	}
+	return er.buf.Read(p)
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorClass classifies the error of a request.
+type ErrorClass string
+
+const (
+	ClassNone    ErrorClass = ""        // no error
+	ClassClient  ErrorClass = "client"  // rejected before the service call, e.g. bad request or auth failure
+	ClassServer  ErrorClass = "server"  // returned by the service method or an after func
+	ClassTimeout ErrorClass = "timeout" // deadline exceeded
+	ClassPanic   ErrorClass = "panic"   // the service method panicked
+)
+
+// CallStats collects the stats of a request. The same CallStats is passed to
+// every callback of a StatsHandler for a request.
+type CallStats struct {
+	Method       string        // method in dotted notation, empty if not decoded
+	Tenant       string        // tenant of the request, empty if none
+	Start        time.Time     // time the request was received
+	DecodeTime   time.Duration // time spent until args were decoded
+	HandlerTime  time.Duration // time spent in the service method
+	Duration     time.Duration // total time spent until the response was written
+	RequestSize  int64         // bytes read from the request body
+	ResponseSize int64         // bytes written to the response body
+	Status       int           // http status of the response
+	Err          error         // error of the request
+	ErrClass     ErrorClass    // class of Err
+
+	// Tag can be set by the StatsHandler to carry its own data across callbacks.
+	Tag interface{}
+}
+
+/*
+fail records the error of the request, keeping the first one
+*/
+func (cs *CallStats) fail(err error, class ErrorClass) {
+	if cs == nil || cs.Err != nil {
+		return
+	}
+	cs.Err = err
+	cs.ErrClass = errorClass(err, class)
+}
+
+/*
+errorClass returns the class of err, class unless the deadline was exceeded or the method panicked
+*/
+func errorClass(err error, class ErrorClass) ErrorClass {
+	if err == ErrDeadlineExceeded {
+		return ClassTimeout
+	}
+	if _, ok := err.(*PanicError); ok {
+		return ClassPanic
+	}
+	return class
+}
+
+// StatsHandler receives the stats of every request at each stage.
+type StatsHandler interface {
+	// RequestStart is called when a request is received.
+	RequestStart(*CallStats)
+	// DecodeComplete is called when the args have been decoded, or failed to.
+	DecodeComplete(*CallStats)
+	// HandlerComplete is called when the service method has returned.
+	HandlerComplete(*CallStats)
+	// ResponseWritten is called when the response has been written.
+	ResponseWritten(*CallStats)
+}
+
+// MethodStats are the counters of the calls of a method since its registration.
+type MethodStats struct {
+	Calls   uint64        // calls of the method
+	Errors  uint64        // calls returning an error or timing out
+	Latency time.Duration // cumulative time spent in the method
+}
+
+// callCounters counts the calls of a method, shared by the copies of the
+// method made when it is updated.
+type callCounters struct {
+	calls   atomic.Uint64
+	errors  atomic.Uint64
+	latency atomic.Int64
+}
+
+/*
+record counts a call of the method
+*/
+func (mc *callCounters) record(latency time.Duration, err error) {
+	mc.calls.Add(1)
+	if err != nil {
+		mc.errors.Add(1)
+	}
+	mc.latency.Add(int64(latency))
+}
+
+/*
+Stats returns the counters of the calls of every registered method, by method in dotted notation.
+The counters are always kept, at the cost of a few atomic additions per call.
+*/
+func (s *Server) Stats() map[string]MethodStats {
+	stats := make(map[string]MethodStats)
+	for _, service := range s.services.load() {
+		for name, method := range service.methods {
+			stats[service.name+"."+name] = MethodStats{
+				Calls:   method.counters.calls.Load(),
+				Errors:  method.counters.errors.Load(),
+				Latency: time.Duration(method.counters.latency.Load()),
+			}
+		}
+	}
+	return stats
+}
+
+// countingReader counts the bytes read from the request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written to the response, and keeps the status.
+type countingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	n           int64
+}
+
+func (cw *countingWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.status = status
+		cw.wroteHeader = true
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the ResponseWriter, for http.ResponseController.
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.wroteHeader = true
+	n, err := cw.ResponseWriter.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
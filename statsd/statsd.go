@@ -0,0 +1,239 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package statsd sends the metrics of an rpc.Server to a StatsD or Datadog agent over UDP, for teams
+not running Prometheus:
+
+	handler, err := statsd.Dial("127.0.0.1:8125", statsd.Options{Tags: []string{"env:prod"}})
+	if err != nil {
+		...
+	}
+	defer handler.Close()
+	server.SetStatsHandler(handler)
+
+Metrics are tagged with the method, status, error class and tenant of the requests, in the DogStatsD
+format also understood by Telegraf and the StatsD exporter of Prometheus. They are buffered, and
+sent in packets of up to MaxPacketSize bytes or every FlushInterval.
+*/
+package statsd
+
+import (
+	"github.com/antenna3mt/rpc"
+	"io"
+	mrand "math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the metrics, without prefix.
+const (
+	MetricRequests        = "requests"         // counter of the requests
+	MetricErrors          = "errors"           // counter of the failed requests
+	MetricDuration        = "duration"         // timing of the requests, in milliseconds
+	MetricHandlerDuration = "handler_duration" // timing of the service methods, in milliseconds
+)
+
+// Options configures a Handler.
+type Options struct {
+	Prefix        string             // prefix of the metric names, "rpc." if empty
+	Tags          []string           // tags sent with every metric, e.g. "env:prod"
+	SampleRates   map[string]float64 // fraction of the values of each metric sent, by name, 1 if unset
+	MaxPacketSize int                // bytes buffered before sending a packet, 1432 if zero
+	FlushInterval time.Duration      // interval of the sending of buffered metrics, a second if zero
+}
+
+/*
+Handler is an rpc.StatsHandler sending the metrics of every request to a StatsD agent
+*/
+type Handler struct {
+	conn      io.WriteCloser
+	opts      Options
+	mutex     sync.Mutex
+	buf       []byte
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+/*
+Dial returns a Handler sending metrics to the StatsD agent listening on the UDP address addr
+*/
+func Dial(addr string, opts Options) (*Handler, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewHandler(conn, opts), nil
+}
+
+/*
+NewHandler returns a Handler writing metrics to conn, every write being a packet
+*/
+func NewHandler(conn io.WriteCloser, opts Options) *Handler {
+	if opts.Prefix == "" {
+		opts.Prefix = "rpc."
+	}
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = 1432
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	h := &Handler{
+		conn: conn,
+		opts: opts,
+		buf:  make([]byte, 0, opts.MaxPacketSize),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go h.flushLoop()
+	return h
+}
+
+// RequestStart implements rpc.StatsHandler.
+func (h *Handler) RequestStart(*rpc.CallStats) {}
+
+// DecodeComplete implements rpc.StatsHandler.
+func (h *Handler) DecodeComplete(*rpc.CallStats) {}
+
+// HandlerComplete implements rpc.StatsHandler.
+func (h *Handler) HandlerComplete(stats *rpc.CallStats) {
+	h.send(MetricHandlerDuration, milliseconds(stats.HandlerTime), "ms", callTags(stats)...)
+}
+
+// ResponseWritten implements rpc.StatsHandler.
+func (h *Handler) ResponseWritten(stats *rpc.CallStats) {
+	tags := append(callTags(stats), "status:"+strconv.Itoa(stats.Status))
+	if stats.Err != nil {
+		h.send(MetricErrors, "1", "c", append(tags, "error_class:"+string(stats.ErrClass))...)
+	}
+	h.send(MetricRequests, "1", "c", tags...)
+	h.send(MetricDuration, milliseconds(stats.Duration), "ms", tags...)
+}
+
+/*
+Flush sends the buffered metrics
+*/
+func (h *Handler) Flush() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.flush()
+}
+
+/*
+Close sends the buffered metrics and closes the connection
+*/
+func (h *Handler) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.quit)
+		<-h.done
+	})
+	err := h.Flush()
+	if errClose := h.conn.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+/*
+send buffers a value of the metric, unless it is sampled out
+*/
+func (h *Handler) send(name, value, kind string, tags ...string) {
+	rate, sampled := h.opts.SampleRates[name]
+	if sampled && rate < 1 && mrand.Float64() >= rate {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(h.opts.Prefix)
+	line.WriteString(name)
+	line.WriteByte(':')
+	line.WriteString(value)
+	line.WriteByte('|')
+	line.WriteString(kind)
+	if sampled && rate < 1 {
+		line.WriteString("|@")
+		line.WriteString(strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	for i, tag := range append(tags, h.opts.Tags...) {
+		if i == 0 {
+			line.WriteString("|#")
+		} else {
+			line.WriteByte(',')
+		}
+		line.WriteString(tag)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.buf) > 0 && len(h.buf)+1+line.Len() > h.opts.MaxPacketSize {
+		h.flush()
+	}
+	if len(h.buf) > 0 {
+		h.buf = append(h.buf, '\n')
+	}
+	h.buf = append(h.buf, line.String()...)
+}
+
+/*
+flush sends the buffer as a packet, the mutex is held
+*/
+func (h *Handler) flush() error {
+	if len(h.buf) == 0 {
+		return nil
+	}
+	_, err := h.conn.Write(h.buf)
+	h.buf = h.buf[:0]
+	return err
+}
+
+/*
+flushLoop sends the buffered metrics every FlushInterval until the handler is closed
+*/
+func (h *Handler) flushLoop() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.Flush()
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+/*
+methodTag returns the method of the request, "unknown" if it wasn't decoded
+*/
+func methodTag(stats *rpc.CallStats) string {
+	if stats.Method == "" {
+		return "unknown"
+	}
+	return stats.Method
+}
+
+/*
+callTags returns the tags of the method and tenant of the request
+*/
+func callTags(stats *rpc.CallStats) []string {
+	tags := make([]string, 1, 4)
+	tags[0] = "method:" + methodTag(stats)
+	if stats.Tenant != "" {
+		tags = append(tags, "tenant:"+stats.Tenant)
+	}
+	return tags
+}
+
+/*
+milliseconds formats d in milliseconds
+*/
+func milliseconds(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pluginStopTimeout is the time a plugin is given to exit once its stdin is
+// closed, before being killed.
+const pluginStopTimeout = 5 * time.Second
+
+// contentLengthFramer precedes frames with a "Content-Length" header, as the
+// Language Server Protocol does.
+type contentLengthFramer struct {
+	reader *textproto.Reader
+	writer io.Writer
+}
+
+func newContentLengthFramer(r io.Reader, w io.Writer) *contentLengthFramer {
+	return &contentLengthFramer{reader: textproto.NewReader(bufio.NewReader(r)), writer: w}
+}
+
+func (f *contentLengthFramer) ReadFrame() ([]byte, error) {
+	header, err := f.reader.ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF || len(header) == 0 {
+			return nil, err
+		}
+		return nil, fmt.Errorf("rpc: invalid frame header: %v", err)
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("rpc: invalid Content-Length %q", header.Get("Content-Length"))
+	}
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("rpc: frame of %d bytes too large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(f.reader.R, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (f *contentLengthFramer) WriteFrame(payload []byte) error {
+	frame := append([]byte("Content-Length: "+strconv.Itoa(len(payload))+"\r\n\r\n"), payload...)
+	_, err := f.writer.Write(frame)
+	return err
+}
+
+// stdioCloser closes nothing, the standard streams being owned by the process.
+type stdioCloser struct{}
+
+func (stdioCloser) Close() error { return nil }
+
+/*
+ServeStdio serves the requests received on the standard input until it is closed, writing the
+responses on the standard output, so the server can run as a plugin subprocess started with
+StartPlugin.
+
+Every request and response is preceded by a "Content-Length: [size]\r\n\r\n" header, as in the
+Language Server Protocol. The requests are served in order, an empty frame answering a
+notification. Logs must go to the standard error.
+*/
+func (s *Server) ServeStdio() error {
+	return s.serveFrames(stdioCloser{}, newContentLengthFramer(os.Stdin, os.Stdout))
+}
+
+// pluginConn is the connection to the standard streams of a plugin subprocess.
+type pluginConn struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	closeOnce sync.Once
+	err       error
+}
+
+/*
+Close closes the stdin of the plugin, and waits for it to exit, killing it after a timeout
+*/
+func (pc *pluginConn) Close() error {
+	pc.closeOnce.Do(func() {
+		pc.stdin.Close()
+		exited := make(chan error, 1)
+		go func() {
+			exited <- pc.cmd.Wait()
+		}()
+		select {
+		case pc.err = <-exited:
+		case <-time.After(pluginStopTimeout):
+			pc.cmd.Process.Kill()
+			pc.err = <-exited
+		}
+	})
+	return pc.err
+}
+
+/*
+StartPlugin starts cmd, a subprocess serving with ServeStdio, and returns a client calling its
+methods. The stderr of the plugin is forwarded to the stderr of the process if cmd.Stderr is nil.
+Closing the client stops the plugin.
+*/
+func StartPlugin(cmd *exec.Cmd, codec ClientCodec) (*ConnClient, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &ConnClient{
+		conn:  &pluginConn{cmd: cmd, stdin: stdin},
+		f:     newContentLengthFramer(stdout, stdin),
+		codec: codec,
+	}, nil
+}
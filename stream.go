@@ -0,0 +1,133 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// StreamDecoder decodes the successive items of a streamed response.
+type StreamDecoder interface {
+	// Decodes the next item into reply, returns io.EOF after the last one.
+	Decode(reply interface{}) error
+}
+
+// StreamClientCodec is implemented by client codecs supporting streamed
+// responses, e.g. chunked or newline delimited JSON.
+type StreamClientCodec interface {
+	ClientCodec
+	// Returns a decoder of the items of the streamed response body.
+	NewStreamDecoder(r io.Reader) StreamDecoder
+}
+
+// Stream is the streamed response of a call made with Client.CallStream.
+type Stream interface {
+	// Recv fills reply with the next item of the response, and returns
+	// io.EOF after the last one.
+	Recv(reply interface{}) error
+	// Close releases the response, it must be called once done.
+	Close() error
+}
+
+/*
+CallStream calls the RPC method with args, and returns its response to be read item by item, so
+large results can be processed incrementally. Server-Sent Events are accepted, the data of each
+event being an item.
+
+The request is retried by the retry policy, but the reading of the response is not. The codec of
+the client must implement StreamClientCodec.
+*/
+func (c *Client) CallStream(ctx context.Context, method string, args interface{}) (Stream, error) {
+	codec, ok := c.codec.(StreamClientCodec)
+	if !ok {
+		return nil, fmt.Errorf("rpc: codec does not support streams")
+	}
+	body, err := codec.EncodeRequest(method, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var stream *clientStream
+	idempotent := c.retryPolicy.idempotent(method)
+	err = c.attempt(ctx, method, idempotent, body, func(body []byte, header http.Header, stats *ClientCallStats) error {
+		header.Set("Accept", EventStreamContentType)
+		resp, done, err := c.hedgedRoundTrip(ctx, body, header, stats, idempotent)
+		if err != nil {
+			return err
+		}
+		var items io.Reader = resp.Body
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), EventStreamContentType) {
+			items = newEventStreamReader(resp.Body)
+		}
+		stream = &clientStream{
+			body:    resp.Body,
+			decoder: codec.NewStreamDecoder(items),
+			done:    done,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// clientStream reads the items of a response body.
+type clientStream struct {
+	body    io.ReadCloser
+	decoder StreamDecoder
+	done    func(error) // records the result of the call
+
+	mutex sync.Mutex
+	err   error // first error reading the response, io.EOF at its end
+}
+
+func (s *clientStream) Recv(reply interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	err := s.decoder.Decode(reply)
+	if err == nil {
+		return nil
+	}
+	s.err = err
+	if err == io.EOF {
+		s.close(nil)
+	} else {
+		s.close(err)
+	}
+	return err
+}
+
+func (s *clientStream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err == nil {
+		s.err = fmt.Errorf("rpc: stream is closed")
+	}
+	s.close(nil)
+	return nil
+}
+
+/*
+close releases the response once
+*/
+func (s *clientStream) close(err error) {
+	if s.done == nil {
+		return
+	}
+	s.body.Close()
+	s.done(err)
+	s.done = nil
+}
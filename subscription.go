@@ -0,0 +1,442 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Built-in methods of subscriptions, if enabled.
+const (
+	SubscribeMethod   = "rpc.subscribe"   // SubscribeArgs, SubscribeReply
+	PollMethod        = "rpc.poll"        // PollArgs, PollReply, or a stream of SubscriptionEvent
+	UnsubscribeMethod = "rpc.unsubscribe" // PollArgs, empty reply
+)
+
+const (
+	maxPollTimeout        = time.Minute // maximum time a poll waits for events
+	maxSubscriptionEvents = 1000        // events kept for a subscription, the oldest are dropped
+	maxSubscriptionTopics = 100         // topics of a subscription
+	maxSubscriptions      = 10000       // subscriptions of a server
+)
+
+// ErrTooManySubscriptions is returned by SubscribeMethod once the server keeps the maximum
+// number of subscriptions. The call fails with status 429.
+var ErrTooManySubscriptions = errors.New("rpc: too many subscriptions")
+
+// TopicAuthorizer reports whether the caller of a request may subscribe to a topic, returning
+// an error, e.g. ErrForbidden, if not. The principal and tenant of the caller are available
+// with PrincipalFromRequest and TenantFromRequest.
+type TopicAuthorizer func(r *http.Request, topic string) error
+
+// Publisher publishes the events of topics to their subscriptions.
+type Publisher interface {
+	Publish(topic string, event interface{}) error
+}
+
+// PublisherSetter is implemented by context types that want to receive the
+// Publisher of the server before hooks and service call are executed.
+type PublisherSetter interface {
+	SetPublisher(Publisher)
+}
+
+// SubscribeArgs are the args of SubscribeMethod.
+type SubscribeArgs struct {
+	Topics []string
+}
+
+// SubscribeReply is the reply of SubscribeMethod.
+type SubscribeReply struct {
+	ID string
+}
+
+// PollArgs are the args of PollMethod and UnsubscribeMethod.
+type PollArgs struct {
+	ID      string
+	Timeout int // milliseconds to wait for an event, at most a minute
+}
+
+// PollReply is the reply of PollMethod.
+type PollReply struct {
+	Events []SubscriptionEvent
+}
+
+// SubscriptionEvent is an event published to a topic.
+type SubscriptionEvent struct {
+	Topic string
+	Data  interface{}
+}
+
+// SubscriptionNotifier is implemented by codec requests of protocols pushing the events of the
+// subscriptions made over websocket connections, e.g. eth_subscribe. EncodeNotification returns
+// the message of an event of the subscription.
+type SubscriptionNotifier interface {
+	EncodeNotification(subscription string, event SubscriptionEvent) ([]byte, error)
+}
+
+/*
+SetSubscriptions enables subscriptions: clients subscribe to topics with SubscribeMethod, then
+receive the events published to them with PollMethod, either as a long poll or as a stream of
+Server-Sent Events. Services publish events with the Publisher given to their context if it
+implements PublisherSetter, or with the Publish method of the server. A subscription is
+dropped when it is not polled for idleTimeout; zero disables subscriptions.
+
+Subscriptions made over a websocket connection with a codec whose requests implement
+SubscriptionNotifier are not polled: their events are pushed on the connection until it is closed
+or they are unsubscribed.
+
+The built-in methods are rate limited and checked against the ACL table as the other methods,
+and subscriptions are polled and unsubscribed only by the caller who made them. A subscription
+has at most 100 topics, and a server keeps at most 10000 subscriptions. Any topic may be
+subscribed to unless SetTopicAuthorizer is set.
+*/
+func (s *Server) SetSubscriptions(idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		s.subscriptions = nil
+		return
+	}
+	s.subscriptions = &subscriptionHub{
+		idleTimeout: idleTimeout,
+		subs:        make(map[string]*subscription),
+		topics:      make(map[string]map[*subscription]struct{}),
+	}
+}
+
+/*
+SetTopicAuthorizer sets the func checking the topics subscribed to with SubscribeMethod, e.g. so
+that callers only subscribe to the topics of their tenant. A nil func allows every topic.
+*/
+func (s *Server) SetTopicAuthorizer(fn TopicAuthorizer) {
+	s.topicAuthorizer = fn
+}
+
+/*
+Publish publishes the event to the subscriptions of the topic, if subscriptions are enabled
+*/
+func (s *Server) Publish(topic string, event interface{}) error {
+	if s.subscriptions == nil {
+		return fmt.Errorf("rpc: subscriptions are disabled")
+	}
+	return s.subscriptions.Publish(topic, event)
+}
+
+/*
+isSubscriptionMethod reports whether the method is a built-in method of enabled subscriptions
+*/
+func (s *Server) isSubscriptionMethod(method string) bool {
+	if s.subscriptions == nil {
+		return false
+	}
+	switch method {
+	case SubscribeMethod, PollMethod, UnsubscribeMethod:
+		return true
+	}
+	return false
+}
+
+/*
+serveSubscription serves a built-in method of subscriptions called by the principal
+*/
+func (s *Server) serveSubscription(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, method string,
+	principal Principal) {
+	hub := s.subscriptions
+	owner := ""
+	if principal != nil {
+		owner = principal.Name()
+	}
+	var reply interface{}
+	var err error
+	status := 400
+	switch method {
+	case SubscribeMethod:
+		args := new(SubscribeArgs)
+		if err = codecReq.ReadRequest(args); err != nil {
+			break
+		}
+		if len(args.Topics) > maxSubscriptionTopics {
+			err = fmt.Errorf("rpc: more than %d topics subscribed to", maxSubscriptionTopics)
+			break
+		}
+		if s.topicAuthorizer != nil {
+			for _, topic := range args.Topics {
+				if err = s.topicAuthorizer(r, topic); err != nil {
+					status = 403
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		var id string
+		if id, err = hub.subscribe(owner, args.Topics); err != nil {
+			status = 429
+			break
+		}
+		subscribed := &SubscribeReply{ID: id}
+		if notifier, ok := codecReq.(SubscriptionNotifier); ok {
+			if conn := WebsocketConnFromContext(r.Context()); conn != nil {
+				hub.push(r.Context(), conn, codecReq, notifier, owner, subscribed)
+				return
+			}
+		}
+		reply = subscribed
+	case PollMethod:
+		args := new(PollArgs)
+		if err = codecReq.ReadRequest(args); err == nil {
+			sub := hub.get(args.ID, owner)
+			if sub == nil {
+				err = fmt.Errorf("rpc: unknown subscription %q", args.ID)
+				break
+			}
+			if flusher, ok := w.(http.Flusher); ok && acceptsEventStream(r) {
+				w.Header().Set("x-content-type-options", "nosniff")
+				writeEventStream(r.Context(), w, flusher, codecReq, &subscriptionStream{hub: hub, sub: sub})
+				return
+			}
+			timeout := time.Duration(args.Timeout) * time.Millisecond
+			if timeout > maxPollTimeout {
+				timeout = maxPollTimeout
+			}
+			reply = &PollReply{Events: hub.poll(r.Context(), sub, timeout)}
+		}
+	case UnsubscribeMethod:
+		args := new(PollArgs)
+		if err = codecReq.ReadRequest(args); err == nil {
+			hub.unsubscribe(args.ID, owner)
+			reply = &struct{}{}
+		}
+	}
+	if err != nil {
+		codecReq.WriteError(w, status, err)
+		return
+	}
+	w.Header().Set("x-content-type-options", "nosniff")
+	codecReq.WriteResponse(w, reply)
+}
+
+// subscription is the subscription of a client to topics.
+type subscription struct {
+	id       string
+	owner    string // name of the principal who subscribed, empty if anonymous
+	topics   []string
+	events   []SubscriptionEvent // events not delivered yet
+	notify   chan struct{}       // signaled when an event is queued
+	done     chan struct{}       // closed once the subscription is removed
+	polling  int                 // polls in progress
+	lastPoll time.Time           // end of the last poll
+}
+
+// subscriptionHub keeps the subscriptions of a server.
+type subscriptionHub struct {
+	idleTimeout time.Duration
+
+	mutex     sync.Mutex
+	subs      map[string]*subscription
+	topics    map[string]map[*subscription]struct{}
+	lastSweep time.Time
+}
+
+/*
+subscribe adds a subscription of the owner to the topics, and returns its id. It fails with
+ErrTooManySubscriptions if the hub keeps the maximum number of subscriptions.
+*/
+func (h *subscriptionHub) subscribe(owner string, topics []string) (string, error) {
+	sub := &subscription{
+		id:       newIdempotencyKey(),
+		owner:    owner,
+		topics:   topics,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		lastPoll: time.Now(),
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sweep()
+	if len(h.subs) >= maxSubscriptions {
+		return "", ErrTooManySubscriptions
+	}
+	h.subs[sub.id] = sub
+	for _, topic := range topics {
+		if h.topics[topic] == nil {
+			h.topics[topic] = make(map[*subscription]struct{})
+		}
+		h.topics[topic][sub] = struct{}{}
+	}
+	return sub.id, nil
+}
+
+/*
+get returns the subscription of the id made by the owner, nil if unknown
+*/
+func (h *subscriptionHub) get(id, owner string) *subscription {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if sub := h.subs[id]; sub != nil && sub.owner == owner {
+		return sub
+	}
+	return nil
+}
+
+/*
+unsubscribe removes the subscription of the id made by the owner
+*/
+func (h *subscriptionHub) unsubscribe(id, owner string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if sub := h.subs[id]; sub != nil && sub.owner == owner {
+		h.remove(sub)
+	}
+}
+
+/*
+remove removes the subscription, the mutex is held
+*/
+func (h *subscriptionHub) remove(sub *subscription) {
+	delete(h.subs, sub.id)
+	close(sub.done)
+	for _, topic := range sub.topics {
+		delete(h.topics[topic], sub)
+		if len(h.topics[topic]) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+}
+
+/*
+sweep removes the subscriptions idle for the idle timeout, at most once per half of it. The
+mutex is held.
+*/
+func (h *subscriptionHub) sweep() {
+	now := time.Now()
+	if now.Sub(h.lastSweep) < h.idleTimeout/2 {
+		return
+	}
+	h.lastSweep = now
+	for _, sub := range h.subs {
+		if sub.polling == 0 && now.Sub(sub.lastPoll) > h.idleTimeout {
+			h.remove(sub)
+		}
+	}
+}
+
+/*
+Publish queues the event for the subscriptions of the topic
+*/
+func (h *subscriptionHub) Publish(topic string, event interface{}) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sweep()
+	for sub := range h.topics[topic] {
+		if len(sub.events) >= maxSubscriptionEvents {
+			sub.events = sub.events[1:]
+		}
+		sub.events = append(sub.events, SubscriptionEvent{Topic: topic, Data: event})
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+/*
+poll returns the queued events of the subscription, waiting up to timeout for one if there is none
+*/
+func (h *subscriptionHub) poll(ctx context.Context, sub *subscription, timeout time.Duration) []SubscriptionEvent {
+	h.mutex.Lock()
+	sub.polling++
+	h.mutex.Unlock()
+	defer func() {
+		h.mutex.Lock()
+		sub.polling--
+		sub.lastPoll = time.Now()
+		h.mutex.Unlock()
+	}()
+
+	if events := h.take(sub); len(events) > 0 || timeout <= 0 {
+		return events
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-sub.notify:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return h.take(sub)
+}
+
+/*
+take returns and clears the queued events of the subscription
+*/
+func (h *subscriptionHub) take(sub *subscription) []SubscriptionEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	events := sub.events
+	sub.events = nil
+	return events
+}
+
+/*
+push writes the reply of the subscription on the websocket connection, then pushes the events of
+the subscription on it until it is closed or unsubscribed
+*/
+func (h *subscriptionHub) push(ctx context.Context, conn *WebsocketConn, codecReq CodecRequest,
+	notifier SubscriptionNotifier, owner string, reply *SubscribeReply) {
+	sub := h.get(reply.ID, owner)
+	bw := newBufferWriter()
+	codecReq.WriteResponse(bw, reply)
+	if err := conn.WriteMessage(bw.buf.Bytes()); err != nil || sub == nil {
+		h.unsubscribe(reply.ID, owner)
+		return
+	}
+
+	// The subscription outlives the request.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		defer cancel()
+		select {
+		case <-conn.done:
+		case <-sub.done:
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer h.unsubscribe(sub.id, sub.owner)
+		defer cancel()
+		stream := &subscriptionStream{hub: h, sub: sub}
+		stream.Stream(ctx, func(item interface{}) error {
+			msg, err := notifier.EncodeNotification(sub.id, item.(SubscriptionEvent))
+			if err != nil {
+				return err
+			}
+			return conn.WriteMessage(msg)
+		})
+	}()
+}
+
+// subscriptionStream streams the events of a subscription as they are published.
+type subscriptionStream struct {
+	hub *subscriptionHub
+	sub *subscription
+}
+
+func (ss *subscriptionStream) Stream(ctx context.Context, send func(item interface{}) error) error {
+	for ctx.Err() == nil {
+		for _, event := range ss.hub.poll(ctx, ss.sub, maxPollTimeout) {
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
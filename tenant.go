@@ -0,0 +1,230 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Errors of the requests whose tenant can't be resolved.
+var (
+	ErrMissingTenant = errors.New("rpc: missing tenant")
+	ErrUnknownTenant = errors.New("rpc: unknown tenant")
+)
+
+// TenantResolver returns the tenant of a request, empty if it has none.
+type TenantResolver func(r *http.Request) (string, error)
+
+/*
+TenantFromHeader returns a TenantResolver reading the tenant from the request header
+*/
+func TenantFromHeader(name string) TenantResolver {
+	return func(r *http.Request) (string, error) {
+		return r.Header.Get(name), nil
+	}
+}
+
+/*
+TenantFromHost returns a TenantResolver reading the tenant from the subdomain of the host of the
+request under domain, e.g. "acme" for "acme.api.example.com" under "api.example.com"
+*/
+func TenantFromHost(domain string) TenantResolver {
+	suffix := "." + strings.ToLower(strings.Trim(domain, "."))
+	return func(r *http.Request) (string, error) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if !strings.HasSuffix(host, suffix) {
+			return "", nil
+		}
+		tenant := strings.TrimSuffix(host, suffix)
+		if strings.Contains(tenant, ".") {
+			return "", fmt.Errorf("%w: %q", ErrUnknownTenant, tenant)
+		}
+		return tenant, nil
+	}
+}
+
+/*
+TenantFromPrincipal returns a TenantResolver reading the tenant from the authenticated principal
+of the request, e.g. an organization claim of its token
+*/
+func TenantFromPrincipal(claim func(Principal) string) TenantResolver {
+	return func(r *http.Request) (string, error) {
+		if p := PrincipalFromRequest(r); p != nil {
+			return claim(p), nil
+		}
+		return "", nil
+	}
+}
+
+// TenantPolicy isolates the tenants sharing a server.
+type TenantPolicy struct {
+	Resolver TenantResolver       // tenant of a request
+	Required bool                 // requests without tenant fail with ErrMissingTenant
+	Tenants  []string             // known tenants, others failing with ErrUnknownTenant, any if empty
+	Limit    RateLimit            // limit of the calls of every tenant, unlimited if zero
+	Limits   map[string]RateLimit // limits of the tenants overriding Limit
+	Store    RateLimitStore       // buckets of the tenants, in memory if nil
+}
+
+// TenantSetter is implemented by context types that want to receive the tenant of the request.
+type TenantSetter interface {
+	SetTenant(string)
+}
+
+type tenantKey struct{}
+
+/*
+TenantFromContext returns the tenant of the request of the context, empty if it has none
+*/
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+/*
+TenantFromRequest returns the tenant attached to the request by the server, used by hooks
+*/
+func TenantFromRequest(r *http.Request) string {
+	return TenantFromContext(r.Context())
+}
+
+/*
+SetTenantPolicy resolves the tenant of every request once it is authenticated, so resolvers may
+read the claims of its principal. The tenant is available to hooks via TenantFromRequest, to
+services via TenantFromContext and if the context type implements TenantSetter, and labels the
+logs and the CallStats of the call.
+
+Requests whose tenant can't be resolved fail with status 400, or 403 for ErrUnknownTenant, and
+calls of a tenant over its limit fail with ErrRateLimited and status 429. Cached replies are
+never shared by tenants. A nil policy disables the resolution.
+*/
+func (s *Server) SetTenantPolicy(policy *TenantPolicy) {
+	if policy == nil {
+		s.tenants = nil
+		return
+	}
+	p := &tenancy{policy: *policy}
+	if p.policy.Store == nil {
+		p.policy.Store = NewMemoryRateLimitStore()
+	}
+	if len(policy.Tenants) > 0 {
+		p.known = make(map[string]bool, len(policy.Tenants))
+		for _, tenant := range policy.Tenants {
+			p.known[tenant] = true
+		}
+	}
+	s.tenants = p
+}
+
+/*
+RegisterTenantService adds a service serving the calls of the tenant in place of the service of
+the same name, e.g. a customized implementation. Methods missing from it are served by the shared
+service, and its methods require the roles of the shared ones.
+*/
+func (s *Server) RegisterTenantService(tenant string, receiver interface{}, name string) error {
+	if tenant == "" {
+		return ErrMissingTenant
+	}
+	services, _ := s.tenantServices.LoadOrStore(tenant, new(serviceMap))
+	service, err := services.(*serviceMap).addWithACL(receiver, name, s.ctxType, nil)
+	if err != nil {
+		return err
+	}
+	s.events.publish(&Event{
+		Type:    EventServiceRegistered,
+		Service: tenant + "/" + service.name,
+		Methods: service.methodNames(),
+	})
+	return nil
+}
+
+/*
+RateKeyByTenant keys requests by their tenant, exempting requests without one
+*/
+func RateKeyByTenant(r *http.Request) string {
+	if tenant := TenantFromRequest(r); tenant != "" {
+		return "tenant:" + tenant
+	}
+	return ""
+}
+
+// tenancy applies a TenantPolicy.
+type tenancy struct {
+	policy TenantPolicy
+	known  map[string]bool // tenants of the policy, nil if any
+}
+
+/*
+resolve returns the tenant of the request, and the http status of the request if it fails
+*/
+func (t *tenancy) resolve(r *http.Request) (string, int, error) {
+	tenant, err := t.policy.Resolver(r)
+	if err != nil {
+		if errors.Is(err, ErrUnknownTenant) {
+			return "", 403, err
+		}
+		return "", 400, err
+	}
+	if tenant == "" {
+		if t.policy.Required {
+			return "", 400, ErrMissingTenant
+		}
+		return "", 0, nil
+	}
+	if t.known != nil && !t.known[tenant] {
+		return "", 403, fmt.Errorf("%w: %q", ErrUnknownTenant, tenant)
+	}
+	return tenant, 0, nil
+}
+
+/*
+allow takes a token for the call of the tenant, and returns ErrRateLimited if its bucket is empty
+*/
+func (t *tenancy) allow(w http.ResponseWriter, r *http.Request, tenant string) error {
+	limit, ok := t.policy.Limits[tenant]
+	if !ok {
+		limit = t.policy.Limit
+	}
+	return takeToken(w, r, t.policy.Store, "tenant|"+tenant, limit)
+}
+
+/*
+withTenant returns a shallow copy of r carrying the tenant in its context
+*/
+func withTenant(r *http.Request, tenant string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant))
+}
+
+/*
+getMethod returns the method serving the call of the tenant, overridden by the tenant if it
+registered its own service, and the roles required to call it. Overrides require the roles of
+the shared method too.
+*/
+func (s *Server) getMethod(tenant, method string) (*serviceMethod, []string, error) {
+	shared, errShared := s.services.get(method)
+	if tenant != "" {
+		if services, ok := s.tenantServices.Load(tenant); ok {
+			if spec, err := services.(*serviceMap).get(method); err == nil {
+				if errShared != nil || len(shared.roles) == 0 {
+					return spec, spec.roles, nil
+				}
+				return spec, append(append([]string{}, shared.roles...), spec.roles...), nil
+			}
+		}
+	}
+	if errShared != nil {
+		return nil, nil, errShared
+	}
+	return shared, shared.roles, nil
+}
@@ -0,0 +1,309 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"github.com/antenna3mt/rpc/amqp"
+	"github.com/antenna3mt/rpc/cbor"
+	"github.com/antenna3mt/rpc/json"
+	"github.com/antenna3mt/rpc/kafka"
+	"github.com/antenna3mt/rpc/mqtt"
+	"github.com/antenna3mt/rpc/nats"
+	"github.com/antenna3mt/rpc/redis"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natsBroker is an in-memory nats.Conn.
+type natsBroker struct {
+	mutex    sync.Mutex
+	handlers map[string]func(*nats.Msg)
+	inbox    chan *nats.Msg
+}
+
+func (b *natsBroker) QueueSubscribe(subject, queue string, handler func(*nats.Msg)) (func() error, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers[subject] = handler
+	return func() error {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.handlers, subject)
+		return nil
+	}, nil
+}
+
+func (b *natsBroker) Publish(subject string, data []byte) error {
+	b.mutex.Lock()
+	handler := b.handlers[subject]
+	b.mutex.Unlock()
+	if handler != nil {
+		handler(&nats.Msg{Subject: subject, Data: data})
+	} else {
+		b.inbox <- &nats.Msg{Subject: subject, Data: data}
+	}
+	return nil
+}
+
+func TestNATS(t *testing.T) {
+	broker := &natsBroker{handlers: make(map[string]func(*nats.Msg)), inbox: make(chan *nats.Msg, 1)}
+	stop, err := nats.Serve(newPushServer(), broker, &nats.Options{ContentType: "application/json"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Contains(t, broker.handlers, "rpc.PushService")
+
+	body, _ := json.EncodeClientRequest("PushService.Echo", &struct{ Text string }{"nats"})
+	broker.handlers["rpc.PushService"](&nats.Msg{Subject: "rpc.PushService", Reply: "inbox.1", Data: body})
+
+	select {
+	case msg := <-broker.inbox:
+		assert.Equal(t, "inbox.1", msg.Subject)
+		reply := &struct{ Text string }{}
+		assert.NoError(t, json.DecodeClientResponse(bytes.NewReader(msg.Data), reply))
+		assert.Equal(t, "nats", reply.Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply published")
+	}
+
+	assert.NoError(t, stop())
+	assert.Empty(t, broker.handlers)
+}
+
+// amqpChannel is an in-memory amqp.Channel.
+type amqpChannel struct {
+	deliveries chan *amqp.Delivery
+	published  chan *amqp.Publishing
+}
+
+func (c *amqpChannel) Consume(queue string) (<-chan *amqp.Delivery, error) {
+	return c.deliveries, nil
+}
+
+func (c *amqpChannel) Publish(ctx context.Context, queue string, msg *amqp.Publishing) error {
+	c.published <- msg
+	return nil
+}
+
+func TestAMQP(t *testing.T) {
+	ch := &amqpChannel{deliveries: make(chan *amqp.Delivery, 2), published: make(chan *amqp.Publishing, 2)}
+	acked := make(chan bool, 2)
+	for i, text := range []string{"one", "two"} {
+		body, _ := json.EncodeClientRequest("PushService.Echo", &struct{ Text string }{text})
+		ch.deliveries <- &amqp.Delivery{
+			Body:          body,
+			ContentType:   "application/json",
+			CorrelationId: fmt.Sprint(i),
+			ReplyTo:       "replies",
+			Ack:           func() error { acked <- true; return nil },
+		}
+	}
+	close(ch.deliveries)
+	assert.NoError(t, amqp.Serve(context.Background(), newPushServer(), ch, "requests", 2))
+
+	replies := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		msg := <-ch.published
+		reply := &struct{ Text string }{}
+		assert.NoError(t, json.DecodeClientResponse(bytes.NewReader(msg.Body), reply))
+		replies[msg.CorrelationId] = reply.Text
+		assert.True(t, <-acked)
+	}
+	assert.Equal(t, map[string]string{"0": "one", "1": "two"}, replies)
+}
+
+// kafkaTopics is an in-memory kafka.Reader and kafka.Writer.
+type kafkaTopics struct {
+	requests  chan kafka.Message
+	replies   []kafka.Message
+	committed []int64
+}
+
+func (k *kafkaTopics) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-k.requests:
+		return msg, nil
+	default:
+		return kafka.Message{}, io.EOF
+	}
+}
+
+func (k *kafkaTopics) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, msg := range msgs {
+		k.committed = append(k.committed, msg.Offset)
+	}
+	return nil
+}
+
+func (k *kafkaTopics) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	k.replies = append(k.replies, msgs...)
+	return nil
+}
+
+func TestKafka(t *testing.T) {
+	topics := &kafkaTopics{requests: make(chan kafka.Message, 2)}
+	body, _ := json.EncodeClientRequest("PushService.Echo", &struct{ Text string }{"kafka"})
+	topics.requests <- kafka.Message{Offset: 1, Value: body, Headers: []kafka.Header{
+		{Key: kafka.CorrelationHeader, Value: []byte("c1")},
+	}}
+	topics.requests <- kafka.Message{Offset: 2, Value: body, Headers: []kafka.Header{
+		{Key: kafka.CorrelationHeader, Value: []byte("c2")},
+		{Key: kafka.ReplyTopicHeader, Value: []byte("other")},
+	}}
+
+	err := kafka.Serve(context.Background(), newPushServer(), topics, topics,
+		&kafka.Options{ReplyTopic: "replies", ContentType: "application/json"})
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []int64{1, 2}, topics.committed)
+	if assert.Len(t, topics.replies, 2) {
+		assert.Equal(t, "replies", topics.replies[0].Topic)
+		assert.Equal(t, "c1", string(topics.replies[0].Key))
+		assert.Equal(t, "other", topics.replies[1].Topic)
+		reply := &struct{ Text string }{}
+		assert.NoError(t, json.DecodeClientResponse(bytes.NewReader(topics.replies[1].Value), reply))
+		assert.Equal(t, "kafka", reply.Text)
+	}
+}
+
+// mqttBroker is an in-memory mqtt.Client.
+type mqttBroker struct {
+	filter    string
+	handler   func(*mqtt.Message)
+	published chan *mqtt.Message
+}
+
+func (b *mqttBroker) Subscribe(filter string, qos byte, handler func(*mqtt.Message)) (func() error, error) {
+	b.filter, b.handler = filter, handler
+	return func() error { return nil }, nil
+}
+
+func (b *mqttBroker) Publish(msg *mqtt.Message) error {
+	b.published <- msg
+	return nil
+}
+
+func TestMQTT(t *testing.T) {
+	broker := &mqttBroker{published: make(chan *mqtt.Message, 1)}
+	server := newPushServer()
+	server.RegisterCodec(cbor.NewCodec(), cbor.ContentType)
+	stop, err := mqtt.Serve(server, broker, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stop()
+	assert.Equal(t, "rpc/+/+/#", broker.filter)
+
+	type text struct {
+		Text string `cbor:"text"`
+	}
+	receive := func() (*mqtt.Message, *text, error) {
+		select {
+		case msg := <-broker.published:
+			reply := &text{}
+			err := cbor.NewClientCodec().DecodeResponse(bytes.NewReader(msg.Payload), reply)
+			return msg, reply, err
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reply published")
+			return nil, nil, nil
+		}
+	}
+
+	// MQTT 5 response topic
+	payload, _ := cbor.Marshal(&text{"v5"})
+	broker.handler(&mqtt.Message{
+		Topic:           "rpc/PushService/Echo",
+		Payload:         payload,
+		ResponseTopic:   "devices/1/replies",
+		CorrelationData: []byte{1},
+	})
+	msg, reply, err := receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "devices/1/replies", msg.Topic)
+	assert.Equal(t, []byte{1}, msg.CorrelationData)
+	assert.Equal(t, "v5", reply.Text)
+
+	// Device reply topic
+	payload, _ = cbor.Marshal(&text{"v3"})
+	broker.handler(&mqtt.Message{Topic: "rpc/PushService/Echo/sensor-7", Payload: payload})
+	msg, reply, err = receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "rpc-reply/sensor-7", msg.Topic)
+	assert.Equal(t, "v3", reply.Text)
+
+	broker.handler(&mqtt.Message{Topic: "rpc/PushService/Missing/sensor-7", Payload: payload})
+	_, _, err = receive()
+	var rpcErr *rpc.Error
+	assert.True(t, errors.As(err, &rpcErr))
+}
+
+// redisLists is an in-memory redis.Conn.
+type redisLists struct {
+	mutex  sync.Mutex
+	lists  map[string][][]byte
+	pushed chan struct{} // closed and replaced by every push
+}
+
+func (r *redisLists) BRPop(ctx context.Context, timeout time.Duration, key string) ([]byte, error) {
+	deadline := time.After(timeout)
+	for {
+		r.mutex.Lock()
+		if list := r.lists[key]; len(list) > 0 {
+			value := list[len(list)-1]
+			r.lists[key] = list[:len(list)-1]
+			r.mutex.Unlock()
+			return value, nil
+		}
+		pushed := r.pushed
+		r.mutex.Unlock()
+		select {
+		case <-pushed:
+		case <-deadline:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *redisLists) LPush(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lists[key] = append([][]byte{value}, r.lists[key]...)
+	close(r.pushed)
+	r.pushed = make(chan struct{})
+	return nil
+}
+
+func TestRedis(t *testing.T) {
+	conn := &redisLists{lists: make(map[string][][]byte), pushed: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- redis.Serve(ctx, newPushServer(), conn, &redis.Options{Concurrency: 2})
+	}()
+
+	client := redis.NewClient(conn, "", json.NewClientCodec())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			text := fmt.Sprint("job", i)
+			reply := &struct{ Text string }{}
+			assert.NoError(t, client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{text}, reply))
+			assert.Equal(t, text, reply.Text)
+		}(i)
+	}
+	wg.Wait()
+	assert.Error(t, client.Call(context.Background(), "PushService.Missing", &struct{}{}, &struct{}{}))
+
+	cancel()
+	assert.NoError(t, <-served)
+}
@@ -0,0 +1,900 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/antenna3mt/rpc"
+	"github.com/antenna3mt/rpc/cbor"
+	"github.com/antenna3mt/rpc/gob"
+	"github.com/antenna3mt/rpc/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestServer() *httptest.Server {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+	return httptest.NewServer(server)
+}
+
+func TestClient(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	_, err := rpc.NewClient("not a url", json.NewClientCodec())
+	assert.Error(t, err)
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", MyToken))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"Hello Client"}, reply))
+	assert.Equal(t, "Hello Client", reply.Text)
+
+	client, err = rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithContentType("text/plain"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"Hello Client"}, reply)
+	if assert.IsType(t, &rpc.HTTPError{}, err) {
+		assert.Equal(t, 415, err.(*rpc.HTTPError).StatusCode)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	failures := 2
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(503)
+			return
+		}
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	policy := rpc.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	client, err := rpc.NewClient(proxy.URL, json.NewClientCodec(),
+		rpc.WithHeader("Authorization", MyToken),
+		rpc.WithRetryPolicy(policy))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"retried"}, reply))
+	assert.Equal(t, "retried", reply.Text)
+
+	failures = 3
+	err = client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"retried"}, reply)
+	if assert.IsType(t, &rpc.HTTPError{}, err) {
+		assert.Equal(t, 503, err.(*rpc.HTTPError).StatusCode)
+	}
+	assert.Equal(t, 0, failures)
+
+	failures = 1
+	policy.Idempotent = func(method string) bool { return false }
+	assert.Error(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"retried"}, reply))
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	down := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(502)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","result":{},"id":1}`))
+	}))
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithCircuitBreaker(&rpc.CircuitBreakerPolicy{
+		FailureThreshold: 2,
+		OpenTimeout:      20 * time.Millisecond,
+	}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	call := func() error {
+		return client.Call(context.Background(), "MyService.Hello", &struct{}{}, &struct{}{})
+	}
+
+	assert.IsType(t, &rpc.HTTPError{}, call())
+	assert.IsType(t, &rpc.HTTPError{}, call())
+	assert.Equal(t, rpc.ErrCircuitOpen, call())
+
+	time.Sleep(30 * time.Millisecond)
+	assert.IsType(t, &rpc.HTTPError{}, call())
+	assert.Equal(t, rpc.ErrCircuitOpen, call())
+
+	time.Sleep(30 * time.Millisecond)
+	down = false
+	assert.NoError(t, call())
+	assert.NoError(t, call())
+}
+
+func TestClientBatch(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", MyToken))
+	if err != nil {
+		log.Fatal(err)
+	}
+	calls := []rpc.BatchCall{
+		{Method: "MyService.Hello", Args: &struct{ Text string }{"one"}, Reply: &struct{ Text string }{}},
+		{Method: "MyService.Missing", Args: &struct{}{}, Reply: &struct{}{}},
+		{Method: "MyService.Hello", Args: &struct{ Text string }{"two"}, Reply: &struct{ Text string }{}},
+	}
+	assert.NoError(t, client.CallBatch(context.Background(), calls))
+	assert.NoError(t, calls[0].Err)
+	assert.Equal(t, "one", calls[0].Reply.(*struct{ Text string }).Text)
+	assert.IsType(t, &json.Error{}, calls[1].Err)
+	assert.NoError(t, calls[2].Err)
+	assert.Equal(t, "two", calls[2].Reply.(*struct{ Text string }).Text)
+}
+
+func TestClientGo(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", MyToken))
+	if err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan *rpc.AsyncCall, 2)
+	client.Go(context.Background(), "MyService.Hello", &struct{ Text string }{"a"}, &struct{ Text string }{}, done)
+	client.Go(context.Background(), "MyService.Hello", &struct{ Text string }{"b"}, &struct{ Text string }{}, done)
+
+	texts := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		call := <-done
+		assert.NoError(t, call.Error)
+		texts[call.Reply.(*struct{ Text string }).Text] = true
+	}
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, texts)
+
+	assert.Panics(t, func() {
+		client.Go(context.Background(), "MyService.Hello", nil, nil, make(chan *rpc.AsyncCall))
+	})
+}
+
+func TestClientContext(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := rpc.WithCallHeader(context.Background(), "Authorization", MyToken)
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(ctx, "MyService.Hello", &struct{ Text string }{"ctx"}, reply))
+	assert.Equal(t, "ctx", reply.Text)
+	assert.Error(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"ctx"}, reply))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	assert.NoError(t, client.Call(timeoutCtx, "MyService.Hello", &struct{ Text string }{"ctx"}, reply))
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Error(t, client.Call(canceledCtx, "MyService.Hello", &struct{ Text string }{"ctx"}, reply))
+
+	// Expired deadlines fail locally, and deadlines about to expire send a budget of 1ms.
+	expiredCtx, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Millisecond))
+	defer cancel()
+	assert.ErrorIs(t, client.Call(expiredCtx, "MyService.Hello", &struct{ Text string }{"ctx"}, reply), context.DeadlineExceeded)
+
+	var timeout string
+	recorder, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithRoundTripper(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		timeout = r.Header.Get(rpc.TimeoutHeader)
+		return &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(`{"result":{"Text":"ctx"},"id":0}`))}, nil
+	})))
+	if err != nil {
+		log.Fatal(err)
+	}
+	expiringCtx, cancel := context.WithTimeout(ctx, 400*time.Microsecond)
+	defer cancel()
+	if err := recorder.Call(expiringCtx, "MyService.Hello", &struct{ Text string }{"ctx"}, reply); err == nil {
+		assert.Equal(t, "1ms", timeout)
+	} else {
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestClientGob(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterCodec(gob.NewCodec(), gob.ContentType)
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, gob.NewClientCodec(), rpc.WithHeader("Authorization", MyToken))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"gob"}, reply))
+	assert.Equal(t, "gob", reply.Text)
+	assert.EqualError(t, client.Call(context.Background(), "MyService.Missing", &struct{}{}, reply),
+		`rpc: can't find method "MyService.Missing"`)
+}
+
+type HelloText struct {
+	Text string
+}
+
+func TestBindClient(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", MyToken))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var proxy struct {
+		Hello   func(context.Context, *HelloText) (*HelloText, error)
+		Greet   func(context.Context, *HelloText) (*HelloText, error) `rpc:"Hello"`
+		Missing func(context.Context, *HelloText) (*HelloText, error)
+	}
+	assert.NoError(t, rpc.BindClient(client, "MyService", &proxy))
+
+	reply, err := proxy.Hello(context.Background(), &HelloText{"proxy"})
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy", reply.Text)
+	reply, err = proxy.Greet(context.Background(), &HelloText{"greet"})
+	assert.NoError(t, err)
+	assert.Equal(t, "greet", reply.Text)
+	reply, err = proxy.Missing(context.Background(), &HelloText{})
+	assert.Error(t, err)
+	assert.Nil(t, reply)
+
+	var bad struct {
+		Hello func(*HelloText) error
+	}
+	assert.Error(t, rpc.BindClient(client, "MyService", &bad))
+	assert.Error(t, rpc.BindClient(client, "MyService", proxy))
+}
+
+func TestClientInterceptors(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	var trace []string
+	logger := func(name string) rpc.Interceptor {
+		return func(next rpc.CallFunc) rpc.CallFunc {
+			return func(ctx context.Context, method string, args interface{}, reply interface{}) error {
+				trace = append(trace, name+" "+method)
+				err := next(ctx, method, args, reply)
+				trace = append(trace, name+" done")
+				return err
+			}
+		}
+	}
+	auth := func(next rpc.CallFunc) rpc.CallFunc {
+		return func(ctx context.Context, method string, args interface{}, reply interface{}) error {
+			return next(rpc.WithCallHeader(ctx, "Authorization", MyToken), method, args, reply)
+		}
+	}
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithInterceptors(logger("outer"), logger("inner"), auth))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"intercepted"}, reply))
+	assert.Equal(t, "intercepted", reply.Text)
+	assert.Equal(t, []string{"outer MyService.Hello", "inner MyService.Hello", "inner done", "outer done"}, trace)
+}
+
+func TestClientTLS(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+	ts := httptest.NewTLSServer(server)
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = rpc.NewTLSConfig("", "", filepath.Join(t.TempDir(), "missing.pem"), "")
+	assert.Error(t, err)
+	cfg, err := rpc.NewTLSConfig("", "", caFile, "example.com")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(),
+		rpc.WithTLSConfig(cfg),
+		rpc.WithHeader("Authorization", MyToken))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"tls"}, reply))
+	assert.Equal(t, "tls", reply.Text)
+
+	client, err = rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Error(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"tls"}, reply))
+}
+
+func TestClientAuth(t *testing.T) {
+	secret := []byte("secret")
+	var header http.Header
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{"jsonrpc":"2.0","result":{},"id":1}`))
+	}))
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithBearerToken("token"), rpc.WithHMACSigning(secret))
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{}{}, &struct{}{}))
+	assert.Equal(t, "Bearer token", header.Get("Authorization"))
+	assert.NotEmpty(t, header.Get(rpc.NonceHeader))
+	assert.Equal(t,
+		rpc.Sign(secret, header.Get(rpc.TimestampHeader), header.Get(rpc.NonceHeader), body),
+		header.Get(rpc.SignatureHeader))
+}
+
+func TestClientBalancer(t *testing.T) {
+	hits := map[string]int{}
+	var mutex sync.Mutex
+	newEndpoint := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			hits[name]++
+			mutex.Unlock()
+			if status != 200 {
+				w.WriteHeader(status)
+				return
+			}
+			w.Write([]byte(`{"jsonrpc":"2.0","result":{},"id":1}`))
+		}))
+	}
+	a, b, down := newEndpoint("a", 200), newEndpoint("b", 200), newEndpoint("down", 503)
+	defer a.Close()
+	defer b.Close()
+	defer down.Close()
+
+	client, err := rpc.NewClient(a.URL, json.NewClientCodec(), rpc.WithEndpoints(b.URL))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{}{}, &struct{}{}))
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, hits)
+
+	_, err = rpc.NewClient(a.URL, json.NewClientCodec(), rpc.WithEndpoints("bad"))
+	assert.Error(t, err)
+
+	hits = map[string]int{}
+	client, err = rpc.NewClient(down.URL, json.NewClientCodec(),
+		rpc.WithEndpoints(a.URL),
+		rpc.WithBalancePolicy(rpc.LeastPending),
+		rpc.WithEjection(1, time.Minute))
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Error(t, client.Call(context.Background(), "MyService.Hello", &struct{}{}, &struct{}{}))
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{}{}, &struct{}{}))
+	}
+	assert.Equal(t, map[string]int{"down": 1, "a": 3}, hits)
+}
+
+type chanResolver chan []rpc.Endpoint
+
+func (cr chanResolver) Resolve(service string) ([]rpc.Endpoint, error) {
+	return <-cr, nil
+}
+
+func (cr chanResolver) Watch(service string) (<-chan []rpc.Endpoint, func(), error) {
+	return cr, func() {}, nil
+}
+
+func TestClientResolver(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	_, err := rpc.NewClient("", json.NewClientCodec(), rpc.WithResolver(rpc.StaticResolver{}, "MyService", 0))
+	assert.Error(t, err)
+
+	client, err := rpc.NewClient("", json.NewClientCodec(),
+		rpc.WithHeader("Authorization", MyToken),
+		rpc.WithResolver(rpc.StaticResolver{"MyService": {ts.URL}}, "MyService", time.Minute))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"resolved"}, reply))
+	assert.Equal(t, "resolved", reply.Text)
+
+	resolver := make(chanResolver, 1)
+	resolver <- []rpc.Endpoint{{URL: "http://127.0.0.1:1"}}
+	client, err = rpc.NewClient("", json.NewClientCodec(),
+		rpc.WithHeader("Authorization", MyToken),
+		rpc.WithResolver(resolver, "MyService", 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+	assert.Error(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"watched"}, reply))
+	resolver <- []rpc.Endpoint{{URL: ts.URL}}
+	assert.Eventually(t, func() bool {
+		return client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"watched"}, reply) == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestClientCompression(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(),
+		rpc.WithHeader("Authorization", MyToken),
+		rpc.WithRequestCompression(64))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, text := range []string{"short", strings.Repeat("long", 100)} {
+		reply := &struct{ Text string }{}
+		assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{text}, reply))
+		assert.Equal(t, text, reply.Text)
+	}
+}
+
+func TestClientNotify(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	counter := new(CounterService)
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(counter, "")
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.NoError(t, client.Notify(context.Background(), "CounterService.Incr", &struct{}{}))
+	assert.NoError(t, client.Notify(context.Background(), "CounterService.Incr", &struct{}{}))
+	assert.Equal(t, 2, counter.Count)
+}
+
+func TestClientStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","result":{"N":%d},"id":1}`+"\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	stream, err := client.CallStream(context.Background(), "MyService.List", &struct{}{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stream.Close()
+
+	var items []int
+	for {
+		item := &struct{ N int }{}
+		err := stream.Recv(item)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		items = append(items, item.N)
+	}
+	assert.Equal(t, []int{1, 2, 3}, items)
+	assert.Equal(t, io.EOF, stream.Recv(&struct{ N int }{}))
+}
+
+func TestGenericCall(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", MyToken))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply, err := rpc.Call[*HelloText, HelloText](context.Background(), client, "MyService.Hello", &HelloText{"Hello Generic"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello Generic", reply.Text)
+
+	ptrReply, err := rpc.Call[HelloText, *HelloText](context.Background(), client, "MyService.Hello", HelloText{"Hello Pointer"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello Pointer", ptrReply.Text)
+}
+
+type CodeService struct{}
+
+func (*CodeService) Find(ctx *Context, args *struct{}, reply *struct{}) error {
+	return &rpc.Error{Code: 404, Message: "not found", Data: "item"}
+}
+
+func TestClientTypedError(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterCodec(gob.NewCodec(), gob.ContentType)
+	server.RegisterCodec(cbor.NewCodec(), cbor.ContentType)
+	server.RegisterService(new(CodeService), "")
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for _, codec := range []rpc.ClientCodec{json.NewClientCodec(), gob.NewClientCodec(), cbor.NewClientCodec()} {
+		client, err := rpc.NewClient(ts.URL, codec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = client.Call(context.Background(), "CodeService.Find", &struct{}{}, &struct{}{})
+		var rpcErr *rpc.Error
+		if assert.True(t, errors.As(err, &rpcErr)) {
+			assert.Equal(t, 404, rpcErr.Code)
+			assert.Equal(t, "not found", rpcErr.Message)
+		}
+	}
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = client.Call(context.Background(), "CodeService.Find", &struct{}{}, &struct{}{})
+	var rpcErr *rpc.Error
+	if assert.True(t, errors.As(err, &rpcErr)) {
+		assert.Equal(t, "item", rpcErr.Data)
+	}
+}
+
+type recordingClientStats struct {
+	stages []string
+	last   *rpc.ClientCallStats
+}
+
+func (h *recordingClientStats) CallStart(cs *rpc.ClientCallStats) {
+	h.stages = append(h.stages, "start")
+	cs.Header.Set("X-Trace-Id", "trace")
+}
+func (h *recordingClientStats) CallRetry(cs *rpc.ClientCallStats) {
+	h.stages = append(h.stages, "retry")
+}
+func (h *recordingClientStats) CallResponse(cs *rpc.ClientCallStats) {
+	h.stages = append(h.stages, "response")
+	h.last = cs
+}
+func (h *recordingClientStats) CallError(cs *rpc.ClientCallStats) {
+	h.stages = append(h.stages, "error")
+	h.last = cs
+}
+
+func TestClientStatsHandler(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	failures := 1
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "trace", r.Header.Get("X-Trace-Id"))
+		if failures > 0 {
+			failures--
+			w.WriteHeader(503)
+			return
+		}
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	policy := rpc.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	h := new(recordingClientStats)
+	client, err := rpc.NewClient(proxy.URL, json.NewClientCodec(),
+		rpc.WithHeader("Authorization", MyToken),
+		rpc.WithRetryPolicy(policy),
+		rpc.WithStatsHandler(h))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"stats"}, reply))
+	assert.Equal(t, []string{"start", "retry", "response"}, h.stages)
+	assert.Equal(t, "MyService.Hello", h.last.Method)
+	assert.Equal(t, 2, h.last.Attempts)
+	assert.Equal(t, 200, h.last.Status)
+	assert.NoError(t, h.last.Err)
+
+	h.stages = nil
+	assert.Error(t, client.Call(context.Background(), "MyService.Missing", &struct{}{}, reply))
+	assert.Equal(t, []string{"start", "error"}, h.stages)
+	assert.Error(t, h.last.Err)
+}
+
+func TestClientHedging(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body so the cancellation of the request is noticed.
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(503)
+	}))
+	defer slow.Close()
+
+	client, err := rpc.NewClient(slow.URL, json.NewClientCodec(),
+		rpc.WithEndpoints(ts.URL),
+		rpc.WithHeader("Authorization", MyToken),
+		rpc.WithHedging(&rpc.HedgePolicy{Percentile: 95, MinDelay: 10 * time.Millisecond}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := time.Now()
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"hedged"}, reply))
+	assert.Equal(t, "hedged", reply.Text)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+type countingTransport struct {
+	n int
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.n++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClientTransport(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	rt := new(countingTransport)
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(),
+		rpc.WithHeader("Authorization", MyToken),
+		rpc.WithRoundTripper(rt))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"transport"}, reply))
+	assert.Equal(t, 1, rt.n)
+
+	_, err = rpc.NewClient(ts.URL, json.NewClientCodec(),
+		rpc.WithRoundTripper(rt),
+		rpc.WithMaxIdleConnsPerHost(64))
+	assert.Error(t, err)
+
+	client, err = rpc.NewClient(ts.URL, json.NewClientCodec(),
+		rpc.WithHeader("Authorization", MyToken),
+		rpc.WithMaxIdleConnsPerHost(64),
+		rpc.WithIdleConnTimeout(time.Minute),
+		rpc.WithHTTP2(false))
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"pool"}, reply))
+	assert.Equal(t, "pool", reply.Text)
+}
+
+func TestClientLogger(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(),
+		rpc.WithHeader("Authorization", MyToken),
+		rpc.WithLogger(log.New(&buf, "", 0), true))
+	if err != nil {
+		log.Fatal(err)
+	}
+	args := &struct {
+		Text     string
+		Password string `redact:"true"`
+	}{"logged", "secret"}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", args, reply))
+
+	line := buf.String()
+	assert.Contains(t, line, "rpc: call MyService.Hello status=200")
+	assert.Contains(t, line, `reply={"Text":"logged"}`)
+	assert.Contains(t, line, rpc.Redacted)
+	assert.NotContains(t, line, "secret")
+}
+
+func TestInprocClient(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+
+	for _, codec := range []rpc.ClientCodec{nil, json.NewClientCodec()} {
+		client, err := rpc.NewInprocClient(server, codec, rpc.WithHeader("Authorization", MyToken))
+		if err != nil {
+			log.Fatal(err)
+		}
+		reply := &HelloText{}
+		assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &HelloText{"inproc"}, reply))
+		assert.Equal(t, "inproc", reply.Text)
+		assert.Error(t, client.Call(context.Background(), "MyService.Missing", &struct{}{}, reply))
+
+		client, err = rpc.NewInprocClient(server, codec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		assert.Error(t, client.Call(context.Background(), "MyService.Hello", &HelloText{"inproc"}, reply))
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	secret := []byte("secret")
+	type callback struct {
+		jobID string
+		body  []byte
+	}
+	callbacks := make(chan callback, 1)
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(503)
+			return
+		}
+		body, err := rpc.VerifyWebhook(r, secret, time.Minute)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+		assert.Equal(t, "200", r.Header.Get(rpc.StatusHeader))
+		callbacks <- callback{r.Header.Get(rpc.JobIDHeader), body}
+	}))
+	defer receiver.Close()
+
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		if r.Header.Get("Authorization") != MyToken {
+			return nil, errors.New("unknown token")
+		}
+		return &User{Username: "token"}, nil
+	}))
+	server.SetMaxBodyBytes(1024)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// Callbacks are not allowed unless the policy allows them.
+	server.SetWebhooks(&rpc.WebhookPolicy{Secret: secret, InitialBackoff: time.Millisecond})
+	submit := func(client *rpc.Client, args *HelloText, callback string) int {
+		_, err := client.Submit(context.Background(), "MyService.Hello", args, callback)
+		if httpErr, ok := err.(*rpc.HTTPError); ok {
+			return httpErr.StatusCode
+		}
+		assert.NoError(t, err)
+		return 202
+	}
+	anonymous, err := rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, 403, submit(anonymous, &HelloText{"later"}, receiver.URL))
+	server.SetWebhooks(&rpc.WebhookPolicy{
+		Secret:         secret,
+		InitialBackoff: time.Millisecond,
+		Allow: func(u *url.URL) bool {
+			return u.Host == strings.TrimPrefix(receiver.URL, "http://")
+		},
+	})
+	assert.Equal(t, 403, submit(anonymous, &HelloText{"later"}, "http://169.254.169.254/"))
+
+	// Callers are authenticated, and their bodies bounded, before being accepted.
+	assert.Equal(t, 401, submit(anonymous, &HelloText{"later"}, receiver.URL))
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", MyToken))
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobID, err := client.Submit(context.Background(), "MyService.Hello", &HelloText{"later"}, receiver.URL)
+	assert.NoError(t, err)
+
+	select {
+	case cb := <-callbacks:
+		assert.Equal(t, jobID, cb.jobID)
+		reply := &HelloText{}
+		assert.NoError(t, json.DecodeClientResponse(bytes.NewReader(cb.body), reply))
+		assert.Equal(t, "later", reply.Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback")
+	}
+
+	_, err = client.Submit(context.Background(), "MyService.Hello", &HelloText{"later"}, "ftp://example.com")
+	if assert.IsType(t, &rpc.HTTPError{}, err) {
+		assert.Equal(t, 400, err.(*rpc.HTTPError).StatusCode)
+	}
+	assert.Equal(t, 413, submit(client, &HelloText{strings.Repeat("later", 300)}, receiver.URL))
+
+	// Job ids chosen by clients are checked.
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(`{"jsonrpc":"2.0","method":"MyService.Hello","params":{},"id":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", MyToken)
+	req.Header.Set(rpc.CallbackHeader, receiver.URL)
+	req.Header.Set(rpc.JobIDHeader, "../job")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 400, resp.StatusCode)
+	}
+	select {
+	case cb := <-callbacks:
+		t.Fatalf("unexpected callback of job %s", cb.jobID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
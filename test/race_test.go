@@ -0,0 +1,8 @@
+//go:build race
+
+package test
+
+func init() {
+	// sync.Pool drops values at random under the race detector.
+	raceEnabled = true
+}
@@ -2,18 +2,54 @@ package test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/antenna3mt/rpc"
+	"github.com/antenna3mt/rpc/apikey"
+	"github.com/antenna3mt/rpc/gokit"
+	"github.com/antenna3mt/rpc/gorilla"
 	"github.com/antenna3mt/rpc/json"
+	"github.com/antenna3mt/rpc/jwt"
+	"github.com/antenna3mt/rpc/oauth2"
+	"github.com/antenna3mt/rpc/statsd"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"log"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const MyToken = "MyToken"
 
+// raceEnabled is true if the race detector is enabled.
+var raceEnabled bool
+
 type Context struct {
 	AuthToken string
 }
@@ -79,3 +115,3097 @@ func TestServer(t *testing.T) {
 
 	}()
 }
+
+type MetaContext struct {
+	Md rpc.Metadata
+}
+
+func (ctx *MetaContext) SetMetadata(md rpc.Metadata) {
+	ctx.Md = md
+}
+
+type MetaService struct{}
+
+func (*MetaService) Trace(ctx *MetaContext, args *struct{}, reply *struct {
+	TraceId string
+	Tenant  string
+}) error {
+	reply.TraceId = ctx.Md.Get("X-Trace-Id")
+	reply.Tenant = ctx.Md.Get("X-Tenant")
+	return nil
+}
+
+func TestMetadata(t *testing.T) {
+	server, err := rpc.NewServer(new(MetaContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MetaService), "")
+	server.SetMetadataHeaders("X-Trace-Id")
+	server.RegisterBeforeFunc(func(r *http.Request, ctx *MetaContext) error {
+		rpc.MetadataFromRequest(r).Set("X-Tenant", "acme")
+		return nil
+	})
+
+	reqBody, _ := json.EncodeClientRequest("MetaService.Trace", &struct{}{})
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	req.Header.Set("X-Trace-Id", "abc")
+	req.Header.Set("X-Ignored", "ignored")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	reply := &struct {
+		TraceId string
+		Tenant  string
+	}{}
+	if err := json.DecodeClientResponse(w.Result().Body, reply); err != nil {
+		log.Fatal(err)
+	}
+	assert.Equal(t, "abc", reply.TraceId)
+	assert.Equal(t, "acme", reply.Tenant)
+}
+
+type SlowService struct{}
+
+func (*SlowService) Sleep(ctx *Context, args *struct{ Millis int }, reply *struct{}) error {
+	time.Sleep(time.Duration(args.Millis) * time.Millisecond)
+	return nil
+}
+
+func TestDeadline(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(SlowService), "")
+
+	call := func(millis int, timeout string) error {
+		reqBody, _ := json.EncodeClientRequest("SlowService.Sleep", &struct{ Millis int }{millis})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set(rpc.TimeoutHeader, timeout)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return json.DecodeClientResponse(w.Result().Body, &struct{}{})
+	}
+
+	assert.NoError(t, call(0, "1s"))
+	assert.Error(t, call(0, "bad"))
+
+	// Budgets overflowing a duration are clamped rather than wrapped.
+	assert.NoError(t, call(20, "9223372036854775"))
+	assert.NoError(t, call(20, "9223372036854775807"))
+
+	err = call(200, "10")
+	if assert.IsType(t, &json.Error{}, err) {
+		assert.Equal(t, json.E_DEADLINE, err.(*json.Error).Code)
+	}
+}
+
+type User struct {
+	Username string
+	Roles    []string
+}
+
+func (u *User) Name() string {
+	return u.Username
+}
+
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type AuthContext struct {
+	User *User
+}
+
+func (ctx *AuthContext) SetPrincipal(p rpc.Principal) {
+	ctx.User = p.(*User)
+}
+
+type AdminService struct{}
+
+func (*AdminService) Whoami(ctx *AuthContext, args *struct{}, reply *struct{ Name string }) error {
+	reply.Name = ctx.User.Name()
+	return nil
+}
+
+func (*AdminService) Purge(ctx *AuthContext, args *struct{}, reply *struct{}) error {
+	return nil
+}
+
+func TestAuthACL(t *testing.T) {
+	server, err := rpc.NewServer(new(AuthContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		switch r.Header.Get("Authorization") {
+		case "admin":
+			return &User{"admin", []string{"user", "admin"}}, nil
+		case "guest":
+			return &User{"guest", []string{"user"}}, nil
+		}
+		return nil, fmt.Errorf("unknown user")
+	}))
+	assert.Error(t, server.RegisterServiceWithACL(new(AdminService), "", rpc.ACL{"Missing": {"admin"}}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(AdminService), "", rpc.ACL{
+		rpc.ACLAllMethods: {"user"},
+		"Purge":           {"admin"},
+	}))
+
+	call := func(method, user string, reply interface{}) error {
+		reqBody, _ := json.EncodeClientRequest(method, &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Authorization", user)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return json.DecodeClientResponse(w.Result().Body, reply)
+	}
+
+	reply := &struct{ Name string }{}
+	assert.NoError(t, call("AdminService.Whoami", "guest", reply))
+	assert.Equal(t, "guest", reply.Name)
+	assert.Error(t, call("AdminService.Whoami", "nobody", reply))
+	assert.NoError(t, call("AdminService.Purge", "admin", &struct{}{}))
+
+	err = call("AdminService.Purge", "guest", &struct{}{})
+	if assert.IsType(t, &json.Error{}, err) {
+		assert.Equal(t, json.E_FORBIDDEN, err.(*json.Error).Code)
+	}
+}
+
+// statusCodec is a JSON codec recording the status of the errors written.
+type statusCodec struct {
+	*json.Codec
+	status int
+}
+
+func (c *statusCodec) NewRequest(r *http.Request) rpc.CodecRequest {
+	return &statusCodecRequest{c.Codec.NewRequest(r), c}
+}
+
+type statusCodecRequest struct {
+	rpc.CodecRequest
+	codec *statusCodec
+}
+
+func (cr *statusCodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	cr.codec.status = status
+	cr.CodecRequest.WriteError(w, status, err)
+}
+
+func TestAuthenticator(t *testing.T) {
+	server, err := rpc.NewServer(new(AuthContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	codec := &statusCodec{Codec: json.NewCodec()}
+	server.RegisterCodec(codec, "application/json")
+	server.RegisterService(new(AdminService), "")
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		switch user := r.Header.Get("Authorization"); user {
+		case "alice":
+			return &User{Username: user}, nil
+		case "busy":
+			return nil, fmt.Errorf("quota: %w", rpc.ErrRateLimited)
+		case "banned":
+			return nil, rpc.ErrLockedOut
+		}
+		return nil, errors.New("unknown user")
+	}))
+	var hooked []string
+	server.AddBeforeFunc(func(r *http.Request, ctx *AuthContext) error {
+		hooked = append(hooked, "before:"+rpc.PrincipalFromRequest(r).Name())
+		return nil
+	}, 0)
+	server.AddAfterFunc(func(r *http.Request, ctx *AuthContext) error {
+		hooked = append(hooked, "after:"+rpc.PrincipalFromRequest(r).Name())
+		return nil
+	}, 0)
+
+	call := func(user string) (string, error) {
+		codec.status = 0
+		reqBody, _ := json.EncodeClientRequest("AdminService.Whoami", &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Authorization", user)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		reply := &struct{ Name string }{}
+		err := json.DecodeClientResponse(w.Result().Body, reply)
+		return reply.Name, err
+	}
+
+	// The principal is attached to the context and to the request of hooks.
+	name, err := call("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", name)
+	assert.Zero(t, codec.status)
+	assert.Equal(t, []string{"before:alice", "after:alice"}, hooked)
+
+	// Rejected callers are not dispatched, and fail with the status of their error.
+	hooked = nil
+	for user, status := range map[string]int{"mallory": 401, "busy": 429, "banned": 429} {
+		_, err := call(user)
+		assert.Error(t, err, user)
+		assert.Equal(t, status, codec.status, user)
+	}
+	assert.Empty(t, hooked)
+}
+
+type CounterService struct {
+	Count int
+}
+
+func (s *CounterService) Incr(ctx *Context, args *struct{}, reply *struct{ Count int }) error {
+	s.Count++
+	reply.Count = s.Count
+	return nil
+}
+
+func TestIdempotency(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	counter := new(CounterService)
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(counter, "")
+	server.SetIdempotencyStore(rpc.NewMemoryIdempotencyStore(), time.Minute)
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		switch user := r.Header.Get("Authorization"); user {
+		case "alice", "bob":
+			return &User{Username: user}, nil
+		}
+		return nil, errors.New("unknown user")
+	}))
+
+	serve := func(user, key string, id int) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"jsonrpc":"2.0","method":"CounterService.Incr","params":{},"id":%d}`, id)
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Authorization", user)
+		if key != "" {
+			req.Header.Set(rpc.IdempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+	call := func(user, key string, id int) int {
+		reply := &struct{ Count int }{}
+		if err := json.DecodeClientResponse(serve(user, key, id).Body, reply); err != nil {
+			return -1
+		}
+		return reply.Count
+	}
+
+	assert.Equal(t, 1, call("alice", "a", 1))
+	assert.Equal(t, 1, call("alice", "a", 1))
+	assert.Equal(t, 2, call("alice", "b", 1))
+	assert.Equal(t, 3, call("alice", "", 1))
+	assert.Equal(t, 1, call("alice", "a", 1))
+	assert.Equal(t, 3, counter.Count)
+
+	// The key of another caller, or with another body, is not replayed.
+	assert.Equal(t, 4, call("bob", "a", 1))
+	assert.Equal(t, -1, call("mallory", "a", 1))
+	assert.Equal(t, 422, serve("alice", "a", 2).Code)
+	assert.Equal(t, 4, counter.Count)
+
+	// Rejections are not stored.
+	assert.Equal(t, -1, call("mallory", "c", 1))
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		return &User{Username: r.Header.Get("Authorization")}, nil
+	}))
+	assert.Equal(t, 5, call("mallory", "c", 1))
+
+	// Concurrent requests with the same key call the method once.
+	var wg sync.WaitGroup
+	counts := make([]int, 8)
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			counts[i] = call("alice", "d", 1)
+		}(i)
+	}
+	wg.Wait()
+	for _, count := range counts {
+		assert.Equal(t, 6, count)
+	}
+	assert.Equal(t, 6, counter.Count)
+
+	// The body is read before the caller is authenticated, so its size is bounded.
+	server.SetMaxBodyBytes(32)
+	assert.Equal(t, 413, serve("alice", "e", 1).Code)
+	assert.Equal(t, 6, counter.Count)
+}
+
+func TestCache(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	counter := new(CounterService)
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(counter, "")
+	assert.Error(t, server.Cache("CounterService.Missing", time.Minute))
+	assert.NoError(t, server.Cache("CounterService.Incr", time.Minute))
+
+	for i := 0; i < 3; i++ {
+		reqBody, _ := json.EncodeClientRequest("CounterService.Incr", &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		reply := &struct{ Count int }{}
+		if err := json.DecodeClientResponse(w.Result().Body, reply); err != nil {
+			log.Fatal(err)
+		}
+		assert.Equal(t, 1, reply.Count)
+	}
+	assert.Equal(t, 1, counter.Count)
+}
+
+var ErrNotFound = errors.New("sql: no rows in result set")
+
+type FailService struct{}
+
+func (*FailService) Find(ctx *Context, args *struct{}, reply *struct{}) error {
+	return ErrNotFound
+}
+
+func TestErrorTranslator(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(FailService), "")
+	server.SetErrorTranslator(func(method string, err error) error {
+		if err == ErrNotFound {
+			return &json.Error{Code: -32004, Message: method + ": not found"}
+		}
+		return nil
+	})
+
+	reqBody, _ := json.EncodeClientRequest("FailService.Find", &struct{}{})
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	err = json.DecodeClientResponse(w.Result().Body, &struct{}{})
+	if assert.IsType(t, &json.Error{}, err) {
+		assert.Equal(t, json.ErrorCode(-32004), err.(*json.Error).Code)
+		assert.Equal(t, "FailService.Find: not found", err.Error())
+	}
+}
+
+type recordingStats struct {
+	stages []string
+	last   *rpc.CallStats
+}
+
+func (h *recordingStats) RequestStart(cs *rpc.CallStats)    { h.stages = append(h.stages, "start") }
+func (h *recordingStats) DecodeComplete(cs *rpc.CallStats)  { h.stages = append(h.stages, "decode") }
+func (h *recordingStats) HandlerComplete(cs *rpc.CallStats) { h.stages = append(h.stages, "handler") }
+func (h *recordingStats) ResponseWritten(cs *rpc.CallStats) {
+	h.stages = append(h.stages, "written")
+	h.last = cs
+}
+
+func TestStatsHandler(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	stats := new(recordingStats)
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(FailService), "")
+	server.SetStatsHandler(stats)
+
+	reqBody, _ := json.EncodeClientRequest("FailService.Find", &struct{}{})
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	assert.Equal(t, []string{"start", "decode", "handler", "written"}, stats.stages)
+	assert.Equal(t, "FailService.Find", stats.last.Method)
+	assert.Equal(t, int64(len(reqBody)), stats.last.RequestSize)
+	assert.Equal(t, int64(w.Body.Len()), stats.last.ResponseSize)
+	assert.Equal(t, ErrNotFound, stats.last.Err)
+	assert.Equal(t, rpc.ClassServer, stats.last.ErrClass)
+
+	stats.stages = nil
+	reqBody, _ = json.EncodeClientRequest("FailService.Missing", &struct{}{})
+	req = httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	server.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, []string{"start", "written"}, stats.stages)
+	assert.Equal(t, rpc.ClassClient, stats.last.ErrClass)
+}
+
+type spanKey struct{}
+
+// recordingStageTracer is a rpc.Tracer recording the stages it brackets.
+type recordingStageTracer struct {
+	events []string
+}
+
+func (t *recordingStageTracer) Start(ctx context.Context, stage rpc.TraceStage, method string) (context.Context, func(error)) {
+	t.events = append(t.events, "start "+string(stage)+" "+method)
+	return context.WithValue(ctx, spanKey{}, string(stage)), func(err error) {
+		t.events = append(t.events, fmt.Sprintf("end %s %v", stage, err))
+	}
+}
+
+type SpanContext struct {
+	Span string
+}
+
+func (ctx *SpanContext) SetContext(c context.Context) {
+	ctx.Span, _ = c.Value(spanKey{}).(string)
+}
+
+type SpanService struct{}
+
+func (*SpanService) Span(ctx *SpanContext, args *struct{ Fail bool }, reply *string) error {
+	if args.Fail {
+		return ErrNotFound
+	}
+	*reply = ctx.Span
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	server, err := rpc.NewServer(new(SpanContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	tracer := new(recordingStageTracer)
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(SpanService), "")
+	server.SetTracer(tracer)
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		tracer.events = nil
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	// The stages are bracketed in order, the service getting the context of the dispatch.
+	var reply string
+	w := serve(`{"jsonrpc":"2.0","method":"SpanService.Span","params":{},"id":1}`)
+	assert.NoError(t, json.DecodeClientResponse(w.Body, &reply))
+	assert.Equal(t, "dispatch", reply)
+	assert.Equal(t, []string{
+		"start decode SpanService.Span", "end decode <nil>",
+		"start dispatch SpanService.Span", "end dispatch <nil>",
+		"start encode SpanService.Span", "end encode <nil>",
+	}, tracer.events)
+
+	// A failing stage ends with its error, and the next stages don't start.
+	serve(`{"jsonrpc":"2.0","method":"SpanService.Span","params":{"Fail":true},"id":1}`)
+	assert.Equal(t, []string{
+		"start decode SpanService.Span", "end decode <nil>",
+		"start dispatch SpanService.Span", "end dispatch " + ErrNotFound.Error(),
+	}, tracer.events)
+
+	serve(`{"jsonrpc":"2.0","method":"SpanService.Span","params":{"Fail":"yes"},"id":1}`)
+	if assert.Len(t, tracer.events, 2) {
+		assert.Equal(t, "start decode SpanService.Span", tracer.events[0])
+		assert.True(t, strings.HasPrefix(tracer.events[1], "end decode "))
+		assert.NotEqual(t, "end decode <nil>", tracer.events[1])
+	}
+}
+
+func TestEvents(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var events []*rpc.Event
+	unsubscribe := server.Subscribe(func(e *rpc.Event) {
+		events = append(events, e)
+	})
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	unsubscribe()
+	server.RegisterService(new(MyService), "Second")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan *rpc.Event, 2)
+	server.Subscribe(func(e *rpc.Event) {
+		done <- e
+	})
+	go server.Serve(l)
+	assert.Equal(t, rpc.EventServeStart, (<-done).Type)
+	l.Close()
+	assert.Equal(t, rpc.EventServeStop, (<-done).Type)
+
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, &rpc.Event{Type: rpc.EventCodecRegistered, ContentType: "application/json"}, events[0])
+		assert.Equal(t, &rpc.Event{Type: rpc.EventServiceRegistered, Service: "MyService", Methods: []string{"Hello"}}, events[1])
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(CounterService), "")
+
+	call := func() (map[string][]string, error) {
+		reqBody, _ := json.EncodeClientRequest(rpc.IntrospectionMethod, &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		var reply map[string][]string
+		err := json.DecodeClientResponse(w.Result().Body, &reply)
+		return reply, err
+	}
+
+	_, err = call()
+	assert.Error(t, err)
+
+	server.SetIntrospection(true)
+	reply, err := call()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"CounterService": {"Incr"}}, reply)
+}
+
+func TestRegisterFunc(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+
+	type text struct{ Text string }
+	assert.NoError(t, rpc.RegisterFunc(server, "MyService.Token", func(ctx *Context, args *struct{}, reply *text) error {
+		reply.Text = ctx.AuthToken
+		return nil
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Fail", func(ctx *Context, args *text, reply *text) error {
+		return errors.New(args.Text)
+	}))
+	assert.Error(t, rpc.RegisterFunc(server, "MyService.Hello", func(ctx *Context, args *text, reply *text) error {
+		return nil
+	}))
+	assert.Error(t, rpc.RegisterFunc(server, "Funcs.Ctx", func(ctx *struct{}, args *text, reply *text) error {
+		return nil
+	}))
+	assert.Error(t, rpc.RegisterFunc(server, "Funcs", func(ctx *Context, args *text, reply *text) error {
+		return nil
+	}))
+	assert.NoError(t, server.Cache("MyService.Token", time.Minute))
+	assert.True(t, server.HasMethod("MyService.Hello"))
+
+	call := func(method string, args interface{}, reply interface{}) error {
+		reqBody, _ := json.EncodeClientRequest(method, args)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", MyToken)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return json.DecodeClientResponse(w.Result().Body, reply)
+	}
+	reply := &text{}
+	assert.NoError(t, call("MyService.Token", &struct{}{}, reply))
+	assert.Equal(t, MyToken, reply.Text)
+	assert.NoError(t, call("MyService.Hello", &text{"hello"}, reply))
+	assert.Equal(t, "hello", reply.Text)
+	assert.EqualError(t, call("Funcs.Fail", &text{"failed"}, reply), "failed")
+}
+
+func TestPooling(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetPooling(true)
+
+	type pair struct{ A, B string }
+	assert.NoError(t, rpc.RegisterFunc(server, "Pairs.Copy", func(ctx *Context, args *pair, reply *pair) error {
+		if ctx.AuthToken != "" {
+			return errors.New("context reused")
+		}
+		ctx.AuthToken = args.A
+		*reply = *args
+		return nil
+	}))
+
+	call := func(args *pair) (*pair, error) {
+		reqBody, _ := json.EncodeClientRequest("Pairs.Copy", args)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		reply := &pair{}
+		return reply, json.DecodeClientResponse(w.Result().Body, reply)
+	}
+
+	// Reused values don't leak the fields of previous calls.
+	for i := 0; i < 10; i++ {
+		reply, err := call(&pair{"a", "b"})
+		assert.NoError(t, err)
+		assert.Equal(t, &pair{"a", "b"}, reply)
+		reply, err = call(&pair{A: "a"})
+		assert.NoError(t, err)
+		assert.Equal(t, &pair{A: "a"}, reply)
+	}
+}
+
+func TestJSONRequestDecoding(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+
+	call := func(body string) string {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", MyToken)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// The params are decoded wherever they are, by name or by position.
+	assert.JSONEq(t, `{"jsonrpc":"2.0","result":{"Text":"a"},"id":1}`,
+		call(`{"jsonrpc":"2.0","method":"MyService.Hello","params":{"Text":"a"},"id":1}`))
+	assert.JSONEq(t, `{"jsonrpc":"2.0","result":{"Text":"b"},"id":2}`,
+		call(`{"params":{"Text":"b"},"id":2,"Method":"MyService.Hello","jsonrpc":"2.0"}`))
+	assert.JSONEq(t, `{"jsonrpc":"2.0","result":{"Text":"c"},"id":3}`,
+		call(`{"jsonrpc":"2.0","method":"MyService.Hello","params":[{"Text":"c"}],"extra":[1,{}],"id":3}`))
+
+	// The id following the params of failed calls is read.
+	for body, code := range map[string]int{
+		`{"jsonrpc":"2.0","method":"Unknown.Method","params":{"Text":[1,2,{"a":"b"}]},"id":4}`: -32000,
+		`{"jsonrpc":"2.0","method":"MyService.Hello","params":{"Text":1},"id":4}`:              -32600,
+		`{"method":"MyService.Hello","params":{"Text":"d"},"jsonrpc":"1.0","id":4}`:            -32600,
+	} {
+		var res struct {
+			Id    int
+			Error struct{ Code int }
+		}
+		assert.NoError(t, stdjson.Unmarshal([]byte(call(body)), &res), body)
+		assert.Equal(t, 4, res.Id, body)
+		assert.Equal(t, code, res.Error.Code, body)
+	}
+
+	// Notifications have no response.
+	assert.Equal(t, "", call(`{"jsonrpc":"2.0","method":"MyService.Hello","params":{"Text":"e"}}`))
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	counter := new(CounterService)
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(counter, "")
+	server.SetMaxBatchSize(3)
+
+	call := func(n int) string {
+		calls := make([]string, n)
+		for i := range calls {
+			calls[i] = fmt.Sprintf(`{"jsonrpc":"2.0","method":"CounterService.Incr","params":{},"id":%d}`, i)
+		}
+		req := httptest.NewRequest("POST", "/", strings.NewReader("["+strings.Join(calls, ",")+"]"))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	var responses []struct{ Id int }
+	assert.NoError(t, stdjson.Unmarshal([]byte(call(3)), &responses))
+	assert.Len(t, responses, 3)
+	assert.Equal(t, 3, counter.Count)
+
+	// Larger batches fail as a whole with a single error.
+	var res struct {
+		Id    *int
+		Error struct{ Code int }
+	}
+	assert.NoError(t, stdjson.Unmarshal([]byte(call(4)), &res))
+	assert.Nil(t, res.Id)
+	assert.Equal(t, int(json.E_INVALID_REQ), res.Error.Code)
+	assert.Equal(t, 3, counter.Count)
+
+	server.SetMinimal(true)
+	assert.NoError(t, stdjson.Unmarshal([]byte(call(4)), &res))
+	assert.Equal(t, int(json.E_INVALID_REQ), res.Error.Code)
+	assert.Equal(t, 3, counter.Count)
+}
+
+func TestJSONLegacyCodec(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewLegacyCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+
+	call := func(body string) string {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", MyToken)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// Responses have both a result and an error, without version.
+	assert.JSONEq(t, `{"result":{"Text":"a"},"error":null,"id":1}`,
+		call(`{"method":"MyService.Hello","params":[{"Text":"a"}],"id":1}`))
+	assert.JSONEq(t, `{"result":{"Text":"b"},"error":null,"id":"b"}`,
+		call(`{"method":"MyService.Hello","params":{"Text":"b"},"jsonrpc":"1.0","id":"b"}`))
+	assert.JSONEq(t, `{"result":null,"error":{"code":-32000,"message":"rpc: can't find service \"Unknown.Method\"","data":null},"id":3}`,
+		call(`{"method":"Unknown.Method","params":[],"id":3}`))
+	assert.JSONEq(t, `{"result":null,"error":{"code":-32600,"message":"batches are not supported by JSON-RPC 1.0","data":null},"id":null}`,
+		call(`[{"method":"MyService.Hello","params":[{"Text":"c"}],"id":4}]`))
+
+	// Requests with a null id are notifications.
+	assert.Equal(t, "", call(`{"method":"MyService.Hello","params":[{"Text":"d"}],"id":null}`))
+	assert.Equal(t, "", call(`{"method":"Unknown.Method","params":[],"id":null}`))
+}
+
+func TestContentLength(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	assert.NoError(t, rpc.RegisterFunc(server, "Strings.Repeat", func(ctx *Context, args *int, reply *string) error {
+		*reply = strings.Repeat("a", *args)
+		return nil
+	}))
+
+	// Replies are buffered whatever their size, and sent with their length.
+	for _, n := range []int{1, 100000} {
+		reqBody, _ := json.EncodeClientRequest("Strings.Repeat", n)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+		var reply string
+		assert.NoError(t, json.DecodeClientResponse(w.Body, &reply))
+		assert.Len(t, reply, n)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	heavy, cheap := rpc.NewWorkerPool(1), rpc.NewWorkerPool(2)
+	defer heavy.Close()
+	defer cheap.Close()
+	server.SetWorkerPool(cheap)
+
+	release := make(chan struct{})
+	var running, maxRunning int32
+	var mutex sync.Mutex
+	assert.NoError(t, rpc.RegisterFunc(server, "Work.Heavy", func(ctx *Context, args *int, reply *int) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		<-release
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		*reply = *args
+		return nil
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Work.Cheap", func(ctx *Context, args *int, reply *int) error {
+		*reply = *args
+		return nil
+	}))
+	assert.NoError(t, server.AssignWorkerPool("Work.Heavy", heavy))
+	assert.Error(t, server.AssignWorkerPool("Work.Missing", heavy))
+
+	call := func(method string, timeout string) (int, error) {
+		reqBody, _ := json.EncodeClientRequest(method, 1)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		if timeout != "" {
+			req.Header.Set(rpc.TimeoutHeader, timeout)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		var reply int
+		err := json.DecodeClientResponse(w.Result().Body, &reply)
+		return reply, err
+	}
+
+	// Heavy calls run one at a time, while cheap calls are served meanwhile.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := call("Work.Heavy", "")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, reply)
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		reply, err := call("Work.Cheap", "")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, reply)
+	}
+
+	// A heavy call waiting for a worker gives up at its deadline.
+	time.Sleep(50 * time.Millisecond)
+	_, err = call("Work.Heavy", "50ms")
+	assert.Error(t, err)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), maxRunning)
+
+	// Calls fail once their pool is closed.
+	heavy.Close()
+	_, err = call("Work.Heavy", "")
+	assert.Error(t, err)
+}
+
+func TestResponseCompression(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCustomCodec(&rpc.CompressionSelector{}), "application/json")
+	assert.NoError(t, rpc.RegisterFunc(server, "Strings.Repeat", func(ctx *Context, args *int, reply *string) error {
+		*reply = strings.Repeat("a", *args)
+		return nil
+	}))
+
+	call := func(n int, acceptEncoding string) *httptest.ResponseRecorder {
+		reqBody, _ := json.EncodeClientRequest("Strings.Repeat", n)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	// Small replies are sent as is.
+	w := call(10, "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	var reply string
+	assert.NoError(t, json.DecodeClientResponse(w.Body, &reply))
+	assert.Equal(t, strings.Repeat("a", 10), reply)
+
+	// Large ones are compressed, with writers reused across responses.
+	for i := 0; i < 3; i++ {
+		for encoding, newReader := range map[string]func(io.Reader) (io.Reader, error){
+			"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+			"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+		} {
+			w := call(5000, encoding)
+			assert.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+			assert.Empty(t, w.Header().Get("Content-Length"))
+			assert.Less(t, w.Body.Len(), 5000)
+			body, err := newReader(w.Body)
+			assert.NoError(t, err)
+			reply = ""
+			assert.NoError(t, json.DecodeClientResponse(body, &reply))
+			assert.Equal(t, strings.Repeat("a", 5000), reply)
+		}
+	}
+}
+
+func TestRequestDecompression(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetMaxDecompressedBytes(4096)
+	assert.NoError(t, rpc.RegisterFunc(server, "Strings.Len", func(ctx *Context, args *string, reply *int) error {
+		*reply = len(*args)
+		return nil
+	}))
+
+	call := func(encoding string, n int) *httptest.ResponseRecorder {
+		reqBody, _ := json.EncodeClientRequest("Strings.Len", strings.Repeat("a", n))
+		var buf bytes.Buffer
+		var cw io.WriteCloser
+		if encoding == "gzip" {
+			cw = gzip.NewWriter(&buf)
+		} else {
+			cw = zlib.NewWriter(&buf)
+		}
+		cw.Write(reqBody)
+		cw.Close()
+		req := httptest.NewRequest("POST", "/", &buf)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		w := call(encoding, 1000)
+		var reply int
+		assert.NoError(t, json.DecodeClientResponse(w.Body, &reply), encoding)
+		assert.Equal(t, 1000, reply, encoding)
+
+		// Bodies decompressing beyond the limit are rejected.
+		w = call(encoding, 1<<20)
+		assert.Equal(t, 413, w.Code, encoding)
+		assert.Contains(t, w.Body.String(), rpc.ErrBodyTooLarge.Error(), encoding)
+	}
+}
+
+// discardWriter is a http.ResponseWriter keeping only the last body written.
+type discardWriter struct {
+	header http.Header
+	body   []byte
+}
+
+func (w *discardWriter) Header() http.Header    { return w.header }
+func (w *discardWriter) WriteHeader(status int) {}
+func (w *discardWriter) Write(p []byte) (int, error) {
+	w.body = append(w.body[:0], p...)
+	return len(p), nil
+}
+
+func TestJSONWriteError(t *testing.T) {
+	newRequest := func(body string) rpc.CodecRequest {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		codecReq := json.NewCodec().NewRequest(req)
+		codecReq.Method()
+		return codecReq
+	}
+
+	for _, test := range []struct {
+		id       string
+		err      error
+		expected string
+	}{
+		{`1`, errors.New(`rpc: can't find method "A.B"`),
+			`{"jsonrpc":"2.0","error":{"code":-32000,"message":"rpc: can't find method \"A.B\"","data":null},"id":1}`},
+		{`"x"`, &rpc.Error{Code: 7, Message: `a\b`},
+			`{"jsonrpc":"2.0","error":{"code":7,"message":"a\\b","data":null},"id":"x"}`},
+		{`"a b"`, rpc.ErrForbidden,
+			`{"jsonrpc":"2.0","error":{"code":-32003,"message":"rpc: permission denied","data":null},"id":"a b"}`},
+		{`2`, errors.New("a\nb"),
+			`{"jsonrpc":"2.0","error":{"code":-32000,"message":"a\nb","data":null},"id":2}`},
+		{`3`, &rpc.Error{Code: 1, Message: "m", Data: "d"},
+			`{"jsonrpc":"2.0","error":{"code":1,"message":"m","data":"d"},"id":3}`},
+	} {
+		codecReq := newRequest(`{"jsonrpc":"2.0","method":"A.B","params":{},"id":` + test.id + `}`)
+		w := httptest.NewRecorder()
+		codecReq.WriteError(w, 400, test.err)
+		assert.Equal(t, test.expected+"\n", w.Body.String())
+		assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+	}
+
+	// Writing plain errors doesn't allocate.
+	if raceEnabled {
+		return
+	}
+	codecReq := newRequest(`{"jsonrpc":"2.0","method":"A.B","params":{},"id":1}`)
+	err := errors.New("rpc: unauthorized")
+	w := &discardWriter{header: make(http.Header)}
+	allocs := testing.AllocsPerRun(100, func() {
+		codecReq.WriteError(w, 401, err)
+	})
+	assert.Zero(t, allocs)
+	assert.Equal(t, `{"jsonrpc":"2.0","error":{"code":-32000,"message":"rpc: unauthorized","data":null},"id":1}`+"\n", string(w.body))
+}
+
+func TestDispatch(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(func(r *http.Request, ctx *Context) error {
+		ctx.AuthToken = MyToken
+		return nil
+	})
+	type text struct{ Text string }
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Token", func(ctx *Context, args *struct{}, reply *text) error {
+		reply.Text = ctx.AuthToken
+		return nil
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Fail", func(ctx *Context, args *text, reply *text) error {
+		return errors.New(args.Text)
+	}))
+	server.SetErrorTranslator(func(method string, err error) error {
+		return &rpc.Error{Code: 42, Message: method + ": " + err.Error()}
+	})
+
+	decodeJSON := func(params string) func(interface{}) error {
+		return func(args interface{}) error {
+			return stdjson.Unmarshal([]byte(params), args)
+		}
+	}
+	reply, err := server.Dispatch(new(Context), "MyService.Hello", decodeJSON(`{"Text":"hello"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", reply.(*struct{ Text string }).Text)
+
+	reply, err = server.Dispatch(new(Context), "Funcs.Token", decodeJSON(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &text{MyToken}, reply)
+
+	_, err = server.Dispatch(new(Context), "Funcs.Fail", decodeJSON(`{"Text":"failed"}`))
+	assert.EqualError(t, err, "Funcs.Fail: failed")
+	_, err = server.Dispatch(new(Context), "Funcs.Fail", decodeJSON(`[`))
+	assert.Error(t, err)
+	_, err = server.Dispatch(new(Context), "Funcs.Missing", decodeJSON(`{}`))
+	assert.Error(t, err)
+	_, err = server.Dispatch(&struct{}{}, "Funcs.Token", decodeJSON(`{}`))
+	assert.Error(t, err)
+	_, err = server.Dispatch(nil, "Funcs.Token", decodeJSON(`{}`))
+	assert.Error(t, err)
+
+	// A panic fails the call rather than the transport.
+	server.SetErrorTranslator(nil)
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Panic", func(ctx *Context, args *struct{}, reply *text) error {
+		panic("boom")
+	}))
+	_, err = server.Dispatch(new(Context), "Funcs.Panic", decodeJSON(`{}`))
+	assert.Equal(t, rpc.ErrInternal, err)
+	reply, err = server.Dispatch(new(Context), "Funcs.Token", decodeJSON(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &text{MyToken}, reply)
+
+	// Methods requiring roles are dispatched on behalf of a principal.
+	var principal rpc.Principal
+	server.RegisterBeforeFunc(func(r *http.Request, ctx *Context) error {
+		principal = rpc.PrincipalFromRequest(r)
+		return nil
+	})
+	assert.NoError(t, server.SetACLTable(rpc.ACLTable{"Funcs.Token": {"admin"}}))
+	_, err = server.Dispatch(new(Context), "Funcs.Token", decodeJSON(`{}`))
+	assert.Equal(t, rpc.ErrForbidden, err)
+	_, err = server.DispatchAs(new(Context), &User{"guest", nil}, "Funcs.Token", decodeJSON(`{}`))
+	assert.Equal(t, rpc.ErrForbidden, err)
+	admin := &User{"root", []string{"admin"}}
+	reply, err = server.DispatchAs(new(Context), admin, "Funcs.Token", decodeJSON(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &text{MyToken}, reply)
+	assert.Equal(t, admin, principal)
+}
+
+func TestMethodStats(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Sleep", func(ctx *Context, args *string, reply *string) error {
+		time.Sleep(10 * time.Millisecond)
+		if *args != "" {
+			return errors.New(*args)
+		}
+		return nil
+	}))
+	assert.NoError(t, server.Cache("Funcs.Sleep", 0))
+
+	call := func(method string, args interface{}) {
+		reqBody, _ := json.EncodeClientRequest(method, args)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		server.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	call("Funcs.Sleep", "")
+	call("Funcs.Sleep", "failed")
+	call("Funcs.Missing", "")
+	_, err = server.Dispatch(new(Context), "Funcs.Sleep", func(interface{}) error { return nil })
+	assert.NoError(t, err)
+
+	// The counters survive the updates of the method.
+	stats := server.Stats()
+	assert.Equal(t, uint64(3), stats["Funcs.Sleep"].Calls)
+	assert.Equal(t, uint64(1), stats["Funcs.Sleep"].Errors)
+	assert.GreaterOrEqual(t, stats["Funcs.Sleep"].Latency, 30*time.Millisecond)
+	assert.Equal(t, rpc.MethodStats{}, stats["MyService.Hello"])
+	assert.NotContains(t, stats, "Funcs.Missing")
+}
+
+func TestArenas(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetArenas(true)
+
+	type pair struct{ A, B string }
+	assert.NoError(t, rpc.RegisterFunc(server, "Pairs.Copy", func(ctx *Context, args *pair, reply *pair) error {
+		*reply = *args
+		return nil
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Pairs.Swap", func(ctx *Context, args *pair, reply *pair) error {
+		reply.A, reply.B = args.B, args.A
+		return nil
+	}))
+	// Cached replies are kept out of the arenas.
+	assert.NoError(t, server.Cache("Pairs.Swap", time.Minute))
+
+	call := func(method string, args *pair) (*pair, error) {
+		reqBody, _ := json.EncodeClientRequest(method, args)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		reply := &pair{}
+		return reply, json.DecodeClientResponse(w.Result().Body, reply)
+	}
+	for i := 0; i < 10; i++ {
+		reply, err := call("Pairs.Copy", &pair{"a", strconv.Itoa(i)})
+		assert.NoError(t, err)
+		assert.Equal(t, &pair{"a", strconv.Itoa(i)}, reply)
+		reply, err = call("Pairs.Swap", &pair{"a", "b"})
+		assert.NoError(t, err)
+		assert.Equal(t, &pair{"b", "a"}, reply)
+	}
+}
+
+func TestLazy(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterBeforeFunc(func(r *http.Request, ctx *Context) error {
+		if token := r.Header.Get("Authorization"); token != "" {
+			ctx.AuthToken = token
+		}
+		return nil
+	})
+
+	type text struct{ Text string }
+	decoded := 0
+	upper := func(ctx *Context, args *rpc.Lazy[text], reply *text) error {
+		if ctx.AuthToken != MyToken {
+			return errors.New("unauthorized")
+		}
+		decoded++
+		value, err := args.Get()
+		if err != nil {
+			return err
+		}
+		reply.Text = strings.ToUpper(value.Text)
+		return nil
+	}
+	assert.NoError(t, rpc.RegisterFunc(server, "Lazy.Upper", upper))
+	assert.NoError(t, rpc.RegisterFunc(server, "Lazy.Cached", upper))
+	assert.NoError(t, server.Cache("Lazy.Cached", time.Minute))
+
+	call := func(method, token, params string) (*text, error) {
+		body := `{"jsonrpc":"2.0","method":"` + method + `","params":` + params + `,"id":1}`
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		reply := &text{}
+		return reply, json.DecodeClientResponse(w.Result().Body, reply)
+	}
+
+	// Rejected calls don't decode their args, even invalid ones.
+	_, err = call("Lazy.Upper", "", `{"Text":1}`)
+	assert.EqualError(t, err, "unauthorized")
+	assert.Equal(t, 0, decoded)
+
+	_, err = call("Lazy.Upper", MyToken, `{"Text":1}`)
+	assert.Error(t, err)
+	reply, err := call("Lazy.Upper", MyToken, `{"Text":"a"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "A", reply.Text)
+
+	// Cached calls decode their args for the key.
+	for i := 0; i < 2; i++ {
+		reply, err = call("Lazy.Cached", MyToken, `{"Text":"b"}`)
+		assert.NoError(t, err)
+		assert.Equal(t, "B", reply.Text)
+	}
+	assert.Equal(t, 3, decoded)
+
+	reply2, err := server.Dispatch(&Context{AuthToken: MyToken}, "Lazy.Upper", func(args interface{}) error {
+		return stdjson.Unmarshal([]byte(`{"Text":"c"}`), args)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &text{"C"}, reply2)
+}
+
+func TestMinimal(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetMinimal(true)
+	server.SetPooling(true)
+	hooked := false
+	server.RegisterBeforeFunc(func(r *http.Request, ctx *Context) error {
+		hooked = true
+		return nil
+	})
+
+	type text struct{ Text string }
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Upper", func(ctx *Context, args *text, reply *text) error {
+		reply.Text = strings.ToUpper(args.Text)
+		return nil
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Fail", func(ctx *Context, args *text, reply *text) error {
+		return errors.New(args.Text)
+	}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(MyService), "", rpc.ACL{rpc.ACLAllMethods: {"user"}}))
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+	call := func(method string, args interface{}) (*text, error) {
+		reqBody, _ := json.EncodeClientRequest(method, args)
+		reply := &text{}
+		return reply, json.DecodeClientResponse(serve(string(reqBody)).Body, reply)
+	}
+
+	reply, err := call("Funcs.Upper", &text{"a"})
+	assert.NoError(t, err)
+	assert.Equal(t, "A", reply.Text)
+	_, err = call("Funcs.Fail", &text{"failed"})
+	assert.EqualError(t, err, "failed")
+	_, err = call("Funcs.Missing", &text{})
+	assert.Error(t, err)
+	_, err = call("MyService.Hello", &text{"a"})
+	assert.EqualError(t, err, rpc.ErrForbidden.Error())
+	assert.False(t, hooked)
+
+	w := serve(`[{"jsonrpc":"2.0","method":"Funcs.Upper","params":{"Text":"b"},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Funcs.Upper","params":{"Text":"c"},"id":2}]`)
+	assert.Contains(t, w.Body.String(), `"result":{"Text":"B"}`)
+	assert.Contains(t, w.Body.String(), `"result":{"Text":"C"}`)
+
+	// The ACL table is checked.
+	assert.NoError(t, server.SetACLTable(rpc.ACLTable{"Funcs.Upper": {"user"}}))
+	_, err = call("Funcs.Upper", &text{"a"})
+	assert.EqualError(t, err, rpc.ErrForbidden.Error())
+	_, err = call("Funcs.Fail", &text{"failed"})
+	assert.EqualError(t, err, "failed")
+
+	// Authentication is never skipped.
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		return nil, errors.New("unknown caller")
+	}))
+	_, err = call("Funcs.Upper", &text{"a"})
+	assert.EqualError(t, err, "unknown caller")
+
+	// Panics of calls received without net/http are recovered.
+	server.SetAuthenticator(nil)
+	assert.NoError(t, server.SetACLTable(nil))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Panic", func(ctx *Context, args *text, reply *text) error {
+		panic("boom")
+	}))
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewConnClient(clientConn, json.NewClientCodec())
+	defer client.Close()
+	err = client.Call(context.Background(), "Funcs.Panic", &text{"a"}, reply)
+	assert.EqualError(t, err, rpc.ErrInternal.Error())
+	assert.NoError(t, client.Call(context.Background(), "Funcs.Upper", &text{"d"}, reply))
+	assert.Equal(t, "D", reply.Text)
+}
+
+func TestSlog(t *testing.T) {
+	server, err := rpc.NewServer(new(AuthContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		return &User{Username: "alice"}, nil
+	}))
+	var buf bytes.Buffer
+	server.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Echo", func(ctx *AuthContext, args *string, reply *string) error {
+		if *args == "fail" {
+			return &rpc.Error{Code: 42, Message: "failed"}
+		}
+		*reply = *args
+		return nil
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Ping", func(ctx *AuthContext, args *string, reply *string) error {
+		if *args == "fail" {
+			return errors.New("down")
+		}
+		return nil
+	}))
+	assert.NoError(t, server.SetLogLevel("Funcs.Ping", slog.LevelDebug))
+	assert.Error(t, server.SetLogLevel("Funcs.Missing", slog.LevelDebug))
+
+	call := func(method string, args interface{}) map[string]interface{} {
+		buf.Reset()
+		reqBody, _ := json.EncodeClientRequest(method, args)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(rpc.RequestIDHeader, "req-1")
+		server.ServeHTTP(httptest.NewRecorder(), req)
+		if buf.Len() == 0 {
+			return nil
+		}
+		var record map[string]interface{}
+		assert.NoError(t, stdjson.Unmarshal(buf.Bytes(), &record))
+		return record
+	}
+
+	record := call("Funcs.Echo", "a")
+	assert.Equal(t, "INFO", record["level"])
+	assert.Equal(t, "Funcs.Echo", record["method"])
+	assert.Equal(t, float64(200), record["status"])
+	assert.Equal(t, "req-1", record["request_id"])
+	assert.Equal(t, "alice", record["principal"])
+	assert.Contains(t, record, "duration")
+	assert.NotContains(t, record, "error")
+
+	record = call("Funcs.Echo", "fail")
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "failed", record["error"])
+	assert.Equal(t, float64(42), record["code"])
+
+	assert.Nil(t, call("Funcs.Ping", ""))
+	record = call("Funcs.Ping", "fail")
+	assert.Equal(t, "INFO", record["level"])
+	assert.Equal(t, "down", record["error"])
+
+	record = call("Funcs.Missing", "")
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "Funcs.Missing", record["method"])
+}
+
+func TestSlowCalls(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	var buf bytes.Buffer
+	server.SetSlowCalls(&rpc.SlowCallPolicy{
+		Logger:         slog.New(slog.NewJSONHandler(&buf, nil)),
+		Threshold:      20 * time.Millisecond,
+		ArgsSampleRate: 1,
+	})
+	type sleepArgs struct {
+		Delay    time.Duration
+		Password string `redact:"true"`
+	}
+	for _, name := range []string{"Funcs.Sleep", "Funcs.Fast"} {
+		assert.NoError(t, rpc.RegisterFunc(server, name, func(ctx *Context, args *sleepArgs, reply *struct{}) error {
+			time.Sleep(args.Delay)
+			return nil
+		}))
+	}
+	assert.NoError(t, server.SetSlowCallThreshold("Funcs.Fast", 5*time.Millisecond))
+	assert.Error(t, server.SetSlowCallThreshold("Funcs.Missing", time.Second))
+
+	call := func(method string, delay time.Duration) map[string]interface{} {
+		buf.Reset()
+		reqBody, _ := json.EncodeClientRequest(method, &sleepArgs{Delay: delay, Password: "secret"})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		server.ServeHTTP(httptest.NewRecorder(), req)
+		if buf.Len() == 0 {
+			return nil
+		}
+		var record map[string]interface{}
+		assert.NoError(t, stdjson.Unmarshal(buf.Bytes(), &record))
+		return record
+	}
+
+	assert.Nil(t, call("Funcs.Sleep", 0))
+	assert.Nil(t, call("Funcs.Sleep", 10*time.Millisecond))
+	record := call("Funcs.Sleep", 30*time.Millisecond)
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "Funcs.Sleep", record["method"])
+	assert.Equal(t, map[string]interface{}{"Delay": float64(30 * time.Millisecond), "Password": rpc.Redacted}, record["args"])
+
+	record = call("Funcs.Fast", 10*time.Millisecond)
+	assert.Equal(t, "Funcs.Fast", record["method"])
+	assert.Equal(t, float64(5*time.Millisecond), record["threshold"])
+}
+
+func TestDebugVars(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterCodec(json.NewCodec(), "text/json")
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Check", func(ctx *Context, args *string, reply *string) error {
+		if *args != "" {
+			return errors.New(*args)
+		}
+		return nil
+	}))
+	for _, args := range []string{"", "", "", "failed"} {
+		reqBody, _ := json.EncodeClientRequest("Funcs.Check", args)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "Application/JSON")
+		server.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	server.PublishVars("rpc_test")
+	w := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var published struct {
+		Vars rpc.DebugVars `json:"rpc_test"`
+	}
+	assert.NoError(t, stdjson.Unmarshal(w.Body.Bytes(), &published))
+
+	w = httptest.NewRecorder()
+	server.DebugVarsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var vars rpc.DebugVars
+	assert.NoError(t, stdjson.Unmarshal(w.Body.Bytes(), &vars))
+
+	for _, vars := range []rpc.DebugVars{published.Vars, vars} {
+		assert.Greater(t, vars.Uptime, 0.0)
+		assert.Equal(t, map[string]uint64{"application/json": 4, "text/json": 0}, vars.Codecs)
+		method := vars.Methods["Funcs.Check"]
+		assert.Equal(t, uint64(4), method.Calls)
+		assert.Equal(t, uint64(1), method.Errors)
+		assert.Equal(t, 0.25, method.ErrorRate)
+	}
+}
+
+type HealthService struct {
+	err error
+}
+
+func (s *HealthService) Health(ctx context.Context) error {
+	return s.err
+}
+
+func (*HealthService) Ping(ctx *Context, args *struct{}, reply *struct{}) error {
+	return nil
+}
+
+func TestReadiness(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	db := &HealthService{}
+	assert.NoError(t, server.RegisterService(db, "DB"))
+	assert.NoError(t, server.RegisterService(&HealthService{}, "Cache"))
+	assert.NoError(t, server.RegisterService(new(MyService), ""))
+
+	check := func() (int, *rpc.Readiness) {
+		w := httptest.NewRecorder()
+		server.ReadinessHandler(time.Second).ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		readiness := &rpc.Readiness{}
+		assert.NoError(t, stdjson.Unmarshal(w.Body.Bytes(), readiness))
+		return w.Code, readiness
+	}
+
+	status, readiness := check()
+	assert.Equal(t, 200, status)
+	assert.True(t, readiness.Ready)
+	if assert.Len(t, readiness.Checks, 2) {
+		assert.Equal(t, "Cache", readiness.Checks[0].Service)
+		assert.Equal(t, "DB", readiness.Checks[1].Service)
+		assert.True(t, readiness.Checks[1].Healthy)
+		assert.Nil(t, readiness.Checks[1].LastErrorAt)
+	}
+
+	db.err = errors.New("connection refused")
+	status, readiness = check()
+	assert.Equal(t, 503, status)
+	assert.False(t, readiness.Ready)
+	assert.True(t, readiness.Checks[0].Healthy)
+	assert.False(t, readiness.Checks[1].Healthy)
+	assert.Equal(t, "connection refused", readiness.Checks[1].Error)
+
+	db.err = nil
+	status, readiness = check()
+	assert.Equal(t, 200, status)
+	assert.Empty(t, readiness.Checks[1].Error)
+	assert.Equal(t, "connection refused", readiness.Checks[1].LastError)
+	assert.NotNil(t, readiness.Checks[1].LastErrorAt)
+}
+
+func TestSampling(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetPooling(true)
+	var samples []*rpc.Sample
+	server.SetSampleSink(rpc.SampleSinkFunc(func(sample *rpc.Sample) {
+		samples = append(samples, sample)
+	}))
+	type login struct {
+		User     string
+		Password string `redact:"true"`
+	}
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Login", func(ctx *Context, args *login, reply *string) error {
+		*reply = "token-" + args.User
+		return nil
+	}))
+	assert.Error(t, server.SetSampleRate("Funcs.Missing", 1))
+
+	call := func(body string) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "client/1.0")
+		server.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	const ok = `{"jsonrpc":"2.0","method":"Funcs.Login","params":{"User":"bob","Password":"secret"},"id":1}`
+	call(ok)
+	assert.Empty(t, samples)
+
+	assert.NoError(t, server.SetSampleRate("Funcs.Login", 1))
+	call(ok)
+	call(`{"jsonrpc":"2.0","method":"Funcs.Login","params":{"User":"eve","Password":1},"id":2}`)
+	if assert.Len(t, samples, 2) {
+		assert.Equal(t, "Funcs.Login", samples[0].Method)
+		assert.Equal(t, "client/1.0", samples[0].UserAgent)
+		assert.Equal(t, map[string]interface{}{"User": "bob", "Password": rpc.Redacted}, samples[0].Args)
+		assert.Equal(t, "token-bob", samples[0].Reply)
+		assert.NoError(t, samples[0].Err)
+		assert.Equal(t, map[string]interface{}{"User": "eve", "Password": rpc.Redacted}, samples[1].Args)
+		assert.Nil(t, samples[1].Reply)
+		assert.Error(t, samples[1].Err)
+	}
+
+	assert.NoError(t, server.SetSampleRate("Funcs.Login", 0))
+	call(ok)
+	assert.Len(t, samples, 2)
+}
+
+func TestStatsD(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer agent.Close()
+	handler, err := statsd.Dial(agent.LocalAddr().String(), statsd.Options{
+		Tags:        []string{"env:test"},
+		SampleRates: map[string]float64{statsd.MetricHandlerDuration: 0},
+	})
+	assert.NoError(t, err)
+
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetStatsHandler(handler)
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Check", func(ctx *Context, args *string, reply *string) error {
+		if *args != "" {
+			return errors.New(*args)
+		}
+		return nil
+	}))
+	for _, args := range []string{"", "failed"} {
+		reqBody, _ := json.EncodeClientRequest("Funcs.Check", args)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		server.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.NoError(t, handler.Close())
+
+	buf := make([]byte, 2048)
+	agent.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := agent.ReadFrom(buf)
+	assert.NoError(t, err)
+	lines := strings.Split(string(buf[:n]), "\n")
+	assert.Len(t, lines, 5)
+	assert.Equal(t, "rpc.requests:1|c|#method:Funcs.Check,status:200,env:test", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "rpc.duration:"))
+	assert.True(t, strings.HasSuffix(lines[1], "|ms|#method:Funcs.Check,status:200,env:test"))
+	assert.Equal(t, "rpc.errors:1|c|#method:Funcs.Check,status:200,error_class:server,env:test", lines[2])
+	assert.NotContains(t, string(buf[:n]), "handler_duration")
+}
+
+func TestAdminHandler(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	assert.NoError(t, server.Cache("MyService.Hello", time.Minute))
+	assert.NoError(t, server.SetLogLevel("MyService.Hello", slog.LevelDebug))
+	handler := http.StripPrefix("/admin", server.AdminHandler())
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, 403, get("/admin/services", MyToken).Code)
+
+	server.SetAdminAuth(func(r *http.Request) error {
+		if r.Header.Get("Authorization") != MyToken {
+			return errors.New("not an admin")
+		}
+		return nil
+	})
+	w := get("/admin/services", "guest")
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, "not an admin", w.Body.String())
+
+	w = get("/admin/services", MyToken)
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"MyService":["Hello"]}`, w.Body.String())
+
+	var config struct {
+		Codecs  []string
+		Methods map[string]struct {
+			CacheTTL string `json:"cache_ttl"`
+			LogLevel string `json:"log_level"`
+		}
+	}
+	w = get("/admin/config", MyToken)
+	assert.NoError(t, stdjson.Unmarshal(w.Body.Bytes(), &config))
+	assert.Equal(t, []string{"application/json"}, config.Codecs)
+	assert.Equal(t, "1m0s", config.Methods["MyService.Hello"].CacheTTL)
+	assert.Equal(t, "DEBUG", config.Methods["MyService.Hello"].LogLevel)
+
+	w = get("/admin/stats", MyToken)
+	assert.Contains(t, w.Body.String(), `"MyService.Hello"`)
+
+	w = get("/admin/pprof/", MyToken)
+	assert.Contains(t, w.Body.String(), "goroutine")
+	w = get("/admin/pprof/goroutine?debug=1", MyToken)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "goroutine profile")
+	assert.Equal(t, 404, get("/admin/pprof/missing", MyToken).Code)
+	assert.Equal(t, 400, get("/admin/pprof/profile?seconds=x", MyToken).Code)
+}
+
+func TestErrorSpikes(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	assert.Nil(t, server.ErrorRates())
+	type spike struct {
+		class rpc.ErrorClass
+		rate  float64
+	}
+	var spikes []spike
+	server.SetErrorSpikes(&rpc.ErrorSpikePolicy{
+		Thresholds: map[rpc.ErrorClass]float64{rpc.ClassPanic: 0.3, rpc.ClassClient: 0.9},
+		MinCalls:   2,
+		OnErrorSpike: func(class rpc.ErrorClass, rate float64) {
+			spikes = append(spikes, spike{class, rate})
+		},
+	})
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Run", func(ctx *Context, args *string, reply *string) error {
+		switch *args {
+		case "panic":
+			panic("boom")
+		case "sleep":
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}))
+
+	call := func(method, args string, header ...string) *httptest.ResponseRecorder {
+		reqBody, _ := json.EncodeClientRequest(method, args)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	w := call("Funcs.Run", "panic")
+	assert.EqualError(t, json.DecodeClientResponse(w.Body, new(string)), rpc.ErrInternal.Error())
+	assert.Empty(t, spikes, "below MinCalls")
+	call("Funcs.Run", "")
+	assert.Equal(t, []spike{{rpc.ClassPanic, 0.5}}, spikes)
+	call("Funcs.Run", "panic")
+	assert.Len(t, spikes, 1, "already spiking")
+	call("Funcs.Run", "sleep", rpc.TimeoutHeader, "10ms")
+	call("Funcs.Missing", "")
+	call("Funcs.Run", "")
+
+	rates := server.ErrorRates()
+	assert.Equal(t, 2.0/6, rates[rpc.ClassPanic])
+	assert.Equal(t, 1.0/6, rates[rpc.ClassTimeout])
+	assert.Equal(t, 1.0/6, rates[rpc.ClassClient])
+	assert.Len(t, spikes, 1)
+}
+
+type ClaimsContext struct {
+	Claims jwt.Claims
+}
+
+func (ctx *ClaimsContext) SetClaims(claims jwt.Claims) {
+	ctx.Claims = claims
+}
+
+type ClaimsService struct{}
+
+func (*ClaimsService) Purge(ctx *ClaimsContext, args *struct{}, reply *string) error {
+	return nil
+}
+
+// signJWT returns a token of the claims signed with key by sign.
+func signJWT(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	h, _ := stdjson.Marshal(header)
+	c, _ := stdjson.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestJWT(t *testing.T) {
+	secret := []byte("secret")
+	hs256 := func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	rs256 := func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		assert.NoError(t, err)
+		return sig
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	es256 := func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, sum[:])
+		assert.NoError(t, err)
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	fetches := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"rsa","use":"sig","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()))
+	}))
+	defer jwks.Close()
+
+	server, err := rpc.NewServer(new(ClaimsContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(jwt.NewAuthenticator(jwt.Options{
+		Keys:     map[string]interface{}{"": secret, "ec": &ecKey.PublicKey},
+		JWKSURL:  jwks.URL,
+		Issuer:   "issuer",
+		Audience: "api",
+	}))
+	assert.NoError(t, server.RegisterBeforeFunc(jwt.ClaimsHook[ClaimsContext]()))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Whoami", func(ctx *ClaimsContext, args *struct{}, reply *string) error {
+		*reply = ctx.Claims.Subject()
+		return nil
+	}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(ClaimsService), "Admin", rpc.ACL{"Purge": {"admin"}}))
+
+	call := func(method, token string) (string, error) {
+		reqBody, _ := json.EncodeClientRequest(method, &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		var reply string
+		err := json.DecodeClientResponse(w.Body, &reply)
+		return reply, err
+	}
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	claims := map[string]interface{}{"sub": "alice", "iss": "issuer", "aud": []string{"api"}, "exp": exp}
+
+	for alg, token := range map[string]string{
+		"HS256": signJWT(t, map[string]interface{}{"alg": "HS256"}, claims, hs256),
+		"RS256": signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims, rs256),
+		"ES256": signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "ec"}, claims, es256),
+	} {
+		reply, err := call("Funcs.Whoami", token)
+		assert.NoError(t, err, alg)
+		assert.Equal(t, "alice", reply, alg)
+	}
+	assert.Equal(t, 1, fetches)
+
+	reject := func(want error, header map[string]interface{}, claims map[string]interface{}, sign func([]byte) []byte) {
+		_, err := call("Funcs.Whoami", signJWT(t, header, claims, sign))
+		assert.ErrorContains(t, err, want.Error())
+	}
+	hs := map[string]interface{}{"alg": "HS256"}
+	reject(jwt.ErrSignature, hs, claims, rs256)
+	reject(jwt.ErrAlgorithm, map[string]interface{}{"alg": "none"}, claims, hs256)
+	reject(jwt.ErrUnknownKey, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, claims, hs256)
+	reject(jwt.ErrExpired, hs, map[string]interface{}{"iss": "issuer", "aud": "api", "exp": 1}, hs256)
+	reject(jwt.ErrNotYetValid, hs, map[string]interface{}{"iss": "issuer", "aud": "api", "nbf": exp}, hs256)
+	reject(jwt.ErrIssuer, hs, map[string]interface{}{"iss": "other", "aud": "api"}, hs256)
+	reject(jwt.ErrAudience, hs, map[string]interface{}{"iss": "issuer", "aud": "other"}, hs256)
+	_, err = call("Funcs.Whoami", "")
+	assert.ErrorContains(t, err, jwt.ErrMissingToken.Error())
+
+	_, err = call("Admin.Purge", signJWT(t, hs, claims, hs256))
+	assert.EqualError(t, err, rpc.ErrForbidden.Error())
+	admin := map[string]interface{}{"sub": "root", "iss": "issuer", "aud": "api", "roles": "admin ops"}
+	_, err = call("Admin.Purge", signJWT(t, hs, admin, hs256))
+	assert.NoError(t, err)
+}
+
+type KeyContext struct {
+	Principal rpc.Principal
+}
+
+func (ctx *KeyContext) SetPrincipal(p rpc.Principal) {
+	ctx.Principal = p
+}
+
+type KeyService struct{}
+
+func (*KeyService) Purge(ctx *KeyContext, args *struct{}, reply *string) error {
+	return nil
+}
+
+func TestAPIKey(t *testing.T) {
+	file := t.TempDir() + "/keys.json"
+	assert.NoError(t, os.WriteFile(file, []byte(`{
+		"k1": {"name": "billing", "roles": ["admin"]},
+		"k2": {"name": "batch", "rate": 1, "burst": 2}
+	}`), 0600))
+	store, err := apikey.LoadFile(file)
+	assert.NoError(t, err)
+	assert.Len(t, store, 2)
+	_, err = apikey.LoadFile(t.TempDir() + "/missing.json")
+	assert.Error(t, err)
+
+	lookups := 0
+	db := apikey.StoreFunc(func(ctx context.Context, key string) (*apikey.Key, error) {
+		lookups++
+		if key == "broken" {
+			return nil, errors.New("database unavailable")
+		}
+		return store.Lookup(ctx, key)
+	})
+
+	server, err := rpc.NewServer(new(KeyContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	auth := apikey.NewAuthenticator(db, apikey.Options{QueryParam: "api_key"})
+	server.SetAuthenticator(auth)
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Whoami", func(ctx *KeyContext, args *struct{}, reply *string) error {
+		*reply = "anonymous"
+		if ctx.Principal != nil {
+			*reply = ctx.Principal.Name()
+		}
+		return nil
+	}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(KeyService), "Admin", rpc.ACL{"Purge": {"admin"}}))
+
+	call := func(method, target, key string) (string, error) {
+		reqBody, _ := json.EncodeClientRequest(method, &struct{}{})
+		req := httptest.NewRequest("POST", target, bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(apikey.DefaultHeader, key)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		var reply string
+		err := json.DecodeClientResponse(w.Body, &reply)
+		return reply, err
+	}
+
+	reply, err := call("Funcs.Whoami", "/", "k1")
+	assert.NoError(t, err)
+	assert.Equal(t, "billing", reply)
+	reply, err = call("Funcs.Whoami", "/?api_key=k1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "billing", reply)
+	_, err = call("Funcs.Whoami", "/", "")
+	assert.ErrorContains(t, err, apikey.ErrMissingKey.Error())
+	_, err = call("Funcs.Whoami", "/", "unknown")
+	assert.ErrorContains(t, err, apikey.ErrInvalidKey.Error())
+	_, err = call("Funcs.Whoami", "/", "broken")
+	assert.ErrorContains(t, err, "database unavailable")
+
+	_, err = call("Admin.Purge", "/", "k1")
+	assert.NoError(t, err)
+	_, err = call("Admin.Purge", "/", "k2")
+	assert.EqualError(t, err, rpc.ErrForbidden.Error())
+
+	// k2 spent a token on Admin.Purge, and has one left of its burst of two
+	_, err = call("Funcs.Whoami", "/", "k2")
+	assert.NoError(t, err)
+	_, err = call("Funcs.Whoami", "/", "k2")
+	assert.ErrorContains(t, err, rpc.ErrRateLimited.Error())
+	_, err = call("Funcs.Whoami", "/", "k1")
+	assert.NoError(t, err)
+	assert.Equal(t, 9, lookups)
+
+	server.SetAuthenticator(apikey.NewAuthenticator(store, apikey.Options{Header: "X-Key", Optional: true}))
+	reply, err = call("Funcs.Whoami", "/", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "anonymous", reply)
+	_, err = call("Funcs.Whoami", "/?api_key=k1", "")
+	assert.NoError(t, err)
+}
+
+func TestSignaturePolicy(t *testing.T) {
+	secret := []byte("secret")
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Echo", func(ctx *Context, args *string, reply *string) error {
+		*reply = *args
+		return nil
+	}))
+	server.SetSignaturePolicy(&rpc.SignaturePolicy{Secret: secret, Replay: rpc.NewReplayGuard(time.Minute, nil)})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHMACSigning(secret), rpc.WithRequestCompression(16))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var reply string
+	assert.NoError(t, client.Call(context.Background(), "Funcs.Echo", strings.Repeat("signed", 10), &reply))
+	assert.Equal(t, strings.Repeat("signed", 10), reply)
+	assert.NoError(t, client.Call(context.Background(), "Funcs.Echo", "again", &reply))
+
+	unsigned, err := rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Error(t, unsigned.Call(context.Background(), "Funcs.Echo", "unsigned", &reply))
+
+	body, _ := json.EncodeClientRequest("Funcs.Echo", "hello")
+	call := func(timestamp time.Time, nonce string, body []byte, signature string) *httptest.ResponseRecorder {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		if signature == "" {
+			signature = rpc.Sign(secret, ts, nonce, body)
+		}
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(rpc.TimestampHeader, ts)
+		req.Header.Set(rpc.NonceHeader, nonce)
+		req.Header.Set(rpc.SignatureHeader, signature)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	w := call(time.Now(), "n1", body, "")
+	assert.Equal(t, 200, w.Code)
+	assert.NoError(t, json.DecodeClientResponse(w.Body, &reply))
+	assert.Equal(t, "hello", reply)
+
+	w = call(time.Now(), "n1", body, "")
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), rpc.ErrReplayedRequest.Error())
+
+	w = call(time.Now().Add(-2*time.Minute), "n2", body, "")
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), rpc.ErrStaleRequest.Error())
+
+	tampered, _ := json.EncodeClientRequest("Funcs.Echo", "tampered")
+	w = call(time.Now(), "n3", tampered, rpc.Sign(secret, strconv.FormatInt(time.Now().Unix(), 10), "n3", body))
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), rpc.ErrInvalidSignature.Error())
+
+	w = call(time.Now(), "n4", body, "zz")
+	assert.Equal(t, 401, w.Code)
+
+	// Bodies are read up to the limit.
+	server.SetSignaturePolicy(&rpc.SignaturePolicy{Secret: secret, MaxBodyBytes: 128})
+	large, _ := json.EncodeClientRequest("Funcs.Echo", strings.Repeat("large", 40))
+	w = call(time.Now(), "n5", large, "")
+	assert.Equal(t, 413, w.Code)
+	assert.Contains(t, w.Body.String(), rpc.ErrBodyTooLarge.Error())
+	w = call(time.Now(), "n6", body, "")
+	assert.Equal(t, 200, w.Code)
+
+	server.SetSignaturePolicy(nil)
+	w = call(time.Now(), "n1", body, "zz")
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	spiffe, _ := url.Parse("spiffe://example.org/ns/prod/sa/billing")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "billing"},
+		DNSNames:     []string{"billing.internal"},
+		URIs:         []*url.URL{spiffe},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	server, err := rpc.NewServer(new(KeyContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(&rpc.CertAuthenticator{Roles: func(p *rpc.CertPrincipal) []string {
+		var roles []string
+		if strings.HasPrefix(p.SPIFFEID, "spiffe://example.org/ns/prod/") {
+			roles = append(roles, "prod")
+		}
+		for _, name := range p.DNSNames {
+			if name == "billing.internal" {
+				roles = append(roles, "billing")
+			}
+		}
+		return roles
+	}})
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Whoami", func(ctx *KeyContext, args *struct{}, reply *string) error {
+		*reply = ctx.Principal.Name()
+		return nil
+	}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(KeyService), "Billing", rpc.ACL{"Purge": {"billing"}}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(KeyService), "Prod", rpc.ACL{"Purge": {"prod"}}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(KeyService), "Other", rpc.ACL{"Purge": {"spiffe://example.org/ns/prod/sa/other"}}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(KeyService), "Admin", rpc.ACL{"Purge": {"billing.internal"}}))
+
+	call := func(method string, state *tls.ConnectionState) (string, error) {
+		reqBody, _ := json.EncodeClientRequest(method, &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.TLS = state
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		var reply string
+		err := json.DecodeClientResponse(w.Body, &reply)
+		return reply, err
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	reply, err := call("Funcs.Whoami", verified)
+	assert.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/ns/prod/sa/billing", reply)
+	_, err = call("Billing.Purge", verified)
+	assert.NoError(t, err)
+	_, err = call("Prod.Purge", verified)
+	assert.NoError(t, err)
+	_, err = call("Other.Purge", verified)
+	assert.EqualError(t, err, rpc.ErrForbidden.Error())
+	_, err = call("Admin.Purge", verified)
+	assert.EqualError(t, err, rpc.ErrForbidden.Error())
+
+	_, err = call("Funcs.Whoami", nil)
+	assert.ErrorContains(t, err, rpc.ErrNoClientCertificate.Error())
+	_, err = call("Funcs.Whoami", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	assert.ErrorContains(t, err, rpc.ErrNoClientCertificate.Error())
+
+	// The identities of certificates are not roles.
+	p := rpc.NewCertPrincipal(cert)
+	assert.Equal(t, "billing", p.CommonName)
+	assert.Equal(t, []string{"billing.internal"}, p.DNSNames)
+	assert.Equal(t, "spiffe://example.org/ns/prod/sa/billing", p.SPIFFEID)
+	for _, role := range []string{"", "billing", "billing.internal", "spiffe://example.org/ns/prod/sa/billing"} {
+		assert.False(t, p.HasRole(role), role)
+	}
+	p.Roles = []string{"billing"}
+	assert.True(t, p.HasRole("billing"))
+}
+
+func TestIPFilter(t *testing.T) {
+	_, err := rpc.NewIPFilter([]string{"10.0.0.0/33"}, nil, nil)
+	assert.Error(t, err)
+	_, err = rpc.NewIPFilter(nil, []string{"nowhere"}, nil)
+	assert.Error(t, err)
+	filter, err := rpc.NewIPFilter(
+		[]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.7"},
+		[]string{"10.6.0.0/16"},
+		[]string{"172.16.0.0/12"})
+	assert.NoError(t, err)
+
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Echo", func(ctx *Context, args *string, reply *string) error {
+		*reply = *args
+		return nil
+	}))
+	server.SetIPFilter(filter)
+
+	call := func(remote string, forwarded ...string) int {
+		reqBody, _ := json.EncodeClientRequest("Funcs.Echo", "hello")
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remote
+		for _, f := range forwarded {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, call("10.1.2.3:1234"))
+	assert.Equal(t, 200, call("[2001:db8::1]:1234"))
+	assert.Equal(t, 200, call("[::ffff:192.168.1.7]:1234"))
+	assert.Equal(t, 403, call("192.168.1.8:1234"))
+	assert.Equal(t, 403, call("10.6.1.1:1234"))
+	assert.Equal(t, 403, call("invalid"))
+
+	// X-Forwarded-For is only honored from trusted proxies, walking past the trusted hops.
+	assert.Equal(t, 403, call("8.8.8.8:1234", "10.1.2.3"))
+	assert.Equal(t, 200, call("172.16.0.1:1234", "8.8.8.8, 10.1.2.3"))
+	assert.Equal(t, 200, call("172.16.0.1:1234", "8.8.8.8, 10.1.2.3, 172.20.0.1"))
+	assert.Equal(t, 403, call("172.16.0.1:1234", "10.1.2.3, 8.8.8.8"))
+	assert.Equal(t, 403, call("172.16.0.1:1234", "10.1.2.3", "8.8.8.8"))
+	assert.Equal(t, 403, call("172.16.0.1:1234", "garbage"))
+	assert.Equal(t, 403, call("172.16.0.1:1234"))
+
+	gateway := rpc.NewGateway(server)
+	reqBody, _ := json.EncodeClientRequest("Funcs.Echo", "hello")
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "8.8.8.8:1234"
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	server.SetIPFilter(nil)
+	assert.Equal(t, 200, call("8.8.8.8:1234"))
+}
+
+// failingRateStore is a RateLimitStore always failing.
+type failingRateStore struct{}
+
+func (failingRateStore) Take(ctx context.Context, key string, limit rpc.RateLimit) (rpc.RateDecision, error) {
+	return rpc.RateDecision{}, errors.New("store unavailable")
+}
+
+func TestRatePolicy(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetMetadataHeaders("X-Tenant")
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Echo", func(ctx *Context, args *string, reply *string) error {
+		*reply = *args
+		return nil
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Other", func(ctx *Context, args *string, reply *string) error {
+		return nil
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Bulk.Export", func(ctx *Context, args *string, reply *string) error {
+		return nil
+	}))
+	server.SetRatePolicy(&rpc.RatePolicy{
+		Key:     rpc.RateKeyByMetadata("X-Tenant"),
+		Default: rpc.RateLimit{Rate: 0.001, Burst: 3},
+		Groups: []rpc.RateGroup{
+			{Name: "bulk", Methods: []string{"Bulk.*"}, Limit: rpc.RateLimit{Rate: 0.5}},
+		},
+	})
+
+	call := func(method, tenant string) (*httptest.ResponseRecorder, error) {
+		reqBody, _ := json.EncodeClientRequest(method, "hello")
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		var reply string
+		return w, json.DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &reply)
+	}
+
+	// Funcs.Echo and Funcs.Other share the bucket of the default group.
+	w, err := call("Funcs.Echo", "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Remaining"))
+	assert.NotEmpty(t, w.Header().Get("RateLimit-Reset"))
+	_, err = call("Funcs.Other", "acme")
+	assert.NoError(t, err)
+	_, err = call("Funcs.Echo", "acme")
+	assert.NoError(t, err)
+	w, err = call("Funcs.Other", "acme")
+	assert.ErrorContains(t, err, rpc.ErrRateLimited.Error())
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1000", w.Header().Get("Retry-After"))
+
+	// Other tenants and groups have their own buckets, and requests without tenant are exempt.
+	_, err = call("Funcs.Echo", "globex")
+	assert.NoError(t, err)
+	w, err = call("Bulk.Export", "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	_, err = call("Bulk.Export", "acme")
+	assert.ErrorContains(t, err, rpc.ErrRateLimited.Error())
+	for i := 0; i < 5; i++ {
+		w, err = call("Funcs.Echo", "")
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+
+	server.SetRatePolicy(&rpc.RatePolicy{Default: rpc.RateLimit{Rate: 1}, Store: failingRateStore{}})
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		return &User{"alice", nil}, nil
+	}))
+	for i := 0; i < 3; i++ {
+		_, err = call("Funcs.Echo", "acme")
+		assert.NoError(t, err)
+	}
+
+	server.SetRatePolicy(&rpc.RatePolicy{Default: rpc.RateLimit{Rate: 1}})
+	_, err = call("Funcs.Echo", "acme")
+	assert.NoError(t, err)
+	_, err = call("Funcs.Echo", "globex")
+	assert.ErrorContains(t, err, rpc.ErrRateLimited.Error())
+
+	server.SetRatePolicy(nil)
+	_, err = call("Funcs.Echo", "acme")
+	assert.NoError(t, err)
+}
+
+func TestCSRFPolicy(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Echo", func(ctx *Context, args *string, reply *string) error {
+		*reply = *args
+		return nil
+	}))
+	handler := server.CSRFTokenHandler()
+
+	issue := func(cookies ...*http.Cookie) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest("GET", "/csrf", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var body struct{ Header, Token string }
+		stdjson.Unmarshal(w.Body.Bytes(), &body)
+		return w, body.Token
+	}
+	call := func(token string, cookies ...*http.Cookie) int {
+		reqBody, _ := json.EncodeClientRequest("Funcs.Echo", "hello")
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set(rpc.DefaultCSRFHeader, token)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	w, _ := issue()
+	assert.Equal(t, 404, w.Code)
+
+	// Double-submitted tokens.
+	server.SetCSRFPolicy(&rpc.CSRFPolicy{SessionCookie: "session"})
+	session := &http.Cookie{Name: "session", Value: "s1"}
+	w, token := issue(session)
+	assert.Equal(t, 200, w.Code)
+	assert.NotEmpty(t, token)
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, rpc.DefaultCSRFCookie, cookies[0].Name)
+		assert.Equal(t, token, cookies[0].Value)
+		assert.Equal(t, http.SameSiteStrictMode, cookies[0].SameSite)
+	}
+	csrfCookie := &http.Cookie{Name: rpc.DefaultCSRFCookie, Value: token}
+	_, again := issue(session, csrfCookie)
+	assert.Equal(t, token, again)
+
+	assert.Equal(t, 200, call(token, session, csrfCookie))
+	assert.Equal(t, 403, call("", session, csrfCookie))
+	assert.Equal(t, 403, call("forged", session, csrfCookie))
+	assert.Equal(t, 403, call(token, session))
+	assert.Equal(t, 200, call(""))
+	assert.Equal(t, 200, call("", &http.Cookie{Name: "other", Value: "x"}))
+
+	// Tokens bound to the session.
+	server.SetCSRFPolicy(&rpc.CSRFPolicy{SessionCookie: "session", Secret: []byte("secret")})
+	w, token = issue(session)
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Result().Cookies())
+	w, _ = issue()
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, 200, call(token, session))
+	assert.Equal(t, 403, call(token, &http.Cookie{Name: "session", Value: "s2"}))
+	assert.Equal(t, 403, call("", session))
+
+	server.SetCSRFPolicy(nil)
+	assert.Equal(t, 200, call("", session))
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	nonces := rpc.NewMemoryNonceCache()
+	a := rpc.NewReplayGuard(time.Minute, nonces)
+	b := rpc.NewReplayGuard(time.Minute, nonces)
+
+	assert.NoError(t, a.Check(now, "n1"))
+	assert.Equal(t, rpc.ErrReplayedRequest, a.Check(now, "n1"))
+	assert.Equal(t, rpc.ErrReplayedRequest, b.Check(now, "n1"))
+	assert.NoError(t, b.Check(now, "n2"))
+	assert.Equal(t, rpc.ErrMissingNonce, a.Check(now, ""))
+	assert.Equal(t, rpc.ErrStaleRequest, a.Check("yesterday", "n3"))
+	assert.Equal(t, rpc.ErrStaleRequest, a.Check(strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10), "n3"))
+	assert.Equal(t, rpc.ErrStaleRequest, a.Check(strconv.FormatInt(time.Now().Add(2*time.Minute).Unix(), 10), "n3"))
+	assert.NoError(t, a.Check(strconv.FormatInt(time.Now().Add(30*time.Second).Unix(), 10), "n3"))
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set(rpc.TimestampHeader, now)
+	req.Header.Set(rpc.NonceHeader, "n4")
+	assert.NoError(t, rpc.NewReplayGuard(0, nil).CheckRequest(req))
+	assert.NoError(t, a.CheckRequest(req))
+	assert.Equal(t, rpc.ErrReplayedRequest, a.CheckRequest(req))
+
+	added, err := nonces.Add("short", 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, added)
+	added, _ = nonces.Add("short", 10*time.Millisecond)
+	assert.False(t, added)
+	time.Sleep(20 * time.Millisecond)
+	added, _ = nonces.Add("short", 10*time.Millisecond)
+	assert.True(t, added)
+}
+
+func TestACLTable(t *testing.T) {
+	server, err := rpc.NewServer(new(AuthContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		return &User{"caller", strings.Fields(r.Header.Get("Authorization"))}, nil
+	}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(AdminService), "", rpc.ACL{"Purge": {"admin"}}))
+	assert.NoError(t, server.RegisterService(new(AdminService), "Ops"))
+
+	file := t.TempDir() + "/acl.json"
+	assert.NoError(t, os.WriteFile(file, []byte(`{
+		"*": ["user"],
+		"Ops.*": ["ops"],
+		"AdminService.Purge": ["audited"]
+	}`), 0600))
+	table, err := rpc.LoadACLFile(file)
+	assert.NoError(t, err)
+	assert.NoError(t, server.SetACLTable(table))
+
+	assert.Error(t, server.SetACLTable(rpc.ACLTable{"Ops*": {"ops"}}))
+	assert.Error(t, server.SetACLTable(rpc.ACLTable{"Ops.": {"ops"}}))
+	assert.Error(t, server.SetACLTable(rpc.ACLTable{"*.Purge": {"ops"}}))
+	_, err = rpc.LoadACLFile(t.TempDir() + "/missing.json")
+	assert.Error(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"AdminService.Whoami": {"user"},
+		"AdminService.Purge":  {"admin", "audited", "user"},
+		"Ops.Whoami":          {"ops", "user"},
+		"Ops.Purge":           {"ops", "user"},
+	}, server.Permissions())
+
+	call := func(method, roles string) error {
+		reqBody, _ := json.EncodeClientRequest(method, &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", roles)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return json.DecodeClientResponse(w.Body, &struct{ Name string }{})
+	}
+	assert.NoError(t, call("AdminService.Whoami", "user"))
+	assert.EqualError(t, call("AdminService.Whoami", ""), rpc.ErrForbidden.Error())
+	assert.EqualError(t, call("AdminService.Purge", "user admin"), rpc.ErrForbidden.Error())
+	assert.NoError(t, call("AdminService.Purge", "user admin audited"))
+	assert.EqualError(t, call("Ops.Whoami", "user"), rpc.ErrForbidden.Error())
+	assert.NoError(t, call("Ops.Whoami", "user ops"))
+
+	_, err = server.Dispatch(new(AuthContext), "Ops.Whoami", func(interface{}) error { return nil })
+	assert.Equal(t, rpc.ErrForbidden, err)
+
+	assert.NoError(t, server.SetACLTable(nil))
+	assert.NoError(t, call("Ops.Whoami", ""))
+	assert.Equal(t, []string{}, server.Permissions()["Ops.Whoami"])
+}
+
+func TestRedactErrorData(t *testing.T) {
+	type login struct {
+		User     string
+		Password string `redact:"true"`
+	}
+	var buf bytes.Buffer
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Login", func(ctx *Context, args *login, reply *struct{}) error {
+		return &rpc.Error{Code: 401, Message: "invalid credentials", Data: args}
+	}))
+
+	reqBody, _ := json.EncodeClientRequest("Funcs.Login", &login{User: "bob", Password: "hunter2"})
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert.NotContains(t, w.Body.String(), "hunter2")
+	err = json.DecodeClientResponse(w.Body, &struct{}{})
+	var rpcErr *rpc.Error
+	if assert.True(t, errors.As(err, &rpcErr)) {
+		assert.Equal(t, map[string]interface{}{"User": "bob", "Password": rpc.Redacted}, rpcErr.Data)
+	}
+
+	assert.NotContains(t, buf.String(), "hunter2")
+	var record map[string]interface{}
+	assert.NoError(t, stdjson.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, map[string]interface{}{"User": "bob", "Password": rpc.Redacted}, record["error_data"])
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Echo", func(ctx *Context, args *string, reply *string) error {
+		*reply = *args
+		return nil
+	}))
+	headers := rpc.DefaultSecurityHeaders()
+	headers.HSTSSubdomains = true
+	headers.Extra = http.Header{"cross-origin-resource-policy": {"same-origin"}}
+	server.SetSecurityHeaders(headers)
+
+	call := func(handler http.Handler, method string, secure bool) http.Header {
+		reqBody, _ := json.EncodeClientRequest("Funcs.Echo", "hello")
+		req := httptest.NewRequest(method, "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		if secure {
+			req.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Header()
+	}
+
+	header := call(server, "POST", false)
+	assert.Equal(t, "DENY", header.Get("X-Frame-Options"))
+	assert.Equal(t, "no-store", header.Get("Cache-Control"))
+	assert.Equal(t, "default-src 'none'; frame-ancestors 'none'", header.Get("Content-Security-Policy"))
+	assert.Equal(t, "no-referrer", header.Get("Referrer-Policy"))
+	assert.Equal(t, "same-origin", header.Get("Cross-Origin-Resource-Policy"))
+	assert.Equal(t, "nosniff", header.Get("X-Content-Type-Options"))
+	assert.Empty(t, header.Get("Strict-Transport-Security"))
+
+	header = call(server, "POST", true)
+	assert.Equal(t, "max-age=31536000; includeSubDomains", header.Get("Strict-Transport-Security"))
+	header = call(server, "GET", false)
+	assert.Equal(t, "DENY", header.Get("X-Frame-Options"))
+	header = call(rpc.NewGateway(server), "POST", true)
+	assert.Equal(t, "no-store", header.Get("Cache-Control"))
+	assert.NotEmpty(t, header.Get("Strict-Transport-Security"))
+
+	server.SetSecurityHeaders(&rpc.SecurityHeaders{FrameOptions: "SAMEORIGIN"})
+	header = call(server, "POST", true)
+	assert.Equal(t, "SAMEORIGIN", header.Get("X-Frame-Options"))
+	assert.Empty(t, header.Get("Cache-Control"))
+	assert.Empty(t, header.Get("Strict-Transport-Security"))
+
+	server.SetSecurityHeaders(nil)
+	header = call(server, "POST", true)
+	assert.Empty(t, header.Get("X-Frame-Options"))
+}
+
+type TokenContext struct {
+	Token *oauth2.Introspection
+}
+
+func (ctx *TokenContext) SetToken(token *oauth2.Introspection) {
+	ctx.Token = token
+}
+
+type TokenService struct{}
+
+func (*TokenService) Purge(ctx *TokenContext, args *struct{}, reply *string) error {
+	return nil
+}
+
+func TestOAuth2(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	tokens := map[string]string{
+		"reader":  fmt.Sprintf(`{"active":true,"sub":"alice","scope":"read","aud":"api","exp":%d}`, exp),
+		"admin":   fmt.Sprintf(`{"active":true,"client_id":"ops","scope":"read admin","aud":["other","api"],"exp":%d}`, exp),
+		"foreign": fmt.Sprintf(`{"active":true,"sub":"bob","scope":"read","aud":"other","exp":%d}`, exp),
+		"writer":  fmt.Sprintf(`{"active":true,"sub":"carol","scope":"write","aud":"api","exp":%d}`, exp),
+		"expired": `{"active":true,"sub":"dave","scope":"read","aud":"api","exp":1}`,
+	}
+	calls := map[string]int{}
+	var mutex sync.Mutex
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if user != "api" || pass != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		token := r.PostFormValue("token")
+		mutex.Lock()
+		calls[token]++
+		mutex.Unlock()
+		if token == "broken" {
+			w.WriteHeader(500)
+			return
+		}
+		if resp, ok := tokens[token]; ok {
+			io.WriteString(w, resp)
+			return
+		}
+		io.WriteString(w, `{"active":false}`)
+	}))
+	defer endpoint.Close()
+
+	server, err := rpc.NewServer(new(TokenContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(oauth2.NewAuthenticator(oauth2.Options{
+		URL:          endpoint.URL,
+		ClientID:     "api",
+		ClientSecret: "secret",
+		Audience:     "api",
+		Scopes:       []string{"read"},
+	}))
+	assert.NoError(t, server.RegisterBeforeFunc(oauth2.TokenHook[TokenContext]()))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Whoami", func(ctx *TokenContext, args *struct{}, reply *string) error {
+		*reply = ctx.Token.Subject + "/" + ctx.Token.Scope
+		return nil
+	}))
+	assert.NoError(t, server.RegisterServiceWithACL(new(TokenService), "Admin", rpc.ACL{"Purge": {"admin"}}))
+
+	call := func(method, token string) (string, error) {
+		reqBody, _ := json.EncodeClientRequest(method, &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		var reply string
+		err := json.DecodeClientResponse(w.Body, &reply)
+		return reply, err
+	}
+
+	for i := 0; i < 3; i++ {
+		reply, err := call("Funcs.Whoami", "reader")
+		assert.NoError(t, err)
+		assert.Equal(t, "alice/read", reply)
+	}
+	assert.Equal(t, 1, calls["reader"])
+
+	_, err = call("Admin.Purge", "reader")
+	assert.EqualError(t, err, rpc.ErrForbidden.Error())
+	_, err = call("Admin.Purge", "admin")
+	assert.NoError(t, err)
+
+	_, err = call("Funcs.Whoami", "")
+	assert.ErrorContains(t, err, oauth2.ErrMissingToken.Error())
+	_, err = call("Funcs.Whoami", "revoked")
+	assert.ErrorContains(t, err, oauth2.ErrInactiveToken.Error())
+	_, err = call("Funcs.Whoami", "revoked")
+	assert.ErrorContains(t, err, oauth2.ErrInactiveToken.Error())
+	assert.Equal(t, 1, calls["revoked"])
+	_, err = call("Funcs.Whoami", "expired")
+	assert.ErrorContains(t, err, oauth2.ErrInactiveToken.Error())
+	_, err = call("Funcs.Whoami", "foreign")
+	assert.ErrorContains(t, err, oauth2.ErrAudience.Error())
+	_, err = call("Funcs.Whoami", "writer")
+	assert.ErrorContains(t, err, oauth2.ErrScope.Error())
+	_, err = call("Funcs.Whoami", "broken")
+	assert.ErrorContains(t, err, "500")
+	_, err = call("Funcs.Whoami", "broken")
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls["broken"])
+
+	a := oauth2.NewAuthenticator(oauth2.Options{URL: endpoint.URL, ClientID: "api", ClientSecret: "secret", Optional: true})
+	req := httptest.NewRequest("POST", "/", nil)
+	p, err := a.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+	req.Header.Set("Authorization", "Bearer admin")
+	p, err = a.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "ops", p.Name())
+
+	// Rejected tokens are told apart from the failures of the endpoint.
+	a = oauth2.NewAuthenticator(oauth2.Options{
+		URL: endpoint.URL, ClientID: "api", ClientSecret: "secret", Audience: "api", Scopes: []string{"read"},
+	})
+	for token, rejected := range map[string]bool{"revoked": true, "foreign": true, "writer": true, "broken": false} {
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err = a.Authenticate(req)
+		assert.Equal(t, rejected, errors.Is(err, rpc.ErrUnauthenticated), token)
+	}
+}
+
+func TestLockoutPolicy(t *testing.T) {
+	server, err := rpc.NewServer(new(KeyContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		switch r.Header.Get("Authorization") {
+		case "good":
+			return &User{"alice", nil}, nil
+		case "":
+			return nil, nil
+		case "down":
+			return nil, errors.New("identity provider unavailable")
+		}
+		return nil, rpc.Unauthenticated(errors.New("bad credentials"))
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Whoami", func(ctx *KeyContext, args *struct{}, reply *string) error {
+		if ctx.Principal != nil {
+			*reply = ctx.Principal.Name()
+		}
+		return nil
+	}))
+
+	var mutex sync.Mutex
+	failures := map[string]int{}
+	var bans []string
+	server.SetLockoutPolicy(&rpc.LockoutPolicy{
+		Delay:    5 * time.Millisecond,
+		MaxDelay: 12 * time.Millisecond,
+		BanAfter: 4,
+		BanFor:   time.Hour,
+		OnFailure: func(key string, n int, err error) {
+			mutex.Lock()
+			failures[key] = n
+			mutex.Unlock()
+		},
+		OnBan: func(key string, n int, until time.Time) {
+			mutex.Lock()
+			bans = append(bans, key)
+			mutex.Unlock()
+		},
+	})
+
+	call := func(remote, auth string) (*httptest.ResponseRecorder, time.Duration, error) {
+		reqBody, _ := json.EncodeClientRequest("Funcs.Whoami", &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", auth)
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		start := time.Now()
+		server.ServeHTTP(w, req)
+		var reply string
+		return w, time.Since(start), json.DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &reply)
+	}
+
+	// Failures are delayed 5ms, 10ms and 12ms, then the caller is banned.
+	_, elapsed, err := call("10.0.0.1:1", "bad")
+	assert.ErrorContains(t, err, "bad credentials")
+	assert.GreaterOrEqual(t, elapsed, 5*time.Millisecond)
+	_, elapsed, _ = call("10.0.0.1:1", "bad")
+	assert.GreaterOrEqual(t, elapsed, 10*time.Millisecond)
+	_, elapsed, _ = call("10.0.0.1:1", "bad")
+	assert.GreaterOrEqual(t, elapsed, 12*time.Millisecond)
+	assert.Equal(t, 3, failures["ip:10.0.0.1"])
+
+	// A success resets the count.
+	_, _, err = call("10.0.0.1:1", "good")
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		call("10.0.0.1:1", "bad")
+	}
+	assert.Equal(t, []string{"ip:10.0.0.1"}, bans)
+	w, _, err := call("10.0.0.1:1", "good")
+	assert.ErrorContains(t, err, rpc.ErrLockedOut.Error())
+	assert.Equal(t, "3600", w.Header().Get("Retry-After"))
+
+	// Other callers are not affected.
+	_, _, err = call("10.0.0.2:1", "good")
+	assert.NoError(t, err)
+
+	// Anonymous requests don't reset the count.
+	for i := 0; i < 4; i++ {
+		call("10.0.0.3:1", "bad")
+		_, _, err = call("10.0.0.3:1", "")
+	}
+	assert.ErrorContains(t, err, rpc.ErrLockedOut.Error())
+	assert.Equal(t, []string{"ip:10.0.0.1", "ip:10.0.0.3"}, bans)
+
+	// Failures to verify credentials are not counted.
+	for i := 0; i < 8; i++ {
+		_, _, err = call("10.0.0.5:1", "down")
+		assert.ErrorContains(t, err, "identity provider unavailable")
+	}
+	assert.Zero(t, failures["ip:10.0.0.5"])
+	_, _, err = call("10.0.0.5:1", "good")
+	assert.NoError(t, err)
+
+	// Concurrent failures are all counted, banning the caller once.
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			call("10.0.0.4:1", "bad")
+		}()
+	}
+	wg.Wait()
+	_, _, err = call("10.0.0.4:1", "good")
+	assert.ErrorContains(t, err, rpc.ErrLockedOut.Error())
+	assert.Equal(t, []string{"ip:10.0.0.1", "ip:10.0.0.3", "ip:10.0.0.4"}, bans)
+
+	server.SetLockoutPolicy(nil)
+	_, _, err = call("10.0.0.1:1", "good")
+	assert.NoError(t, err)
+}
+
+type TenantContext struct {
+	Tenant string
+}
+
+func (ctx *TenantContext) SetTenant(tenant string) {
+	ctx.Tenant = tenant
+}
+
+type TenantService struct{}
+
+func (TenantService) Name(ctx *TenantContext, args *struct{}, reply *string) error {
+	*reply = "shared:" + ctx.Tenant
+	return nil
+}
+
+func (TenantService) Plan(ctx *TenantContext, args *struct{}, reply *string) error {
+	*reply = "free"
+	return nil
+}
+
+type AcmeService struct{}
+
+func (AcmeService) Name(ctx *TenantContext, args *struct{}, reply *string) error {
+	*reply = "acme:" + ctx.Tenant
+	return nil
+}
+
+func TestTenantPolicy(t *testing.T) {
+	server, err := rpc.NewServer(new(TenantContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	stats := new(recordingStats)
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetStatsHandler(stats)
+	assert.NoError(t, server.RegisterService(new(TenantService), ""))
+	assert.NoError(t, server.RegisterTenantService("acme", new(AcmeService), "TenantService"))
+	assert.ErrorIs(t, server.RegisterTenantService("", new(AcmeService), "TenantService"), rpc.ErrMissingTenant)
+	assert.NoError(t, server.Cache("TenantService.Name", time.Minute))
+	server.SetTenantPolicy(&rpc.TenantPolicy{
+		Resolver: rpc.TenantFromHeader("X-Tenant"),
+		Required: true,
+		Tenants:  []string{"acme", "globex"},
+		Limit:    rpc.RateLimit{Rate: 100},
+		Limits:   map[string]rpc.RateLimit{"globex": {Rate: 0.001, Burst: 2}},
+	})
+
+	call := func(method, tenant string) (*httptest.ResponseRecorder, string, error) {
+		reqBody, _ := json.EncodeClientRequest(method, &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		var reply string
+		err := json.DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &reply)
+		return w, reply, err
+	}
+
+	// The override serves the methods it has, the shared service the others.
+	_, reply, err := call("TenantService.Name", "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, "acme:acme", reply)
+	assert.Equal(t, "acme", stats.last.Tenant)
+	_, reply, err = call("TenantService.Plan", "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, "free", reply)
+
+	// Cached replies are not shared by tenants.
+	_, reply, err = call("TenantService.Name", "globex")
+	assert.NoError(t, err)
+	assert.Equal(t, "shared:globex", reply)
+
+	_, _, err = call("TenantService.Name", "")
+	assert.ErrorContains(t, err, rpc.ErrMissingTenant.Error())
+	_, _, err = call("TenantService.Name", "initech")
+	assert.ErrorContains(t, err, rpc.ErrUnknownTenant.Error())
+
+	// The limit of a tenant doesn't affect the others.
+	_, _, err = call("TenantService.Plan", "globex")
+	assert.NoError(t, err)
+	w, _, err := call("TenantService.Plan", "globex")
+	assert.ErrorContains(t, err, rpc.ErrRateLimited.Error())
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	_, _, err = call("TenantService.Plan", "acme")
+	assert.NoError(t, err)
+
+	// Tenants are resolved from the principal.
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		return &User{r.Header.Get("Authorization"), nil}, nil
+	}))
+	server.SetTenantPolicy(&rpc.TenantPolicy{
+		Resolver: rpc.TenantFromPrincipal(func(p rpc.Principal) string {
+			_, org, _ := strings.Cut(p.Name(), "@")
+			return org
+		}),
+	})
+	reqBody, _ := json.EncodeClientRequest("TenantService.Plan", &struct{}{})
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "alice@initech")
+	server.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "initech", stats.last.Tenant)
+
+	// Tenants are resolved from the host.
+	resolve := rpc.TenantFromHost("api.example.com")
+	req = httptest.NewRequest("POST", "http://acme.api.example.com:8443/", nil)
+	tenant, err := resolve(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", tenant)
+	req = httptest.NewRequest("POST", "http://api.example.com/", nil)
+	tenant, err = resolve(req)
+	assert.NoError(t, err)
+	assert.Empty(t, tenant)
+	req = httptest.NewRequest("POST", "http://a.b.api.example.com/", nil)
+	_, err = resolve(req)
+	assert.ErrorIs(t, err, rpc.ErrUnknownTenant)
+}
+
+func TestTenantServiceACL(t *testing.T) {
+	server, err := rpc.NewServer(new(TenantContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		return &User{Username: "alice", Roles: r.Header.Values("X-Role")}, nil
+	}))
+	server.SetTenantPolicy(&rpc.TenantPolicy{Resolver: rpc.TenantFromHeader("X-Tenant")})
+
+	// Overrides require the roles of the shared methods, whichever is registered first.
+	assert.NoError(t, server.RegisterTenantService("acme", new(AcmeService), "Secret"))
+	assert.NoError(t, server.RegisterServiceWithACL(new(TenantService), "Secret", rpc.ACL{"Name": {"admin"}}))
+	assert.NoError(t, server.RegisterTenantService("globex", new(AcmeService), "Secret"))
+
+	call := func(tenant string, roles ...string) (string, error) {
+		reqBody, _ := json.EncodeClientRequest("Secret.Name", &struct{}{})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tenant", tenant)
+		for _, role := range roles {
+			req.Header.Add("X-Role", role)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		var reply string
+		err := json.DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &reply)
+		return reply, err
+	}
+	for _, tenant := range []string{"acme", "globex"} {
+		_, err := call(tenant)
+		assert.ErrorContains(t, err, rpc.ErrForbidden.Error(), tenant)
+		reply, err := call(tenant, "admin")
+		assert.NoError(t, err, tenant)
+		assert.Equal(t, "acme:"+tenant, reply)
+	}
+	_, err = call("initech")
+	assert.ErrorContains(t, err, rpc.ErrForbidden.Error())
+}
+
+// gorillaCodecRequest stands for the CodecRequest interface of gorilla/rpc/v2.
+type gorillaCodecRequest interface {
+	Method() (string, error)
+	ReadRequest(interface{}) error
+	WriteResponse(http.ResponseWriter, interface{})
+	WriteError(w http.ResponseWriter, status int, err error)
+}
+
+// gorillaCodec stands for a codec of gorilla/rpc/v2.
+type gorillaCodec struct {
+	requests int
+}
+
+func (c *gorillaCodec) NewRequest(r *http.Request) gorillaCodecRequest {
+	c.requests++
+	return json.NewCodec().NewRequest(r)
+}
+
+func TestGorillaCodec(t *testing.T) {
+	server, err := rpc.NewServer(new(TenantContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := new(gorillaCodec)
+	server.RegisterCodec(gorilla.NewCodec[gorillaCodecRequest](c), "application/json")
+	server.RegisterService(new(TenantService), "")
+
+	reqBody, _ := json.EncodeClientRequest("TenantService.Plan", &struct{}{})
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert.Equal(t, 1, c.requests)
+	var reply string
+	assert.NoError(t, json.DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &reply))
+	assert.Equal(t, "free", reply)
+}
+
+// kitEndpoint and kitMiddleware stand for the endpoint.Endpoint and endpoint.Middleware of go-kit.
+type kitEndpoint func(ctx context.Context, request interface{}) (interface{}, error)
+type kitMiddleware func(kitEndpoint) kitEndpoint
+
+func TestGoKit(t *testing.T) {
+	server, err := rpc.NewServer(new(KeyContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		if r.Header.Get("Authorization") == "" {
+			return nil, errors.New("missing credentials")
+		}
+		return &User{r.Header.Get("Authorization"), nil}, nil
+	}))
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Greet", func(ctx *KeyContext, args *struct{ Name string }, reply *string) error {
+		*reply = "hello " + args.Name + " from " + ctx.Principal.Name()
+		return nil
+	}))
+
+	// The methods are endpoints, called through the authenticator.
+	endpoints := gokit.Endpoints(server)
+	assert.Contains(t, endpoints, "Funcs.Greet")
+	var greet kitEndpoint = gokit.NewEndpoint(server, "Funcs.Greet")
+	ctx := rpc.WithCallHeader(context.Background(), "Authorization", "alice")
+	resp, err := greet(ctx, &struct{ Name string }{"bob"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello bob from alice", *resp.(*string))
+	resp, err = greet(ctx, map[string]string{"Name": "carol"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello carol from alice", *resp.(*string))
+	_, err = greet(context.Background(), &struct{ Name string }{"bob"})
+	assert.EqualError(t, err, "missing credentials")
+	_, err = gokit.NewEndpoint(server, "Funcs.Missing")(ctx, nil)
+	assert.Error(t, err)
+
+	// The middleware wrap the calls served by the server.
+	var calls []string
+	tag := func(name string) kitMiddleware {
+		return func(next kitEndpoint) kitEndpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				calls = append(calls, name)
+				resp, err := next(ctx, request)
+				if err != nil {
+					return nil, err
+				}
+				if text, ok := resp.(*string); ok {
+					resp = *text
+				}
+				return resp.(string) + " via " + name, nil
+			}
+		}
+	}
+	assert.NoError(t, server.SetMiddleware("Funcs.Greet", gokit.Middleware(tag("outer")), gokit.Middleware(tag("inner"))))
+	assert.Error(t, server.SetMiddleware("Funcs.Missing", gokit.Middleware(tag("outer"))))
+
+	reqBody, _ := json.EncodeClientRequest("Funcs.Greet", &struct{ Name string }{"dave"})
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "erin")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	var reply string
+	assert.NoError(t, json.DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &reply))
+	assert.Equal(t, "hello dave from erin via inner via outer", reply)
+	assert.Equal(t, []string{"outer", "inner"}, calls)
+
+	// Use wraps every method.
+	calls = nil
+	assert.NoError(t, gokit.Use(server, tag("all")))
+	resp, err = greet(ctx, &struct{ Name string }{"bob"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello bob from alice via all", *resp.(*string))
+	assert.Equal(t, []string{"all"}, calls)
+}
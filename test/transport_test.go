@@ -0,0 +1,1128 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	stdjson "encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/antenna3mt/rpc"
+	"github.com/antenna3mt/rpc/cbor"
+	rpcfasthttp "github.com/antenna3mt/rpc/fasthttp"
+	rpcgrpc "github.com/antenna3mt/rpc/grpc"
+	"github.com/antenna3mt/rpc/json"
+	rpclambda "github.com/antenna3mt/rpc/lambda"
+	"github.com/antenna3mt/rpc/otel"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	netrpc "net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type ConnContext struct {
+	ctx       context.Context
+	publisher rpc.Publisher
+}
+
+func (c *ConnContext) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+func (c *ConnContext) SetPublisher(p rpc.Publisher) {
+	c.publisher = p
+}
+
+type PushService struct{}
+
+func (*PushService) Echo(ctx *ConnContext, args *struct{ Text string }, reply *struct{ Text string }) error {
+	if conn := rpc.WebsocketConnFromContext(ctx.ctx); conn != nil {
+		if err := json.Notify(conn, "Pushed", args); err != nil {
+			return err
+		}
+	}
+	reply.Text = args.Text
+	return nil
+}
+
+func (*PushService) Announce(ctx *ConnContext, args *struct{ Text string }, reply *struct{}) error {
+	return ctx.publisher.Publish("news", args.Text)
+}
+
+func (*PushService) Upper(ctx *ConnContext, args *rpc.RequestStream, reply *rpc.ResponseStream) error {
+	for {
+		item := &struct{ Text string }{}
+		if err := args.Recv(item); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := reply.Send(&struct{ Text string }{strings.ToUpper(item.Text)}); err != nil {
+			return err
+		}
+	}
+}
+
+func newPushServer() *rpc.Server {
+	server, err := rpc.NewServer(new(ConnContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(PushService), "")
+	return server
+}
+
+func TestWebsocket(t *testing.T) {
+	ts := httptest.NewServer(newPushServer().WebsocketHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+
+	pushed := make(chan string, 1)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	client, err := json.DialWebsocket(context.Background(), url, nil, func(method string, params stdjson.RawMessage) {
+		select {
+		case pushed <- method + " " + string(params):
+		default:
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(ctx, "PushService.Echo", &struct{ Text string }{strings.Repeat("x", 70000)}, reply))
+	assert.Equal(t, 70000, len(reply.Text))
+	assert.NoError(t, client.Call(ctx, "PushService.Echo", &struct{ Text string }{"hi"}, reply))
+	assert.Equal(t, "hi", reply.Text)
+	assert.Error(t, client.Call(ctx, "PushService.Missing", &struct{}{}, reply))
+
+	select {
+	case msg := <-pushed:
+		assert.True(t, strings.HasPrefix(msg, "Pushed "))
+	case <-ctx.Done():
+		t.Fatal("no notification received")
+	}
+
+	// Concurrent messages beyond the in-flight limit wait for their turn.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply := &struct{ Text string }{}
+			assert.NoError(t, client.Call(ctx, "PushService.Echo", &struct{ Text string }{strconv.Itoa(i)}, reply))
+			assert.Equal(t, strconv.Itoa(i), reply.Text)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	server := newPushServer()
+	ts := httptest.NewServer(server.WebsocketHandler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	dial := func(origin string) error {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		client, err := json.DialWebsocket(context.Background(), url, header, nil)
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	// Pages of other sites can't open connections, unless allowed.
+	assert.NoError(t, dial(""))
+	assert.NoError(t, dial(ts.URL))
+	assert.Error(t, dial("https://evil.example"))
+	server.SetWebsocketCheckOrigin(func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "https://app.example"
+	})
+	assert.NoError(t, dial("https://app.example"))
+	assert.Error(t, dial("https://evil.example"))
+	assert.Error(t, dial(ts.URL))
+}
+
+type Progress struct {
+	Steps int
+}
+
+func (p *Progress) Stream(ctx context.Context, send func(item interface{}) error) error {
+	for i := 1; i <= p.Steps; i++ {
+		if err := send(&struct{ Step int }{i}); err != nil {
+			return err
+		}
+	}
+	return errors.New("interrupted")
+}
+
+type ExportService struct{}
+
+func (*ExportService) Run(ctx *ConnContext, args *struct{ Steps int }, reply *Progress) error {
+	reply.Steps = args.Steps
+	return nil
+}
+
+func TestEventStream(t *testing.T) {
+	server, err := rpc.NewServer(new(ConnContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(ExportService), "")
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	stream, err := client.CallStream(context.Background(), "ExportService.Run", &struct{ Steps int }{3})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stream.Close()
+
+	var steps []int
+	for {
+		item := &struct{ Step int }{}
+		if err = stream.Recv(item); err != nil {
+			break
+		}
+		steps = append(steps, item.Step)
+	}
+	assert.Equal(t, []int{1, 2, 3}, steps)
+	assert.EqualError(t, err, "interrupted")
+
+	reply := &Progress{}
+	assert.NoError(t, client.Call(context.Background(), "ExportService.Run", &struct{ Steps int }{3}, reply))
+	assert.Equal(t, 3, reply.Steps)
+}
+
+func TestServeListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := newPushServer()
+	go server.ServeListener(l)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := rpc.NewConnClient(conn, json.NewClientCodec())
+	defer client.Close()
+
+	for _, text := range []string{"one", "two"} {
+		reply := &struct{ Text string }{}
+		assert.NoError(t, client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{text}, reply))
+		assert.Equal(t, text, reply.Text)
+	}
+	assert.Error(t, client.Call(context.Background(), "PushService.Missing", &struct{}{}, &struct{}{}))
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpc.sock")
+	server := newPushServer()
+	go server.ListenAndServeUnix(path, 0600)
+
+	var fi os.FileInfo
+	var err error
+	for i := 0; i < 100; i++ {
+		if fi, err = os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	client, err := rpc.NewClient("http://unix/", json.NewClientCodec(), rpc.WithUnixSocket(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"unix"}, reply))
+	assert.Equal(t, "unix", reply.Text)
+}
+
+func TestServeConn(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	go newPushServer().ServeConn(serverConn)
+
+	client := rpc.NewConnClient(clientConn, json.NewClientCodec())
+	defer client.Close()
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"pipe"}, reply))
+	assert.Equal(t, "pipe", reply.Text)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, client.Call(ctx, "PushService.Echo", &struct{ Text string }{"pipe"}, reply))
+}
+
+type ArithArgs struct {
+	A, B int
+}
+
+// Arith is a net/rpc service.
+type Arith struct{}
+
+func (*Arith) Add(args ArithArgs, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func (*Arith) Div(args *ArithArgs, reply *int) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	*reply = args.A / args.B
+	return nil
+}
+
+func TestNetRPC(t *testing.T) {
+	server := newPushServer()
+	assert.NoError(t, server.RegisterNetRPCService(new(Arith), ""))
+	assert.Error(t, server.RegisterNetRPCService(new(PushService), ""))
+
+	// The net/rpc services are served with the codecs of the server.
+	reqBody, _ := json.EncodeClientRequest("Arith.Div", &ArithArgs{7, 2})
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	var quotient int
+	assert.NoError(t, json.DecodeClientResponse(w.Body, &quotient))
+	assert.Equal(t, 3, quotient)
+
+	// The services of the server are served to net/rpc clients.
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.ServeNetRPCCodec(jsonrpc.NewServerCodec(serverConn))
+		close(done)
+	}()
+	client := netrpc.NewClientWithCodec(jsonrpc.NewClientCodec(clientConn))
+
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call("PushService.Echo", &struct{ Text string }{"net/rpc"}, reply))
+	assert.Equal(t, "net/rpc", reply.Text)
+	var sum int
+	assert.NoError(t, client.Call("Arith.Add", &ArithArgs{1, 2}, &sum))
+	assert.Equal(t, 3, sum)
+	assert.EqualError(t, client.Call("Arith.Div", &ArithArgs{1, 0}, &sum), "divide by zero")
+	assert.ErrorContains(t, client.Call("Arith.Missing", &ArithArgs{}, &sum), "can't find method")
+
+	// Concurrent calls are answered to their callers.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var sum int
+			assert.NoError(t, client.Call("Arith.Add", &ArithArgs{i, i}, &sum))
+			assert.Equal(t, 2*i, sum)
+		}(i)
+	}
+	wg.Wait()
+
+	client.Close()
+	<-done
+}
+
+type BalanceArgs struct {
+	Address string
+	Block   string
+}
+
+type EthService struct{}
+
+func (*EthService) GetBalance(ctx *ConnContext, args *BalanceArgs, reply *string) error {
+	*reply = args.Address + "@" + args.Block
+	return nil
+}
+
+func TestEthereumMode(t *testing.T) {
+	server, err := rpc.NewServer(new(ConnContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewEthereumCodec(), "application/json")
+	server.RegisterService(new(EthService), "Eth")
+	server.SetSubscriptions(time.Minute)
+
+	// Methods are mapped to services, and params to the fields of args.
+	call := func(body string) string {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return strings.TrimSpace(w.Body.String())
+	}
+	assert.Equal(t, `{"jsonrpc":"2.0","result":"0x407d@latest","id":1}`,
+		call(`{"jsonrpc":"2.0","method":"eth_getBalance","params":["0x407d","latest"],"id":1}`))
+	assert.Equal(t, `{"jsonrpc":"2.0","result":"0x407d@","id":2}`,
+		call(`{"jsonrpc":"2.0","method":"eth_getBalance","params":["0x407d"],"id":2}`))
+	assert.Equal(t, `{"jsonrpc":"2.0","result":"0x407d@pending","id":3}`,
+		call(`{"jsonrpc":"2.0","method":"Eth.GetBalance","params":{"Address":"0x407d","Block":"pending"},"id":3}`))
+	assert.Contains(t, call(`{"jsonrpc":"2.0","method":"eth_getBalance","params":["0x407d","latest",1],"id":4}`),
+		"too many params")
+	assert.Contains(t, call(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":5}`),
+		`can't find method \"Eth.BlockNumber\"`)
+
+	// Subscriptions push their events over websocket connections.
+	ts := httptest.NewServer(server.WebsocketHandler())
+	defer ts.Close()
+	pushed := make(chan string, 10)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	client, err := json.DialWebsocket(context.Background(), url, nil, func(method string, params stdjson.RawMessage) {
+		pushed <- method + " " + string(params)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var id string
+	assert.NoError(t, client.Call(ctx, "eth_subscribe", []string{"newHeads"}, &id))
+	assert.NotEmpty(t, id)
+	assert.NoError(t, server.Publish("newHeads", map[string]string{"number": "0x1"}))
+	select {
+	case msg := <-pushed:
+		assert.Equal(t, `eth_subscription {"subscription":"`+id+`","result":{"number":"0x1"}}`, msg)
+	case <-ctx.Done():
+		t.Fatal("no notification received")
+	}
+
+	var unsubscribed bool
+	assert.NoError(t, client.Call(ctx, "eth_unsubscribe", []string{id}, &unsubscribed))
+	assert.True(t, unsubscribed)
+	assert.NoError(t, server.Publish("newHeads", map[string]string{"number": "0x2"}))
+	select {
+	case msg := <-pushed:
+		t.Fatalf("notification after unsubscribe: %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMain(m *testing.M) {
+	// The test binary runs as a plugin for TestPlugin.
+	if os.Getenv("RPC_TEST_PLUGIN") == "1" {
+		if err := newPushServer().ServeStdio(); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPlugin(t *testing.T) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "RPC_TEST_PLUGIN=1")
+	client, err := rpc.StartPlugin(cmd, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, text := range []string{"one", strings.Repeat("two", 1000)} {
+		reply := &struct{ Text string }{}
+		assert.NoError(t, client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{text}, reply))
+		assert.Equal(t, text, reply.Text)
+	}
+	assert.NoError(t, client.Close())
+	assert.True(t, cmd.ProcessState.Success())
+}
+
+func TestLambda(t *testing.T) {
+	handler := rpclambda.NewHandler(newPushServer())
+	body, _ := json.EncodeClientRequest("PushService.Echo", &struct{ Text string }{"lambda"})
+
+	events := map[string]interface{}{
+		"api gateway": &rpclambda.APIGatewayProxyRequest{
+			HTTPMethod:      "POST",
+			Path:            "/rpc",
+			Headers:         map[string]string{"content-type": "application/json"},
+			Body:            base64.StdEncoding.EncodeToString(body),
+			IsBase64Encoded: true,
+		},
+		"alb": map[string]interface{}{
+			"httpMethod":        "POST",
+			"path":              "/rpc",
+			"multiValueHeaders": map[string][]string{"content-type": {"application/json"}},
+			"requestContext":    map[string]interface{}{"elb": map[string]string{"targetGroupArn": "arn"}},
+			"body":              string(body),
+		},
+	}
+	for name, event := range events {
+		payload, _ := stdjson.Marshal(event)
+		out, err := handler.Invoke(context.Background(), payload)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		var resp struct {
+			StatusCode        int
+			StatusDescription string
+			Headers           map[string]string
+			MultiValueHeaders map[string][]string
+			Body              string
+		}
+		assert.NoError(t, stdjson.Unmarshal(out, &resp), name)
+		assert.Equal(t, 200, resp.StatusCode, name)
+		if name == "alb" {
+			assert.Equal(t, "200 OK", resp.StatusDescription)
+			assert.Equal(t, []string{"application/json; charset=utf-8"}, resp.MultiValueHeaders["Content-Type"])
+		} else {
+			assert.Equal(t, "application/json; charset=utf-8", resp.Headers["Content-Type"])
+		}
+		reply := &struct{ Text string }{}
+		assert.NoError(t, json.DecodeClientResponse(strings.NewReader(resp.Body), reply), name)
+		assert.Equal(t, "lambda", reply.Text, name)
+	}
+}
+
+// fastCtx is an in-memory fasthttp.RequestCtx.
+type fastCtx struct {
+	context.Context
+	body   []byte
+	status int
+	resp   []byte
+	header map[string]string
+}
+
+func (c *fastCtx) Method() []byte           { return []byte("POST") }
+func (c *fastCtx) PostBody() []byte         { return c.body }
+func (c *fastCtx) RemoteAddr() net.Addr     { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234} }
+func (c *fastCtx) SetStatusCode(status int) { c.status = status }
+func (c *fastCtx) SetBody(body []byte)      { c.resp = append([]byte(nil), body...) }
+func (c *fastCtx) VisitAll(f func(key, value []byte)) {
+	f([]byte("Content-Type"), []byte("application/json"))
+}
+func (c *fastCtx) Add(key, value string) { c.header[key] = value }
+
+func TestFastHTTP(t *testing.T) {
+	handler := rpcfasthttp.NewHandler(newPushServer())
+	for _, text := range []string{"one", "two"} {
+		body, _ := json.EncodeClientRequest("PushService.Echo", &struct{ Text string }{text})
+		ctx := &fastCtx{Context: context.Background(), body: body, header: make(map[string]string)}
+		handler.Serve(ctx, ctx, ctx)
+
+		assert.Equal(t, 200, ctx.status)
+		assert.Equal(t, "application/json; charset=utf-8", ctx.header["Content-Type"])
+		reply := &struct{ Text string }{}
+		assert.NoError(t, json.DecodeClientResponse(bytes.NewReader(ctx.resp), reply))
+		assert.Equal(t, text, reply.Text)
+	}
+}
+
+// fakeHTTP3Server is an HTTP3Server serving until closed.
+type fakeHTTP3Server struct {
+	addr   string
+	cfg    *tls.Config
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (s *fakeHTTP3Server) ListenAndServe() error {
+	<-s.closed
+	return http.ErrServerClosed
+}
+
+func (s *fakeHTTP3Server) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func TestHTTP3(t *testing.T) {
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+
+	started := make(chan *fakeHTTP3Server, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- newPushServer().ListenAndServeHTTP3("127.0.0.1:0", ts.TLS,
+			func(addr string, handler http.Handler, cfg *tls.Config) rpc.HTTP3Server {
+				h3 := &fakeHTTP3Server{addr: addr, cfg: cfg, closed: make(chan struct{})}
+				started <- h3
+				return h3
+			})
+	}()
+	h3 := <-started
+	assert.Equal(t, []string{"h3"}, h3.cfg.NextProtos)
+	assert.Equal(t, uint16(tls.VersionTLS13), h3.cfg.MinVersion)
+
+	client, err := rpc.NewClient("https://"+h3.addr, json.NewClientCodec(), rpc.WithRoundTripper(ts.Client().Transport))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"h3"}, reply))
+	assert.Equal(t, "h3", reply.Text)
+
+	resp, err := ts.Client().Post("https://"+h3.addr, "application/json", strings.NewReader("{}"))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		_, port, _ := net.SplitHostPort(h3.addr)
+		assert.Equal(t, `h3=":`+port+`"; ma=86400`, resp.Header.Get("Alt-Svc"))
+	}
+
+	h3.Close()
+	assert.Equal(t, http.ErrServerClosed, <-done)
+}
+
+func TestSubscriptions(t *testing.T) {
+	server := newPushServer()
+	server.SetSubscriptions(time.Minute)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	announce := func(text string) {
+		assert.NoError(t, client.Call(ctx, "PushService.Announce", &struct{ Text string }{text}, &struct{}{}))
+	}
+
+	sub := &rpc.SubscribeReply{}
+	assert.NoError(t, client.Call(ctx, rpc.SubscribeMethod, &rpc.SubscribeArgs{Topics: []string{"news"}}, sub))
+	assert.NotEmpty(t, sub.ID)
+
+	// Long poll
+	polled := make(chan *rpc.PollReply, 1)
+	go func() {
+		reply := &rpc.PollReply{}
+		assert.NoError(t, client.Call(ctx, rpc.PollMethod, &rpc.PollArgs{ID: sub.ID, Timeout: 5000}, reply))
+		polled <- reply
+	}()
+	time.Sleep(50 * time.Millisecond)
+	announce("polled")
+	reply := <-polled
+	if assert.Len(t, reply.Events, 1) {
+		assert.Equal(t, "news", reply.Events[0].Topic)
+		assert.Equal(t, "polled", reply.Events[0].Data)
+	}
+
+	// Server-Sent Events
+	stream, err := client.CallStream(ctx, rpc.PollMethod, &rpc.PollArgs{ID: sub.ID})
+	if err != nil {
+		log.Fatal(err)
+	}
+	announce("streamed")
+	event := &rpc.SubscriptionEvent{}
+	assert.NoError(t, stream.Recv(event))
+	assert.Equal(t, "streamed", event.Data)
+	stream.Close()
+
+	assert.NoError(t, client.Call(ctx, rpc.UnsubscribeMethod, &rpc.PollArgs{ID: sub.ID}, &struct{}{}))
+	assert.Error(t, client.Call(ctx, rpc.PollMethod, &rpc.PollArgs{ID: sub.ID}, &rpc.PollReply{}))
+
+	// Subscriptions are polled and unsubscribed by their owner only.
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		return &User{r.Header.Get("Authorization"), []string{"user"}}, nil
+	}))
+	alice, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", "alice"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	bob, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", "bob"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.NoError(t, alice.Call(ctx, rpc.SubscribeMethod, &rpc.SubscribeArgs{Topics: []string{"news"}}, sub))
+	assert.Error(t, bob.Call(ctx, rpc.PollMethod, &rpc.PollArgs{ID: sub.ID}, &rpc.PollReply{}))
+	assert.NoError(t, bob.Call(ctx, rpc.UnsubscribeMethod, &rpc.PollArgs{ID: sub.ID}, &struct{}{}))
+	assert.NoError(t, alice.Call(ctx, rpc.PollMethod, &rpc.PollArgs{ID: sub.ID}, &rpc.PollReply{}))
+
+	// Topics are authorized and bounded.
+	server.SetTopicAuthorizer(func(r *http.Request, topic string) error {
+		if topic != "news" {
+			return rpc.ErrForbidden
+		}
+		return nil
+	})
+	err = alice.Call(ctx, rpc.SubscribeMethod, &rpc.SubscribeArgs{Topics: []string{"news", "payroll"}}, sub)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), rpc.ErrForbidden.Error())
+	}
+	topics := make([]string, 101)
+	for i := range topics {
+		topics[i] = "news"
+	}
+	assert.Error(t, alice.Call(ctx, rpc.SubscribeMethod, &rpc.SubscribeArgs{Topics: topics}, sub))
+
+	// The built-in methods are checked against the ACL table and the rate limits.
+	assert.NoError(t, server.SetACLTable(rpc.ACLTable{"rpc.*": {"admin"}}))
+	err = alice.Call(ctx, rpc.SubscribeMethod, &rpc.SubscribeArgs{Topics: []string{"news"}}, sub)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), rpc.ErrForbidden.Error())
+	}
+	assert.NoError(t, server.SetACLTable(nil))
+	server.SetRatePolicy(&rpc.RatePolicy{Default: rpc.RateLimit{Rate: 0.001, Burst: 1}})
+	assert.NoError(t, alice.Call(ctx, rpc.SubscribeMethod, &rpc.SubscribeArgs{Topics: []string{"news"}}, sub))
+	err = alice.Call(ctx, rpc.SubscribeMethod, &rpc.SubscribeArgs{Topics: []string{"news"}}, sub)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), rpc.ErrRateLimited.Error())
+	}
+
+	// The number of subscriptions is bounded.
+	server.SetRatePolicy(nil)
+	server.SetSubscriptions(time.Minute)
+	subscribe := func() string {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"jsonrpc":"2.0","method":"rpc.subscribe","params":{"Topics":["news"]},"id":1}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	for i := 0; i < 10000; i++ {
+		subscribe()
+	}
+	assert.Contains(t, subscribe(), rpc.ErrTooManySubscriptions.Error())
+}
+
+func TestGateway(t *testing.T) {
+	pushServer := newPushServer()
+	pushServer.SetIntrospection(true)
+	upstream := httptest.NewServer(pushServer)
+	defer upstream.Close()
+	upstreamClient, err := rpc.NewClient(upstream.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+	server.SetIntrospection(true)
+	gateway := rpc.NewGateway(server)
+	gateway.Route("PushService", upstreamClient)
+	ts := httptest.NewServer(gateway)
+	defer ts.Close()
+
+	client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", MyToken))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply := &struct{ Text string }{}
+	assert.NoError(t, client.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"local"}, reply))
+	assert.Equal(t, "local", reply.Text)
+	assert.NoError(t, client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"forwarded"}, reply))
+	assert.Equal(t, "forwarded", reply.Text)
+	assert.Error(t, client.Call(context.Background(), "Unknown.Method", &struct{}{}, reply))
+
+	var methods map[string][]string
+	assert.NoError(t, client.Call(context.Background(), rpc.IntrospectionMethod, &struct{}{}, &methods))
+	assert.Equal(t, []string{"Hello"}, methods["MyService"])
+	assert.Equal(t, []string{"Announce", "Echo", "Upper"}, methods["PushService"])
+
+	// Forwarded calls are authenticated, rate limited and authorized as local ones.
+	server.SetAuthenticator(rpc.AuthenticatorFunc(func(r *http.Request) (rpc.Principal, error) {
+		switch r.Header.Get("Authorization") {
+		case MyToken:
+			return &User{"user", []string{"user"}}, nil
+		case "admin":
+			return &User{"admin", []string{"admin"}}, nil
+		}
+		return nil, errors.New("unknown token")
+	}))
+	assert.NoError(t, server.SetACLTable(rpc.ACLTable{"PushService.*": {"admin"}}))
+	server.SetRatePolicy(&rpc.RatePolicy{Groups: []rpc.RateGroup{
+		{Name: "echo", Methods: []string{"PushService.Echo"}, Limit: rpc.RateLimit{Rate: 0.001, Burst: 1}},
+	}})
+	anonymous, err := rpc.NewClient(ts.URL, json.NewClientCodec())
+	if err != nil {
+		log.Fatal(err)
+	}
+	admin, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", "admin"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.Error(t, anonymous.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"anonymous"}, reply))
+	assert.Error(t, anonymous.Call(context.Background(), rpc.IntrospectionMethod, &struct{}{}, &methods))
+	err = client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"user"}, reply)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), rpc.ErrForbidden.Error())
+	}
+	assert.NoError(t, admin.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"admin"}, reply))
+	assert.Equal(t, "admin", reply.Text)
+	err = admin.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"admin"}, reply)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), rpc.ErrRateLimited.Error())
+	}
+
+	// Signatures are verified once, whether the call is served locally or forwarded.
+	assert.NoError(t, server.SetACLTable(nil))
+	server.SetRatePolicy(nil)
+	secret := []byte("secret")
+	server.SetSignaturePolicy(&rpc.SignaturePolicy{Secret: secret})
+	signed, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHeader("Authorization", MyToken), rpc.WithHMACSigning(secret))
+	if err != nil {
+		log.Fatal(err)
+	}
+	assert.NoError(t, signed.Call(context.Background(), "MyService.Hello", &struct{ Text string }{"signed"}, reply))
+	assert.NoError(t, signed.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"signed"}, reply))
+	assert.Equal(t, "signed", reply.Text)
+	assert.Error(t, client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{"unsigned"}, reply))
+
+	// Bodies are bounded before being peeked at.
+	server.SetSignaturePolicy(nil)
+	server.SetMaxBodyBytes(256)
+	err = client.Call(context.Background(), "PushService.Echo", &struct{ Text string }{strings.Repeat("large", 60)}, reply)
+	if assert.IsType(t, &rpc.HTTPError{}, err) {
+		assert.Equal(t, 413, err.(*rpc.HTTPError).StatusCode)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	server, err := rpc.NewServer(new(Context))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.RegisterCodec(cbor.NewCodec(), cbor.ContentType)
+	server.RegisterService(new(MyService), "")
+	server.RegisterBeforeFunc(FetchAuthToken)
+	server.SetIntrospection(true)
+	ts := httptest.NewUnstartedServer(rpcgrpc.NewHandler(server))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	call := func(path, contentType string, msg []byte, token string) (*http.Response, []byte) {
+		body := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+		req, _ := http.NewRequest("POST", ts.URL+path, bytes.NewReader(append(body, msg...)))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Te", "trailers")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if len(data) >= 5 {
+			data = data[5:]
+		}
+		return resp, data
+	}
+
+	args, _ := cbor.Marshal(map[string]string{"Text": "cbor"})
+	resp, data := call("/MyService/Hello", "application/grpc+cbor", args, MyToken)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	reply := &struct{ Text string }{}
+	assert.NoError(t, cbor.Unmarshal(data, reply))
+	assert.Equal(t, "cbor", reply.Text)
+
+	resp, data = call("/MyService/Hello", "application/grpc+json", []byte(`{"Text":"json"}`), MyToken)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.JSONEq(t, `{"Text":"json"}`, string(data))
+
+	resp, _ = call("/MyService/Hello", "application/grpc+cbor", args, "")
+	assert.Equal(t, "2", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "authorization fail", resp.Trailer.Get("Grpc-Message"))
+
+	resp, _ = call("/MyService/Hello", "application/grpc+xml", args, MyToken)
+	assert.Equal(t, "12", resp.Trailer.Get("Grpc-Status"))
+
+	// A list_services request of server reflection.
+	resp, data = call("/grpc.reflection.v1.ServerReflection/ServerReflectionInfo", "application/grpc", []byte{0x3a, 0}, "")
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Contains(t, string(data), "MyService")
+	assert.Contains(t, string(data), "grpc.reflection.v1.ServerReflection")
+}
+
+func TestDuplex(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(newPushServer())
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewServer(newPushServer())
+	defer h1.Close()
+
+	for _, ts := range []*httptest.Server{h2, h1} {
+		client, err := rpc.NewClient(ts.URL, json.NewClientCodec(), rpc.WithHTTPClient(ts.Client()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		stream, err := client.CallDuplex(context.Background(), "PushService.Upper")
+		assert.NoError(t, err)
+
+		// Each item is answered before the next one is sent.
+		reply := &struct{ Text string }{}
+		for _, text := range []string{"a", "b"} {
+			assert.NoError(t, stream.Send(&struct{ Text string }{text}))
+			assert.NoError(t, stream.Recv(reply))
+			assert.Equal(t, strings.ToUpper(text), reply.Text)
+		}
+		assert.NoError(t, stream.CloseSend())
+		assert.Equal(t, io.EOF, stream.Recv(reply))
+		assert.NoError(t, stream.Close())
+
+		err = client.Call(context.Background(), "PushService.Upper", &struct{ Text string }{"a"}, reply)
+		assert.EqualError(t, err, "rpc: PushService.Upper requires a streamed call")
+	}
+}
+
+// recordingTracer is an otel.Tracer recording the spans it starts.
+type recordingTracer struct {
+	mutex sync.Mutex
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	name   string
+	parent otel.SpanContext
+	attrs  []otel.Attribute
+	sc     otel.SpanContext
+	err    error
+	ended  bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, parent otel.SpanContext, attrs []otel.Attribute) (context.Context, otel.Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	span := &recordingSpan{name: name, parent: parent, attrs: attrs, sc: parent}
+	if !parent.IsValid() {
+		span.sc.TraceID[0] = 1
+	}
+	span.sc.SpanID = [8]byte{byte(len(t.spans) + 1)}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func (s *recordingSpan) SpanContext() otel.SpanContext { return s.sc }
+func (s *recordingSpan) RecordError(err error)         { s.err = err }
+func (s *recordingSpan) End()                          { s.ended = true }
+
+type TraceService struct {
+	client *rpc.Client
+}
+
+func (s *TraceService) Relay(ctx *ConnContext, args *struct{ Text string }, reply *struct{ Text string }) error {
+	if args.Text == "fail" {
+		return errors.New("relay failed")
+	}
+	return s.client.Call(ctx.ctx, "PushService.Echo", args, reply)
+}
+
+func TestOtel(t *testing.T) {
+	var traceparent string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(otel.TraceparentHeader)
+		newPushServer().ServeHTTP(w, r)
+	}))
+	defer downstream.Close()
+	client, err := rpc.NewClient(downstream.URL, json.NewClientCodec(), rpc.WithInterceptors(otel.ClientInterceptor()))
+	assert.NoError(t, err)
+
+	server := newPushServer()
+	server.RegisterService(&TraceService{client: client}, "")
+	tracer := &recordingTracer{}
+	ts := httptest.NewServer(otel.Instrument(server, tracer))
+	defer ts.Close()
+
+	const incoming = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	call := func(text string) {
+		body, _ := json.EncodeClientRequest("TraceService.Relay", &struct{ Text string }{text})
+		req, _ := http.NewRequest("POST", ts.URL, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(otel.TraceparentHeader, incoming)
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+	call("hello")
+	call("fail")
+
+	if !assert.Len(t, tracer.spans, 2) {
+		return
+	}
+	parent, err := otel.ParseTraceparent(incoming)
+	assert.NoError(t, err)
+	for _, span := range tracer.spans {
+		assert.Equal(t, "TraceService.Relay", span.name)
+		assert.Equal(t, parent, span.parent)
+		assert.Contains(t, span.attrs, otel.Attribute{Key: "rpc.service", Value: "TraceService"})
+		assert.Contains(t, span.attrs, otel.Attribute{Key: "rpc.method", Value: "Relay"})
+		assert.True(t, span.ended)
+	}
+	assert.NoError(t, tracer.spans[0].err)
+	assert.EqualError(t, tracer.spans[1].err, "relay failed")
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-0100000000000000-01", traceparent)
+
+	for _, value := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01",
+	} {
+		_, err := otel.ParseTraceparent(value)
+		assert.Error(t, err, value)
+	}
+	sc, err := otel.ParseTraceparent("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00-extra")
+	assert.NoError(t, err)
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", sc.Traceparent())
+}
+
+// writeCert writes the PEM certificate and key of a certificate signed by parent, self-signed if
+// nil, and returns it with its key.
+func writeCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, dir, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil, dir, "ca")
+	writeCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey, dir, "server")
+	writeCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "worker"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey, dir, "client")
+
+	server, err := rpc.NewServer(new(KeyContext))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.RegisterCodec(json.NewCodec(), "application/json")
+	server.SetAuthenticator(&rpc.CertAuthenticator{})
+	assert.NoError(t, rpc.RegisterFunc(server, "Funcs.Whoami", func(ctx *KeyContext, args *struct{}, reply *string) error {
+		*reply = ctx.Principal.Name()
+		return nil
+	}))
+
+	addrs := make(chan net.Addr, 2)
+	server.Subscribe(func(e *rpc.Event) {
+		if e.Type == rpc.EventServeStart || e.Type == rpc.EventServeStop {
+			addrs <- e.Addr
+		}
+	})
+	var version uint16
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServeTLS("127.0.0.1:0", filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"),
+			rpc.WithClientAuth(tls.RequireAndVerifyClientCert, filepath.Join(dir, "ca.pem")),
+			rpc.WithMinTLSVersion(tls.VersionTLS11),
+			rpc.WithHTTPServerFunc(func(hs *http.Server) {
+				hs.ConnState = func(conn net.Conn, state http.ConnState) {
+					if tc, ok := conn.(*tls.Conn); ok && state == http.StateActive {
+						version = tc.ConnectionState().Version
+					}
+				}
+			}),
+			rpc.WithGracefulShutdown(ctx, time.Second))
+	}()
+	var addr net.Addr
+	select {
+	case addr = <-addrs:
+	case err := <-served:
+		t.Fatal(err)
+	}
+	endpoint := "https://" + addr.String()
+
+	cfg, err := rpc.NewTLSConfig(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"), filepath.Join(dir, "ca.pem"), "")
+	assert.NoError(t, err)
+	client, err := rpc.NewClient(endpoint, json.NewClientCodec(), rpc.WithTLSConfig(cfg))
+	assert.NoError(t, err)
+	var reply string
+	assert.NoError(t, client.Call(context.Background(), "Funcs.Whoami", &struct{}{}, &reply))
+	assert.Equal(t, "worker", reply)
+	assert.GreaterOrEqual(t, version, uint16(tls.VersionTLS12))
+
+	cfg, err = rpc.NewTLSConfig("", "", filepath.Join(dir, "ca.pem"), "")
+	assert.NoError(t, err)
+	anonymous, err := rpc.NewClient(endpoint, json.NewClientCodec(), rpc.WithTLSConfig(cfg))
+	assert.NoError(t, err)
+	assert.Error(t, anonymous.Call(context.Background(), "Funcs.Whoami", &struct{}{}, &reply))
+
+	cancel()
+	assert.NoError(t, <-served)
+	assert.Equal(t, addr, <-addrs)
+
+	assert.Error(t, server.ListenAndServeTLS("127.0.0.1:0", filepath.Join(dir, "missing.pem"), filepath.Join(dir, "server.key")))
+	assert.Error(t, server.ListenAndServeTLS("127.0.0.1:0", filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"),
+		rpc.WithClientAuth(tls.RequireAndVerifyClientCert, filepath.Join(dir, "server.key"))))
+}
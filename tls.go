@@ -0,0 +1,213 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+WithTLSConfig sets the TLS configuration of the connections of the client, e.g. client
+certificates for mutual TLS, a custom CA pool or the server name
+*/
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.transport.tlsConfig = cfg
+	}
+}
+
+/*
+NewTLSConfig builds a client TLS configuration from PEM files.
+
+certFile and keyFile hold the client certificate used for mutual TLS, caFile the certificates
+of the CAs trusted to verify the server, and serverName overrides the name used for SNI and
+verification. Empty params are ignored.
+*/
+func NewTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("rpc: load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("rpc: read ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("rpc: no certificate found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// TLSOption configures the serving of ListenAndServeTLS.
+type TLSOption func(*tlsServing)
+
+// tlsServing is the configuration of ListenAndServeTLS.
+type tlsServing struct {
+	config          *tls.Config
+	clientCAFile    string
+	server          *http.Server
+	shutdown        context.Context // shuts the server down once done, nil if never
+	shutdownTimeout time.Duration   // bound of the wait for the calls in flight
+}
+
+/*
+WithClientAuth requests client certificates in the mode, e.g. tls.RequireAndVerifyClientCert
+for mutual TLS, verified against the CAs of the PEM caFile, the system pool if empty. The
+CertAuthenticator turns verified certificates into principals.
+*/
+func WithClientAuth(mode tls.ClientAuthType, caFile string) TLSOption {
+	return func(ts *tlsServing) {
+		ts.config.ClientAuth = mode
+		ts.clientCAFile = caFile
+	}
+}
+
+/*
+WithMinTLSVersion raises the minimum TLS version, e.g. to tls.VersionTLS13
+*/
+func WithMinTLSVersion(version uint16) TLSOption {
+	return func(ts *tlsServing) {
+		if version > ts.config.MinVersion {
+			ts.config.MinVersion = version
+		}
+	}
+}
+
+/*
+WithTLSConfigFunc lets fn adjust the TLS configuration, e.g. to add certificates or set
+GetCertificate for reloading them
+*/
+func WithTLSConfigFunc(fn func(*tls.Config)) TLSOption {
+	return func(ts *tlsServing) {
+		fn(ts.config)
+	}
+}
+
+/*
+WithHTTPServerFunc lets fn adjust the http.Server, e.g. its timeouts or error log
+*/
+func WithHTTPServerFunc(fn func(*http.Server)) TLSOption {
+	return func(ts *tlsServing) {
+		fn(ts.server)
+	}
+}
+
+/*
+WithGracefulShutdown shuts the server down once ctx is done, e.g. canceled on SIGTERM by
+signal.NotifyContext: the listener is closed, and the calls in flight are given up to timeout to
+complete before their connections are closed
+*/
+func WithGracefulShutdown(ctx context.Context, timeout time.Duration) TLSOption {
+	return func(ts *tlsServing) {
+		ts.shutdown = ctx
+		ts.shutdownTimeout = timeout
+	}
+}
+
+/*
+ListenAndServeTLS serves HTTP/1.1 and HTTP/2 requests over TLS on the TCP address addr, with the
+certificate and key of the PEM files.
+
+TLS 1.2 is the minimum version, with the ECDHE AEAD cipher suites preferred by the server and the
+X25519 and P-256 curves, and the http.Server bounds the time to read the headers of requests to
+10 seconds and keeps idle connections for 2 minutes. It publishes EventServeStart and
+EventServeStop, and returns nil once shut down by WithGracefulShutdown.
+*/
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string, opts ...TLSOption) error {
+	ts := &tlsServing{
+		config: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			CipherSuites: []uint16{
+				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			},
+			CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+			NextProtos:       []string{"h2", "http/1.1"},
+		},
+		server: &http.Server{
+			Handler:           s,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+		},
+	}
+	for _, opt := range opts {
+		opt(ts)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("rpc: load server certificate: %v", err)
+	}
+	ts.config.Certificates = append(ts.config.Certificates, cert)
+	if ts.clientCAFile != "" {
+		pem, err := os.ReadFile(ts.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("rpc: read client ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("rpc: no certificate found in %s", ts.clientCAFile)
+		}
+		ts.config.ClientCAs = pool
+	}
+	ts.server.TLSConfig = ts.config
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	if ts.shutdown != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ts.shutdown.Done():
+			case <-stop:
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), ts.shutdownTimeout)
+			defer cancel()
+			err := ts.server.Shutdown(ctx)
+			if err != nil {
+				ts.server.Close()
+			}
+			done <- err
+		}()
+	}
+
+	s.events.publish(&Event{Type: EventServeStart, Addr: l.Addr()})
+	err = ts.server.ServeTLS(l, "", "")
+	if err == http.ErrServerClosed && ts.shutdown != nil {
+		err = <-done
+	}
+	s.events.publish(&Event{Type: EventServeStop, Addr: l.Addr(), Err: err})
+	return err
+}
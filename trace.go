@@ -0,0 +1,44 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+)
+
+// TraceStage is a stage of a request bracketed by the Tracer.
+type TraceStage string
+
+const (
+	StageDecode   TraceStage = "decode"   // decoding of the args
+	StageDispatch TraceStage = "dispatch" // call of the service method
+	StageEncode   TraceStage = "encode"   // encoding of the reply
+)
+
+// Tracer brackets the stages of a request, so tracing integrations can be
+// built on top of it.
+type Tracer interface {
+	// Start is called when a stage of the call of method begins. It returns the
+	// context used during the stage, e.g. carrying a span, and a func called
+	// with the error of the stage when it ends.
+	Start(ctx context.Context, stage TraceStage, method string) (context.Context, func(error))
+}
+
+/*
+startStage starts a stage with the tracer, the returned func is never nil
+*/
+func (s *Server) startStage(ctx context.Context, stage TraceStage, method string) (context.Context, func(error)) {
+	if s.tracer == nil {
+		return ctx, func(error) {}
+	}
+	spanCtx, end := s.tracer.Start(ctx, stage, method)
+	if spanCtx == nil {
+		spanCtx = ctx
+	}
+	if end == nil {
+		end = func(error) {}
+	}
+	return spanCtx, end
+}
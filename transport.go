@@ -0,0 +1,116 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/*
+WithRoundTripper sets the RoundTripper sending the requests of the client, instead of the
+transport of its http.Client. The pool and TLS options require an *http.Transport.
+*/
+func WithRoundTripper(rt http.RoundTripper) ClientOption {
+	return func(c *Client) {
+		c.transport.roundTripper = rt
+	}
+}
+
+/*
+WithMaxIdleConnsPerHost sets the maximum idle connections kept per endpoint, the default
+transport keeps 2
+*/
+func WithMaxIdleConnsPerHost(n int) ClientOption {
+	return func(c *Client) {
+		c.transport.maxIdleConnsPerHost = n
+	}
+}
+
+/*
+WithIdleConnTimeout sets the time an idle connection is kept before being closed
+*/
+func WithIdleConnTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.transport.idleConnTimeout = d
+	}
+}
+
+/*
+WithHTTP2 enables or disables HTTP/2 on the connections of the client
+*/
+func WithHTTP2(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.transport.http2 = &enabled
+	}
+}
+
+// transportSettings are the settings of the transport of a Client.
+type transportSettings struct {
+	roundTripper        http.RoundTripper // replaces the transport, nil to keep it
+	tlsConfig           *tls.Config       // TLS configuration of connections, nil for default
+	maxIdleConnsPerHost int               // zero for default
+	idleConnTimeout     time.Duration     // zero for default
+	http2               *bool             // nil for default
+	unixSocket          string            // path of the unix socket dialed, empty for TCP
+}
+
+/*
+configured reports whether the settings require a copy of the transport
+*/
+func (ts *transportSettings) configured() bool {
+	return ts.tlsConfig != nil || ts.maxIdleConnsPerHost > 0 || ts.idleConnTimeout > 0 || ts.http2 != nil ||
+		ts.unixSocket != ""
+}
+
+/*
+apply returns a copy of hc with the transport settings
+*/
+func (ts *transportSettings) apply(hc *http.Client) (*http.Client, error) {
+	ret := *hc
+	if ts.roundTripper != nil {
+		ret.Transport = ts.roundTripper
+	}
+	if !ts.configured() {
+		return &ret, nil
+	}
+
+	var transport *http.Transport
+	switch t := ret.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("rpc: transport options require an *http.Transport, got %T", ret.Transport)
+	}
+	if ts.tlsConfig != nil {
+		transport.TLSClientConfig = ts.tlsConfig
+	}
+	if ts.maxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = ts.maxIdleConnsPerHost
+		if transport.MaxIdleConns > 0 && transport.MaxIdleConns < ts.maxIdleConnsPerHost {
+			transport.MaxIdleConns = ts.maxIdleConnsPerHost
+		}
+	}
+	if ts.idleConnTimeout > 0 {
+		transport.IdleConnTimeout = ts.idleConnTimeout
+	}
+	if ts.http2 != nil {
+		transport.ForceAttemptHTTP2 = *ts.http2
+		if !*ts.http2 {
+			// A non-nil empty map disables HTTP/2.
+			transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+	}
+	if ts.unixSocket != "" {
+		transport.DialContext = dialUnix(ts.unixSocket)
+	}
+
+	ret.Transport = transport
+	return &ret, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+)
+
+/*
+ListenAndServeUnix serves HTTP requests on the unix domain socket at path, created with the
+permissions perms. A stale socket left at path is removed first.
+*/
+func (s *Server) ListenAndServeUnix(path string, perms os.FileMode) error {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("rpc: %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	if err := os.Chmod(path, perms); err != nil {
+		l.Close()
+		return err
+	}
+	return s.Serve(l)
+}
+
+/*
+WithUnixSocket connects to the unix domain socket at path, whatever the host of the endpoints,
+e.g. "http://unix/rpc"
+*/
+func WithUnixSocket(path string) ClientOption {
+	return func(c *Client) {
+		c.transport.unixSocket = path
+	}
+}
+
+/*
+dialUnix returns a dial func connecting to the unix domain socket at path
+*/
+func dialUnix(path string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Headers of calls answered by a webhook callback.
+const (
+	CallbackHeader = "X-Rpc-Callback" // url the response is posted to
+	JobIDHeader    = "X-Rpc-Job-Id"   // id of the call, sent back with the response
+	StatusHeader   = "X-Rpc-Status"   // HTTP status of the response posted to the callback
+)
+
+// WebhookPolicy configures the delivery of responses to callbacks.
+type WebhookPolicy struct {
+	Secret         []byte                        // signs the callbacks as WithHMACSigning does, unsigned if empty
+	Client         *http.Client                  // posts the callbacks, http.DefaultClient if nil
+	MaxAttempts    int                           // attempts to deliver a response, 5 if zero
+	InitialBackoff time.Duration                 // delay before the first retry, doubled for each retry, a second if zero
+	Allow          func(*url.URL) bool           // reports whether a callback url is allowed, none if nil
+	OnFailure      func(jobID string, err error) // called when a response can't be delivered, may be nil
+}
+
+/*
+SetWebhooks enables callbacks: a call with the X-Rpc-Callback header is accepted with status 202
+and the X-Rpc-Job-Id header, then served in the background, and its response is posted to the
+callback url along with the job id, the X-Rpc-Status header and the signature headers. Failed
+deliveries are retried with exponential backoff. A nil policy disables callbacks.
+
+The signature of the call is verified and its caller authenticated before it is accepted, and
+only the callback urls allowed by the Allow func of the policy are posted to, none if it is nil,
+so that callers can't make the server post to internal addresses. The body of the call is
+limited by SetMaxBodyBytes.
+*/
+func (s *Server) SetWebhooks(policy *WebhookPolicy) {
+	s.webhooks = policy
+}
+
+// maxJobIDLength is the length limit of the job ids chosen by clients.
+const maxJobIDLength = 128
+
+/*
+validJobID reports whether the job id chosen by a client is made of letters, digits, '-', '_'
+and '.'
+*/
+func validJobID(id string) bool {
+	if len(id) > maxJobIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+serveWithCallback authenticates and accepts the request, whose signature is verified, and serves
+it in the background, posting the response to the callback url
+*/
+func (s *Server) serveWithCallback(w http.ResponseWriter, r *http.Request, callback string) {
+	p := s.webhooks
+	u, err := url.Parse(callback)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		WriteError(w, 400, fmt.Sprintf("rpc: invalid callback %q", callback))
+		return
+	}
+	if p.Allow == nil || !p.Allow(u) {
+		WriteError(w, 403, fmt.Sprintf("rpc: callback %q not allowed", callback))
+		return
+	}
+	jobID := r.Header.Get(JobIDHeader)
+	if jobID == "" {
+		jobID = newIdempotencyKey()
+	} else if !validJobID(jobID) {
+		WriteError(w, 400, fmt.Sprintf("rpc: invalid job id %q", jobID))
+		return
+	}
+	body, err := readBody(r.Body, s.maxBodyBytes)
+	r.Body.Close()
+	if err != nil {
+		WriteError(w, bodyStatus(err), err.Error())
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Only authenticated callers get their responses posted.
+	var principal Principal
+	if s.authenticator != nil {
+		if principal, err = s.authenticate(w, r); err != nil {
+			WriteError(w, authStatus(err), err.Error())
+			return
+		}
+	}
+	r = withAuthenticated(r, principal)
+
+	w.Header().Set(JobIDHeader, jobID)
+	w.WriteHeader(202)
+
+	// The call outlives the request.
+	bg := r.Clone(context.WithoutCancel(r.Context()))
+	bg.Body = io.NopCloser(bytes.NewReader(body))
+	bg.Header.Del(CallbackHeader)
+	go func() {
+		bw := newBufferWriter()
+		s.serve(bw, bg)
+		if err := p.deliver(u.String(), jobID, bw); err != nil && p.OnFailure != nil {
+			p.OnFailure(jobID, err)
+		}
+	}()
+}
+
+/*
+deliver posts the response to the callback url, retrying on network errors, 429 and 5xx statuses
+*/
+func (p *WebhookPolicy) deliver(callback, jobID string, resp *bufferWriter) error {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retryable bool
+		if retryable, err = p.post(client, callback, jobID, resp); err == nil || !retryable {
+			return err
+		}
+	}
+	return err
+}
+
+/*
+post posts the response to the callback url once, and reports whether a failure is retryable
+*/
+func (p *WebhookPolicy) post(client *http.Client, callback, jobID string, resp *bufferWriter) (bool, error) {
+	body := resp.buf.Bytes()
+	req, err := http.NewRequest("POST", callback, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", resp.header.Get("Content-Type"))
+	req.Header.Set(JobIDHeader, jobID)
+	req.Header.Set(StatusHeader, strconv.Itoa(resp.status))
+	if len(p.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := newIdempotencyKey()
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(NonceHeader, nonce)
+		req.Header.Set(SignatureHeader, Sign(p.Secret, timestamp, nonce, body))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		err = &HTTPError{StatusCode: res.StatusCode, Message: res.Status}
+		return res.StatusCode == 429 || res.StatusCode >= 500, err
+	}
+	return false, nil
+}
+
+/*
+VerifyWebhook checks the signature of a callback posted by a server with the secret of its
+WebhookPolicy, and returns the body, the encoded response of the call. Signatures older than
+maxAge are rejected.
+*/
+func VerifyWebhook(r *http.Request, secret []byte, maxAge time.Duration) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := r.Header.Get(TimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("rpc: invalid callback timestamp %q", timestamp)
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+		return nil, fmt.Errorf("rpc: callback signature expired")
+	}
+	expected := Sign(secret, timestamp, r.Header.Get(NonceHeader), body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(SignatureHeader))) {
+		return nil, fmt.Errorf("rpc: invalid callback signature")
+	}
+	return body, nil
+}
+
+/*
+Submit calls the RPC method with args, and returns the id of the job once the server accepts
+it. The response is posted by the server to the callback url, along with the job id. The
+server must have webhooks enabled with SetWebhooks.
+*/
+func (c *Client) Submit(ctx context.Context, method string, args interface{}, callback string) (jobID string, err error) {
+	if c.codec == nil {
+		return "", fmt.Errorf("rpc: Submit requires a codec")
+	}
+	body, err := c.codec.EncodeRequest(method, args)
+	if err != nil {
+		return "", err
+	}
+	jobID = newIdempotencyKey()
+	ctx = WithCallHeader(WithCallHeader(ctx, CallbackHeader, callback), JobIDHeader, jobID)
+	err = c.do(ctx, method, c.retryPolicy.idempotent(method), body, func(r io.Reader) error {
+		// Drain the body so the connection can be reused.
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return jobID, nil
+}
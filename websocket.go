@@ -0,0 +1,439 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebsocketContentType is the Content-Type of the messages of a websocket
+// connection, decoded by the codec registered for it.
+const WebsocketContentType = "application/json"
+
+const (
+	websocketGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	websocketMaxMessageSize = 16 << 20
+	websocketMaxInFlight    = 64 // messages of a connection served at once
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// ErrWebsocketClosed is returned by the operations of a closed WebsocketConn.
+var ErrWebsocketClosed = errors.New("rpc: websocket is closed")
+
+// WebsocketConn is a websocket connection exchanging text messages.
+type WebsocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool // masks the frames written, as required from clients
+
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+	done       chan struct{} // closed once the connection is closed
+}
+
+type websocketConnKey struct{}
+
+/*
+WebsocketConnFromContext returns the websocket connection a request was received from, so
+services can send notifications to the peer later on. It returns nil for other requests.
+*/
+func WebsocketConnFromContext(ctx context.Context) *WebsocketConn {
+	conn, _ := ctx.Value(websocketConnKey{}).(*WebsocketConn)
+	return conn
+}
+
+/*
+WebsocketHandler returns a handler upgrading requests to websocket connections, and serving every
+message received as a request, with the headers of the upgrade request, e.g. for authentication.
+Responses are sent back on the connection, in completion order. Messages are decoded by the codec
+registered for WebsocketContentType.
+
+As the headers of the upgrade request carry the cookies of browsers, requests from other origins
+are rejected with status 403, unless allowed by SetWebsocketCheckOrigin. At most 64 messages of a
+connection are served at once, the next ones being read once a response is sent.
+*/
+func (s *Server) WebsocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checkOrigin := s.checkOrigin
+		if checkOrigin == nil {
+			checkOrigin = sameOrigin
+		}
+		if !checkOrigin(r) {
+			WriteError(w, 403, fmt.Sprintf("rpc: websocket origin %q not allowed", r.Header.Get("Origin")))
+			return
+		}
+		conn, err := upgradeWebsocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		header := r.Header.Clone()
+		header.Set("Content-Type", WebsocketContentType)
+		ctx := context.WithValue(r.Context(), websocketConnKey{}, conn)
+
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		inFlight := make(chan struct{}, websocketMaxInFlight)
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			inFlight <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-inFlight
+					wg.Done()
+				}()
+				if resp := s.serveMessage(ctx, header, msg); resp.buf.Len() > 0 {
+					conn.WriteMessage(resp.buf.Bytes())
+				}
+			}()
+		}
+	})
+}
+
+/*
+SetWebsocketCheckOrigin sets the func reporting whether the websocket handler accepts an upgrade
+request, given its Origin header. By default, only the requests without Origin, e.g. of clients
+other than browsers, and those whose Origin has the host of the request are accepted, so that the
+pages of other sites can't open connections with the cookies of their visitors. A nil func
+restores the default.
+*/
+func (s *Server) SetWebsocketCheckOrigin(fn func(r *http.Request) bool) {
+	s.checkOrigin = fn
+}
+
+/*
+sameOrigin reports whether the request has no Origin header, or one whose host is the host of
+the request
+*/
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+/*
+upgradeWebsocket completes the websocket handshake of the request, and takes over its connection.
+The http error is written if the request is not a valid handshake.
+*/
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*WebsocketConn, error) {
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		WriteError(w, 400, "rpc: websocket upgrade required")
+		return nil, fmt.Errorf("rpc: websocket upgrade required")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-Websocket-Version", "13")
+		WriteError(w, 426, "rpc: unsupported websocket version")
+		return nil, fmt.Errorf("rpc: unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		WriteError(w, 400, "rpc: missing Sec-WebSocket-Key")
+		return nil, fmt.Errorf("rpc: missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		WriteError(w, 500, "rpc: websocket not supported by the connection")
+		return nil, fmt.Errorf("rpc: websocket not supported by the connection")
+	}
+	netConn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := netConn.Write([]byte(handshake)); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return &WebsocketConn{conn: netConn, reader: rw.Reader, done: make(chan struct{})}, nil
+}
+
+/*
+DialWebsocket opens a websocket connection to the url, "ws://" or "wss://", sending header with
+the handshake
+*/
+func DialWebsocket(ctx context.Context, rawURL string, header http.Header) (*WebsocketConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("rpc: invalid websocket url: %v", err)
+	}
+	var dialer interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}
+	var scheme, port string
+	switch u.Scheme {
+	case "ws":
+		dialer, scheme, port = new(net.Dialer), "http", "80"
+	case "wss":
+		dialer, scheme, port = &tls.Dialer{Config: &tls.Config{MinVersion: tls.VersionTLS12}}, "https", "443"
+	default:
+		return nil, fmt.Errorf("rpc: invalid websocket url scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	u.Scheme = scheme
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(netConn); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-Websocket-Accept") != websocketAccept(key) {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		netConn.Close()
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Message: string(msg)}
+	}
+	netConn.SetDeadline(time.Time{})
+	return &WebsocketConn{conn: netConn, reader: reader, client: true, done: make(chan struct{})}, nil
+}
+
+/*
+ReadMessage returns the next text or binary message, answering pings in the meantime. It returns
+io.EOF once the peer has closed the connection.
+*/
+func (c *WebsocketConn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.writeFrame(wsOpClose, nil)
+			c.Close()
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, fmt.Errorf("rpc: websocket message interrupted")
+			}
+			started = true
+			msg = payload
+		case wsOpContinuation:
+			if !started {
+				return nil, fmt.Errorf("rpc: unexpected websocket continuation")
+			}
+			msg = append(msg, payload...)
+		default:
+			return nil, fmt.Errorf("rpc: unknown websocket opcode %d", opcode)
+		}
+		if len(msg) > websocketMaxMessageSize {
+			return nil, fmt.Errorf("rpc: websocket message too large")
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+/*
+WriteMessage sends a text message, it is safe for concurrent use
+*/
+func (c *WebsocketConn) WriteMessage(msg []byte) error {
+	return c.writeFrame(wsOpText, msg)
+}
+
+/*
+Close closes the connection
+*/
+func (c *WebsocketConn) Close() error {
+	err := ErrWebsocketClosed
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+		close(c.done)
+	})
+	return err
+}
+
+/*
+readFrame reads a frame, unmasking its payload
+*/
+func (c *WebsocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.reader, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > websocketMaxMessageSize {
+		err = fmt.Errorf("rpc: websocket frame too large")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+/*
+writeFrame writes a final frame, masked if the connection is a client
+*/
+func (c *WebsocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+/*
+websocketAccept returns the Sec-WebSocket-Accept value of a handshake key
+*/
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+/*
+headerContains reports whether a comma separated header contains the token, case insensitively
+*/
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
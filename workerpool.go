@@ -0,0 +1,110 @@
+// Copyright 2018 Yi Jin. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrWorkerPoolClosed is returned for calls submitted to a closed WorkerPool.
+var ErrWorkerPoolClosed = errors.New("rpc: worker pool is closed")
+
+/*
+WorkerPool runs calls of service methods on a bounded set of long-lived goroutines rather than on
+the goroutines serving the requests. Calls wait for an idle worker, up to their deadline, so
+methods assigned to separate pools don't compete for workers: CPU-heavy methods can't starve
+cheap ones, and no goroutine is started per call.
+*/
+type WorkerPool struct {
+	tasks     chan func()
+	quit      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+/*
+NewWorkerPool returns a pool running at most workers calls at once, at least one
+*/
+func NewWorkerPool(workers int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &WorkerPool{tasks: make(chan func()), quit: make(chan struct{})}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+/*
+Close stops the workers once their current calls are over, calls waiting for a worker then fail
+with ErrWorkerPoolClosed
+*/
+func (p *WorkerPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+	})
+	p.wg.Wait()
+}
+
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case task := <-p.tasks:
+			task()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+/*
+run executes call on a worker, and gives up waiting for it when ctx is done, with
+ErrDeadlineExceeded once its deadline expired
+*/
+func (p *WorkerPool) run(ctx context.Context, call func() error) error {
+	done := make(chan error, 1)
+	task := func() {
+		// The caller may have given up while the call was waiting.
+		if ctx.Err() != nil {
+			done <- ctx.Err()
+			return
+		}
+		done <- call()
+	}
+	select {
+	case p.tasks <- task:
+	case <-p.quit:
+		return ErrWorkerPoolClosed
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+/*
+SetWorkerPool sets the pool running the calls of every method without a pool of its own, nil runs
+them on the goroutines serving the requests
+*/
+func (s *Server) SetWorkerPool(pool *WorkerPool) {
+	s.workers = pool
+}
+
+/*
+AssignWorkerPool sets the pool running the calls of a registered method, overriding the pool of
+the server. A nil pool reverts the method to the pool of the server.
+*/
+func (s *Server) AssignWorkerPool(method string, pool *WorkerPool) error {
+	return s.services.setWorkerPool(method, pool)
+}